@@ -181,6 +181,9 @@ type AnnounceResponse struct {
 	MinInterval time.Duration
 	IPv4Peers   Peers
 	IPv6Peers   Peers
+	// Warning is the optional message, which should be shown to user
+	// (supported only by HTTP frontend)
+	Warning string
 }
 
 // MarshalZerologObject writes fields into zerolog event
@@ -190,7 +193,8 @@ func (r AnnounceResponse) MarshalZerologObject(e *zerolog.Event) {
 		Dur("interval", r.Interval).
 		Dur("minInterval", r.MinInterval).
 		Array("ipv4Peers", r.IPv4Peers).
-		Array("ipv6Peers", r.IPv6Peers)
+		Array("ipv6Peers", r.IPv6Peers).
+		Str("warning", r.Warning)
 }
 
 // InfoHashes wrapper of array of InfoHash-es
@@ -210,6 +214,10 @@ type ScrapeRequest struct {
 	RequestAddresses
 	InfoHashes InfoHashes
 	Params     Params
+	// Positional is set if frontend matches response statistics with
+	// requested hashes by position (UDP), so hashes must not be removed
+	// from request
+	Positional bool
 }
 
 // MarshalZerologObject writes fields into zerolog event
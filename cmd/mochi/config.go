@@ -9,11 +9,19 @@ import (
 
 	fh "github.com/sot-tech/mochi/frontend/http"
 	fu "github.com/sot-tech/mochi/frontend/udp"
+	"github.com/sot-tech/mochi/middleware"
 	"github.com/sot-tech/mochi/pkg/conf"
 
 	// Imports to register middleware hooks.
+	_ "github.com/sot-tech/mochi/middleware/adaptiveinterval"
+	_ "github.com/sot-tech/mochi/middleware/authcallback"
 	_ "github.com/sot-tech/mochi/middleware/clientapproval"
+	_ "github.com/sot-tech/mochi/middleware/connectability"
+	_ "github.com/sot-tech/mochi/middleware/eventstream"
+	_ "github.com/sot-tech/mochi/middleware/exec"
+	_ "github.com/sot-tech/mochi/middleware/ipblocklist"
 	_ "github.com/sot-tech/mochi/middleware/jwt"
+	_ "github.com/sot-tech/mochi/middleware/rules"
 	_ "github.com/sot-tech/mochi/middleware/torrentapproval"
 	_ "github.com/sot-tech/mochi/middleware/varinterval"
 
@@ -23,6 +31,8 @@ import (
 	sm "github.com/sot-tech/mochi/storage/memory"
 	_ "github.com/sot-tech/mochi/storage/pg"
 	_ "github.com/sot-tech/mochi/storage/redis"
+	_ "github.com/sot-tech/mochi/storage/sharded"
+	_ "github.com/sot-tech/mochi/storage/tiered"
 )
 
 // Config represents the configuration used for Server start.
@@ -39,6 +49,12 @@ type Config struct {
 	Storage             conf.NamedMapConfig   `yaml:"storage"`
 	PreHooks            []conf.NamedMapConfig `yaml:"prehooks"`
 	PostHooks           []conf.NamedMapConfig `yaml:"posthooks"`
+	// ResponseCache is the configuration of short-living
+	// swarm statistics and peers cache (disabled by default)
+	ResponseCache middleware.ResponseCacheConfig `yaml:"response_cache"`
+	// PeerFilter is the configuration of announcing peer's own
+	// and same host peers filtering in announce responses
+	PeerFilter middleware.PeerFilterConfig `yaml:"peer_filter"`
 }
 
 // QuickConfig is the simple configuration for quick start without config file.
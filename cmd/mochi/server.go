@@ -62,7 +62,8 @@ func (r *Server) Run(cfg *Config) (err error) {
 
 	if len(cfg.Frontends) > 0 {
 		var fs []frontend.Frontend
-		logic := middleware.NewLogic(cfg.AnnounceInterval, cfg.MinAnnounceInterval, r.storage, preHooks, postHooks)
+		logic := middleware.NewLogic(cfg.AnnounceInterval, cfg.MinAnnounceInterval,
+			middleware.NewResponseCache(cfg.ResponseCache, r.storage), cfg.PeerFilter, preHooks, postHooks)
 		if fs, err = frontend.NewFrontends(cfg.Frontends, logic); err == nil {
 			for _, f := range fs {
 				r.frontends = append(r.frontends, f)
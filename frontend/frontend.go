@@ -51,9 +51,24 @@ type Frontend interface {
 	io.Closer
 }
 
+// chainFrontend is the Frontend with own middleware chain,
+// which should be closed after frontend
+type chainFrontend struct {
+	Frontend
+	logic *middleware.Logic
+}
+
+func (f chainFrontend) Close() error {
+	return errors.Join(f.Frontend.Close(), f.logic.Close())
+}
+
 // NewFrontends is a utility function for initializing Frontend-s in bulk.
 // Returns nil hook and error if frontend with name provided in config
 // does not exists.
+//
+// If frontend configuration contains middleware.ChainConfig options
+// (`prehooks`, `posthooks`, `announce_interval` etc.), frontend
+// uses own middleware.Logic derived from provided one.
 func NewFrontends(configs []conf.NamedMapConfig, logic *middleware.Logic) (fs []Frontend, err error) {
 	buildersMU.RLock()
 	defer buildersMU.RUnlock()
@@ -64,10 +79,23 @@ func NewFrontends(configs []conf.NamedMapConfig, logic *middleware.Logic) (fs []
 			err = fmt.Errorf("hook with name '%s' does not exists", c.Name)
 			break
 		}
+		var chainCfg middleware.ChainConfig
+		if err = c.Config.Unmarshal(&chainCfg); err != nil {
+			break
+		}
+		var feLogic *middleware.Logic
+		if feLogic, err = logic.Derive(chainCfg); err != nil {
+			err = fmt.Errorf("frontend %s: %w", c.Name, err)
+			break
+		}
 		var f Frontend
-		if f, err = newFrontend(c.Config, logic); err != nil {
+		if f, err = newFrontend(c.Config, feLogic); err != nil {
+			_ = feLogic.Close()
 			break
 		}
+		if feLogic != logic {
+			f = chainFrontend{Frontend: f, logic: feLogic}
+		}
 		fs = append(fs, f)
 		logger.Info().Str("name", c.Name).Msg("frontend started")
 	}
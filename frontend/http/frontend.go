@@ -47,9 +47,20 @@ type Config struct {
 	AnnounceRoutes  []string      `cfg:"announce_routes"`
 	ScrapeRoutes    []string      `cfg:"scrape_routes"`
 	PingRoutes      []string      `cfg:"ping_routes"`
+	// RouteChains are middleware chains, which are used
+	// only for specified announce or scrape routes
+	RouteChains []RouteChainConfig `cfg:"route_chains"`
 	ParseOptions
 }
 
+// RouteChainConfig is the middleware chain configuration
+// (see middleware.ChainConfig) for specific routes.
+// Routes should be also listed in AnnounceRoutes or ScrapeRoutes.
+type RouteChainConfig struct {
+	Routes                 []string
+	middleware.ChainConfig `cfg:",squash"`
+}
+
 const (
 	defaultReadTimeout  = 2 * time.Second
 	defaultWriteTimeout = 2 * time.Second
@@ -123,7 +134,9 @@ func (cfg Config) Validate() (validCfg Config, err error) {
 
 type httpFE struct {
 	*fasthttp.Server
-	logic          *middleware.Logic
+	logic *middleware.Logic
+	// chains are middleware.Logic-s derived for RouteChainConfig-s
+	chains         []*middleware.Logic
 	collectTimings bool
 	onceCloser     sync.Once
 
@@ -169,29 +182,46 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 		}
 	}
 
+	routeLogic := make(map[string]*middleware.Logic)
+	for _, rc := range cfg.RouteChains {
+		var l *middleware.Logic
+		if l, err = logic.Derive(rc.ChainConfig); err != nil {
+			_ = f.closeChains()
+			return nil, err
+		}
+		if l != logic {
+			f.chains = append(f.chains, l)
+		}
+		for _, route := range rc.Routes {
+			routeLogic[cleanRoute(route)] = l
+		}
+	}
+	getLogic := func(route string) *middleware.Logic {
+		if l, exists := routeLogic[route]; exists {
+			return l
+		}
+		return logic
+	}
+
 	pathRouting := make(map[string]func(*fasthttp.RequestCtx),
 		len(cfg.AnnounceRoutes)+len(cfg.ScrapeRoutes)+len(cfg.PingRoutes))
 
 	for _, route := range cfg.AnnounceRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
+		route = cleanRoute(route)
+		l := getLogic(route)
+		pathRouting[route] = func(ctx *fasthttp.RequestCtx) {
+			f.announceRoute(ctx, l)
 		}
-		pathRouting[route] = f.announceRoute
 	}
 	for _, route := range cfg.ScrapeRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
+		route = cleanRoute(route)
+		l := getLogic(route)
+		pathRouting[route] = func(ctx *fasthttp.RequestCtx) {
+			f.scrapeRoute(ctx, l)
 		}
-		pathRouting[path.Clean(route)] = f.scrapeRoute
 	}
 	for _, route := range cfg.PingRoutes {
-		route = path.Clean(route)
-		if !path.IsAbs(route) {
-			route = "/" + route
-		}
-		pathRouting[path.Clean(route)] = f.ping
+		pathRouting[cleanRoute(route)] = f.ping
 	}
 
 	f.Server.Handler = func(ctx *fasthttp.RequestCtx) {
@@ -206,6 +236,15 @@ func NewFrontend(c conf.MapConfig, logic *middleware.Logic) (frontend.Frontend,
 	return f, nil
 }
 
+// cleanRoute returns absolute and cleaned URL path of route
+func cleanRoute(route string) string {
+	route = path.Clean(route)
+	if !path.IsAbs(route) {
+		route = "/" + route
+	}
+	return route
+}
+
 func runServer(s *fasthttp.Server, cfg *Config) {
 	logger.Debug().Str("addr", cfg.Addr).Msg("starting listener")
 	ln, err := cfg.ListenTCP()
@@ -230,13 +269,21 @@ func (f *httpFE) Close() (err error) {
 		if f.Server != nil {
 			err = f.Server.Shutdown()
 		}
+		err = errors.Join(err, f.closeChains())
 	})
 
 	return
 }
 
+func (f *httpFE) closeChains() (err error) {
+	for _, l := range f.chains {
+		err = errors.Join(err, l.Close())
+	}
+	return
+}
+
 // announceRoute parses and responds to an Announce.
-func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
+func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx, logic *middleware.Logic) {
 	var err error
 	var start time.Time
 	var addr netip.Addr
@@ -256,7 +303,7 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 	addr = aReq.GetFirst()
 
 	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
-	ctx, aResp, err := f.logic.HandleAnnounce(ctx, aReq)
+	ctx, aResp, err := logic.HandleAnnounce(ctx, aReq)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
 			writeErrorResponse(reqCtx, err)
@@ -277,12 +324,12 @@ func (f *httpFE) announceRoute(reqCtx *fasthttp.RequestCtx) {
 		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
 		// params mapped from fasthttp.QueryArgs will be reused in the next request
 		aReq.Params = nil
-		go f.logic.AfterAnnounce(ctx, aReq, aResp)
+		go logic.AfterAnnounce(ctx, aReq, aResp)
 	}
 }
 
 // scrapeRoute parses and responds to a Scrape.
-func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
+func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx, logic *middleware.Logic) {
 	var err error
 	var start time.Time
 	var addr netip.Addr
@@ -301,7 +348,7 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 	addr = req.GetFirst()
 
 	ctx := bittorrent.InjectRouteParamsToContext(reqCtx, nil)
-	ctx, resp, err := f.logic.HandleScrape(ctx, req)
+	ctx, resp, err := logic.HandleScrape(ctx, req)
 	if err != nil {
 		if !errors.Is(err, context.Canceled) {
 			writeErrorResponse(reqCtx, err)
@@ -317,7 +364,7 @@ func (f *httpFE) scrapeRoute(reqCtx *fasthttp.RequestCtx) {
 		ctx = bittorrent.RemapRouteParamsToBgContext(ctx)
 		// params mapped from fasthttp.QueryArgs will in the next request
 		req.Params = nil
-		go f.logic.AfterScrape(ctx, req, resp)
+		go logic.AfterScrape(ctx, req, resp)
 	}
 }
 
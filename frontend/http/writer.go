@@ -66,6 +66,12 @@ func writeAnnounceResponse(w io.Writer, resp *bittorrent.AnnounceResponse, compa
 		}
 		bb.WriteByte('e')
 	}
+	if len(resp.Warning) > 0 {
+		bb.WriteString("15:warning message")
+		bb.Write(fasthttp.AppendUint(nil, len(resp.Warning)))
+		bb.WriteByte(':')
+		bb.WriteString(resp.Warning)
+	}
 	bb.WriteByte('e')
 
 	_, _ = bb.WriteTo(w)
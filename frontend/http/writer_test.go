@@ -47,3 +47,10 @@ func TestWriteStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteAnnounceWarning(t *testing.T) {
+	r := httptest.NewRecorder()
+	writeAnnounceResponse(r, &bittorrent.AnnounceResponse{Warning: "update client"}, true, false)
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e"+
+		"15:warning message13:update cliente", r.Body.String())
+}
@@ -23,7 +23,7 @@ func TestStartStopRaceIssue437(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	lgc := middleware.NewLogic(0, 0, ps, nil, nil)
+	lgc := middleware.NewLogic(0, 0, ps, middleware.PeerFilterConfig{}, nil, nil)
 	fe, err := udp.NewFrontend(conf.MapConfig{"addr": "127.0.0.1:0"}, lgc)
 	if err != nil {
 		t.Fatal(err)
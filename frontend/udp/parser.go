@@ -189,6 +189,7 @@ func parseScrape(r Request, opts frontend.ParseOptions) (*bittorrent.ScrapeReque
 		request = &bittorrent.ScrapeRequest{
 			InfoHashes:       infoHashes,
 			RequestAddresses: bittorrent.RequestAddresses{bittorrent.RequestAddress{Addr: r.IP}},
+			Positional:       true,
 		}
 
 		err = bittorrent.SanitizeScrape(request, opts.MaxScrapeInfoHashes, opts.FilterPrivateIPs)
@@ -3,7 +3,10 @@ package udp
 import (
 	"errors"
 	"fmt"
+	"net/netip"
 	"testing"
+
+	"github.com/sot-tech/mochi/frontend"
 )
 
 var table = []struct {
@@ -75,3 +78,21 @@ func TestHandleOptionalParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestParseScrapePositional(t *testing.T) {
+	packet := make([]byte, 16+2*20)
+	for i := 16; i < len(packet); i++ {
+		packet[i] = byte(i)
+	}
+	req, err := parseScrape(Request{Packet: packet, IP: netip.MustParseAddr("1.2.3.4")},
+		frontend.ParseOptions{MaxScrapeInfoHashes: 10})
+	if err != nil {
+		t.Fatalf("expected no parsing error but got %s", err)
+	}
+	if len(req.InfoHashes) != 2 {
+		t.Fatalf("expected 2 info hashes, but got %d", len(req.InfoHashes))
+	}
+	if !req.Positional {
+		t.Fatal("expected positional scrape request")
+	}
+}
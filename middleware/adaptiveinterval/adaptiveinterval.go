@@ -0,0 +1,208 @@
+// Package adaptiveinterval contains middleware which scales announce
+// interval depending on swarm size and tracker load
+package adaptiveinterval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "adaptive interval"
+
+const (
+	// CurveLinear scales interval proportionally to value
+	CurveLinear = "linear"
+	// CurveSqrt scales interval proportionally to square root of value
+	CurveSqrt = "sqrt"
+	// CurveLog scales interval proportionally to logarithm of value
+	CurveLog = "log"
+
+	defaultLoadPeriod = 10 * time.Second
+)
+
+var (
+	logger = log.NewLogger("middleware/adaptive interval")
+
+	// ErrInvalidMaxInterval is returned for a config with an invalid MaxInterval.
+	ErrInvalidMaxInterval = errors.New("max_interval must be greater than min_interval")
+
+	// ErrInvalidCurve is returned for a config with an invalid Curve.
+	ErrInvalidCurve = errors.New("invalid curve")
+
+	// ErrNoCurves is returned if neither swarm nor load curve configured.
+	ErrNoCurves = errors.New("swarm or load curve must be provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Curve describes how some value (swarm size, request rate)
+// affects announce interval.
+type Curve struct {
+	// Type of curve: linear, sqrt or log. If empty, curve is disabled.
+	Type string
+	// From is the value at which interval starts to increase
+	From float64
+	// To is the value at which interval reaches Config.MaxInterval
+	To float64
+}
+
+func (c Curve) enabled() bool {
+	return len(c.Type) > 0
+}
+
+func (c Curve) check() error {
+	switch c.Type {
+	case CurveLinear, CurveSqrt, CurveLog:
+	default:
+		return fmt.Errorf("%w: unknown type '%s'", ErrInvalidCurve, c.Type)
+	}
+	if c.From < 0 || c.To <= c.From {
+		return fmt.Errorf("%w: 'to' must be greater than 'from' and 'from' must not be negative", ErrInvalidCurve)
+	}
+	return nil
+}
+
+func (c Curve) apply(v float64) float64 {
+	switch c.Type {
+	case CurveSqrt:
+		return math.Sqrt(v)
+	case CurveLog:
+		return math.Log1p(v)
+	default:
+		return v
+	}
+}
+
+// factor returns value in range [0, 1], which is the position
+// of provided value on the curve between From and To
+func (c Curve) factor(v float64) float64 {
+	if !c.enabled() || v <= c.From {
+		return 0
+	}
+	if v >= c.To {
+		return 1
+	}
+	from := c.apply(c.From)
+	return (c.apply(v) - from) / (c.apply(c.To) - from)
+}
+
+// Config represents the configuration for the adaptiveinterval middleware.
+type Config struct {
+	// MinInterval is the lower bound of announce interval
+	MinInterval time.Duration `cfg:"min_interval"`
+	// MaxInterval is the upper bound of announce interval,
+	// which is reached when swarm size or load reaches the end of curve
+	MaxInterval time.Duration `cfg:"max_interval"`
+	// ModifyMinInterval specifies whether min_interval should be scaled
+	// in the same proportion as interval
+	ModifyMinInterval bool `cfg:"modify_min_interval"`
+	// Swarm is the curve of swarm size (seeders + leechers)
+	Swarm Curve
+	// Load is the curve of announce requests per second
+	Load Curve
+	// LoadPeriod is the time window, used to calculate request rate
+	LoadPeriod time.Duration `cfg:"load_period"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.MaxInterval <= cfg.MinInterval {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrInvalidMaxInterval)
+	}
+	if !cfg.Swarm.enabled() && !cfg.Load.enabled() {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrNoCurves)
+	}
+	for _, c := range []Curve{cfg.Swarm, cfg.Load} {
+		if c.enabled() {
+			if err := c.check(); err != nil {
+				return nil, fmt.Errorf("middleware %s: %w", Name, err)
+			}
+		}
+	}
+	if cfg.Load.enabled() && cfg.LoadPeriod <= 0 {
+		logger.Warn().
+			Str("name", "LoadPeriod").
+			Dur("provided", cfg.LoadPeriod).
+			Dur("default", defaultLoadPeriod).
+			Msg("falling back to default configuration")
+		cfg.LoadPeriod = defaultLoadPeriod
+	}
+	h := &hook{cfg: cfg}
+	h.windowStart.Store(timecache.NowUnixNano())
+	return h, nil
+}
+
+type hook struct {
+	cfg Config
+	// requests counted in current window
+	requests atomic.Int64
+	// windowStart is the start time (unix nanoseconds) of current window
+	windowStart atomic.Int64
+	// rate is the float64 bits of requests per second in previous window
+	rate atomic.Uint64
+}
+
+// countRequest increments requests counter and recalculates
+// request rate if load window elapsed
+func (h *hook) countRequest() {
+	h.requests.Add(1)
+	now, start := timecache.NowUnixNano(), h.windowStart.Load()
+	if elapsed := time.Duration(now - start); elapsed >= h.cfg.LoadPeriod &&
+		h.windowStart.CompareAndSwap(start, now) {
+		rate := float64(h.requests.Swap(0)) / elapsed.Seconds()
+		h.rate.Store(math.Float64bits(rate))
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.cfg.Load.enabled() {
+		h.countRequest()
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not altered.
+	return ctx, nil
+}
+
+// ModifyAnnounceResponse scales announce intervals after response
+// has been filled with swarm statistics (see middleware.ResponseModifier)
+func (h *hook) ModifyAnnounceResponse(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	f := max(
+		h.cfg.Swarm.factor(float64(resp.Complete)+float64(resp.Incomplete)),
+		h.cfg.Load.factor(math.Float64frombits(h.rate.Load())),
+	)
+	base := resp.Interval
+	interval := base
+	if f > 0 && h.cfg.MaxInterval > base {
+		interval += time.Duration(f * float64(h.cfg.MaxInterval-base))
+	}
+	interval = min(max(interval, h.cfg.MinInterval), h.cfg.MaxInterval).Round(time.Second)
+	if interval == base {
+		return ctx, nil
+	}
+	resp.Interval = interval
+	if h.cfg.ModifyMinInterval && base > 0 {
+		resp.MinInterval = time.Duration(float64(resp.MinInterval) * float64(interval) / float64(base)).Round(time.Second)
+	}
+	resp.MinInterval = min(resp.MinInterval, resp.Interval)
+	return ctx, nil
+}
@@ -0,0 +1,103 @@
+package adaptiveinterval
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func TestBuild(t *testing.T) {
+	_, err := build(conf.MapConfig{"max_interval": "1h"}, nil)
+	require.ErrorIs(t, err, ErrNoCurves)
+
+	_, err = build(conf.MapConfig{
+		"min_interval": "1h",
+		"max_interval": "30m",
+		"swarm":        map[string]any{"type": CurveLinear, "to": 100},
+	}, nil)
+	require.ErrorIs(t, err, ErrInvalidMaxInterval)
+
+	_, err = build(conf.MapConfig{
+		"max_interval": "1h",
+		"swarm":        map[string]any{"type": "cubic", "to": 100},
+	}, nil)
+	require.ErrorIs(t, err, ErrInvalidCurve)
+
+	_, err = build(conf.MapConfig{
+		"max_interval": "1h",
+		"load":         map[string]any{"type": CurveLog, "from": 100, "to": 10},
+	}, nil)
+	require.ErrorIs(t, err, ErrInvalidCurve)
+}
+
+func TestSwarmScaling(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"min_interval":        "15m",
+		"max_interval":        "1h",
+		"modify_min_interval": true,
+		"swarm": map[string]any{
+			"type": CurveLinear,
+			"from": 100,
+			"to":   1100,
+		},
+	}, nil)
+	require.Nil(t, err)
+	m := h.(*hook)
+
+	cases := []struct {
+		seeders, leechers     uint32
+		interval, minInterval time.Duration
+	}{
+		{0, 10, 20 * time.Minute, 10 * time.Minute},
+		{300, 300, 40 * time.Minute, 20 * time.Minute},
+		{1000, 1000, time.Hour, 30 * time.Minute},
+	}
+	for _, c := range cases {
+		resp := &bittorrent.AnnounceResponse{
+			Interval:    20 * time.Minute,
+			MinInterval: 10 * time.Minute,
+			Complete:    c.seeders,
+			Incomplete:  c.leechers,
+		}
+		_, err = m.ModifyAnnounceResponse(context.Background(), nil, resp)
+		require.Nil(t, err)
+		require.Equal(t, c.interval, resp.Interval)
+		require.Equal(t, c.minInterval, resp.MinInterval)
+	}
+}
+
+func TestLoadScaling(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"max_interval": "1h",
+		"load": map[string]any{
+			"type": CurveSqrt,
+			"from": 0,
+			"to":   100,
+		},
+		"load_period": "1ns",
+	}, nil)
+	require.Nil(t, err)
+	m := h.(*hook)
+	m.rate.Store(math.Float64bits(25))
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, MinInterval: 10 * time.Minute}
+	_, err = m.ModifyAnnounceResponse(context.Background(), nil, resp)
+	require.Nil(t, err)
+	require.Equal(t, 45*time.Minute, resp.Interval)
+	require.Equal(t, 10*time.Minute, resp.MinInterval)
+
+	m.windowStart.Store(0)
+	_, err = m.HandleAnnounce(context.Background(), nil, nil)
+	require.Nil(t, err)
+	require.Less(t, math.Float64frombits(m.rate.Load()), 1.0)
+}
@@ -0,0 +1,498 @@
+// Package authcallback implements middleware, which sends request metadata
+// to external HTTP endpoint and applies its JSON decision (allow, deny,
+// interval and numwant overrides) to the request.
+package authcallback
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/internal/external"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "auth callback"
+
+const (
+	// FailOpen accepts requests if callback is not available
+	FailOpen = external.FailOpen
+	// FailClosed rejects requests if callback is not available
+	FailClosed = external.FailClosed
+
+	// paramKeyPrefix is the prefix of cache key field, which refers route parameter
+	paramKeyPrefix = "param:"
+
+	defaultTimeout          = time.Second
+	defaultMaxConns         = 100
+	defaultBreakerThreshold = 5
+	defaultBreakerTimeout   = 10 * time.Second
+	defaultCacheSize        = 10000
+	jsonContentType         = "application/json"
+	// maxReplySize is the maximal size of callback reply body
+	maxReplySize = 64 * 1024
+)
+
+const (
+	resultAllow       = "allow"
+	resultDeny        = "deny"
+	resultCached      = "cached"
+	resultError       = "error"
+	resultCircuitOpen = "circuit_open"
+)
+
+var (
+	logger = log.NewLogger("middleware/auth callback")
+
+	// ErrNoURL returned if callback URL is not provided
+	ErrNoURL = errors.New("url not provided")
+	// ErrUnavailable returned to client if callback is not available
+	// and fail policy is closed
+	ErrUnavailable = bittorrent.ClientError("authorization unavailable")
+
+	errCircuitOpen = errors.New("circuit is open")
+
+	defaultCacheKey = []string{"action", "info_hash", "peer_id", "address", "params"}
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+	prometheus.MustRegister(promRequestsTotal)
+}
+
+var promRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_middleware_auth_callback_requests_total",
+		Help: "The number of requests processed by authorization callback middleware",
+	},
+	[]string{"action", "result"},
+)
+
+// Config represents the configuration for the auth callback middleware.
+type Config struct {
+	// URL of HTTP endpoint, which receives POST requests with JSON body
+	URL string
+	// PingURL is the URL, requested (GET) to check callback health.
+	// If not set, health is reported by circuit breaker state
+	PingURL string `cfg:"ping_url"`
+	// Headers added to every request (i.e. Authorization)
+	Headers map[string]string
+	// Timeout of one HTTP request
+	Timeout time.Duration
+	// MaxConns is the maximal number of idle (pooled) connections
+	MaxConns int `cfg:"max_conns"`
+	// FailPolicy is the decision if callback is not available: open or closed
+	FailPolicy string `cfg:"fail_policy"`
+	// BreakerThreshold is the number of sequential failures,
+	// after which requests to callback are stopped for BreakerTimeout
+	BreakerThreshold int `cfg:"breaker_threshold"`
+	// BreakerTimeout is the time, requests to callback are not performed
+	// after BreakerThreshold sequential failures
+	BreakerTimeout time.Duration `cfg:"breaker_timeout"`
+	// CacheTTL is the time, decision is cached. Zero disables cache
+	CacheTTL time.Duration `cfg:"cache_ttl"`
+	// CacheSize is the maximal number of cached decisions
+	CacheSize int `cfg:"cache_size"`
+	// CacheKey are request fields, which make cache key
+	CacheKey []string `cfg:"cache_key"`
+	// HandleAnnounce enables sending announce requests to callback
+	HandleAnnounce bool `cfg:"handle_announce"`
+	// HandleScrape enables sending scrape requests to callback
+	HandleScrape bool `cfg:"handle_scrape"`
+}
+
+// callbackRequest is the body of request to callback
+type callbackRequest struct {
+	Action      string            `json:"action"`
+	Event       string            `json:"event,omitempty"`
+	InfoHash    string            `json:"info_hash,omitempty"`
+	InfoHashes  []string          `json:"info_hashes,omitempty"`
+	PeerID      string            `json:"peer_id,omitempty"`
+	Addresses   []string          `json:"addresses"`
+	Port        uint16            `json:"port,omitempty"`
+	Left        uint64            `json:"left"`
+	Downloaded  uint64            `json:"downloaded"`
+	Uploaded    uint64            `json:"uploaded"`
+	NumWant     uint32            `json:"numwant,omitempty"`
+	RouteParams map[string]string `json:"route_params,omitempty"`
+}
+
+// decision is the body of callback reply
+type decision struct {
+	// Allow is the decision about request. If false, request
+	// is rejected with Reason
+	Allow bool `json:"allow"`
+	// Reason of rejection
+	Reason string `json:"reason,omitempty"`
+	// NumWant if set, replaces requested peers count
+	NumWant *uint32 `json:"numwant,omitempty"`
+	// Interval if set, replaces announce interval (seconds)
+	Interval *float64 `json:"interval,omitempty"`
+	// MinInterval if set, replaces minimal announce interval (seconds)
+	MinInterval *float64 `json:"min_interval,omitempty"`
+	// Warning if set, is returned to client as warning message
+	Warning string `json:"warning,omitempty"`
+}
+
+// keyField appends request field value to cache key
+type keyField func(*strings.Builder, *callbackRequest)
+
+var keyFields = map[string]keyField{
+	"action": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(r.Action)
+	},
+	"event": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(r.Event)
+	},
+	"info_hash": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(r.InfoHash)
+		for _, ih := range r.InfoHashes {
+			sb.WriteString(ih)
+		}
+	},
+	"peer_id": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(r.PeerID)
+	},
+	"address": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(strings.Join(r.Addresses, ","))
+	},
+	"port": func(sb *strings.Builder, r *callbackRequest) {
+		sb.WriteString(strconv.Itoa(int(r.Port)))
+	},
+	"params": func(sb *strings.Builder, r *callbackRequest) {
+		keys := make([]string, 0, len(r.RouteParams))
+		for k := range r.RouteParams {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			sb.WriteString(k)
+			sb.WriteByte('=')
+			sb.WriteString(r.RouteParams[k])
+			sb.WriteByte(',')
+		}
+	},
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrNoURL)
+	}
+	var err error
+	if cfg.FailPolicy, err = external.ValidateFailPolicy(cfg.FailPolicy); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.Timeout <= 0 {
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", defaultTimeout).
+			Msg("falling back to default configuration")
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.MaxConns <= 0 {
+		cfg.MaxConns = defaultMaxConns
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = defaultBreakerThreshold
+	}
+	if cfg.BreakerTimeout <= 0 {
+		cfg.BreakerTimeout = defaultBreakerTimeout
+	}
+	if !cfg.HandleAnnounce && !cfg.HandleScrape {
+		logger.Warn().Msg("both announce and scrape handle disabled")
+	}
+
+	h := &hook{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: cfg.Timeout,
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        cfg.MaxConns,
+				MaxIdleConnsPerHost: cfg.MaxConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		breaker: &breaker{threshold: cfg.BreakerThreshold, timeout: cfg.BreakerTimeout},
+	}
+	if cfg.CacheTTL > 0 {
+		if cfg.CacheSize <= 0 {
+			cfg.CacheSize = defaultCacheSize
+		}
+		if len(cfg.CacheKey) == 0 {
+			cfg.CacheKey = defaultCacheKey
+		}
+		h.key = make([]keyField, 0, len(cfg.CacheKey))
+		for _, k := range cfg.CacheKey {
+			f, isOk := keyFields[k]
+			if !isOk {
+				if name, isParam := strings.CutPrefix(k, paramKeyPrefix); isParam && len(name) > 0 {
+					f = func(sb *strings.Builder, r *callbackRequest) {
+						sb.WriteString(r.RouteParams[name])
+					}
+				} else {
+					return nil, fmt.Errorf("middleware %s: unknown cache key field '%s'", Name, k)
+				}
+			}
+			h.key = append(h.key, f)
+		}
+		h.cache = newCache(cfg.CacheTTL, cfg.CacheSize)
+	}
+	return h, nil
+}
+
+type hook struct {
+	cfg     Config
+	client  *http.Client
+	breaker *breaker
+	key     []keyField
+	cache   *cache
+}
+
+func (h *hook) cacheKey(r *callbackRequest) string {
+	var sb strings.Builder
+	for _, f := range h.key {
+		f(&sb, r)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// post sends request to callback and decodes reply
+func (h *hook) post(ctx context.Context, r *callbackRequest) (d decision, err error) {
+	var body []byte
+	if body, err = json.Marshal(r); err != nil {
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, h.cfg.URL, bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	var resp *http.Response
+	if resp, err = h.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		// drain body to reuse connection
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxReplySize))
+		return d, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxReplySize)).Decode(&d)
+	return
+}
+
+// decide returns decision from cache or callback
+func (h *hook) decide(ctx context.Context, r *callbackRequest) (d decision, err error) {
+	var key string
+	if h.cache != nil {
+		key = h.cacheKey(r)
+		var isOk bool
+		if d, isOk = h.cache.get(key); isOk {
+			promRequestsTotal.WithLabelValues(r.Action, resultCached).Inc()
+			return
+		}
+	}
+	if !h.breaker.allow() {
+		promRequestsTotal.WithLabelValues(r.Action, resultCircuitOpen).Inc()
+		return d, errCircuitOpen
+	}
+	if d, err = h.post(ctx, r); err != nil {
+		// request cancelled by client is not the callback failure
+		if ctx.Err() == nil {
+			h.breaker.failure()
+		} else {
+			h.breaker.release()
+		}
+		promRequestsTotal.WithLabelValues(r.Action, resultError).Inc()
+		return
+	}
+	h.breaker.success()
+	if d.Allow {
+		promRequestsTotal.WithLabelValues(r.Action, resultAllow).Inc()
+	} else {
+		promRequestsTotal.WithLabelValues(r.Action, resultDeny).Inc()
+	}
+	if h.cache != nil {
+		h.cache.put(key, d)
+	}
+	return
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.cfg.HandleAnnounce {
+		return ctx, nil
+	}
+	d, err := h.decide(ctx, &callbackRequest{
+		Action:      "announce",
+		Event:       req.Event.String(),
+		InfoHash:    req.InfoHash.String(),
+		PeerID:      req.ID.String(),
+		Addresses:   external.Addresses(req.RequestAddresses),
+		Port:        req.Port,
+		Left:        req.Left,
+		Downloaded:  req.Downloaded,
+		Uploaded:    req.Uploaded,
+		NumWant:     req.NumWant,
+		RouteParams: external.RouteParams(ctx),
+	})
+	if err != nil {
+		return ctx, external.Failed(logger, h.cfg.FailPolicy, "announce", err, ErrUnavailable)
+	}
+	if !d.Allow {
+		return ctx, external.Deny(d.Reason)
+	}
+	if d.NumWant != nil {
+		req.NumWant = *d.NumWant
+	}
+	if d.Interval != nil && *d.Interval > 0 {
+		resp.Interval = time.Duration(*d.Interval * float64(time.Second))
+	}
+	if d.MinInterval != nil && *d.MinInterval > 0 {
+		resp.MinInterval = time.Duration(*d.MinInterval * float64(time.Second))
+	}
+	resp.MinInterval = min(resp.MinInterval, resp.Interval)
+	if len(d.Warning) > 0 {
+		resp.Warning = d.Warning
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.cfg.HandleScrape {
+		return ctx, nil
+	}
+	ihs := make([]string, 0, len(req.InfoHashes))
+	for _, ih := range req.InfoHashes {
+		ihs = append(ihs, ih.String())
+	}
+	d, err := h.decide(ctx, &callbackRequest{
+		Action:      "scrape",
+		InfoHashes:  ihs,
+		Addresses:   external.Addresses(req.RequestAddresses),
+		RouteParams: external.RouteParams(ctx),
+	})
+	if err != nil {
+		return ctx, external.Failed(logger, h.cfg.FailPolicy, "scrape", err, ErrUnavailable)
+	}
+	if !d.Allow {
+		return ctx, external.Deny(d.Reason)
+	}
+	return ctx, nil
+}
+
+// Ping requests PingURL if provided or checks circuit breaker state
+func (h *hook) Ping(ctx context.Context) error {
+	if len(h.cfg.PingURL) == 0 {
+		if h.breaker.isOpen() {
+			return fmt.Errorf("middleware %s: %w", Name, errCircuitOpen)
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.cfg.PingURL, nil)
+	if err != nil {
+		return fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	for k, v := range h.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxReplySize))
+	_ = resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("middleware %s: unexpected response status: %s", Name, resp.Status)
+	}
+	return nil
+}
+
+// Close closes pooled connections
+func (h *hook) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+type cacheEntry struct {
+	key string
+	decision
+	expires int64
+}
+
+// cache is the bounded LRU decisions cache
+type cache struct {
+	sync.Mutex
+	ttl  time.Duration
+	size int
+	// lru holds entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newCache(ttl time.Duration, size int) *cache {
+	return &cache{ttl: ttl, size: size, lru: list.New(), entries: make(map[string]*list.Element, size)}
+}
+
+func (c *cache) get(key string) (decision, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, isOk := c.entries[key]
+	if !isOk {
+		return decision{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.expires < timecache.NowUnixNano() {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return decision{}, false
+	}
+	c.lru.MoveToFront(el)
+	return e.decision, true
+}
+
+func (c *cache) put(key string, d decision) {
+	expires := timecache.NowUnixNano() + int64(c.ttl)
+	c.Lock()
+	defer c.Unlock()
+	if el, exists := c.entries[key]; exists {
+		e := el.Value.(*cacheEntry)
+		e.decision, e.expires = d, expires
+		c.lru.MoveToFront(el)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		// evict the least recently used entry
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, decision: d, expires: expires})
+}
@@ -0,0 +1,216 @@
+package authcallback
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+// server denies peers with port 1, fails with port 2,
+// allows others with overrides and rejects unauthorized requests
+type server struct {
+	*httptest.Server
+	calls atomic.Int32
+}
+
+func newServer(t *testing.T) *server {
+	s := new(server)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req callbackRequest
+		if r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.Port {
+		case 1:
+			_ = json.NewEncoder(w).Encode(decision{Reason: "unknown user " + req.RouteParams["passkey"]})
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			nw, interval := uint32(10), float64(3600)
+			_ = json.NewEncoder(w).Encode(decision{Allow: true, NumWant: &nw, Interval: &interval})
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newHook(t *testing.T, cfg conf.MapConfig) middleware.Hook {
+	h, err := build(cfg, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, h.(*hook).Close())
+	})
+	return h
+}
+
+func announce(port uint16) (context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+	ctx := context.WithValue(context.Background(), bittorrent.RouteParamsKey,
+		bittorrent.RouteParams{{Key: "passkey", Value: "abc"}})
+	return ctx, &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Started,
+		InfoHash: bittorrent.InfoHash("01234567890123456789"),
+		NumWant:  50,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID([]byte("-TR3000-000000000000")),
+			Port:             port,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+		},
+	}, &bittorrent.AnnounceResponse{
+		Interval:    10 * time.Minute,
+		MinInterval: 5 * time.Minute,
+	}
+}
+
+func TestDecision(t *testing.T) {
+	s := newServer(t)
+	h := newHook(t, conf.MapConfig{
+		"url":             s.URL,
+		"headers":         map[string]any{"Authorization": "secret"},
+		"handle_announce": true,
+	})
+
+	ctx, req, resp := announce(6881)
+	_, err := h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(10), req.NumWant)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+
+	ctx, req, resp = announce(1)
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Equal(t, bittorrent.ClientError("unknown user abc"), err)
+
+	// scrape is not handled
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{}, nil)
+	require.Nil(t, err)
+	require.Equal(t, int32(2), s.calls.Load())
+}
+
+func TestCache(t *testing.T) {
+	s := newServer(t)
+	h := newHook(t, conf.MapConfig{
+		"url":             s.URL,
+		"headers":         map[string]any{"Authorization": "secret"},
+		"cache_ttl":       time.Minute,
+		"cache_key":       []any{"param:passkey", "port"},
+		"handle_announce": true,
+	})
+	for range 3 {
+		ctx, req, resp := announce(1)
+		_, err := h.HandleAnnounce(ctx, req, resp)
+		require.Error(t, err)
+		ctx, req, resp = announce(6881)
+		_, err = h.HandleAnnounce(ctx, req, resp)
+		require.Nil(t, err)
+		require.Equal(t, uint32(10), req.NumWant)
+	}
+	require.Equal(t, int32(2), s.calls.Load())
+
+	_, err := build(conf.MapConfig{"url": s.URL, "cache_ttl": time.Minute, "cache_key": []any{"unknown"}}, nil)
+	require.Error(t, err)
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := newCache(time.Minute, 2)
+	c.put("a", decision{Allow: true})
+	c.put("b", decision{Allow: true})
+	// a is used, so b is evicted
+	_, isOk := c.get("a")
+	require.True(t, isOk)
+	c.put("c", decision{Allow: true})
+	_, isOk = c.get("b")
+	require.False(t, isOk)
+	_, isOk = c.get("a")
+	require.True(t, isOk)
+	_, isOk = c.get("c")
+	require.True(t, isOk)
+	require.Equal(t, 2, c.lru.Len())
+}
+
+func TestDefaultCacheKeyParams(t *testing.T) {
+	h, err := build(conf.MapConfig{"url": "http://127.0.0.1", "cache_ttl": time.Minute}, nil)
+	require.Nil(t, err)
+	r := &callbackRequest{Action: "announce", RouteParams: map[string]string{"passkey": "abc"}}
+	k := h.(*hook).cacheKey(r)
+	r.RouteParams["passkey"] = "def"
+	require.NotEqual(t, k, h.(*hook).cacheKey(r))
+}
+
+func TestBreaker(t *testing.T) {
+	s := newServer(t)
+	h := newHook(t, conf.MapConfig{
+		"url":               s.URL,
+		"headers":           map[string]any{"Authorization": "secret"},
+		"breaker_threshold": 2,
+		"breaker_timeout":   100 * time.Millisecond,
+		"handle_announce":   true,
+	})
+	p := h.(middleware.Pinger)
+	for range 2 {
+		ctx, req, resp := announce(2)
+		_, err := h.HandleAnnounce(ctx, req, resp)
+		require.ErrorIs(t, err, ErrUnavailable)
+	}
+	require.Error(t, p.Ping(context.Background()))
+
+	// circuit is open, callback is not requested
+	ctx, req, resp := announce(6881)
+	_, err := h.HandleAnnounce(ctx, req, resp)
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.Equal(t, int32(2), s.calls.Load())
+
+	time.Sleep(150 * time.Millisecond)
+	require.Nil(t, p.Ping(context.Background()))
+	ctx, req, resp = announce(6881)
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, int32(3), s.calls.Load())
+}
+
+func TestFailOpen(t *testing.T) {
+	s := newServer(t)
+	h := newHook(t, conf.MapConfig{
+		"url":             s.URL,
+		"headers":         map[string]any{"Authorization": "secret"},
+		"fail_policy":     FailOpen,
+		"handle_announce": true,
+	})
+	ctx, req, resp := announce(2)
+	_, err := h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(50), req.NumWant)
+}
+
+func TestPingURL(t *testing.T) {
+	s := newServer(t)
+	h := newHook(t, conf.MapConfig{"url": s.URL, "ping_url": s.URL + "/health"})
+	// test server expects authorization header
+	require.Error(t, h.(middleware.Pinger).Ping(context.Background()))
+
+	ok := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer ok.Close()
+	h = newHook(t, conf.MapConfig{"url": s.URL, "ping_url": ok.URL})
+	require.Nil(t, h.(middleware.Pinger).Ping(context.Background()))
+}
@@ -0,0 +1,84 @@
+package authcallback
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is the circuit breaker, which stops calls to callback
+// after threshold sequential failures for timeout. After timeout
+// single trial call is allowed: if it succeeds, breaker is closed,
+// otherwise opened again.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	timeout   time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+}
+
+// allow checks if call may be performed
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// trial call is in progress
+		return false
+	default:
+		return true
+	}
+}
+
+// success records successful call
+func (b *breaker) success() {
+	b.Lock()
+	if b.state != breakerClosed {
+		logger.Info().Msg("callback recovered, circuit closed")
+	}
+	b.state, b.failures = breakerClosed, 0
+	b.Unlock()
+}
+
+// failure records failed call
+func (b *breaker) failure() {
+	b.Lock()
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		if b.state == breakerClosed {
+			logger.Warn().Int("failures", b.failures).Dur("timeout", b.timeout).Msg("callback failing, circuit opened")
+		}
+		b.state, b.openedAt = breakerOpen, time.Now()
+	}
+	b.Unlock()
+}
+
+// release records call, which result is unknown (i.e. cancelled),
+// so next call may be a trial
+func (b *breaker) release() {
+	b.Lock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+	b.Unlock()
+}
+
+// isOpen returns true if calls are not allowed
+func (b *breaker) isOpen() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state == breakerOpen && time.Since(b.openedAt) < b.timeout
+}
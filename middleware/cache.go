@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const defaultCachePoolSize = 200
+
+func init() {
+	prometheus.MustRegister(promCacheRequestsTotal)
+}
+
+var promCacheRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_middleware_response_cache_requests_total",
+		Help: "The number of announce response cache lookups",
+	},
+	[]string{"type", "result"},
+)
+
+func recordCacheLookup(typ string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	promCacheRequestsTotal.WithLabelValues(typ, result).Inc()
+}
+
+// ResponseCacheConfig is the configuration of short-living cache
+// of swarm statistics and peer lists, used to generate announce responses.
+type ResponseCacheConfig struct {
+	// TTL is the lifetime of cached data. Zero value disables cache
+	TTL time.Duration `yaml:"ttl"`
+	// PoolSize is the number of peers fetched from storage and cached
+	// for each info hash, address family and seeder flag.
+	// Each response contains random sample from the pool.
+	PoolSize int `yaml:"pool_size"`
+	// KeepOnPut disables invalidation of info hash cache when
+	// peer is put to storage, so cache is invalidated only when
+	// peer deleted or graduated. New peers appear in responses
+	// after TTL, but in hot swarms storage is not requested on
+	// almost every announce.
+	KeepOnPut bool `yaml:"keep_on_put"`
+}
+
+type peersCacheKey struct {
+	ih        bittorrent.InfoHash
+	forSeeder bool
+	v6        bool
+}
+
+// String returns key of load in singleflight.Group
+func (k peersCacheKey) String() string {
+	flags := byte(0)
+	if k.forSeeder {
+		flags |= 1
+	}
+	if k.v6 {
+		flags |= 2
+	}
+	return string(k.ih) + string(flags)
+}
+
+type peersCacheEntry struct {
+	peers    []bittorrent.Peer
+	notExist bool
+	expires  int64
+}
+
+type scrapeCacheEntry struct {
+	leechers, seeders, snatched uint32
+	expires                     int64
+}
+
+// cachedStorage is the storage.PeerStorage decorator, which
+// caches ScrapeSwarm and AnnouncePeers results for short time
+type cachedStorage struct {
+	storage.PeerStorage
+	ttl       time.Duration
+	poolSize  int
+	keepOnPut bool
+	mu        sync.RWMutex
+	peers     map[peersCacheKey]*peersCacheEntry
+	scrapes   map[bittorrent.InfoHash]*scrapeCacheEntry
+	lastSweep int64
+	// peerLoads and scrapeLoads coalesce concurrent loads
+	// of the same expired entry into one storage request
+	peerLoads, scrapeLoads singleflight.Group
+}
+
+// NewResponseCache wraps provided storage with cache of swarm statistics and
+// peer lists, if ResponseCacheConfig.TTL is set, or returns provided storage.
+// Returned storage should be used only for Logic, because it does not
+// provide storage's optional interfaces.
+func NewResponseCache(cfg ResponseCacheConfig, ps storage.PeerStorage) storage.PeerStorage {
+	if cfg.TTL <= 0 {
+		return ps
+	}
+	if cfg.PoolSize <= 0 {
+		logger.Warn().
+			Str("name", "PoolSize").
+			Int("provided", cfg.PoolSize).
+			Int("default", defaultCachePoolSize).
+			Msg("falling back to default configuration")
+		cfg.PoolSize = defaultCachePoolSize
+	}
+	return &cachedStorage{
+		PeerStorage: ps,
+		ttl:         cfg.TTL,
+		poolSize:    cfg.PoolSize,
+		keepOnPut:   cfg.KeepOnPut,
+		peers:       make(map[peersCacheKey]*peersCacheEntry),
+		scrapes:     make(map[bittorrent.InfoHash]*scrapeCacheEntry),
+		lastSweep:   timecache.NowUnixNano(),
+	}
+}
+
+// sweep deletes expired entries. Should be called with acquired write lock.
+func (cs *cachedStorage) sweep(now int64) {
+	if now-cs.lastSweep < int64(cs.ttl) {
+		return
+	}
+	cs.lastSweep = now
+	for k, e := range cs.peers {
+		if e.expires <= now {
+			delete(cs.peers, k)
+		}
+	}
+	for k, e := range cs.scrapes {
+		if e.expires <= now {
+			delete(cs.scrapes, k)
+		}
+	}
+}
+
+func (cs *cachedStorage) invalidate(ih bittorrent.InfoHash) {
+	cs.mu.Lock()
+	delete(cs.scrapes, ih)
+	for _, forSeeder := range []bool{false, true} {
+		for _, v6 := range []bool{false, true} {
+			delete(cs.peers, peersCacheKey{ih, forSeeder, v6})
+		}
+	}
+	cs.mu.Unlock()
+}
+
+func (cs *cachedStorage) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if !cs.keepOnPut {
+		defer cs.invalidate(ih)
+	}
+	return cs.PeerStorage.PutSeeder(ctx, ih, peer)
+}
+
+func (cs *cachedStorage) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if !cs.keepOnPut {
+		defer cs.invalidate(ih)
+	}
+	return cs.PeerStorage.PutLeecher(ctx, ih, peer)
+}
+
+func (cs *cachedStorage) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer cs.invalidate(ih)
+	return cs.PeerStorage.DeleteSeeder(ctx, ih, peer)
+}
+
+func (cs *cachedStorage) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer cs.invalidate(ih)
+	return cs.PeerStorage.DeleteLeecher(ctx, ih, peer)
+}
+
+func (cs *cachedStorage) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer cs.invalidate(ih)
+	return cs.PeerStorage.GraduateLeecher(ctx, ih, peer)
+}
+
+// AnnouncePeers returns random sample of cached peers pool.
+// If pool is expired or absent, it is fetched from underlying storage.
+func (cs *cachedStorage) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	if numWant > cs.poolSize {
+		recordCacheLookup("peers", false)
+		return cs.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+	}
+	k := peersCacheKey{ih, forSeeder, v6}
+	e, hit := cs.cachedPeers(k, timecache.NowUnixNano())
+	recordCacheLookup("peers", hit)
+	if !hit {
+		v, err, _ := cs.peerLoads.Do(k.String(), func() (any, error) {
+			// load is shared between requesters, so it is not cancelled by one of them
+			return cs.loadPeers(context.WithoutCancel(ctx), k)
+		})
+		if err != nil {
+			return nil, err
+		}
+		e = v.(*peersCacheEntry)
+	}
+	if e.notExist {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+	return samplePeers(e.peers, numWant, storage.ExclusionFromContext(ctx)), nil
+}
+
+func (cs *cachedStorage) cachedPeers(k peersCacheKey, now int64) (*peersCacheEntry, bool) {
+	cs.mu.RLock()
+	e, found := cs.peers[k]
+	cs.mu.RUnlock()
+	return e, found && e.expires > now
+}
+
+// loadPeers fetches peers pool from underlying storage, unless
+// it was just loaded by previous load
+func (cs *cachedStorage) loadPeers(ctx context.Context, k peersCacheKey) (*peersCacheEntry, error) {
+	now := timecache.NowUnixNano()
+	if e, hit := cs.cachedPeers(k, now); hit {
+		return e, nil
+	}
+	// pool is shared between requesters, so exclusion hint
+	// is not passed to storage, but applied to sample
+	peers, err := cs.PeerStorage.AnnouncePeers(storage.WithExclusion(ctx, storage.Exclusion{}), k.ih, k.forSeeder, cs.poolSize, k.v6)
+	notExist := errors.Is(err, storage.ErrResourceDoesNotExist)
+	if err != nil && !notExist {
+		return nil, err
+	}
+	e := &peersCacheEntry{peers: peers, notExist: notExist, expires: now + int64(cs.ttl)}
+	cs.mu.Lock()
+	cs.sweep(now)
+	cs.peers[k] = e
+	cs.mu.Unlock()
+	return e, nil
+}
+
+// samplePeers returns n (or less if pool is smaller) random
+// not excluded peers from pool. Pool is not copied: indices are
+// shuffled with partial Fisher-Yates shuffle, and only swapped
+// indices are stored.
+func samplePeers(pool []bittorrent.Peer, n int, excl storage.Exclusion) []bittorrent.Peer {
+	n = min(n, len(pool))
+	out := make([]bittorrent.Peer, 0, n)
+	swapped := make(map[int]int, n)
+	for i := 0; i < len(pool) && len(out) < n; i++ {
+		j := i + rand.IntN(len(pool)-i) //nolint:gosec
+		vi, isOk := swapped[i]
+		if !isOk {
+			vi = i
+		}
+		vj, isOk := swapped[j]
+		if !isOk {
+			vj = j
+		}
+		// position i is not visited again, so only j is updated
+		swapped[j] = vi
+		if p := pool[vj]; !excl.Excludes(p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (cs *cachedStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	e, hit := cs.cachedScrape(ih, timecache.NowUnixNano())
+	recordCacheLookup("scrape", hit)
+	if !hit {
+		v, err, _ := cs.scrapeLoads.Do(string(ih), func() (any, error) {
+			return cs.loadScrape(context.WithoutCancel(ctx), ih)
+		})
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		e = v.(*scrapeCacheEntry)
+	}
+	return e.leechers, e.seeders, e.snatched, nil
+}
+
+func (cs *cachedStorage) cachedScrape(ih bittorrent.InfoHash, now int64) (*scrapeCacheEntry, bool) {
+	cs.mu.RLock()
+	e, found := cs.scrapes[ih]
+	cs.mu.RUnlock()
+	return e, found && e.expires > now
+}
+
+// loadScrape fetches swarm statistics from underlying storage, unless
+// it was just loaded by previous load
+func (cs *cachedStorage) loadScrape(ctx context.Context, ih bittorrent.InfoHash) (*scrapeCacheEntry, error) {
+	now := timecache.NowUnixNano()
+	if e, hit := cs.cachedScrape(ih, now); hit {
+		return e, nil
+	}
+	l, s, n, err := cs.PeerStorage.ScrapeSwarm(ctx, ih)
+	if err != nil {
+		return nil, err
+	}
+	e := &scrapeCacheEntry{leechers: l, seeders: s, snatched: n, expires: now + int64(cs.ttl)}
+	cs.mu.Lock()
+	cs.sweep(now)
+	cs.scrapes[ih] = e
+	cs.mu.Unlock()
+	return e, nil
+}
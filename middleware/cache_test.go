@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func TestResponseCache(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+	require.Equal(t, ps, NewResponseCache(ResponseCacheConfig{}, ps))
+
+	cs := NewResponseCache(ResponseCacheConfig{TTL: time.Hour, PoolSize: 10, KeepOnPut: true}, ps)
+	ctx := context.Background()
+	ih := bittorrent.InfoHash("01234567890123456789")
+	newPeer := func(i byte) bittorrent.Peer {
+		id := bittorrent.PeerID([]byte("-TR3000-01234567890" + string(rune('a'+i))))
+		return bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, i}), 6881)}
+	}
+	for i := byte(0); i < 5; i++ {
+		require.Nil(t, cs.PutSeeder(ctx, ih, newPeer(i)))
+	}
+
+	l, s, _, err := cs.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), l)
+	require.Equal(t, uint32(5), s)
+	peers, err := cs.AnnouncePeers(ctx, ih, false, 3, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 3)
+
+	// put does not invalidate cache if KeepOnPut set
+	require.Nil(t, cs.PutSeeder(ctx, ih, newPeer(5)))
+	_, s, _, err = cs.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(5), s)
+	peers, err = cs.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 5)
+
+	// delete does
+	require.Nil(t, cs.DeleteSeeder(ctx, ih, newPeer(0)))
+	_, s, _, err = cs.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(5), s)
+	peers, err = cs.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 5)
+	require.NotContains(t, peers, newPeer(0))
+}
+
+func TestResponseCacheInvalidatedOnPut(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+	cs := NewResponseCache(ResponseCacheConfig{TTL: time.Hour, PoolSize: 10}, ps)
+	ctx, ih := context.Background(), bittorrent.InfoHash("01234567890123456789")
+	seeder := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}
+	require.Nil(t, cs.PutSeeder(ctx, ih, seeder))
+	peers, err := cs.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{seeder}, peers)
+
+	leecher := bittorrent.Peer{AddrPort: netip.MustParseAddrPort("10.0.0.2:6881")}
+	require.Nil(t, cs.PutLeecher(ctx, ih, leecher))
+	l, s, _, err := cs.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), l)
+	require.Equal(t, uint32(1), s)
+	peers, err = cs.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 2)
+}
+
+func TestSamplePeers(t *testing.T) {
+	pool := make([]bittorrent.Peer, 10)
+	for i := range pool {
+		pool[i] = bittorrent.Peer{AddrPort: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)}
+	}
+	orig := slices.Clone(pool)
+	excl := storage.Exclusion{Addrs: []netip.Addr{pool[0].Addr(), pool[1].Addr()}}
+	for range 100 {
+		out := samplePeers(pool, 5, excl)
+		require.Len(t, out, 5)
+		for _, p := range out {
+			require.False(t, excl.Excludes(p))
+			require.Contains(t, pool, p)
+		}
+		slices.SortFunc(out, func(a, b bittorrent.Peer) int { return a.AddrPort.Compare(b.AddrPort) })
+		require.Len(t, slices.Compact(out), 5)
+	}
+	require.Len(t, samplePeers(pool, 20, excl), 8)
+	require.Equal(t, orig, pool)
+}
+
+// slowStorage counts and delays swarm requests
+type slowStorage struct {
+	storage.PeerStorage
+	announces, scrapes atomic.Int32
+}
+
+func (s *slowStorage) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	s.announces.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return s.PeerStorage.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (s *slowStorage) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	s.scrapes.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return s.PeerStorage.ScrapeSwarm(ctx, ih)
+}
+
+func TestResponseCacheCoalesce(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("01234567890123456789")
+	require.Nil(t, ps.PutSeeder(ctx, ih, bittorrent.Peer{AddrPort: netip.MustParseAddrPort("10.0.0.1:6881")}))
+	ss := &slowStorage{PeerStorage: ps}
+	cs := NewResponseCache(ResponseCacheConfig{TTL: time.Hour, PoolSize: 10}, ss)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			peers, err := cs.AnnouncePeers(ctx, ih, false, 5, false)
+			require.Nil(t, err)
+			require.Len(t, peers, 1)
+		}()
+		go func() {
+			defer wg.Done()
+			_, s, _, err := cs.ScrapeSwarm(ctx, ih)
+			require.Nil(t, err)
+			require.Equal(t, uint32(1), s)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), ss.announces.Load())
+	require.Equal(t, int32(1), ss.scrapes.Load())
+}
@@ -0,0 +1,482 @@
+// Package connectability implements middleware, which asynchronously
+// checks if announcing peers accept incoming connections and moves
+// unconnectable peers to the end of announce responses (or drops them).
+package connectability
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "connectability"
+
+const (
+	// FilterOrder moves unconnectable peers to the end of response
+	FilterOrder = "order"
+	// FilterDrop removes unconnectable peers from response
+	FilterDrop = "drop"
+
+	defaultStorageCtx      = "connectability"
+	defaultProbeRate       = 10
+	defaultProbeTimeout    = 2 * time.Second
+	defaultRecheckInterval = time.Hour
+	defaultWorkers         = 4
+	defaultQueueSize       = 1000
+	defaultCacheSize       = 100000
+	defaultExpireInterval  = time.Minute
+
+	protocolName = "BitTorrent protocol"
+	// handshakeLen is the length of handshake without peer ID
+	handshakeLen = 1 + len(protocolName) + 8 + bittorrent.InfoHashV1Len
+)
+
+const (
+	resultConnectable   = "connectable"
+	resultUnconnectable = "unconnectable"
+	resultRateLimited   = "rate_limited"
+	resultQueueFull     = "queue_full"
+	resultNotGlobal     = "not_global"
+)
+
+var (
+	logger = log.NewLogger("middleware/connectability")
+
+	// ErrInvalidProbability returned if probe probability is not in [0, 1]
+	ErrInvalidProbability = errors.New("invalid probe_probability")
+
+	errHandshake = errors.New("invalid handshake")
+
+	// trackerPeerID is the peer ID sent in handshake
+	trackerPeerID = bittorrent.PeerID([]byte("-MO0000-connectcheck"))
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+	prometheus.MustRegister(promProbesTotal)
+}
+
+var promProbesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_middleware_connectability_probes_total",
+		Help: "The number of peer connectability probes by result",
+	},
+	[]string{"result"},
+)
+
+// Config represents the configuration for the connectability middleware.
+type Config struct {
+	// ProbeProbability is the probability of announcing peer check,
+	// zero disables checks
+	ProbeProbability float64 `cfg:"probe_probability"`
+	// ProbeRate is the maximal number of checks per second
+	ProbeRate float64 `cfg:"probe_rate"`
+	// ProbeTimeout is the timeout of connection (and handshake)
+	ProbeTimeout time.Duration `cfg:"probe_timeout"`
+	// Handshake enables BitTorrent handshake after connection established
+	Handshake bool
+	// RecheckInterval is the time, check result is valid
+	RecheckInterval time.Duration `cfg:"recheck_interval"`
+	// Workers is the number of concurrent checks
+	Workers int
+	// QueueSize is the maximal number of checks waiting for worker
+	QueueSize int `cfg:"queue_size"`
+	// Filter is the action with unconnectable peers in response:
+	// order, drop or empty (do nothing)
+	Filter string
+	// StorageCtx is the name of storage context where to store check results
+	StorageCtx string `cfg:"storage_ctx"`
+}
+
+func build(config conf.MapConfig, st storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.ProbeProbability < 0 || cfg.ProbeProbability > 1 {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrInvalidProbability)
+	}
+	switch cfg.Filter {
+	case "", FilterOrder, FilterDrop:
+	default:
+		return nil, fmt.Errorf("middleware %s: unknown filter '%s'", Name, cfg.Filter)
+	}
+	if cfg.ProbeProbability == 0 && len(cfg.Filter) == 0 {
+		logger.Warn().Msg("both probe and filter disabled")
+	}
+	if len(cfg.StorageCtx) == 0 {
+		logger.Warn().
+			Str("name", "StorageCtx").
+			Str("provided", cfg.StorageCtx).
+			Str("default", defaultStorageCtx).
+			Msg("falling back to default configuration")
+		cfg.StorageCtx = defaultStorageCtx
+	}
+	if cfg.RecheckInterval <= 0 {
+		logger.Warn().
+			Str("name", "RecheckInterval").
+			Dur("provided", cfg.RecheckInterval).
+			Dur("default", defaultRecheckInterval).
+			Msg("falling back to default configuration")
+		cfg.RecheckInterval = defaultRecheckInterval
+	}
+	h := &hook{cfg: cfg, store: st}
+	if cfg.ProbeProbability > 0 {
+		if cfg.ProbeRate <= 0 {
+			logger.Warn().
+				Str("name", "ProbeRate").
+				Float64("provided", cfg.ProbeRate).
+				Float64("default", defaultProbeRate).
+				Msg("falling back to default configuration")
+			cfg.ProbeRate = defaultProbeRate
+		}
+		if cfg.ProbeTimeout <= 0 {
+			logger.Warn().
+				Str("name", "ProbeTimeout").
+				Dur("provided", cfg.ProbeTimeout).
+				Dur("default", defaultProbeTimeout).
+				Msg("falling back to default configuration")
+			cfg.ProbeTimeout = defaultProbeTimeout
+		}
+		if cfg.Workers <= 0 {
+			cfg.Workers = defaultWorkers
+		}
+		if cfg.QueueSize <= 0 {
+			cfg.QueueSize = defaultQueueSize
+		}
+		h.cfg = cfg
+		h.limiter = newLimiter(cfg.ProbeRate)
+		h.recent = make(map[netip.AddrPort]*list.Element)
+		h.checks = list.New()
+		h.jobs = make(chan job, cfg.QueueSize)
+		h.closed = make(chan any)
+		h.dialer = &net.Dialer{Timeout: cfg.ProbeTimeout}
+		for range cfg.Workers {
+			h.wg.Add(1)
+			go h.work()
+		}
+		h.wg.Add(1)
+		go h.expireLoop(min(cfg.RecheckInterval, defaultExpireInterval))
+	}
+	return h, nil
+}
+
+type job struct {
+	addr netip.AddrPort
+	ih   bittorrent.InfoHash
+}
+
+type hook struct {
+	cfg     Config
+	store   storage.DataStorage
+	limiter *limiter
+	dialer  *net.Dialer
+	jobs    chan job
+	closed  chan any
+	wg      sync.WaitGroup
+	// recent holds last check of address, used to prevent
+	// repeated checks of the same peer
+	recentMu sync.Mutex
+	recent   map[netip.AddrPort]*list.Element
+	// checks holds values of recent ordered by check time, oldest first
+	checks *list.List
+}
+
+// check is the result of peer check
+type check struct {
+	addr netip.AddrPort
+	// at is the time (unix seconds) of check
+	at            int64
+	unconnectable bool
+}
+
+// HandleAnnounce schedules check of announcing peer
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.jobs == nil || req.Event == bittorrent.Stopped || req.Port == 0 ||
+		rand.Float64() >= h.cfg.ProbeProbability { //nolint:gosec
+		return ctx, nil
+	}
+	for _, p := range req.Peers() {
+		if !probeable(p.Addr()) {
+			// provided (or spoofed) address must not make
+			// tracker connect to internal hosts
+			promProbesTotal.WithLabelValues(resultNotGlobal).Inc()
+			continue
+		}
+		select {
+		case h.jobs <- job{addr: p.AddrPort, ih: req.InfoHash}:
+		default:
+			promProbesTotal.WithLabelValues(resultQueueFull).Inc()
+		}
+	}
+	return ctx, nil
+}
+
+// probeable checks if address is public unicast address, which may be checked
+func probeable(a netip.Addr) bool {
+	a = a.Unmap()
+	return a.IsGlobalUnicast() && !a.IsPrivate() && !a.IsLoopback() && !a.IsLinkLocalUnicast()
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't require any protection.
+	return ctx, nil
+}
+
+func (h *hook) work() {
+	defer h.wg.Done()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case j := <-h.jobs:
+			h.probe(j)
+		}
+	}
+}
+
+// markRecent returns false if address was checked during RecheckInterval,
+// otherwise saves current check time
+func (h *hook) markRecent(addr netip.AddrPort) bool {
+	h.recentMu.Lock()
+	defer h.recentMu.Unlock()
+	if _, exists := h.recent[addr]; exists {
+		return false
+	}
+	if len(h.recent) >= defaultCacheSize {
+		// too many peers checked recently, skip check
+		// to prevent unbounded memory usage
+		return false
+	}
+	h.recent[addr] = h.checks.PushBack(&check{addr: addr, at: timecache.NowUnix()})
+	return true
+}
+
+// setResult saves result of address check
+func (h *hook) setResult(addr netip.AddrPort, unconnectable bool) {
+	h.recentMu.Lock()
+	defer h.recentMu.Unlock()
+	if e := h.recent[addr]; e != nil {
+		e.Value.(*check).unconnectable = unconnectable
+	}
+}
+
+// forget removes address from recent checks
+func (h *hook) forget(addr netip.AddrPort) {
+	h.recentMu.Lock()
+	defer h.recentMu.Unlock()
+	if e := h.recent[addr]; e != nil {
+		h.checks.Remove(e)
+		delete(h.recent, addr)
+	}
+}
+
+// expire removes checks older than RecheckInterval and
+// deletes stored results of unconnectable peers
+func (h *hook) expire() {
+	expired := timecache.NowUnix() - int64(h.cfg.RecheckInterval.Seconds())
+	var keys []string
+	h.recentMu.Lock()
+	for e := h.checks.Front(); e != nil; e = h.checks.Front() {
+		c := e.Value.(*check)
+		if c.at > expired {
+			break
+		}
+		h.checks.Remove(e)
+		delete(h.recent, c.addr)
+		if c.unconnectable {
+			keys = append(keys, c.addr.String())
+		}
+	}
+	h.recentMu.Unlock()
+	if len(keys) > 0 {
+		if err := h.store.Delete(context.Background(), h.cfg.StorageCtx, keys...); err != nil {
+			logger.Error().Err(err).Int("count", len(keys)).Msg("unable to delete expired connectability")
+		}
+	}
+}
+
+func (h *hook) expireLoop(interval time.Duration) {
+	defer h.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			h.expire()
+		}
+	}
+}
+
+func (h *hook) probe(j job) {
+	if !h.markRecent(j.addr) {
+		return
+	}
+	if !h.limiter.allow() {
+		h.forget(j.addr)
+		promProbesTotal.WithLabelValues(resultRateLimited).Inc()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.ProbeTimeout)
+	defer cancel()
+	err := h.connect(ctx, j)
+	h.setResult(j.addr, err != nil)
+	key := j.addr.String()
+	if err == nil {
+		promProbesTotal.WithLabelValues(resultConnectable).Inc()
+		err = h.store.Delete(context.Background(), h.cfg.StorageCtx, key)
+	} else {
+		logger.Debug().Err(err).Stringer("addr", j.addr).Msg("peer is not connectable")
+		promProbesTotal.WithLabelValues(resultUnconnectable).Inc()
+		v := binary.BigEndian.AppendUint64(nil, uint64(timecache.NowUnix()))
+		err = h.store.Put(context.Background(), h.cfg.StorageCtx, storage.Entry{Key: key, Value: v})
+	}
+	if err != nil {
+		logger.Error().Err(err).Stringer("addr", j.addr).Msg("unable to store connectability")
+	}
+}
+
+// connect dials peer and performs handshake if configured
+func (h *hook) connect(ctx context.Context, j job) error {
+	c, err := h.dialer.DialContext(ctx, "tcp", j.addr.String())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !h.cfg.Handshake {
+		return nil
+	}
+	if dl, isOk := ctx.Deadline(); isOk {
+		_ = c.SetDeadline(dl)
+	}
+	ih := j.ih.TruncateV1().Bytes()
+	hs := make([]byte, 0, handshakeLen+bittorrent.PeerIDLen)
+	hs = append(hs, byte(len(protocolName)))
+	hs = append(hs, protocolName...)
+	hs = append(hs, make([]byte, 8)...)
+	hs = append(hs, ih...)
+	hs = append(hs, trackerPeerID[:]...)
+	if _, err = c.Write(hs); err != nil {
+		return err
+	}
+	// peer ID of reply is not checked, some clients
+	// send it only after own check of info hash
+	reply := make([]byte, handshakeLen)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if !bytes.Equal(reply[:1+len(protocolName)], hs[:1+len(protocolName)]) ||
+		!bytes.Equal(reply[handshakeLen-len(ih):], ih) {
+		return errHandshake
+	}
+	return nil
+}
+
+// filter loads check results of all peers with one storage request,
+// and moves unconnectable peers to the end or drops them.
+// Results older than RecheckInterval are deleted.
+func (h *hook) filter(ctx context.Context, peers bittorrent.Peers) bittorrent.Peers {
+	if len(peers) == 0 {
+		return peers
+	}
+	keys := make([]string, len(peers))
+	for i, p := range peers {
+		keys[i] = p.AddrPort.String()
+	}
+	values, err := storage.LoadMany(ctx, h.store, h.cfg.StorageCtx, keys...)
+	if err != nil {
+		logger.Error().Err(err).Msg("unable to load connectability")
+		return peers
+	}
+	expired := timecache.NowUnix() - int64(h.cfg.RecheckInterval.Seconds())
+	out := make(bittorrent.Peers, 0, len(peers))
+	var bad bittorrent.Peers
+	var stale []string
+	for i, p := range peers {
+		switch v := values[i]; {
+		case len(v) != 8:
+			out = append(out, p)
+		case int64(binary.BigEndian.Uint64(v)) > expired:
+			bad = append(bad, p)
+		default:
+			out = append(out, p)
+			stale = append(stale, keys[i])
+		}
+	}
+	if len(stale) > 0 {
+		if err = h.store.Delete(ctx, h.cfg.StorageCtx, stale...); err != nil {
+			logger.Error().Err(err).Int("count", len(stale)).Msg("unable to delete expired connectability")
+		}
+	}
+	if h.cfg.Filter == FilterOrder {
+		out = append(out, bad...)
+	}
+	return out
+}
+
+// ModifyAnnounceResponse moves unconnectable peers to the end of response or drops them
+func (h *hook) ModifyAnnounceResponse(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if len(h.cfg.Filter) > 0 {
+		resp.IPv4Peers = h.filter(ctx, resp.IPv4Peers)
+		resp.IPv6Peers = h.filter(ctx, resp.IPv6Peers)
+	}
+	return ctx, nil
+}
+
+// Close stops checks
+func (h *hook) Close() error {
+	if h.closed != nil {
+		close(h.closed)
+		h.wg.Wait()
+	}
+	return nil
+}
+
+// limiter is the token bucket rate limiter
+type limiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	burst := max(rate, 1)
+	return &limiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// allow takes token if available
+func (l *limiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,172 @@
+package connectability
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+var ih = bittorrent.InfoHash("01234567890123456789")
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+// listen starts TCP server, which replies handshake with provided info hash
+func listen(t *testing.T, replyHash bittorrent.InfoHash) netip.AddrPort {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				hs := make([]byte, handshakeLen+bittorrent.PeerIDLen)
+				if _, err := io.ReadFull(c, hs); err != nil {
+					return
+				}
+				copy(hs[handshakeLen-bittorrent.InfoHashV1Len:], replyHash)
+				_, _ = c.Write(hs)
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(l.Addr().String())
+}
+
+// closedPort returns address, which does not accept connections
+func closedPort(t *testing.T) netip.AddrPort {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ap := netip.MustParseAddrPort(l.Addr().String())
+	require.Nil(t, l.Close())
+	return ap
+}
+
+func newStorage(t *testing.T) storage.PeerStorage {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func newHook(t *testing.T, st storage.PeerStorage, cfg conf.MapConfig) *hook {
+	h, err := build(cfg, st)
+	require.Nil(t, err)
+	t.Cleanup(func() { require.Nil(t, h.(*hook).Close()) })
+	return h.(*hook)
+}
+
+func announce(h *hook, addr netip.AddrPort) {
+	_, _ = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		RequestPeer: bittorrent.RequestPeer{
+			Port:             addr.Port(),
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: addr.Addr()}},
+		},
+	}, nil)
+}
+
+func unconnectable(t *testing.T, st storage.PeerStorage, addr netip.AddrPort) bool {
+	v, err := st.Load(context.Background(), defaultStorageCtx, addr.String())
+	require.Nil(t, err)
+	return v != nil
+}
+
+func TestProbeAndFilter(t *testing.T) {
+	st := newStorage(t)
+	good, bad := listen(t, ih), closedPort(t)
+	// pre-mark good peer as unconnectable, successful check must clear it
+	require.Nil(t, st.Put(context.Background(), defaultStorageCtx, storage.Entry{Key: good.String(), Value: []byte{0, 0, 0, 0, 0, 0, 0, 1}}))
+
+	prober := newHook(t, st, conf.MapConfig{
+		"probe_probability": 1,
+		"probe_rate":        100,
+		"probe_timeout":     time.Second,
+		"storage_ctx":       defaultStorageCtx,
+	})
+	// test servers listen on loopback, which is not accepted
+	// from announces, so checks are queued directly
+	prober.jobs <- job{addr: good, ih: ih}
+	prober.jobs <- job{addr: bad, ih: ih}
+	require.Eventually(t, func() bool {
+		return unconnectable(t, st, bad) && !unconnectable(t, st, good)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp := &bittorrent.AnnounceResponse{IPv4Peers: bittorrent.Peers{{AddrPort: bad}, {AddrPort: good}}}
+	orderer := newHook(t, st, conf.MapConfig{"filter": FilterOrder, "storage_ctx": defaultStorageCtx})
+	_, err := orderer.ModifyAnnounceResponse(context.Background(), nil, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Peers{{AddrPort: good}, {AddrPort: bad}}, resp.IPv4Peers)
+
+	dropper := newHook(t, st, conf.MapConfig{"filter": FilterDrop, "storage_ctx": defaultStorageCtx})
+	_, err = dropper.ModifyAnnounceResponse(context.Background(), nil, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Peers{{AddrPort: good}}, resp.IPv4Peers)
+}
+
+func TestHandshake(t *testing.T) {
+	st := newStorage(t)
+	good, wrong := listen(t, ih), listen(t, bittorrent.InfoHash("98765432109876543210"))
+	h := newHook(t, st, conf.MapConfig{
+		"probe_probability": 1,
+		"probe_rate":        100,
+		"handshake":         true,
+		"storage_ctx":       defaultStorageCtx,
+	})
+	require.Nil(t, h.connect(context.Background(), job{addr: good, ih: ih}))
+	require.ErrorIs(t, h.connect(context.Background(), job{addr: wrong, ih: ih}), errHandshake)
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2)
+	require.True(t, l.allow())
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+	time.Sleep(600 * time.Millisecond)
+	require.True(t, l.allow())
+	require.False(t, l.allow())
+}
+
+func TestRecent(t *testing.T) {
+	h := newHook(t, newStorage(t), conf.MapConfig{"probe_probability": 1, "storage_ctx": defaultStorageCtx})
+	addr := netip.MustParseAddrPort("192.0.2.1:6881")
+	require.True(t, h.markRecent(addr))
+	require.False(t, h.markRecent(addr))
+	require.True(t, h.markRecent(netip.MustParseAddrPort("192.0.2.1:6882")))
+}
+
+func TestInternalAddressesNotProbed(t *testing.T) {
+	h := newHook(t, newStorage(t), conf.MapConfig{"probe_probability": 1, "storage_ctx": defaultStorageCtx})
+	skipped := testutil.ToFloat64(promProbesTotal.WithLabelValues(resultNotGlobal))
+	internal := []string{
+		"127.0.0.1:6881", "10.0.0.1:6881", "192.168.1.1:6881", "169.254.1.1:6881",
+		"0.0.0.0:6881", "[::1]:6881", "[fe80::1]:6881", "[fd00::1]:6881", "[::ffff:10.0.0.1]:6881",
+	}
+	for _, a := range internal {
+		announce(h, netip.MustParseAddrPort(a))
+	}
+	require.Equal(t, skipped+float64(len(internal)), testutil.ToFloat64(promProbesTotal.WithLabelValues(resultNotGlobal)))
+	time.Sleep(50 * time.Millisecond)
+	h.recentMu.Lock()
+	defer h.recentMu.Unlock()
+	require.Empty(t, h.recent)
+
+	require.True(t, probeable(netip.MustParseAddr("192.0.2.1")))
+	require.True(t, probeable(netip.MustParseAddr("2001:db8::1")))
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// DryRunKey is the key of hook configuration, which enables dry-run
+// (shadow) mode of the hook: hook is executed, but its decisions
+// are only logged and counted, not enforced.
+const DryRunKey = "dry_run"
+
+const (
+	dryRunResultAllow  = "allow"
+	dryRunResultDeny   = "deny"
+	dryRunResultModify = "modify"
+)
+
+func init() {
+	prometheus.MustRegister(promDryRunDecisionsTotal)
+}
+
+var promDryRunDecisionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mochi_middleware_dry_run_decisions_total",
+		Help: "The number of decisions made by hooks in dry-run mode",
+	},
+	[]string{"hook", "action", "result"},
+)
+
+// dryRunConfig is the part of hook configuration,
+// read by NewHooks
+type dryRunConfig struct {
+	DryRun bool `cfg:"dry_run"`
+}
+
+// dryRunHook wraps Hook and executes it with copies of request and response,
+// so hook can not affect request processing. Errors returned by hook
+// are logged, counted and swallowed, changes of copies are counted too.
+type dryRunHook struct {
+	Hook
+	name string
+}
+
+// record counts decision of hook, reason of denial is only logged
+// to keep metric cardinality low. Request, which hook would only
+// modify (i.e. cap numwant or change interval), is counted separately.
+func (h *dryRunHook) record(action string, req zerolog.LogObjectMarshaler, err error, modified bool) {
+	result := dryRunResultAllow
+	switch {
+	case err != nil:
+		result = dryRunResultDeny
+		logger.Info().
+			Str("hook", h.name).
+			Str("action", action).
+			Bool("clientError", errors.As(err, new(bittorrent.ClientError))).
+			Err(err).
+			Object("request", req).
+			Msg("dry-run hook would deny request")
+	case modified:
+		result = dryRunResultModify
+		logger.Debug().
+			Str("hook", h.name).
+			Str("action", action).
+			Object("request", req).
+			Msg("dry-run hook would modify request or response")
+	}
+	promDryRunDecisionsTotal.WithLabelValues(h.name, action, result).Inc()
+}
+
+func copyAnnounce(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (*bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+	reqCopy, respCopy := *req, *resp
+	reqCopy.RequestAddresses = slices.Clone(req.RequestAddresses)
+	respCopy.IPv4Peers, respCopy.IPv6Peers = slices.Clone(resp.IPv4Peers), slices.Clone(resp.IPv6Peers)
+	return &reqCopy, &respCopy
+}
+
+// announceModified checks if hook changed copies of announce request or response
+func announceModified(req, reqCopy *bittorrent.AnnounceRequest, resp, respCopy *bittorrent.AnnounceResponse) bool {
+	return req.Event != reqCopy.Event || req.InfoHash != reqCopy.InfoHash ||
+		req.NumWant != reqCopy.NumWant || req.Left != reqCopy.Left ||
+		req.Downloaded != reqCopy.Downloaded || req.Uploaded != reqCopy.Uploaded ||
+		req.ID != reqCopy.ID || req.Port != reqCopy.Port ||
+		!slices.Equal(req.RequestAddresses, reqCopy.RequestAddresses) ||
+		resp.Complete != respCopy.Complete || resp.Incomplete != respCopy.Incomplete ||
+		resp.Interval != respCopy.Interval || resp.MinInterval != respCopy.MinInterval ||
+		resp.Warning != respCopy.Warning ||
+		!slices.Equal(resp.IPv4Peers, respCopy.IPv4Peers) || !slices.Equal(resp.IPv6Peers, respCopy.IPv6Peers)
+}
+
+func copyScrape(req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (*bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) {
+	reqCopy := *req
+	reqCopy.RequestAddresses = slices.Clone(req.RequestAddresses)
+	reqCopy.InfoHashes = slices.Clone(req.InfoHashes)
+	var respCopy *bittorrent.ScrapeResponse
+	if resp != nil {
+		respCopy = &bittorrent.ScrapeResponse{Data: slices.Clone(resp.Data)}
+	}
+	return &reqCopy, respCopy
+}
+
+// scrapeModified checks if hook changed copies of scrape request or response
+func scrapeModified(req, reqCopy *bittorrent.ScrapeRequest, resp, respCopy *bittorrent.ScrapeResponse) bool {
+	return !slices.Equal(req.InfoHashes, reqCopy.InfoHashes) ||
+		!slices.Equal(req.RequestAddresses, reqCopy.RequestAddresses) ||
+		resp != nil && !slices.Equal(resp.Data, respCopy.Data)
+}
+
+func (h *dryRunHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	reqCopy, respCopy := copyAnnounce(req, resp)
+	_, err := h.Hook.HandleAnnounce(ctx, reqCopy, respCopy)
+	h.record("announce", req, err, announceModified(req, reqCopy, resp, respCopy))
+	return ctx, nil
+}
+
+func (h *dryRunHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	reqCopy, respCopy := copyScrape(req, resp)
+	_, err := h.Hook.HandleScrape(ctx, reqCopy, respCopy)
+	h.record("scrape", req, err, scrapeModified(req, reqCopy, resp, respCopy))
+	return ctx, nil
+}
+
+// dryRunModifierHook is the dryRunHook for hooks,
+// which implement ResponseModifier or ScrapeResponseModifier
+type dryRunModifierHook struct {
+	*dryRunHook
+}
+
+func (h dryRunModifierHook) ModifyAnnounceResponse(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if m, isOk := h.Hook.(ResponseModifier); isOk {
+		reqCopy, respCopy := copyAnnounce(req, resp)
+		// allowed requests are already counted in HandleAnnounce
+		if _, err := m.ModifyAnnounceResponse(ctx, reqCopy, respCopy); err != nil || announceModified(req, reqCopy, resp, respCopy) {
+			h.record("announce", req, err, true)
+		}
+	}
+	return ctx, nil
+}
+
+func (h dryRunModifierHook) ModifyScrapeResponse(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if m, isOk := h.Hook.(ScrapeResponseModifier); isOk {
+		reqCopy, respCopy := copyScrape(req, resp)
+		// allowed requests are already counted in HandleScrape
+		if _, err := m.ModifyScrapeResponse(ctx, reqCopy, respCopy); err != nil || scrapeModified(req, reqCopy, resp, respCopy) {
+			h.record("scrape", req, err, true)
+		}
+	}
+	return ctx, nil
+}
+
+// Ping checks wrapped hook if it implements Pinger,
+// but only logs error to not affect tracker health status
+func (h *dryRunHook) Ping(ctx context.Context) error {
+	if p, isOk := h.Hook.(Pinger); isOk {
+		if err := p.Ping(ctx); err != nil {
+			logger.Warn().Str("hook", h.name).Err(err).Msg("dry-run hook ping failed")
+		}
+	}
+	return nil
+}
+
+// Close closes wrapped hook if it implements io.Closer
+func (h *dryRunHook) Close() error {
+	if c, isOk := h.Hook.(io.Closer); isOk {
+		return c.Close()
+	}
+	return nil
+}
+
+// newDryRunHook wraps hook to execute it in dry-run mode
+func newDryRunHook(name string, h Hook) Hook {
+	dh := &dryRunHook{Hook: h, name: name}
+	_, isAnnounceModifier := h.(ResponseModifier)
+	_, isScrapeModifier := h.(ScrapeResponseModifier)
+	if isAnnounceModifier || isScrapeModifier {
+		return dryRunModifierHook{dh}
+	}
+	return dh
+}
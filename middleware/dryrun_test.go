@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// limitHook denies scrapes and caps numwant
+type limitHook struct{}
+
+func (limitHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	req.NumWant = 1
+	return context.WithValue(ctx, SkipSwarmInteractionKey, true), nil
+}
+
+func (limitHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, bittorrent.ClientError("scrape denied")
+}
+
+// intervalHook sets announce interval in response modification phase
+type intervalHook struct{}
+
+func (intervalHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func (intervalHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, nil
+}
+
+func (intervalHook) ModifyAnnounceResponse(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	resp.Interval = time.Hour
+	return ctx, nil
+}
+
+func TestDryRun(t *testing.T) {
+	RegisterBuilder("test limit", func(conf.MapConfig, storage.PeerStorage) (Hook, error) {
+		return limitHook{}, nil
+	})
+	hooks, err := NewHooks([]conf.NamedMapConfig{
+		{Name: "test limit", Config: conf.MapConfig{DryRunKey: true}},
+		{Name: "test limit"},
+	}, nil)
+	require.Nil(t, err)
+	require.Len(t, hooks, 2)
+	dh, enforced := hooks[0], hooks[1]
+	require.Implements(t, (*io.Closer)(nil), dh)
+	ctx := context.Background()
+
+	req := &bittorrent.AnnounceRequest{NumWant: 50}
+	outCtx, err := dh.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(50), req.NumWant)
+	require.Nil(t, outCtx.Value(SkipSwarmInteractionKey))
+	require.Equal(t, 1.0, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test limit", "announce", dryRunResultModify)))
+	require.Zero(t, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test limit", "announce", dryRunResultAllow)))
+
+	// numwant is already capped
+	_, err = dh.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{NumWant: 1}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, 1.0, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test limit", "announce", dryRunResultAllow)))
+
+	sreq := &bittorrent.ScrapeRequest{}
+	_, err = dh.HandleScrape(ctx, sreq, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	_, err = dh.HandleScrape(ctx, sreq, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Equal(t, 2.0, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test limit", "scrape", dryRunResultDeny)))
+
+	_, err = enforced.HandleScrape(ctx, sreq, &bittorrent.ScrapeResponse{})
+	require.NotNil(t, err)
+}
+
+func TestDryRunInvalidConfig(t *testing.T) {
+	built := 0
+	RegisterBuilder("test invalid dry run", func(conf.MapConfig, storage.PeerStorage) (Hook, error) {
+		built++
+		return limitHook{}, nil
+	})
+	_, err := NewHooks([]conf.NamedMapConfig{
+		{Name: "test invalid dry run", Config: conf.MapConfig{DryRunKey: []any{"yes"}}},
+	}, nil)
+	require.NotNil(t, err)
+	require.Zero(t, built)
+}
+
+func TestDryRunModifier(t *testing.T) {
+	RegisterBuilder("test interval", func(conf.MapConfig, storage.PeerStorage) (Hook, error) {
+		return intervalHook{}, nil
+	})
+	hooks, err := NewHooks([]conf.NamedMapConfig{
+		{Name: "test interval", Config: conf.MapConfig{DryRunKey: true}},
+	}, nil)
+	require.Nil(t, err)
+	dh := hooks[0].(ResponseModifier)
+	ctx := context.Background()
+
+	req, resp := new(bittorrent.AnnounceRequest), &bittorrent.AnnounceResponse{Interval: time.Minute}
+	_, err = hooks[0].HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	_, err = dh.ModifyAnnounceResponse(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+	require.Equal(t, 1.0, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test interval", "announce", dryRunResultAllow)))
+	require.Equal(t, 1.0, testutil.ToFloat64(promDryRunDecisionsTotal.WithLabelValues("test interval", "announce", dryRunResultModify)))
+}
@@ -0,0 +1,326 @@
+// Package eventstream implements a post Hook that serializes every
+// announce as an event into newline delimited JSON (NDJSON) and writes
+// it into rotating file or sends to HTTP webhook in batches.
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"slices"
+
+	"github.com/rs/zerolog"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/clientapproval"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "event stream"
+
+// Output types
+const (
+	// OutputFile writes events into file
+	OutputFile = "file"
+	// OutputWebhook sends events to HTTP endpoint
+	OutputWebhook = "webhook"
+)
+
+// Anonymization modes
+const (
+	// AnonymizeHash replaces address with HMAC-SHA256 of address
+	AnonymizeHash = "hash"
+	// AnonymizeTruncate replaces address with its network prefix
+	AnonymizeTruncate = "truncate"
+)
+
+const (
+	defaultIPv4PrefixLen = 24
+	defaultIPv6PrefixLen = 48
+	hashedAddrLen        = 16
+)
+
+var logger = log.NewLogger("middleware/event stream")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// requestFields maps event fields to keys written by
+// bittorrent.AnnounceRequest.MarshalZerologObject,
+// keys of nested objects are joined with dot
+var requestFields = map[string]string{
+	"event":      "event",
+	"info_hash":  "infoHash",
+	"peer_id":    "source.id",
+	"port":       "source.port",
+	"left":       "left",
+	"downloaded": "downloaded",
+	"uploaded":   "uploaded",
+	"num_want":   "numWant",
+	"params":     "params",
+}
+
+// fieldWriter appends single field, which is not provided by
+// request marshaler or should be modified, into event
+type fieldWriter func(*zerolog.Event, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse, *hook)
+
+var fieldWriters = map[string]fieldWriter{
+	"time": func(e *zerolog.Event, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse, _ *hook) {
+		e.Time("time", timecache.Now())
+	},
+	"client": func(e *zerolog.Event, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse, _ *hook) {
+		cid := clientapproval.NewClientID(req.ID)
+		e.Bytes("client", cid[:])
+	},
+	"family": func(e *zerolog.Event, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse, _ *hook) {
+		family := "ipv4"
+		if req.GetFirst().Is6() {
+			family = "ipv6"
+		}
+		e.Str("family", family)
+	},
+	// addresses are written as plain (possibly anonymized) strings
+	"addresses": func(e *zerolog.Event, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse, h *hook) {
+		arr := zerolog.Arr()
+		for _, a := range req.RequestAddresses {
+			arr.Str(h.anonymize(a.Addr))
+		}
+		e.Array("addresses", arr)
+	},
+	"seeders": func(e *zerolog.Event, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, _ *hook) {
+		seeders, _ := swarmSize(req, resp)
+		e.Uint32("seeders", seeders)
+	},
+	"leechers": func(e *zerolog.Event, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, _ *hook) {
+		_, leechers := swarmSize(req, resp)
+		e.Uint32("leechers", leechers)
+	},
+}
+
+// swarmSize returns number of seeders and leechers after announce.
+// Response contains swarm statistics read before announcing peer is stored,
+// so they are adjusted by announce event: started peer is added (if it is not
+// already counted, i.e. returned to itself), stopped peer is removed and
+// completed peer is moved from leechers to seeders.
+func swarmSize(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (seeders, leechers uint32) {
+	seeders, leechers = resp.Complete, resp.Incomplete
+	own := &leechers
+	if req.Left == 0 {
+		own = &seeders
+	}
+	switch req.Event {
+	case bittorrent.Started:
+		if !containsAny(resp, req.Peers()) {
+			*own++
+		}
+	case bittorrent.Stopped:
+		if *own > 0 {
+			*own--
+		}
+	case bittorrent.Completed:
+		if leechers > 0 {
+			leechers--
+		}
+		seeders++
+	}
+	return
+}
+
+func containsAny(resp *bittorrent.AnnounceResponse, peers []bittorrent.Peer) bool {
+	for _, p := range peers {
+		if slices.Contains(resp.IPv4Peers, p) || slices.Contains(resp.IPv6Peers, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFields is the list of fields written if Config.Fields is empty
+var defaultFields = []string{
+	"time", "event", "info_hash", "peer_id", "client", "family",
+	"addresses", "port", "left", "downloaded", "uploaded", "seeders", "leechers",
+}
+
+// Config represents all the values required by this middleware to
+// serialize and send events.
+type Config struct {
+	// Output type: file or webhook
+	Output string
+	// Fields is the list of fields to write. If empty, all fields
+	// except `num_want` and `params` are written
+	Fields []string
+	// Anonymize peers' addresses: empty (disabled), hash or truncate
+	Anonymize string
+	// HashKey is the HMAC key used if Anonymize is set to hash
+	HashKey string `cfg:"hash_key"`
+	// IPv4PrefixLen is the prefix length of truncated IPv4 address
+	IPv4PrefixLen int `cfg:"ipv4_prefix_len"`
+	// IPv6PrefixLen is the prefix length of truncated IPv6 address
+	IPv6PrefixLen int `cfg:"ipv6_prefix_len"`
+	// File is the configuration of file output
+	File FileConfig
+	// Webhook is the configuration of webhook output
+	Webhook WebhookConfig
+}
+
+type hook struct {
+	enc    zerolog.Logger
+	out    io.Closer
+	fields []string
+	// marshalRequest is set if any of fields is written by request marshaler
+	marshalRequest bool
+	anonymize      func(netip.Addr) string
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+
+	h := new(hook)
+	if len(cfg.Fields) == 0 {
+		cfg.Fields = defaultFields
+	}
+	for _, f := range cfg.Fields {
+		if _, exists := requestFields[f]; exists {
+			h.marshalRequest = true
+		} else if _, exists = fieldWriters[f]; !exists {
+			return nil, fmt.Errorf("invalid config for middleware %s: unknown field '%s'", Name, f)
+		}
+	}
+	h.fields = cfg.Fields
+
+	switch cfg.Anonymize {
+	case "":
+		h.anonymize = func(a netip.Addr) string { return a.String() }
+	case AnonymizeHash:
+		if len(cfg.HashKey) == 0 {
+			logger.Warn().Msg("hash key is empty, hashed addresses may be easily restored")
+		}
+		key := []byte(cfg.HashKey)
+		h.anonymize = func(a netip.Addr) string {
+			b, _ := a.MarshalBinary()
+			mac := hmac.New(sha256.New, key)
+			mac.Write(b)
+			return hex.EncodeToString(mac.Sum(nil)[:hashedAddrLen])
+		}
+	case AnonymizeTruncate:
+		if cfg.IPv4PrefixLen <= 0 || cfg.IPv4PrefixLen > 32 {
+			cfg.IPv4PrefixLen = defaultIPv4PrefixLen
+		}
+		if cfg.IPv6PrefixLen <= 0 || cfg.IPv6PrefixLen > 128 {
+			cfg.IPv6PrefixLen = defaultIPv6PrefixLen
+		}
+		h.anonymize = func(a netip.Addr) string {
+			bits := cfg.IPv4PrefixLen
+			if a.Is6() {
+				bits = cfg.IPv6PrefixLen
+			}
+			p, _ := a.Prefix(bits)
+			return p.Addr().String()
+		}
+	default:
+		return nil, fmt.Errorf("invalid config for middleware %s: unknown anonymization mode '%s'", Name, cfg.Anonymize)
+	}
+
+	var w io.WriteCloser
+	var err error
+	switch cfg.Output {
+	case OutputFile:
+		w, err = newFileWriter(cfg.File)
+	case OutputWebhook:
+		w, err = newWebhookWriter(cfg.Webhook)
+	default:
+		err = fmt.Errorf("unknown output '%s'", cfg.Output)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h.out, h.enc = w, zerolog.New(w)
+
+	return h, nil
+}
+
+// HandleAnnounce writes announce event into output.
+// Note: this hook should be used as post hook, otherwise
+// swarm size (seeders, leechers) fields will be empty.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	var values map[string]json.RawMessage
+	if h.marshalRequest {
+		var err error
+		if values, err = marshalRequest(req); err != nil {
+			logger.Warn().Err(err).Msg("unable to marshal announce request")
+		}
+	}
+	e := h.enc.Log()
+	for _, f := range h.fields {
+		if key, exists := requestFields[f]; exists {
+			// null values (i.e. empty params) are omitted
+			if v := values[key]; len(v) > 0 && !bytes.Equal(v, jsonNull) {
+				e.RawJSON(f, v)
+			}
+		} else {
+			fieldWriters[f](e, req, resp, h)
+		}
+	}
+	e.Send()
+	return ctx, nil
+}
+
+var jsonNull = []byte("null")
+
+// marshalRequest serializes request with its zerolog marshaler
+// and returns top level and nested values by keys joined with dot
+func marshalRequest(req *bittorrent.AnnounceRequest) (map[string]json.RawMessage, error) {
+	var buf bytes.Buffer
+	enc := zerolog.New(&buf)
+	enc.Log().EmbedObject(req).Send()
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &top); err != nil {
+		return nil, err
+	}
+	values := maps.Clone(top)
+	for k, v := range top {
+		// params are written as is
+		if len(v) > 0 && v[0] == '{' && k != "params" {
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(v, &nested); err != nil {
+				return nil, err
+			}
+			for nk, nv := range nested {
+				values[k+"."+nk] = nv
+			}
+		}
+	}
+	return values, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not streamed.
+	return ctx, nil
+}
+
+// Close flushes pending events and closes output
+func (h *hook) Close() (err error) {
+	if h.out != nil {
+		err = h.out.Close()
+	}
+	return
+}
+
+var errWriterClosed = errors.New("writer closed")
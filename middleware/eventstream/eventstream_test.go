@@ -0,0 +1,189 @@
+package eventstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+var (
+	testReq = &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Completed,
+		InfoHash: bittorrent.InfoHash("01234567890123456789"),
+		RequestPeer: bittorrent.RequestPeer{
+			ID:   bittorrent.PeerID([]byte("-TR3000-012345678901")),
+			Port: 6881,
+			RequestAddresses: bittorrent.RequestAddresses{
+				{Addr: netip.MustParseAddr("192.168.1.17")},
+			},
+		},
+	}
+	testResp = &bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}
+)
+
+func readEvents(t *testing.T, r io.Reader) (events []map[string]any) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		e := make(map[string]any)
+		require.Nil(t, json.Unmarshal(sc.Bytes(), &e))
+		events = append(events, e)
+	}
+	return
+}
+
+func TestFileOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	h, err := build(conf.MapConfig{
+		"output":    OutputFile,
+		"fields":    []string{"event", "client", "family", "addresses", "seeders", "leechers"},
+		"anonymize": AnonymizeTruncate,
+		"file": map[string]any{
+			"path":        path,
+			"max_size":    150,
+			"max_backups": 2,
+		},
+	}, nil)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = h.HandleAnnounce(context.Background(), testReq, testResp)
+		require.Nil(t, err)
+	}
+	require.Nil(t, h.(*hook).Close())
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	events := readEvents(t, f)
+	require.Len(t, events, 1)
+	require.Equal(t, map[string]any{
+		"event":     "completed",
+		"client":    "TR3000",
+		"family":    "ipv4",
+		"addresses": []any{"192.168.1.0"},
+		// completed leecher is counted as seeder
+		"seeders":  float64(3),
+		"leechers": float64(2),
+	}, events[0])
+	_, err = os.Stat(path + ".1")
+	require.Nil(t, err)
+	_, err = os.Stat(path + ".2")
+	require.Nil(t, err)
+}
+
+func TestWebhookOutput(t *testing.T) {
+	var mu sync.Mutex
+	var events []map[string]any
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal(t, ndJSONContentType, r.Header.Get("Content-Type"))
+		events = append(events, readEvents(t, r.Body)...)
+	}))
+	defer srv.Close()
+
+	h, err := build(conf.MapConfig{
+		"output":    OutputWebhook,
+		"fields":    []string{"info_hash", "addresses"},
+		"anonymize": AnonymizeHash,
+		"hash_key":  "secret",
+		"webhook": map[string]any{
+			"url":         srv.URL,
+			"batch_size":  2,
+			"retries":     1,
+			"retry_delay": "1ms",
+		},
+	}, nil)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = h.HandleAnnounce(context.Background(), testReq, testResp)
+		require.Nil(t, err)
+	}
+	require.Nil(t, h.(*hook).Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, events, 3)
+	for _, e := range events {
+		require.Equal(t, testReq.InfoHash.String(), e["info_hash"])
+		addrs := e["addresses"].([]any)
+		require.Len(t, addrs, 1)
+		require.Len(t, addrs[0], hashedAddrLen*2)
+		require.False(t, strings.Contains(addrs[0].(string), "."))
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	h, err := build(conf.MapConfig{
+		"output": OutputFile,
+		"fields": []string{"info_hash", "peer_id", "port", "left", "num_want", "params"},
+		"file":   map[string]any{"path": path},
+	}, nil)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), testReq, testResp)
+	require.Nil(t, err)
+	require.Nil(t, h.(*hook).Close())
+
+	f, err := os.Open(path)
+	require.Nil(t, err)
+	defer f.Close()
+	events := readEvents(t, f)
+	require.Len(t, events, 1)
+	// params are nil, so omitted
+	require.Equal(t, map[string]any{
+		"info_hash": testReq.InfoHash.String(),
+		"peer_id":   testReq.ID.String(),
+		"port":      float64(6881),
+		"left":      float64(0),
+		"num_want":  float64(0),
+	}, events[0])
+}
+
+func TestSwarmSize(t *testing.T) {
+	self := testReq.Peers()
+	for _, c := range []struct {
+		event             bittorrent.Event
+		left              uint64
+		resp              bittorrent.AnnounceResponse
+		seeders, leechers uint32
+	}{
+		{bittorrent.None, 1, bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}, 2, 3},
+		{bittorrent.Started, 1, bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}, 2, 4},
+		{bittorrent.Started, 0, bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}, 3, 3},
+		// peer of empty swarm is already counted and returned to itself
+		{bittorrent.Started, 1, bittorrent.AnnounceResponse{Incomplete: 1, IPv4Peers: self}, 0, 1},
+		{bittorrent.Stopped, 1, bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}, 2, 2},
+		{bittorrent.Stopped, 0, bittorrent.AnnounceResponse{}, 0, 0},
+		{bittorrent.Completed, 0, bittorrent.AnnounceResponse{Complete: 2, Incomplete: 3}, 3, 2},
+	} {
+		req := *testReq
+		req.Event, req.Left = c.event, c.left
+		seeders, leechers := swarmSize(&req, &c.resp)
+		require.Equal(t, c.seeders, seeders, "%s left %d", c.event, c.left)
+		require.Equal(t, c.leechers, leechers, "%s left %d", c.event, c.left)
+	}
+}
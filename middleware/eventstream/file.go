@@ -0,0 +1,105 @@
+package eventstream
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const defaultMaxBackups = 5
+
+// FileConfig is the configuration of file output
+type FileConfig struct {
+	// Path to events file
+	Path string
+	// MaxSize is the maximal size of file in bytes, after which
+	// file is rotated. Zero disables rotation
+	MaxSize int64 `cfg:"max_size"`
+	// MaxBackups is the number of rotated files to keep
+	// (path.1, path.2...)
+	MaxBackups int `cfg:"max_backups"`
+}
+
+// fileWriter writes events into file and rotates it
+// if its size exceeds FileConfig.MaxSize
+type fileWriter struct {
+	FileConfig
+	sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func newFileWriter(cfg FileConfig) (*fileWriter, error) {
+	if len(cfg.Path) == 0 {
+		return nil, errors.New("file path not provided")
+	}
+	if cfg.MaxSize > 0 && cfg.MaxBackups <= 0 {
+		logger.Warn().
+			Str("name", "File.MaxBackups").
+			Int("provided", cfg.MaxBackups).
+			Int("default", defaultMaxBackups).
+			Msg("falling back to default configuration")
+		cfg.MaxBackups = defaultMaxBackups
+	}
+	w := &fileWriter{FileConfig: cfg}
+	return w, w.open()
+}
+
+func (w *fileWriter) open() (err error) {
+	if w.f, err = os.OpenFile(w.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err == nil {
+		var fi os.FileInfo
+		if fi, err = w.f.Stat(); err == nil {
+			w.size = fi.Size()
+		}
+	}
+	return
+}
+
+// rotate shifts backups, renames current file to `path.1` and
+// opens new one. If rename fails, writing continues to current file.
+func (w *fileWriter) rotate() (err error) {
+	if err = w.f.Close(); err == nil {
+		_ = os.Remove(fmt.Sprintf("%s.%d", w.Path, w.MaxBackups))
+		for i := w.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", w.Path, i), fmt.Sprintf("%s.%d", w.Path, i+1))
+		}
+		err = os.Rename(w.Path, w.Path+".1")
+	}
+	if openErr := w.open(); openErr != nil {
+		err = errors.Join(err, openErr)
+	}
+	return
+}
+
+// Write writes one event into file. zerolog guarantees,
+// that every Write call contains exactly one event.
+func (w *fileWriter) Write(p []byte) (n int, err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.f == nil {
+		return 0, errWriterClosed
+	}
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.MaxSize {
+		if err = w.rotate(); err != nil {
+			logger.Error().Err(err).Str("file", w.Path).Msg("unable to rotate events file")
+			if w.f == nil {
+				return 0, err
+			}
+		}
+	}
+	n, err = w.f.Write(p)
+	w.size += int64(n)
+	return
+}
+
+// Close closes events file
+func (w *fileWriter) Close() (err error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.f != nil {
+		err = w.f.Close()
+		w.f = nil
+	}
+	return
+}
@@ -0,0 +1,188 @@
+package eventstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultBufferSize    = 10000
+	defaultFlushInterval = time.Second
+	defaultTimeout       = 5 * time.Second
+	defaultRetryDelay    = time.Second
+	ndJSONContentType    = "application/x-ndjson"
+)
+
+// WebhookConfig is the configuration of webhook output
+type WebhookConfig struct {
+	// URL of HTTP endpoint, which receives POST requests with
+	// NDJSON body
+	URL string
+	// BatchSize is the maximal number of events sent in one request
+	BatchSize int `cfg:"batch_size"`
+	// BufferSize is the maximal number of events waiting for sending.
+	// If buffer is full, new events are dropped
+	BufferSize int `cfg:"buffer_size"`
+	// FlushInterval is the maximal time event waits in buffer
+	FlushInterval time.Duration `cfg:"flush_interval"`
+	// Timeout of one HTTP request
+	Timeout time.Duration
+	// Retries is the number of additional attempts to send batch
+	// if request failed or endpoint returned non-2xx status
+	Retries int
+	// RetryDelay is the time between two attempts, doubled after each attempt
+	RetryDelay time.Duration `cfg:"retry_delay"`
+}
+
+// webhookWriter buffers events in bounded channel and
+// sends them in batches to HTTP endpoint
+type webhookWriter struct {
+	WebhookConfig
+	client  *http.Client
+	events  chan []byte
+	closed  chan any
+	wg      sync.WaitGroup
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+func newWebhookWriter(cfg WebhookConfig) (*webhookWriter, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("webhook url not provided")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultBatchSize
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultFlushInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = defaultRetryDelay
+	}
+	w := &webhookWriter{
+		WebhookConfig: cfg,
+		client:        &http.Client{Timeout: cfg.Timeout},
+		events:        make(chan []byte, cfg.BufferSize),
+		closed:        make(chan any),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Write copies event into buffer or drops it if buffer is full
+func (w *webhookWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.closed:
+		return 0, errWriterClosed
+	default:
+	}
+	select {
+	case w.events <- append([]byte(nil), p...):
+	default:
+		if n := w.dropped.Add(1); n&(n-1) == 0 {
+			// log only on 1, 2, 4, 8... dropped events to prevent log flood
+			logger.Warn().Uint64("count", n).Msg("events buffer is full, dropping events")
+		}
+	}
+	return len(p), nil
+}
+
+func (w *webhookWriter) run() {
+	defer w.wg.Done()
+	t := time.NewTicker(w.FlushInterval)
+	defer t.Stop()
+	batch, count := new(bytes.Buffer), 0
+	flush := func() {
+		if count > 0 {
+			w.send(batch.Bytes(), count)
+			batch.Reset()
+			count = 0
+		}
+	}
+	for {
+		select {
+		case <-w.closed:
+			for {
+				select {
+				case e := <-w.events:
+					batch.Write(e)
+					if count++; count >= w.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case e := <-w.events:
+			batch.Write(e)
+			if count++; count >= w.BatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+func (w *webhookWriter) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ndJSONContentType)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return err
+}
+
+func (w *webhookWriter) send(body []byte, count int) {
+	delay := w.RetryDelay
+	var err error
+	for attempt := 0; attempt <= w.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-w.closed:
+				// do not wait on shutdown, just make last attempt
+			}
+		}
+		if err = w.post(body); err == nil {
+			return
+		}
+		logger.Debug().Err(err).Int("attempt", attempt).Msg("unable to send events")
+	}
+	logger.Error().Err(err).Int("count", count).Msg("unable to send events, batch dropped")
+}
+
+// Close sends all buffered events and stops sending
+func (w *webhookWriter) Close() error {
+	w.once.Do(func() {
+		close(w.closed)
+		w.wg.Wait()
+	})
+	return nil
+}
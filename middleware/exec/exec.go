@@ -0,0 +1,415 @@
+// Package exec implements middleware, which delegates announce and scrape
+// decisions to external long-running process, communicating with it
+// through length-prefixed JSON messages over stdin/stdout.
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/internal/external"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "exec"
+
+const (
+	// FailOpen accepts requests if process is not available
+	FailOpen = external.FailOpen
+	// FailClosed rejects requests if process is not available
+	FailClosed = external.FailClosed
+
+	defaultTimeout      = time.Second
+	defaultRestartDelay = time.Second
+	maxRestartDelay     = 30 * time.Second
+	shutdownTimeout     = 5 * time.Second
+	// writeQueueSize is the number of messages, which may wait
+	// for writing to stdin, if process does not read them
+	writeQueueSize = 256
+)
+
+var (
+	logger = log.NewLogger("middleware/exec")
+
+	// ErrNoCommand returned if command is not provided
+	ErrNoCommand = errors.New("command not provided")
+	// ErrUnavailable returned to client if process is not available
+	// (not running, timed out or crashed) and fail policy is closed
+	ErrUnavailable = bittorrent.ClientError("request processing unavailable")
+
+	errNotRunning    = errors.New("process is not running")
+	errProcessExited = errors.New("process exited before reply")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Config represents the configuration for the exec middleware.
+type Config struct {
+	// Command is the path to executable
+	Command string
+	// Args are command line arguments of Command
+	Args []string
+	// Env are additional environment variables (KEY=VALUE) of process
+	Env []string
+	// Timeout is the maximal time to wait reply from process
+	Timeout time.Duration
+	// FailPolicy is the decision if process did not reply: open or closed
+	FailPolicy string `cfg:"fail_policy"`
+	// RestartDelay is the initial delay before process restart,
+	// doubled after each sequential crash
+	RestartDelay time.Duration `cfg:"restart_delay"`
+	// HandleAnnounce enables sending announce requests to process
+	HandleAnnounce bool `cfg:"handle_announce"`
+	// HandleScrape enables sending scrape requests to process
+	HandleScrape bool `cfg:"handle_scrape"`
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.Command) == 0 {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrNoCommand)
+	}
+	var err error
+	if cfg.FailPolicy, err = external.ValidateFailPolicy(cfg.FailPolicy); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if cfg.Timeout <= 0 {
+		logger.Warn().
+			Str("name", "Timeout").
+			Dur("provided", cfg.Timeout).
+			Dur("default", defaultTimeout).
+			Msg("falling back to default configuration")
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.RestartDelay <= 0 {
+		logger.Warn().
+			Str("name", "RestartDelay").
+			Dur("provided", cfg.RestartDelay).
+			Dur("default", defaultRestartDelay).
+			Msg("falling back to default configuration")
+		cfg.RestartDelay = defaultRestartDelay
+	}
+	if !cfg.HandleAnnounce && !cfg.HandleScrape {
+		logger.Warn().Msg("both announce and scrape handle disabled")
+	}
+
+	h := &hook{cfg: cfg, closed: make(chan any)}
+	p, err := h.start()
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h.wg.Add(1)
+	go h.supervise(p)
+	return h, nil
+}
+
+// process is the running instance of command
+type process struct {
+	cmd   *osexec.Cmd
+	stdin io.WriteCloser
+	// writes are messages to write to stdin
+	writes chan []byte
+	// pmu guards pending and exited
+	pmu     sync.Mutex
+	pending map[uint64]chan response
+	exited  bool
+	// done closed after process exited and all pending calls failed
+	done chan struct{}
+}
+
+func (p *process) read(stdout io.Reader) {
+	for {
+		b, err := readMessage(stdout)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				logger.Error().Err(err).Msg("unable to read message from process")
+				_ = p.cmd.Process.Kill()
+			}
+			return
+		}
+		var r response
+		if err = json.Unmarshal(b, &r); err != nil {
+			logger.Error().Err(err).Msg("unable to decode message from process")
+			_ = p.cmd.Process.Kill()
+			return
+		}
+		p.pmu.Lock()
+		ch, isOk := p.pending[r.ID]
+		delete(p.pending, r.ID)
+		p.pmu.Unlock()
+		if isOk {
+			ch <- r
+		} else {
+			logger.Warn().Uint64("id", r.ID).Msg("received reply for unknown (or timed out) request")
+		}
+	}
+}
+
+// write sends queued messages to stdin. Messages are written by separate
+// goroutine, so callers are not blocked if process stops reading stdin.
+func (p *process) write() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case b := <-p.writes:
+			if err := writeMessage(p.stdin, b); err != nil {
+				if !errors.Is(err, os.ErrClosed) {
+					logger.Error().Err(err).Msg("unable to write message to process")
+					_ = p.cmd.Process.Kill()
+				}
+				return
+			}
+		}
+	}
+}
+
+// fail marks process as exited and fails all pending calls
+func (p *process) fail() {
+	p.pmu.Lock()
+	p.exited = true
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+	p.pmu.Unlock()
+}
+
+type hook struct {
+	cfg    Config
+	cur    atomic.Pointer[process]
+	nextID atomic.Uint64
+	closed chan any
+	wg     sync.WaitGroup
+}
+
+// start runs command and goroutines, which read its stdout and stderr
+func (h *hook) start() (*process, error) {
+	cmd := osexec.Command(h.cfg.Command, h.cfg.Args...)
+	cmd.Env = append(os.Environ(), h.cfg.Env...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	logger.Info().Str("command", h.cfg.Command).Int("pid", cmd.Process.Pid).Msg("process started")
+	p := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		writes:  make(chan []byte, writeQueueSize),
+		pending: make(map[uint64]chan response),
+		done:    make(chan struct{}),
+	}
+	go p.write()
+	var rwg sync.WaitGroup
+	rwg.Add(2)
+	go func() {
+		defer rwg.Done()
+		p.read(stdout)
+	}()
+	go func() {
+		defer rwg.Done()
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			logger.Warn().Int("pid", cmd.Process.Pid).Str("stderr", s.Text()).Send()
+		}
+	}()
+	go func() {
+		// Wait must be called after all reads from pipes completed
+		rwg.Wait()
+		err := cmd.Wait()
+		p.fail()
+		logger.Info().Err(err).Int("pid", cmd.Process.Pid).Msg("process exited")
+		close(p.done)
+	}()
+	h.cur.Store(p)
+	return p, nil
+}
+
+// stop closes process's stdin and waits it to exit or kills it after shutdownTimeout
+func (h *hook) stop(p *process) {
+	_ = p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(shutdownTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// supervise restarts process if it exited until hook is closed
+func (h *hook) supervise(p *process) {
+	defer h.wg.Done()
+	delay := h.cfg.RestartDelay
+	for {
+		if p != nil {
+			startedAt := time.Now()
+			select {
+			case <-h.closed:
+				h.stop(p)
+				return
+			case <-p.done:
+				h.cur.CompareAndSwap(p, nil)
+			}
+			// process worked long enough, so this is not a crash loop
+			if time.Since(startedAt) > maxRestartDelay {
+				delay = h.cfg.RestartDelay
+			}
+		}
+		logger.Warn().Dur("delay", delay).Msg("restarting process")
+		select {
+		case <-h.closed:
+			return
+		case <-time.After(delay):
+		}
+		var err error
+		if p, err = h.start(); err != nil {
+			logger.Error().Err(err).Str("command", h.cfg.Command).Msg("unable to start process")
+		}
+		delay = min(delay*2, maxRestartDelay)
+	}
+}
+
+// call sends request to process and waits reply
+func (h *hook) call(ctx context.Context, req request) (r response, err error) {
+	p := h.cur.Load()
+	if p == nil {
+		return r, errNotRunning
+	}
+	req.ID = h.nextID.Add(1)
+	ch := make(chan response, 1)
+	p.pmu.Lock()
+	if p.exited {
+		p.pmu.Unlock()
+		return r, errNotRunning
+	}
+	p.pending[req.ID] = ch
+	p.pmu.Unlock()
+	defer func() {
+		p.pmu.Lock()
+		delete(p.pending, req.ID)
+		p.pmu.Unlock()
+	}()
+
+	var b []byte
+	if b, err = json.Marshal(req); err != nil {
+		return
+	}
+
+	// timeout includes waiting for write, process may not read stdin
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+	select {
+	case p.writes <- b:
+	case <-p.done:
+		return r, errProcessExited
+	case <-ctx.Done():
+		return r, ctx.Err()
+	}
+
+	select {
+	case res, isOk := <-ch:
+		if !isOk {
+			err = errProcessExited
+		}
+		r = res
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.cfg.HandleAnnounce {
+		return ctx, nil
+	}
+	r, err := h.call(ctx, request{Type: msgAnnounce, Announce: newAnnounceMessage(ctx, req, resp)})
+	if err != nil {
+		return ctx, external.Failed(logger, h.cfg.FailPolicy, msgAnnounce, err, ErrUnavailable)
+	}
+	if !r.Allow {
+		return ctx, external.Deny(r.Message)
+	}
+	if r.NumWant != nil {
+		req.NumWant = *r.NumWant
+	}
+	if r.Interval != nil && *r.Interval > 0 {
+		resp.Interval = time.Duration(*r.Interval * float64(time.Second))
+	}
+	if r.MinInterval != nil && *r.MinInterval > 0 {
+		resp.MinInterval = time.Duration(*r.MinInterval * float64(time.Second))
+	}
+	resp.MinInterval = min(resp.MinInterval, resp.Interval)
+	if len(r.Warning) > 0 {
+		resp.Warning = r.Warning
+	}
+	if r.SkipSwarmInteraction {
+		ctx = context.WithValue(ctx, middleware.SkipSwarmInteractionKey, true)
+	}
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if !h.cfg.HandleScrape {
+		return ctx, nil
+	}
+	r, err := h.call(ctx, request{Type: msgScrape, Scrape: newScrapeMessage(ctx, req)})
+	if err != nil {
+		return ctx, external.Failed(logger, h.cfg.FailPolicy, msgScrape, err, ErrUnavailable)
+	}
+	if !r.Allow {
+		return ctx, external.Deny(r.Message)
+	}
+	return ctx, nil
+}
+
+// Ping sends ping message to process, process is considered healthy
+// if it replied with allow flag set
+func (h *hook) Ping(ctx context.Context) error {
+	r, err := h.call(ctx, request{Type: msgPing})
+	if err == nil && !r.Allow {
+		err = fmt.Errorf("process is unhealthy: %s", r.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	return nil
+}
+
+// Close stops process and its supervisor
+func (h *hook) Close() error {
+	if h.closed != nil {
+		close(h.closed)
+		h.wg.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package exec
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+const helperEnv = "MOCHI_EXEC_TEST_HELPER"
+
+const (
+	portDeny    = 1
+	portHang    = 2
+	portCrash   = 3
+	portStall   = 4
+	portDefault = 6881
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+// TestMain runs test binary as hook's process if helperEnv is set
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) == "1" {
+		helper()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// helper replies to requests depending on announced port
+func helper() {
+	var wmu sync.Mutex
+	reply := func(r response) {
+		b, _ := json.Marshal(r)
+		wmu.Lock()
+		_ = writeMessage(os.Stdout, b)
+		wmu.Unlock()
+	}
+	for {
+		b, err := readMessage(os.Stdin)
+		if err != nil {
+			return
+		}
+		var req request
+		if err = json.Unmarshal(b, &req); err != nil {
+			os.Exit(2)
+		}
+		switch {
+		case req.Type == msgPing, req.Type == msgScrape:
+			reply(response{ID: req.ID, Allow: true})
+		case req.Announce.Port == portDeny:
+			reply(response{ID: req.ID, Message: "blocked by " + req.Announce.Addresses[0]})
+		case req.Announce.Port == portHang:
+			// no reply
+		case req.Announce.Port == portCrash:
+			os.Exit(1)
+		case req.Announce.Port == portStall:
+			// stop reading stdin for a while
+			time.Sleep(time.Second)
+			os.Exit(1)
+		default:
+			nw, interval := uint32(5), req.Announce.Interval*2
+			reply(response{
+				ID:                   req.ID,
+				Allow:                true,
+				NumWant:              &nw,
+				Interval:             &interval,
+				SkipSwarmInteraction: true,
+				Warning:              "warning for " + req.Announce.Event,
+			})
+		}
+	}
+}
+
+func newHook(t *testing.T, policy string) middleware.Hook {
+	t.Setenv(helperEnv, "1")
+	h, err := build(conf.MapConfig{
+		"command":         os.Args[0],
+		"timeout":         200 * time.Millisecond,
+		"fail_policy":     policy,
+		"restart_delay":   10 * time.Millisecond,
+		"handle_announce": true,
+		"handle_scrape":   true,
+	}, nil)
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		require.Nil(t, h.(*hook).Close())
+	})
+	return h
+}
+
+func announce(port uint16) (*bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+	return &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Started,
+		InfoHash: bittorrent.InfoHash("01234567890123456789"),
+		NumWant:  50,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID([]byte("-TR3000-000000000000")),
+			Port:             port,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.0.2.1")}},
+		},
+	}, &bittorrent.AnnounceResponse{
+		Interval:    10 * time.Minute,
+		MinInterval: 5 * time.Minute,
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	h := newHook(t, FailClosed)
+	require.Nil(t, h.(middleware.Pinger).Ping(context.Background()))
+
+	req, resp := announce(portDefault)
+	ctx, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(5), req.NumWant)
+	require.Equal(t, 20*time.Minute, resp.Interval)
+	require.Equal(t, 5*time.Minute, resp.MinInterval)
+	require.Equal(t, "warning for started", resp.Warning)
+	require.Equal(t, true, ctx.Value(middleware.SkipSwarmInteractionKey))
+
+	req, resp = announce(portDeny)
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Equal(t, bittorrent.ClientError("blocked by 192.0.2.1"), err)
+
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{
+		InfoHashes: []bittorrent.InfoHash{bittorrent.InfoHash("01234567890123456789")},
+	}, nil)
+	require.Nil(t, err)
+}
+
+func TestConcurrent(t *testing.T) {
+	h := newHook(t, FailClosed)
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port := uint16(portDefault)
+			if i%2 == 0 {
+				port = portDeny
+			}
+			req, resp := announce(port)
+			_, err := h.HandleAnnounce(context.Background(), req, resp)
+			if port == portDeny {
+				require.Error(t, err)
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, uint32(5), req.NumWant)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFailPolicy(t *testing.T) {
+	closed := newHook(t, FailClosed)
+	req, resp := announce(portHang)
+	_, err := closed.HandleAnnounce(context.Background(), req, resp)
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	open := newHook(t, FailOpen)
+	req, resp = announce(portHang)
+	_, err = open.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(50), req.NumWant)
+}
+
+func TestRestart(t *testing.T) {
+	h := newHook(t, FailClosed)
+	pid := h.(*hook).cur.Load().cmd.Process.Pid
+
+	req, resp := announce(portCrash)
+	_, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.ErrorIs(t, err, ErrUnavailable)
+
+	require.Eventually(t, func() bool {
+		return h.(middleware.Pinger).Ping(context.Background()) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NotEqual(t, pid, h.(*hook).cur.Load().cmd.Process.Pid)
+}
+
+func TestNoCommand(t *testing.T) {
+	_, err := build(conf.MapConfig{}, nil)
+	require.ErrorIs(t, err, ErrNoCommand)
+
+	_, err = build(conf.MapConfig{"command": "/nonexistent/command"}, nil)
+	require.Error(t, err)
+}
+
+func TestStalledStdin(t *testing.T) {
+	h := newHook(t, FailClosed)
+	req, resp := announce(portStall)
+	_, err := h.HandleAnnounce(context.Background(), req, resp)
+	require.Equal(t, ErrUnavailable, err)
+
+	// enough requests to fill stdin pipe and write queue
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, resp := announce(portDefault)
+			_, err := h.HandleAnnounce(context.Background(), req, resp)
+			require.Equal(t, ErrUnavailable, err)
+		}()
+	}
+	wg.Wait()
+	require.Less(t, time.Since(start), time.Second)
+}
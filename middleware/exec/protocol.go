@@ -0,0 +1,125 @@
+package exec
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware/internal/external"
+)
+
+// maxMessageSize is the maximal size of message, received from process
+const maxMessageSize = 16 * 1024 * 1024
+
+const (
+	msgAnnounce = "announce"
+	msgScrape   = "scrape"
+	msgPing     = "ping"
+)
+
+var errMessageTooLarge = errors.New("message too large")
+
+// request is the message sent to process
+type request struct {
+	ID       uint64           `json:"id"`
+	Type     string           `json:"type"`
+	Announce *announceMessage `json:"announce,omitempty"`
+	Scrape   *scrapeMessage   `json:"scrape,omitempty"`
+}
+
+type announceMessage struct {
+	Event       string            `json:"event"`
+	InfoHash    string            `json:"info_hash"`
+	PeerID      string            `json:"peer_id"`
+	Addresses   []string          `json:"addresses"`
+	Port        uint16            `json:"port"`
+	Left        uint64            `json:"left"`
+	Downloaded  uint64            `json:"downloaded"`
+	Uploaded    uint64            `json:"uploaded"`
+	NumWant     uint32            `json:"numwant"`
+	Interval    float64           `json:"interval"`
+	MinInterval float64           `json:"min_interval"`
+	RouteParams map[string]string `json:"route_params,omitempty"`
+}
+
+type scrapeMessage struct {
+	InfoHashes  []string          `json:"info_hashes"`
+	Addresses   []string          `json:"addresses"`
+	RouteParams map[string]string `json:"route_params,omitempty"`
+}
+
+// response is the message received from process
+type response struct {
+	ID uint64 `json:"id"`
+	// Allow is the decision about request. If false, request
+	// is rejected with Message
+	Allow bool `json:"allow"`
+	// Message is the reason of rejection (or ping error)
+	Message string `json:"message,omitempty"`
+	// NumWant if set, replaces requested peers count
+	NumWant *uint32 `json:"numwant,omitempty"`
+	// Interval if set, replaces announce interval (seconds)
+	Interval *float64 `json:"interval,omitempty"`
+	// MinInterval if set, replaces minimal announce interval (seconds)
+	MinInterval *float64 `json:"min_interval,omitempty"`
+	// SkipSwarmInteraction if true, peer is not stored in storage
+	SkipSwarmInteraction bool `json:"skip_swarm_interaction,omitempty"`
+	// Warning if set, is returned to client as warning message
+	Warning string `json:"warning,omitempty"`
+}
+
+// writeMessage writes 4-byte big-endian length of b followed by b
+func writeMessage(w io.Writer, b []byte) error {
+	buf := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	_, err := w.Write(append(buf, b...))
+	return err
+}
+
+// readMessage reads length-prefixed message
+func readMessage(r io.Reader) ([]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxMessageSize {
+		return nil, fmt.Errorf("%w: %d bytes", errMessageTooLarge, n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func newAnnounceMessage(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) *announceMessage {
+	return &announceMessage{
+		Event:       req.Event.String(),
+		InfoHash:    req.InfoHash.String(),
+		PeerID:      hex.EncodeToString(req.ID[:]),
+		Addresses:   external.Addresses(req.RequestAddresses),
+		Port:        req.Port,
+		Left:        req.Left,
+		Downloaded:  req.Downloaded,
+		Uploaded:    req.Uploaded,
+		NumWant:     req.NumWant,
+		Interval:    resp.Interval.Seconds(),
+		MinInterval: resp.MinInterval.Seconds(),
+		RouteParams: external.RouteParams(ctx),
+	}
+}
+
+func newScrapeMessage(ctx context.Context, req *bittorrent.ScrapeRequest) *scrapeMessage {
+	m := &scrapeMessage{
+		InfoHashes:  make([]string, 0, len(req.InfoHashes)),
+		Addresses:   external.Addresses(req.RequestAddresses),
+		RouteParams: external.RouteParams(ctx),
+	}
+	for _, ih := range req.InfoHashes {
+		m.InfoHashes = append(m.InfoHashes, ih.String())
+	}
+	return m
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"errors"
+	"net/netip"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/storage"
@@ -28,6 +29,42 @@ type Pinger interface {
 	Ping(ctx context.Context) error
 }
 
+// ResponseModifier is an optional interface that may be implemented by a pre Hook
+// to alter AnnounceResponse after it has been filled with swarm statistics
+// and peers from storage (pre Hooks are executed before internal response
+// hook, so AnnounceResponse is empty at that time).
+//
+// Modifiers are executed in the same order as pre Hooks were provided.
+type ResponseModifier interface {
+	ModifyAnnounceResponse(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) (context.Context, error)
+}
+
+// ScrapeResponseModifier is the same as ResponseModifier, but for ScrapeResponse.
+type ScrapeResponseModifier interface {
+	ModifyScrapeResponse(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse) (context.Context, error)
+}
+
+// responseModifierHook wraps ResponseModifier and/or ScrapeResponseModifier
+// to be placed in pre Hook chain after internal response hook
+type responseModifierHook struct {
+	announce ResponseModifier
+	scrape   ScrapeResponseModifier
+}
+
+func (h responseModifierHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.announce == nil {
+		return ctx, nil
+	}
+	return h.announce.ModifyAnnounceResponse(ctx, req, resp)
+}
+
+func (h responseModifierHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.scrape == nil {
+		return ctx, nil
+	}
+	return h.scrape.ModifyScrapeResponse(ctx, req, resp)
+}
+
 type skipSwarmInteraction struct{}
 
 // SkipSwarmInteractionKey is a key for the context of an Announce to control
@@ -98,8 +135,33 @@ type skipResponseHook struct{}
 // skip.
 var SkipResponseHookKey = skipResponseHook{}
 
+// PeerFilterConfig is the configuration of peers filtering in announce responses.
+type PeerFilterConfig struct {
+	// ExcludeSelf drops announcing peer's own entries
+	// (the same peer ID and address) from response
+	ExcludeSelf bool `yaml:"exclude_self"`
+	// ExcludeSameHost drops all peers with the same address
+	// as announcing peer from response
+	ExcludeSameHost bool `yaml:"exclude_same_host"`
+}
+
+// exclusion returns storage.Exclusion for provided request
+func (c PeerFilterConfig) exclusion(req *bittorrent.AnnounceRequest) (e storage.Exclusion) {
+	if c.ExcludeSelf {
+		e.Peers = req.Peers()
+	}
+	if c.ExcludeSameHost {
+		e.Addrs = make([]netip.Addr, 0, len(req.RequestAddresses))
+		for _, a := range req.RequestAddresses {
+			e.Addrs = append(e.Addrs, a.Addr)
+		}
+	}
+	return
+}
+
 type responseHook struct {
-	store storage.PeerStorage
+	store  storage.PeerStorage
+	filter PeerFilterConfig
 }
 
 func (h *responseHook) scrape(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
@@ -164,12 +226,18 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 		maxPeers -= l
 	}
 
+	excl := h.filter.exclusion(req)
+	if !excl.IsEmpty() {
+		ctx = storage.WithExclusion(ctx, excl)
+		peers = excl.Filter(peers)
+	}
+
 	for _, a := range args {
 		if maxPeers <= 0 {
 			break
 		}
 		var storePeers []bittorrent.Peer
-		storePeers, err = h.store.AnnouncePeers(ctx, a.ih, seeding, maxPeers, a.v6)
+		storePeers, err = h.fetchPeers(ctx, a, seeding, maxPeers, excl)
 		if err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
 			return err
 		}
@@ -179,8 +247,9 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 	}
 
 	// Some clients expect a minimum of their own peer representation returned to
-	// them if they are the only peer in a swarm.
-	if len(peers) == 0 {
+	// them if they are the only peer in a swarm, unless peer filter excludes it
+	// (both exclude_self and exclude_same_host drop announcing peer).
+	if len(peers) == 0 && excl.IsEmpty() {
 		if seeding {
 			resp.Complete++
 		} else {
@@ -212,6 +281,32 @@ func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.Announce
 	return
 }
 
+// maxFetchAttempts is the maximal number of storage requests
+// to top up filtered peers
+const maxFetchAttempts = 3
+
+// fetchPeers requests peers from storage and drops excluded ones
+// (if storage ignored exclusion hint). If some peers were dropped
+// and swarm may contain more peers, request is repeated
+// with doubled count to top up result to maxPeers.
+func (h *responseHook) fetchPeers(ctx context.Context, a fetchArgs, seeding bool, maxPeers int, excl storage.Exclusion) (peers []bittorrent.Peer, err error) {
+	if excl.IsEmpty() {
+		return h.store.AnnouncePeers(ctx, a.ih, seeding, maxPeers, a.v6)
+	}
+	count := maxPeers + len(excl.Peers)
+	for attempt := 1; ; attempt++ {
+		if peers, err = h.store.AnnouncePeers(ctx, a.ih, seeding, count, a.v6); err != nil {
+			return
+		}
+		l := len(peers)
+		peers = excl.Filter(peers)
+		if len(peers) >= maxPeers || l < count || attempt >= maxFetchAttempts {
+			return peers[:min(len(peers), maxPeers)], nil
+		}
+		count *= 2
+	}
+}
+
 func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (_ context.Context, err error) {
 	if ctx.Value(SkipResponseHookKey) != nil {
 		return ctx, nil
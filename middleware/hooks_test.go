@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+// hintIgnoringStorage drops exclusion hint before calling storage
+type hintIgnoringStorage struct {
+	storage.PeerStorage
+}
+
+func (s hintIgnoringStorage) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	return s.PeerStorage.AnnouncePeers(storage.WithExclusion(ctx, storage.Exclusion{}), ih, forSeeder, numWant, v6)
+}
+
+func TestResponseHookPeerFilter(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih := bittorrent.InfoHash("01234567890123456789")
+	self := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}
+	sameHost := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000002")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6882")}
+	other1 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000003")), AddrPort: netip.MustParseAddrPort("192.0.2.2:6881")}
+	other2 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000004")), AddrPort: netip.MustParseAddrPort("192.0.2.3:6881")}
+	for _, p := range []bittorrent.Peer{self, sameHost, other1, other2} {
+		require.Nil(t, ps.PutSeeder(context.Background(), ih, p))
+	}
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		NumWant:  2,
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               self.ID,
+			Port:             self.Port(),
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: self.Addr()}},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		filter   PeerFilterConfig
+		numWant  uint32
+		expected []bittorrent.Peer
+		excluded []bittorrent.Peer
+	}{
+		{"self", PeerFilterConfig{ExcludeSelf: true}, 3, []bittorrent.Peer{sameHost, other1, other2}, []bittorrent.Peer{self}},
+		{"same host", PeerFilterConfig{ExcludeSameHost: true}, 3, []bittorrent.Peer{other1, other2}, []bittorrent.Peer{self, sameHost}},
+		{"top up", PeerFilterConfig{ExcludeSameHost: true}, 2, []bittorrent.Peer{other1, other2}, []bittorrent.Peer{self, sameHost}},
+	}
+	for _, c := range cases {
+		for _, st := range []storage.PeerStorage{ps, hintIgnoringStorage{ps}} {
+			t.Run(c.name, func(t *testing.T) {
+				h := &responseHook{store: st, filter: c.filter}
+				r := *req
+				r.NumWant = c.numWant
+				resp := new(bittorrent.AnnounceResponse)
+				_, err := h.HandleAnnounce(context.Background(), &r, resp)
+				require.Nil(t, err)
+				require.ElementsMatch(t, c.expected, resp.IPv4Peers)
+				for _, p := range c.excluded {
+					require.NotContains(t, resp.IPv4Peers, p)
+				}
+			})
+		}
+	}
+}
+
+func TestResponseHookPeerFilterOnlySelf(t *testing.T) {
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+
+	ih := bittorrent.InfoHash("01234567890123456789")
+	self := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, self))
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: ih,
+		NumWant:  2,
+		Left:     1,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               self.ID,
+			Port:             self.Port(),
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: self.Addr()}},
+		},
+	}
+
+	for _, c := range []struct {
+		name     string
+		filter   PeerFilterConfig
+		expected []bittorrent.Peer
+	}{
+		{"no filter", PeerFilterConfig{}, []bittorrent.Peer{self}},
+		{"self", PeerFilterConfig{ExcludeSelf: true}, []bittorrent.Peer{}},
+		{"same host", PeerFilterConfig{ExcludeSameHost: true}, []bittorrent.Peer{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := &responseHook{store: ps, filter: c.filter}
+			resp := new(bittorrent.AnnounceResponse)
+			_, err := h.HandleAnnounce(context.Background(), req, resp)
+			require.Nil(t, err)
+			require.ElementsMatch(t, c.expected, resp.IPv4Peers)
+			require.Equal(t, uint32(1), resp.Incomplete)
+		})
+	}
+}
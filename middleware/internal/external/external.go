@@ -0,0 +1,72 @@
+// Package external contains helpers of middlewares, which delegate
+// decisions about requests to external services (auth callback, exec).
+package external
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+const (
+	// FailOpen accepts requests if decision service is not available
+	FailOpen = "open"
+	// FailClosed rejects requests if decision service is not available
+	FailClosed = "closed"
+
+	// DefaultDenyReason is the reason of rejection, if service did not provide it
+	DefaultDenyReason = "request denied"
+)
+
+// ValidateFailPolicy checks fail policy, empty policy is FailClosed
+func ValidateFailPolicy(policy string) (string, error) {
+	switch policy {
+	case FailOpen, FailClosed:
+		return policy, nil
+	case "":
+		return FailClosed, nil
+	default:
+		return "", fmt.Errorf("unknown fail policy '%s'", policy)
+	}
+}
+
+// Failed logs error of decision request and applies fail policy:
+// returns nil if policy is FailOpen, otherwise unavailable
+func Failed(logger *log.Logger, policy, action string, err, unavailable error) error {
+	logger.Warn().Err(err).Str("action", action).Str("policy", policy).Msg("unable to get decision")
+	if policy == FailOpen {
+		return nil
+	}
+	return unavailable
+}
+
+// Deny returns error, which rejects request with provided reason
+// or DefaultDenyReason if reason is empty
+func Deny(reason string) error {
+	if len(reason) > 0 {
+		return bittorrent.ClientError(reason)
+	}
+	return bittorrent.ClientError(DefaultDenyReason)
+}
+
+// RouteParams returns route parameters of request stored in context
+func RouteParams(ctx context.Context) (out map[string]string) {
+	if rp, isOk := ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams); isOk && len(rp) > 0 {
+		out = make(map[string]string, len(rp))
+		for _, p := range rp {
+			out[p.Key] = p.Value
+		}
+	}
+	return
+}
+
+// Addresses returns string representation of request addresses
+func Addresses(aa bittorrent.RequestAddresses) []string {
+	out := make([]string, 0, len(aa))
+	for _, a := range aa {
+		out = append(out, a.Addr.String())
+	}
+	return out
+}
@@ -0,0 +1,222 @@
+// Package ipblocklist implements a Hook that fails an Announce or Scrape
+// if request originated from blocked network ranges. Ranges are loaded from
+// local files in plain CIDR, PeerGuardian P2P or eMule DAT formats and
+// reloaded when files change.
+package ipblocklist
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "ip blocklist"
+
+const defaultPeriod = time.Minute
+
+var logger = log.NewLogger("middleware/ip blocklist")
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// ErrAddressBlocked is the error returned when a request's address is blocked.
+var ErrAddressBlocked = bittorrent.ClientError("address not allowed by mochi")
+
+// Config represents all the values required by this middleware to load
+// block lists and check requests' addresses.
+type Config struct {
+	// Files is the list of paths to block lists
+	Files []string
+	// Format of block lists: auto, cidr, p2p or dat
+	Format string
+	// Period is time between two checks if files changed
+	Period time.Duration
+	// HandleAnnounce enables announce requests check
+	HandleAnnounce bool `cfg:"handle_announce"`
+	// HandleScrape enables scrape requests check
+	HandleScrape bool `cfg:"handle_scrape"`
+	// FilterPeers enables deletion of blocked peers
+	// from announce response
+	FilterPeers bool `cfg:"filter_peers"`
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type hook struct {
+	cfg    Config
+	trie   atomic.Pointer[prefixTrie]
+	files  map[string]fileState
+	closed chan any
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+
+	if len(cfg.Files) == 0 {
+		return nil, fmt.Errorf("invalid config for middleware %s: files not provided", Name)
+	}
+
+	switch cfg.Format {
+	case FormatAuto, FormatCIDR, FormatP2P, FormatDAT:
+	case "":
+		cfg.Format = FormatAuto
+	default:
+		return nil, fmt.Errorf("invalid config for middleware %s: unknown format '%s'", Name, cfg.Format)
+	}
+
+	if cfg.Period <= 0 {
+		logger.Warn().
+			Str("name", "Period").
+			Dur("provided", cfg.Period).
+			Dur("default", defaultPeriod).
+			Msg("falling back to default configuration")
+		cfg.Period = defaultPeriod
+	}
+
+	if !cfg.HandleAnnounce && !cfg.HandleScrape && !cfg.FilterPeers {
+		logger.Warn().Msg("announce, scrape handle and peer filtering disabled")
+	}
+
+	h := &hook{
+		cfg:    cfg,
+		files:  make(map[string]fileState, len(cfg.Files)),
+		closed: make(chan any),
+	}
+	if _, err := h.reload(); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	go h.watch()
+	return h, nil
+}
+
+// reload checks if any of files changed (or if list is not loaded yet)
+// and reloads all files into new trie.
+func (h *hook) reload() (bool, error) {
+	changed := h.trie.Load() == nil
+	states := make(map[string]fileState, len(h.cfg.Files))
+	for _, p := range h.cfg.Files {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return false, err
+		}
+		st := fileState{modTime: fi.ModTime(), size: fi.Size()}
+		if old, exists := h.files[p]; !exists || old != st {
+			changed = true
+		}
+		states[p] = st
+	}
+	if !changed {
+		return false, nil
+	}
+
+	t := new(prefixTrie)
+	for _, p := range h.cfg.Files {
+		f, err := os.Open(p)
+		if err != nil {
+			return false, err
+		}
+		added, invalid, err := parseList(t, f, h.cfg.Format)
+		_ = f.Close()
+		if err != nil {
+			return false, fmt.Errorf("unable to read %s: %w", p, err)
+		}
+		logger.Info().
+			Str("file", p).
+			Int("ranges", added).
+			Int("invalid", invalid).
+			Msg("block list loaded")
+	}
+	h.trie.Store(t)
+	h.files = states
+	return true, nil
+}
+
+func (h *hook) watch() {
+	t := time.NewTicker(h.cfg.Period)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			if reloaded, err := h.reload(); err != nil {
+				logger.Warn().Err(err).Msg("unable to reload block lists, keeping previous")
+			} else if reloaded {
+				logger.Debug().Msg("block lists reloaded")
+			}
+		}
+	}
+}
+
+func (h *hook) blocked(addrs bittorrent.RequestAddresses) bool {
+	t := h.trie.Load()
+	for _, a := range addrs {
+		if t.contains(a.Addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	var err error
+	if h.cfg.HandleAnnounce && h.blocked(req.RequestAddresses) {
+		logger.Debug().Object("source", req.RequestPeer).Msg("announce from blocked address")
+		err = ErrAddressBlocked
+	}
+	return ctx, err
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	var err error
+	if h.cfg.HandleScrape && h.blocked(req.RequestAddresses) {
+		logger.Debug().Array("addresses", &req.RequestAddresses).Msg("scrape from blocked address")
+		err = ErrAddressBlocked
+	}
+	return ctx, err
+}
+
+func (h *hook) filterPeers(t *prefixTrie, peers bittorrent.Peers) bittorrent.Peers {
+	filtered := peers[:0]
+	for _, p := range peers {
+		if !t.contains(p.Addr()) {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+// ModifyAnnounceResponse removes blocked peers from response
+// (see middleware.ResponseModifier).
+func (h *hook) ModifyAnnounceResponse(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.cfg.FilterPeers {
+		t := h.trie.Load()
+		resp.IPv4Peers = h.filterPeers(t, resp.IPv4Peers)
+		resp.IPv6Peers = h.filterPeers(t, resp.IPv6Peers)
+	}
+	return ctx, nil
+}
+
+// Close stops watching of block lists
+func (h *hook) Close() error {
+	if h.closed != nil {
+		close(h.closed)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package ipblocklist
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+const testList = `# comment
+10.0.0.0/8
+192.168.1.1
+2001:db8::/32
+Some bad org:1.2.3.0-1.2.3.255
+Bad-Org 2:5.6.7.8-5.6.7.10
+Bad, Inc. (see: example.org):9.9.9.0-9.9.9.127
+Bad v6 org:2001:db9:1::-2001:db9:1::ff
+Bad v6: no 2:2001:db9:2::10-2001:db9:2::1f
+001.002.004.000 - 001.002.004.127 , 000 , DAT blocked
+001.002.005.000 - 001.002.005.255 , 200 , DAT allowed
+invalid line
+`
+
+var cases = []struct {
+	addr    string
+	blocked bool
+}{
+	{"10.1.2.3", true},
+	{"11.0.0.1", false},
+	{"192.168.1.1", true},
+	{"192.168.1.2", false},
+	{"2001:db8::1", true},
+	{"2001:db9::1", false},
+	{"1.2.3.0", true},
+	{"1.2.3.255", true},
+	{"1.2.2.255", false},
+	{"5.6.7.7", false},
+	{"5.6.7.8", true},
+	{"5.6.7.10", true},
+	{"5.6.7.11", false},
+	{"1.2.4.127", true},
+	{"1.2.4.128", false},
+	{"1.2.5.1", false},
+	{"::ffff:10.0.0.1", true},
+	{"9.9.9.0", true},
+	{"9.9.9.127", true},
+	{"9.9.9.128", false},
+	{"2001:db9:1::", true},
+	{"2001:db9:1::ff", true},
+	{"2001:db9:1::100", false},
+	{"2001:db9:2::f", false},
+	{"2001:db9:2::10", true},
+	{"2001:db9:2::1f", true},
+	{"2001:db9:2::20", false},
+}
+
+func TestParseList(t *testing.T) {
+	tr := new(prefixTrie)
+	added, invalid, err := parseList(tr, strings.NewReader(testList), FormatAuto)
+	require.Nil(t, err)
+	require.Equal(t, 9, added)
+	require.Equal(t, 1, invalid)
+	for _, c := range cases {
+		t.Run(c.addr, func(t *testing.T) {
+			require.Equal(t, c.blocked, tr.contains(netip.MustParseAddr(c.addr)))
+		})
+	}
+}
+
+func TestHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.p2p")
+	require.Nil(t, os.WriteFile(path, []byte(testList), 0o600))
+	h, err := build(conf.MapConfig{
+		"files":           []string{path},
+		"handle_announce": true,
+		"handle_scrape":   true,
+		"filter_peers":    true,
+	}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	ctx := context.Background()
+	blocked := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("10.0.0.1")}}
+	allowed := bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("11.0.0.1")}}
+
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{RequestPeer: bittorrent.RequestPeer{RequestAddresses: blocked}}, nil)
+	require.Equal(t, ErrAddressBlocked, err)
+	_, err = h.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{RequestPeer: bittorrent.RequestPeer{RequestAddresses: allowed}}, nil)
+	require.Nil(t, err)
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{RequestAddresses: blocked}, nil)
+	require.Equal(t, ErrAddressBlocked, err)
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{RequestAddresses: allowed}, nil)
+	require.Nil(t, err)
+
+	resp := &bittorrent.AnnounceResponse{
+		IPv4Peers: bittorrent.Peers{
+			{AddrPort: netip.MustParseAddrPort("10.0.0.1:1234")},
+			{AddrPort: netip.MustParseAddrPort("11.0.0.1:1234")},
+		},
+		IPv6Peers: bittorrent.Peers{
+			{AddrPort: netip.MustParseAddrPort("[2001:db8::1]:1234")},
+		},
+	}
+	_, err = h.(middleware.ResponseModifier).ModifyAnnounceResponse(ctx, nil, resp)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 1)
+	require.Equal(t, netip.MustParseAddr("11.0.0.1"), resp.IPv4Peers[0].Addr())
+	require.Empty(t, resp.IPv6Peers)
+
+	require.Nil(t, os.WriteFile(path, []byte("11.0.0.0/8\n"), 0o600))
+	reloaded, err := h.(*hook).reload()
+	require.Nil(t, err)
+	require.True(t, reloaded)
+	_, err = h.HandleScrape(ctx, &bittorrent.ScrapeRequest{RequestAddresses: allowed}, nil)
+	require.Equal(t, ErrAddressBlocked, err)
+}
@@ -0,0 +1,182 @@
+package ipblocklist
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Supported list formats
+const (
+	// FormatAuto detects format of each line automatically
+	FormatAuto = "auto"
+	// FormatCIDR is a list of CIDR prefixes or single addresses, one per line
+	FormatCIDR = "cidr"
+	// FormatP2P is a PeerGuardian text list: `description:first-last`
+	FormatP2P = "p2p"
+	// FormatDAT is an eMule (ipfilter.dat) list: `first - last , level , description`
+	FormatDAT = "dat"
+)
+
+// datMaxBlockLevel is the maximal eMule filter level,
+// which means that range should be blocked.
+// Ranges with level above this value are allowed.
+const datMaxBlockLevel = 127
+
+var errInvalidRange = errors.New("invalid address range")
+
+// parseAddr parses IPv4 or IPv6 address. Unlike netip.ParseAddr,
+// leading zeros in IPv4 octets (`001.002.003.004`), which are common
+// for P2P and DAT lists, are allowed.
+func parseAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, ':') < 0 && strings.Count(s, ".") == 3 {
+		var a4 [4]byte
+		for i, o := range strings.Split(s, ".") {
+			v, err := strconv.ParseUint(o, 10, 8)
+			if err != nil {
+				return netip.Addr{}, fmt.Errorf("invalid address %s: %w", s, err)
+			}
+			a4[i] = byte(v)
+		}
+		return netip.AddrFrom4(a4), nil
+	}
+	a, err := netip.ParseAddr(s)
+	return a.Unmap(), err
+}
+
+func parseRange(s string) (from, to netip.Addr, err error) {
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		err = errInvalidRange
+		return
+	}
+	if from, err = parseAddr(first); err == nil {
+		if to, err = parseAddr(last); err == nil && (from.Is4() != to.Is4() || from.Compare(to) > 0) {
+			err = errInvalidRange
+		}
+	}
+	return
+}
+
+// parseP2PRange parses PeerGuardian line `description:first-last`.
+// Description may contain colons, dashes and commas, and IPv6 addresses
+// contain colons too, so the last address is everything after the last dash,
+// and the first address is the longest valid address after description's colon.
+// Line without description is also accepted.
+func parseP2PRange(s string) (from, to netip.Addr, err error) {
+	i := strings.LastIndexByte(s, '-')
+	if i < 0 {
+		err = errInvalidRange
+		return
+	}
+	if to, err = parseAddr(s[i+1:]); err != nil {
+		return
+	}
+	s = s[:i]
+	for {
+		if from, err = parseAddr(s); err == nil && from.Is4() == to.Is4() && from.Compare(to) <= 0 {
+			return
+		}
+		if i = strings.IndexByte(s, ':'); i < 0 {
+			break
+		}
+		s = s[i+1:]
+	}
+	err = errInvalidRange
+	return
+}
+
+func parsePrefix(s string) (p netip.Prefix, err error) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, '/') >= 0 {
+		if p, err = netip.ParsePrefix(s); err == nil {
+			if p.Addr().Is4In6() {
+				p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+			}
+		}
+	} else {
+		var a netip.Addr
+		if a, err = parseAddr(s); err == nil {
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+	}
+	return
+}
+
+// parseLine parses one line of list in specified format and
+// inserts parsed range into trie. Returns false if line is
+// empty, commented or describes allowed (for DAT) range.
+func parseLine(t *prefixTrie, line, format string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' || strings.HasPrefix(line, "//") {
+		return false, nil
+	}
+	if format == FormatAuto {
+		// line is P2P if it ends with range, otherwise commas
+		// in description would be treated as DAT fields
+		if from, to, err := parseP2PRange(line); err == nil {
+			t.insertRange(from, to)
+			return true, nil
+		}
+		if strings.IndexByte(line, ',') >= 0 {
+			format = FormatDAT
+		} else {
+			format = FormatCIDR
+		}
+	}
+
+	switch format {
+	case FormatCIDR:
+		p, err := parsePrefix(line)
+		if err != nil {
+			return false, err
+		}
+		t.insert(p)
+	case FormatP2P:
+		from, to, err := parseP2PRange(line)
+		if err != nil {
+			return false, err
+		}
+		t.insertRange(from, to)
+	case FormatDAT:
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) > 1 {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return false, fmt.Errorf("invalid level: %w", err)
+			}
+			if level > datMaxBlockLevel {
+				return false, nil
+			}
+		}
+		from, to, err := parseRange(fields[0])
+		if err != nil {
+			return false, err
+		}
+		t.insertRange(from, to)
+	default:
+		return false, fmt.Errorf("unknown list format: %s", format)
+	}
+	return true, nil
+}
+
+// parseList reads list from reader and adds all ranges into trie.
+// Invalid lines are skipped and counted.
+func parseList(t *prefixTrie, r io.Reader, format string) (added, invalid int, err error) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var ok bool
+		if ok, err = parseLine(t, sc.Text(), format); err != nil {
+			invalid++
+		} else if ok {
+			added++
+		}
+	}
+	err = sc.Err()
+	return
+}
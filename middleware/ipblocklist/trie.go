@@ -0,0 +1,103 @@
+package ipblocklist
+
+import (
+	"net/netip"
+)
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+// prefixTrie is a binary (radix-2) trie of network prefixes.
+// IPv4 and IPv6 prefixes are held in separate roots, so IPv4 lookup
+// requires maximum 32 steps and IPv6 - 128.
+type prefixTrie struct {
+	v4, v6 trieNode
+}
+
+func bitAt(b []byte, i int) byte {
+	return (b[i>>3] >> (7 - uint(i&7))) & 1
+}
+
+func (t *prefixTrie) root(a netip.Addr) (n *trieNode, b []byte) {
+	if a.Is4() {
+		a4 := a.As4()
+		n, b = &t.v4, a4[:]
+	} else {
+		a16 := a.As16()
+		n, b = &t.v6, a16[:]
+	}
+	return
+}
+
+// insert adds prefix into trie. If a wider prefix
+// already exists, insertion is no-op, if narrower
+// prefixes exist, they are discarded.
+func (t *prefixTrie) insert(p netip.Prefix) {
+	p = p.Masked()
+	n, b := t.root(p.Addr())
+	for i := 0; i < p.Bits(); i++ {
+		if n.terminal {
+			return
+		}
+		bit := bitAt(b, i)
+		if n.children[bit] == nil {
+			n.children[bit] = new(trieNode)
+		}
+		n = n.children[bit]
+	}
+	n.terminal, n.children = true, [2]*trieNode{}
+}
+
+// contains checks if provided address belongs to any
+// of inserted prefixes
+func (t *prefixTrie) contains(a netip.Addr) bool {
+	if !a.IsValid() {
+		return false
+	}
+	a = a.Unmap()
+	n, b := t.root(a)
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			return true
+		}
+		if i >= a.BitLen() {
+			break
+		}
+		n = n.children[bitAt(b, i)]
+	}
+	return false
+}
+
+// lastAddr returns the last address in prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	a16, bits := p.Masked().Addr().As16(), p.Bits()
+	if p.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		a16[i>>3] |= 1 << (7 - uint(i&7))
+	}
+	a := netip.AddrFrom16(a16)
+	if p.Addr().Is4() {
+		a = a.Unmap()
+	}
+	return a
+}
+
+// insertRange splits range of addresses into minimal set of
+// prefixes and adds them into trie
+func (t *prefixTrie) insertRange(from, to netip.Addr) {
+	for from.IsValid() && from.Compare(to) <= 0 {
+		var p netip.Prefix
+		for bits := 0; bits <= from.BitLen(); bits++ {
+			p = netip.PrefixFrom(from, bits)
+			if p.Masked().Addr() == from && lastAddr(p).Compare(to) <= 0 {
+				break
+			}
+		}
+		t.insert(p)
+		from = lastAddr(p).Next()
+	}
+}
@@ -2,18 +2,18 @@
 // is missing a valid JSON Web Token.
 //
 // JWTs are validated against the standard claims in RFC7519 along with an
-// extra "infohash(es)" claim that verifies the client has access to the Swarm.
+// extra "infohash(es)" claim that verifies the client has access to the Swarm
+// and optional "permissions" claim that restricts request parameters.
 package jwt
 
 import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/MicahParks/jwkset"
-	"github.com/MicahParks/keyfunc/v3"
 	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/sot-tech/mochi/bittorrent"
@@ -40,7 +40,11 @@ var (
 	// ErrInvalidJWT is returned when a JWT fails to verify.
 	ErrInvalidJWT = bittorrent.ClientError("request not allowed by mochi: invalid jwt")
 
-	errJWKsNotSet = errors.New("required parameters not provided: Issuer/Audience/JWKSetURL")
+	// ErrForbiddenByClaims is returned when JWT is valid, but request
+	// does not satisfy token's permissions.
+	ErrForbiddenByClaims = bittorrent.ClientError("request not allowed by mochi: forbidden by jwt permissions")
+
+	errJWKsNotSet = errors.New("required parameters not provided: Issuer/Audience/JWKSetURL/JWKSetFile/HMACSecret/PublicKeys")
 
 	hmacAlgorithms = jwt.WithValidMethods([]string{
 		jwt.SigningMethodHS256.Alg(), jwt.SigningMethodHS384.Alg(), jwt.SigningMethodHS512.Alg(),
@@ -53,19 +57,30 @@ var (
 
 // Config represents all the values required by this middleware to fetch JWKs
 // and verify JWTs.
+//
+// At least one key source (JWKSetURL, JWKSetFile, HMACSecret or PublicKeys)
+// should be provided.
 type Config struct {
-	Header            string
-	Issuer            string
-	Audience          string
-	JWKSetURL         string        `cfg:"jwk_set_url"`
+	Header   string
+	Issuer   string
+	Audience string
+	// JWKSetURL is the URL of JWKS, periodically reloaded
+	JWKSetURL string `cfg:"jwk_set_url"`
+	// JWKSetFile is the path to local JWKS file, reloaded if changed
+	JWKSetFile string `cfg:"jwk_set_file"`
+	// JWKUpdateInterval is the interval of JWKSetURL reload and JWKSetFile checks
 	JWKUpdateInterval time.Duration `cfg:"jwk_set_update_interval"`
-	HandleAnnounce    bool          `cfg:"handle_announce"`
-	HandleScrape      bool          `cfg:"handle_scrape"`
+	// HMACSecret is the secret to verify HS256/384/512 signed tokens
+	HMACSecret string `cfg:"hmac_secret"`
+	// PublicKeys is the list of paths to PEM encoded RSA, ECDSA or Ed25519 public keys
+	PublicKeys     []string `cfg:"public_keys"`
+	HandleAnnounce bool     `cfg:"handle_announce"`
+	HandleScrape   bool     `cfg:"handle_scrape"`
 }
 
 type hook struct {
 	cfg    Config
-	jwks   keyfunc.Keyfunc
+	jwks   *keySet
 	parser *jwt.Parser
 }
 
@@ -76,7 +91,7 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (h middleware.Hook, err
 		return nil, fmt.Errorf("unable to deserialise configuration: %w", err)
 	}
 
-	if len(cfg.JWKSetURL) > 0 && len(cfg.Issuer) > 0 && len(cfg.Audience) > 0 {
+	if len(cfg.Issuer) > 0 && len(cfg.Audience) > 0 {
 		if len(cfg.Header) == 0 {
 			cfg.Header = authorizationHeader
 			logger.Warn().
@@ -86,19 +101,9 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (h middleware.Hook, err
 				Msg("falling back to default configuration")
 		}
 
-		var jwks keyfunc.Keyfunc
+		var jwks *keySet
 		if cfg.HandleAnnounce || cfg.HandleScrape {
-			var httpStorage jwkset.Storage
-			httpStorage, err = jwkset.NewStorageFromHTTP(cfg.JWKSetURL, jwkset.HTTPClientStorageOptions{
-				NoErrorReturnFirstHTTPReq: true,
-				RefreshErrorHandler: func(_ context.Context, err error) {
-					logger.Error().Err(err).Msg("error occurred while updating JWKs")
-				},
-				RefreshInterval: cfg.JWKUpdateInterval,
-			})
-			if err == nil {
-				jwks, err = keyfunc.New(keyfunc.Options{Storage: httpStorage})
-			}
+			jwks, err = newKeySet(cfg)
 		} else {
 			logger.Warn().Msg("both announce and scrape handle disabled")
 		}
@@ -116,9 +121,50 @@ func build(config conf.MapConfig, _ storage.PeerStorage) (h middleware.Hook, err
 	return
 }
 
+// Permissions is the optional claim, which restricts
+// request parameters allowed for token holder
+type Permissions struct {
+	// Events is the list of allowed announce events (started, stopped...),
+	// if empty, all events are allowed
+	Events []string `json:"events,omitempty"`
+	// Scrape allows or denies scrape requests, if not set, scrape is allowed
+	Scrape *bool `json:"scrape,omitempty"`
+	// MaxNumWant caps number of peers requested in announce
+	MaxNumWant *uint32 `json:"max_numwant,omitempty"`
+	// PeerIDPrefix binds token to peer ID with specified (raw) prefix
+	PeerIDPrefix string `json:"peer_id_prefix,omitempty"`
+}
+
+// checkAnnounce checks if announce is allowed by permissions
+// and caps bittorrent.AnnounceRequest NumWant.
+func (p *Permissions) checkAnnounce(req *bittorrent.AnnounceRequest) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.Events) > 0 && !slices.ContainsFunc(p.Events, func(e string) bool {
+		evt, err := bittorrent.NewEvent(e)
+		return err == nil && evt == req.Event
+	}) {
+		return false
+	}
+	if len(p.PeerIDPrefix) > 0 && !strings.HasPrefix(req.ID.RawString(), p.PeerIDPrefix) {
+		return false
+	}
+	if p.MaxNumWant != nil && req.NumWant > *p.MaxNumWant {
+		req.NumWant = *p.MaxNumWant
+	}
+	return true
+}
+
+// checkScrape checks if scrape is allowed by permissions
+func (p *Permissions) checkScrape() bool {
+	return p == nil || p.Scrape == nil || *p.Scrape
+}
+
 type announceClaims struct {
 	jwt.RegisteredClaims
-	InfoHash string `json:"infohash,omitempty"`
+	InfoHash    string       `json:"infohash,omitempty"`
+	Permissions *Permissions `json:"permissions,omitempty"`
 }
 
 func (h *hook) HandleAnnounce(
@@ -150,6 +196,12 @@ func (h *hook) HandleAnnounce(
 					Msg("unequal 'infohash' claim when validating JWT")
 				err = ErrInvalidJWT
 			}
+			if err == nil && !claims.Permissions.checkAnnounce(req) {
+				logger.Info().
+					Object("request", req).
+					Msg("announce forbidden by 'permissions' claim")
+				err = ErrForbiddenByClaims
+			}
 		} else {
 			logger.Info().
 				Err(jwtErr).
@@ -164,7 +216,8 @@ func (h *hook) HandleAnnounce(
 
 type scrapeClaims struct {
 	jwt.RegisteredClaims
-	InfoHashes []string `json:"infohashes,omitempty"`
+	InfoHashes  []string     `json:"infohashes,omitempty"`
+	Permissions *Permissions `json:"permissions,omitempty"`
 }
 
 func (h *hook) HandleScrape(
@@ -180,7 +233,18 @@ func (h *hook) HandleScrape(
 		err = ErrMissingJWT
 	} else {
 		claims := new(scrapeClaims)
-		if _, jwtErr := h.parser.ParseWithClaims(jwtParam, claims, h.jwks.KeyfuncCtx(ctx)); jwtErr == nil {
+		if _, jwtErr := h.parser.ParseWithClaims(jwtParam, claims, h.jwks.KeyfuncCtx(ctx)); jwtErr != nil {
+			logger.Info().
+				Err(jwtErr).
+				Array("addresses", &req.RequestAddresses).
+				Msg("JWT validation failed")
+			err = ErrInvalidJWT
+		} else if !claims.Permissions.checkScrape() {
+			logger.Info().
+				Array("addresses", &req.RequestAddresses).
+				Msg("scrape forbidden by 'permissions' claim")
+			err = ErrForbiddenByClaims
+		} else {
 			var claimIHs bittorrent.InfoHashes
 			for _, s := range claims.InfoHashes {
 				if providedIh, err := bittorrent.NewInfoHashString(s); err == nil {
@@ -216,12 +280,6 @@ func (h *hook) HandleScrape(
 					Msg("unequal 'infohashes' claim when validating JWT")
 				err = ErrInvalidJWT
 			}
-		} else {
-			logger.Info().
-				Err(jwtErr).
-				Array("addresses", &req.RequestAddresses).
-				Msg("JWT validation failed")
-			err = ErrInvalidJWT
 		}
 	}
 
@@ -239,3 +297,11 @@ func (h *hook) getJWTString(params bittorrent.Params) (jwt string) {
 	}
 	return
 }
+
+// Close stops JWKs reloading
+func (h *hook) Close() (err error) {
+	if h.jwks != nil {
+		err = h.jwks.Close()
+	}
+	return
+}
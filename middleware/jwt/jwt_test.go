@@ -5,11 +5,15 @@ import (
 	"crypto/ecdsa"
 	cr "crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -233,3 +237,137 @@ func TestHook_HandleScrapeValid(t *testing.T) {
 	}, nil)
 	require.Nil(t, err)
 }
+
+func newRegisteredClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Issuer:    "CN=test",
+		Subject:   "CN=test",
+		Audience:  []string{"test"},
+		ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(time.Hour)},
+		NotBefore: &jwt.NumericDate{Time: time.Now().Add(-time.Hour)},
+		// nolint:gosec
+		ID: strconv.FormatInt(rand.Int63(), 16),
+	}
+}
+
+func TestHook_LocalKeys(t *testing.T) {
+	dir := t.TempDir()
+	pubBytes, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	require.Nil(t, err)
+	pubPath := filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0o600))
+	jwksPath := filepath.Join(dir, "jwks.json")
+	jwksBytes, err := json.Marshal(jwksData)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(jwksPath, jwksBytes, 0o600))
+
+	ecToken := jwt.NewWithClaims(jwt.SigningMethodES256, announceClaims{
+		RegisteredClaims: newRegisteredClaims(),
+		InfoHash:         infoHash.String(),
+	})
+	ecString, err := ecToken.SignedString(privKey)
+	require.Nil(t, err)
+	ecToken.Header["kid"] = jwksData.Keys[0].KeyID
+	ecKIDString, err := ecToken.SignedString(privKey)
+	require.Nil(t, err)
+	hmacString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, announceClaims{
+		RegisteredClaims: newRegisteredClaims(),
+		InfoHash:         infoHash.String(),
+	}).SignedString([]byte("secret"))
+	require.Nil(t, err)
+
+	cases := []struct {
+		name  string
+		cfg   conf.MapConfig
+		token string
+		valid bool
+	}{
+		{"hmac", conf.MapConfig{"hmac_secret": "secret"}, hmacString, true},
+		{"hmac-invalid-secret", conf.MapConfig{"hmac_secret": "another"}, hmacString, false},
+		{"hmac-with-pem", conf.MapConfig{"public_keys": []string{pubPath}}, hmacString, false},
+		{"pem", conf.MapConfig{"public_keys": []string{pubPath}}, ecString, true},
+		{"pem-with-hmac", conf.MapConfig{"hmac_secret": "secret"}, ecString, false},
+		{"pem-and-hmac", conf.MapConfig{"hmac_secret": "secret", "public_keys": []string{pubPath}}, ecString, true},
+		{"jwks-file", conf.MapConfig{"jwk_set_file": jwksPath}, ecKIDString, true},
+		{"jwks-file-no-kid", conf.MapConfig{"jwk_set_file": jwksPath}, ecString, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.cfg["handle_announce"] = true
+			c.cfg["issuer"] = "CN=test"
+			c.cfg["audience"] = "test"
+			h, err := build(c.cfg, nil)
+			require.Nil(t, err)
+			defer h.(*hook).Close()
+			_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{
+				InfoHash: infoHash,
+				Params:   params{authorizationHeader: c.token},
+			}, nil)
+			if c.valid {
+				require.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestHook_Permissions(t *testing.T) {
+	var numWant uint32 = 10
+	noScrape := false
+	perms := &Permissions{
+		Events:       []string{bittorrent.StartedStr, bittorrent.StoppedStr},
+		Scrape:       &noScrape,
+		MaxNumWant:   &numWant,
+		PeerIDPrefix: "-TR",
+	}
+	announceToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, announceClaims{
+		RegisteredClaims: newRegisteredClaims(),
+		InfoHash:         infoHash.String(),
+		Permissions:      perms,
+	}).SignedString([]byte("secret"))
+	require.Nil(t, err)
+	scrapeToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, scrapeClaims{
+		RegisteredClaims: newRegisteredClaims(),
+		InfoHashes:       []string{infoHash.String()},
+		Permissions:      perms,
+	}).SignedString([]byte("secret"))
+	require.Nil(t, err)
+
+	h, err := build(conf.MapConfig{
+		"handle_announce": true,
+		"handle_scrape":   true,
+		"issuer":          "CN=test",
+		"audience":        "test",
+		"hmac_secret":     "secret",
+	}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	newReq := func(evt bittorrent.Event, pid string) *bittorrent.AnnounceRequest {
+		return &bittorrent.AnnounceRequest{
+			Event:       evt,
+			InfoHash:    infoHash,
+			NumWant:     50,
+			RequestPeer: bittorrent.RequestPeer{ID: bittorrent.PeerID([]byte(pid))},
+			Params:      params{authorizationHeader: announceToken},
+		}
+	}
+
+	req := newReq(bittorrent.Started, "-TR3000-012345678901")
+	_, err = h.HandleAnnounce(context.Background(), req, nil)
+	require.Nil(t, err)
+	require.Equal(t, numWant, req.NumWant)
+
+	_, err = h.HandleAnnounce(context.Background(), newReq(bittorrent.Completed, "-TR3000-012345678901"), nil)
+	require.Equal(t, ErrForbiddenByClaims, err)
+
+	_, err = h.HandleAnnounce(context.Background(), newReq(bittorrent.Started, "-qB4650-012345678901"), nil)
+	require.Equal(t, ErrForbiddenByClaims, err)
+
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{
+		InfoHashes: bittorrent.InfoHashes{infoHash},
+		Params:     params{authorizationHeader: scrapeToken},
+	}, nil)
+	require.Equal(t, ErrForbiddenByClaims, err)
+}
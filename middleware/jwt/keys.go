@@ -0,0 +1,165 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const defaultJWKFileUpdateInterval = time.Minute
+
+// keySet combines remote (JWKS URL), local (JWKS file)
+// and static (HMAC secret, PEM public keys) key sources.
+// Key sets with key IDs (JWKS) are checked first, if token
+// does not contain known key ID, static keys are used.
+type keySet struct {
+	remote keyfunc.Keyfunc
+	file   atomic.Pointer[keyfunc.Keyfunc]
+	static []jwt.VerificationKey
+	closed chan any
+}
+
+func newKeySet(cfg Config) (ks *keySet, err error) {
+	ks = &keySet{closed: make(chan any)}
+	if len(cfg.JWKSetURL) > 0 {
+		var httpStorage jwkset.Storage
+		httpStorage, err = jwkset.NewStorageFromHTTP(cfg.JWKSetURL, jwkset.HTTPClientStorageOptions{
+			NoErrorReturnFirstHTTPReq: true,
+			RefreshErrorHandler: func(_ context.Context, err error) {
+				logger.Error().Err(err).Msg("error occurred while updating JWKs")
+			},
+			RefreshInterval: cfg.JWKUpdateInterval,
+		})
+		if err == nil {
+			ks.remote, err = keyfunc.New(keyfunc.Options{Storage: httpStorage})
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if len(cfg.HMACSecret) > 0 {
+		ks.static = append(ks.static, []byte(cfg.HMACSecret))
+	}
+
+	for _, p := range cfg.PublicKeys {
+		var k jwt.VerificationKey
+		if k, err = loadPublicKey(p); err != nil {
+			return
+		}
+		ks.static = append(ks.static, k)
+	}
+
+	if len(cfg.JWKSetFile) > 0 {
+		var mt time.Time
+		if mt, err = ks.loadFile(cfg.JWKSetFile); err != nil {
+			return
+		}
+		interval := cfg.JWKUpdateInterval
+		if interval <= 0 {
+			interval = defaultJWKFileUpdateInterval
+		}
+		go ks.watchFile(cfg.JWKSetFile, mt, interval)
+	}
+
+	if ks.remote == nil && ks.file.Load() == nil && len(ks.static) == 0 {
+		err = errJWKsNotSet
+	}
+	return
+}
+
+// loadPublicKey reads PEM encoded RSA, ECDSA or Ed25519 public key from file
+func loadPublicKey(path string) (k jwt.VerificationKey, err error) {
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+	if k, err = jwt.ParseRSAPublicKeyFromPEM(b); err == nil {
+		return
+	}
+	if k, err = jwt.ParseECPublicKeyFromPEM(b); err == nil {
+		return
+	}
+	if k, err = jwt.ParseEdPublicKeyFromPEM(b); err != nil {
+		err = fmt.Errorf("unable to parse public key %s: %w", path, err)
+	}
+	return
+}
+
+func (ks *keySet) loadFile(path string) (mt time.Time, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(path); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+	var kf keyfunc.Keyfunc
+	if kf, err = keyfunc.NewJWKSetJSON(b); err != nil {
+		return
+	}
+	ks.file.Store(&kf)
+	return fi.ModTime(), nil
+}
+
+func (ks *keySet) watchFile(path string, mt time.Time, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ks.closed:
+			return
+		case <-t.C:
+			if fi, err := os.Stat(path); err != nil {
+				logger.Warn().Err(err).Str("file", path).Msg("unable to check JWKs file")
+			} else if !fi.ModTime().Equal(mt) {
+				if mt, err = ks.loadFile(path); err == nil {
+					logger.Info().Str("file", path).Msg("JWKs reloaded")
+				} else {
+					logger.Error().Err(err).Str("file", path).Msg("error occurred while updating JWKs")
+				}
+			}
+		}
+	}
+}
+
+// KeyfuncCtx returns jwt.Keyfunc which selects key for token verification
+func (ks *keySet) KeyfuncCtx(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (k any, err error) {
+		if _, hasKID := token.Header[jwkset.HeaderKID]; hasKID {
+			if ks.remote != nil {
+				if k, err = ks.remote.KeyfuncCtx(ctx)(token); err == nil {
+					return
+				}
+			}
+			if kf := ks.file.Load(); kf != nil {
+				if k, err = (*kf).KeyfuncCtx(ctx)(token); err == nil {
+					return
+				}
+			}
+		}
+		if len(ks.static) > 0 {
+			return jwt.VerificationKeySet{Keys: ks.static}, nil
+		}
+		if err == nil {
+			err = errors.New("no key to verify token")
+		}
+		return
+	}
+}
+
+// Close stops watching of JWKs file
+func (ks *keySet) Close() error {
+	if ks.closed != nil {
+		close(ks.closed)
+	}
+	return nil
+}
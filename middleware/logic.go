@@ -2,9 +2,14 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
 	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -14,29 +19,134 @@ import (
 type Logic struct {
 	announceInterval    time.Duration
 	minAnnounceInterval time.Duration
-	preHooks            []Hook
-	postHooks           []Hook
-	pingers             []Pinger
+	store               storage.PeerStorage
+	// hooksStore is the store without response cache,
+	// used to create hooks in Derive
+	hooksStore storage.PeerStorage
+	peerFilter PeerFilterConfig
+	// userPreHooks and userPostHooks are hooks provided to NewLogic
+	// without internal ones, used to derive new Logic
+	userPreHooks  []Hook
+	userPostHooks []Hook
+	preHooks      []Hook
+	postHooks     []Hook
+	pingers       []Pinger
+	// closers are hooks created by Derive, which should be closed with Logic
+	closers []io.Closer
 }
 
 // NewLogic creates a new instance of a Logic that executes the provided
-// middleware hooks.
-func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, preHooks, postHooks []Hook) *Logic {
+// middleware hooks and filters peers in announce responses with peerFilter.
+func NewLogic(annInterval, minAnnInterval time.Duration, peerStore storage.PeerStorage, peerFilter PeerFilterConfig, preHooks, postHooks []Hook) *Logic {
 	l := &Logic{
 		announceInterval:    annInterval,
 		minAnnounceInterval: minAnnInterval,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
+		store:               peerStore,
+		hooksStore:          peerStore,
+		peerFilter:          peerFilter,
+		userPreHooks:        slices.Clone(preHooks),
+		userPostHooks:       slices.Clone(postHooks),
+		preHooks:            append(slices.Clone(preHooks), &responseHook{store: peerStore, filter: peerFilter}),
+		postHooks:           append(slices.Clone(postHooks), &swarmInteractionHook{store: peerStore}),
 		pingers:             make([]Pinger, 0, 1),
 	}
+	if cs, isOk := peerStore.(*cachedStorage); isOk {
+		l.hooksStore = cs.PeerStorage
+	}
 	for _, h := range l.preHooks {
 		if ph, isOk := h.(Pinger); isOk {
 			l.pingers = append(l.pingers, ph)
 		}
 	}
+	for _, h := range preHooks {
+		var mh responseModifierHook
+		mh.announce, _ = h.(ResponseModifier)
+		mh.scrape, _ = h.(ScrapeResponseModifier)
+		if mh.announce != nil || mh.scrape != nil {
+			l.preHooks = append(l.preHooks, mh)
+		}
+	}
 	return l
 }
 
+// ChainConfig is the configuration of middleware chain, which overrides
+// global hooks and announce intervals for specific frontend or route.
+type ChainConfig struct {
+	// AnnounceInterval overrides parent announce interval if set
+	AnnounceInterval time.Duration `cfg:"announce_interval"`
+	// MinAnnounceInterval overrides parent minimal announce interval if set
+	MinAnnounceInterval time.Duration `cfg:"min_announce_interval"`
+	// PreHooks executed after parent pre hooks
+	PreHooks []conf.NamedMapConfig `cfg:"prehooks"`
+	// PostHooks executed after parent post hooks
+	PostHooks []conf.NamedMapConfig `cfg:"posthooks"`
+	// SkipParentHooks disables execution of parent hooks,
+	// only PreHooks and PostHooks are executed
+	SkipParentHooks bool `cfg:"skip_parent_hooks"`
+}
+
+// IsEmpty returns true if configuration does not override anything
+func (c ChainConfig) IsEmpty() bool {
+	return c.AnnounceInterval <= 0 && c.MinAnnounceInterval <= 0 &&
+		len(c.PreHooks) == 0 && len(c.PostHooks) == 0 && !c.SkipParentHooks
+}
+
+// Derive creates new Logic, which uses the same storage as l,
+// but executes additional hooks and uses announce intervals
+// provided in configuration. If configuration is empty, l is returned.
+//
+// Hooks created by Derive are closed by Logic.Close.
+func (l *Logic) Derive(cfg ChainConfig) (*Logic, error) {
+	if cfg.IsEmpty() {
+		return l, nil
+	}
+	preHooks, err := NewHooks(cfg.PreHooks, l.hooksStore)
+	var closers []io.Closer
+	appendClosers := func(hooks []Hook) {
+		for _, h := range hooks {
+			if c, isOk := h.(io.Closer); isOk {
+				closers = append(closers, c)
+			}
+		}
+	}
+	appendClosers(preHooks)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to configure pre-hooks: %w", err), closeAll(closers))
+	}
+	postHooks, err := NewHooks(cfg.PostHooks, l.hooksStore)
+	appendClosers(postHooks)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to configure post-hooks: %w", err), closeAll(closers))
+	}
+	if !cfg.SkipParentHooks {
+		preHooks = append(slices.Clone(l.userPreHooks), preHooks...)
+		postHooks = append(slices.Clone(l.userPostHooks), postHooks...)
+	}
+	annInterval, minAnnInterval := l.announceInterval, l.minAnnounceInterval
+	if cfg.AnnounceInterval > 0 {
+		annInterval = cfg.AnnounceInterval
+	}
+	if cfg.MinAnnounceInterval > 0 {
+		minAnnInterval = cfg.MinAnnounceInterval
+	}
+	d := NewLogic(annInterval, minAnnInterval, l.store, l.peerFilter, preHooks, postHooks)
+	d.closers = closers
+	return d, nil
+}
+
+func closeAll(closers []io.Closer) (err error) {
+	for _, c := range closers {
+		err = errors.Join(err, c.Close())
+	}
+	return
+}
+
+// Close closes hooks created by Derive.
+// Hooks provided to NewLogic should be closed by caller.
+func (l *Logic) Close() error {
+	return closeAll(l.closers)
+}
+
 // HandleAnnounce generates a response for an Announce.
 //
 // Returns the updated context, the generated AnnounceResponse and no error
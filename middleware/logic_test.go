@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
 )
 
 func init() {
@@ -89,3 +93,90 @@ func BenchmarkHookOverhead(b *testing.B) {
 		})
 	}
 }
+
+var errChainDenied = bittorrent.ClientError("denied by chain")
+
+// denyHook is a Hook which denies all requests and counts Close calls
+type denyHook struct {
+	closed int
+}
+
+func (h *denyHook) HandleAnnounce(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, errChainDenied
+}
+
+func (h *denyHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, errChainDenied
+}
+
+func (h *denyHook) Close() error {
+	h.closed++
+	return nil
+}
+
+func TestLogicDerive(t *testing.T) {
+	var created []*denyHook
+	RegisterBuilder("test deny", func(conf.MapConfig, storage.PeerStorage) (Hook, error) {
+		h := new(denyHook)
+		created = append(created, h)
+		return h, nil
+	})
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+	parent := NewLogic(time.Minute, 30*time.Second, ps, PeerFilterConfig{}, []Hook{&nopHook{}}, nil)
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHash("01234567890123456789"),
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID([]byte("-TR3000-012345678901")),
+			RequestAddresses: []bittorrent.RequestAddress{{Addr: netip.MustParseAddr("1.2.3.4")}},
+		},
+	}
+
+	d, err := parent.Derive(ChainConfig{})
+	require.Nil(t, err)
+	require.Same(t, parent, d)
+
+	d, err = parent.Derive(ChainConfig{AnnounceInterval: time.Hour})
+	require.Nil(t, err)
+	_, resp, err := d.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 30*time.Second, resp.MinInterval)
+	require.Len(t, d.preHooks, len(parent.preHooks))
+
+	d, err = parent.Derive(ChainConfig{
+		PreHooks:        []conf.NamedMapConfig{{Name: "test deny", Config: conf.MapConfig{}}},
+		SkipParentHooks: true,
+	})
+	require.Nil(t, err)
+	require.Len(t, d.userPreHooks, 1)
+	_, _, err = d.HandleAnnounce(context.Background(), req)
+	require.ErrorIs(t, err, errChainDenied)
+	_, _, err = parent.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+
+	require.Nil(t, d.Close())
+	require.Nil(t, parent.Close())
+	require.Len(t, created, 1)
+	require.Equal(t, 1, created[0].closed)
+}
+
+func TestLogicDeriveUncachedStorage(t *testing.T) {
+	var hookStorage storage.PeerStorage
+	RegisterBuilder("test storage", func(_ conf.MapConfig, st storage.PeerStorage) (Hook, error) {
+		hookStorage = st
+		return &nopHook{}, nil
+	})
+	ps, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer ps.Close()
+	parent := NewLogic(time.Minute, 30*time.Second, NewResponseCache(ResponseCacheConfig{TTL: time.Second}, ps),
+		PeerFilterConfig{}, nil, nil)
+	d, err := parent.Derive(ChainConfig{
+		PreHooks: []conf.NamedMapConfig{{Name: "test storage", Config: conf.MapConfig{}}},
+	})
+	require.Nil(t, err)
+	defer d.Close()
+	require.Same(t, ps, hookStorage)
+}
@@ -44,6 +44,10 @@ func RegisterBuilder(name string, b Builder) {
 }
 
 // NewHooks is a utility function for initializing Hooks in bulk.
+//
+// If hook configuration contains `dry_run: true` (see DryRunKey),
+// hook is executed in dry-run mode: its decisions are logged and counted,
+// but errors are not returned and request/response are not modified.
 func NewHooks(configs []conf.NamedMapConfig, storage storage.PeerStorage) (hooks []Hook, err error) {
 	buildersMU.RLock()
 	defer buildersMU.RUnlock()
@@ -54,12 +58,23 @@ func NewHooks(configs []conf.NamedMapConfig, storage storage.PeerStorage) (hooks
 			err = fmt.Errorf("hook with name '%s' does not exists", c.Name)
 			break
 		}
+		// dry-run configuration is read before hook is built,
+		// so invalid configuration does not leave hook unclosed
+		var drc dryRunConfig
+		if c.Config != nil {
+			if err = c.Config.Unmarshal(&drc); err != nil {
+				break
+			}
+		}
 		var h Hook
 		if h, err = newHook(c.Config, storage); err != nil {
 			break
 		}
+		if drc.DryRun {
+			h = newDryRunHook(c.Name, h)
+		}
 		hooks = append(hooks, h)
-		logger.Info().Str("name", c.Name).Msg("hook started")
+		logger.Info().Str("name", c.Name).Bool("dryRun", drc.DryRun).Msg("hook started")
 	}
 
 	return
@@ -0,0 +1,502 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// valueType is the static type of expression
+type valueType int
+
+const (
+	typeBool valueType = iota
+	typeNumber
+	typeString
+	typeList
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeBool:
+		return "bool"
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	default:
+		return "list"
+	}
+}
+
+// expr is the compiled expression. Only one of functions,
+// corresponding to typ, is set.
+type expr struct {
+	typ  valueType
+	b    func(*env) bool
+	n    func(*env) float64
+	s    func(*env) string
+	l    func(*env) []string
+	lit  bool   // expression is string literal
+	litS string // value of string literal
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of expression")
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(src string) (tokens []token, err error) {
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, src[i:j], i})
+			i = j
+		case unicode.IsDigit(c):
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokNumber, src[i:j], i})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			for ; j < len(src) && rune(src[j]) != c; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			var s string
+			if c == '"' {
+				if s, err = strconv.Unquote(src[i : j+1]); err != nil {
+					return nil, fmt.Errorf("invalid string at %d: %w", i, err)
+				}
+			} else {
+				s = strings.ReplaceAll(src[i+1:j], `\'`, `'`)
+			}
+			tokens = append(tokens, token{tokString, s, i})
+			i = j + 1
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if len(op) == 0 {
+				return nil, fmt.Errorf("unexpected character '%c' at %d", c, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, token{tokEOF, "", len(src)})
+	return
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// compile parses and type-checks boolean expression
+func compile(src string) (*expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected '%s' at %d", t.text, t.pos)
+	}
+	if e.typ != typeBool {
+		return nil, fmt.Errorf("expression must be bool, got %s", e.typ)
+	}
+	return e, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == op
+}
+
+func (p *parser) expectOp(op string) error {
+	if t := p.next(); t.kind != tokOp || t.text != op {
+		if t.kind == tokEOF {
+			return errUnexpectedEnd
+		}
+		return fmt.Errorf("expected '%s' at %d, got '%s'", op, t.pos, t.text)
+	}
+	return nil
+}
+
+func expectType(e *expr, t valueType, what string) error {
+	if e.typ != t {
+		return fmt.Errorf("%s must be %s, got %s", what, t, e.typ)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (*expr, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var r *expr
+		if r, err = p.parseAnd(); err == nil {
+			if err = errors.Join(expectType(l, typeBool, "'||' operand"), expectType(r, typeBool, "'||' operand")); err == nil {
+				lf, rf := l.b, r.b
+				l = &expr{typ: typeBool, b: func(e *env) bool { return lf(e) || rf(e) }}
+			}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseAnd() (*expr, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var r *expr
+		if r, err = p.parseUnary(); err == nil {
+			if err = errors.Join(expectType(l, typeBool, "'&&' operand"), expectType(r, typeBool, "'&&' operand")); err == nil {
+				lf, rf := l.b, r.b
+				l = &expr{typ: typeBool, b: func(e *env) bool { return lf(e) && rf(e) }}
+			}
+		}
+	}
+	return l, err
+}
+
+func (p *parser) parseUnary() (*expr, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if err = expectType(x, typeBool, "'!' operand"); err != nil {
+			return nil, err
+		}
+		f := x.b
+		return &expr{typ: typeBool, b: func(e *env) bool { return !f(e) }}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (*expr, error) {
+	l, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	var op string
+	switch {
+	case t.kind == tokOp && slices.Contains([]string{"==", "!=", "<", "<=", ">", ">="}, t.text):
+		op = t.text
+	case t.kind == tokIdent && (t.text == "in" || t.text == "matches"):
+		op = t.text
+	default:
+		return l, nil
+	}
+	p.next()
+	r, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	return compare(op, l, r)
+}
+
+func compare(op string, l, r *expr) (*expr, error) {
+	switch op {
+	case "in":
+		if err := expectType(r, typeList, "right operand of 'in'"); err != nil {
+			return nil, err
+		}
+		rf := r.l
+		switch l.typ {
+		case typeString:
+			lf := l.s
+			return &expr{typ: typeBool, b: func(e *env) bool { return slices.Contains(rf(e), lf(e)) }}, nil
+		case typeList:
+			lf := l.l
+			return &expr{typ: typeBool, b: func(e *env) bool {
+				rl := rf(e)
+				return slices.ContainsFunc(lf(e), func(s string) bool { return slices.Contains(rl, s) })
+			}}, nil
+		default:
+			return nil, fmt.Errorf("left operand of 'in' must be string or list, got %s", l.typ)
+		}
+	case "matches":
+		if err := expectType(l, typeString, "left operand of 'matches'"); err != nil {
+			return nil, err
+		}
+		if !r.lit {
+			return nil, errors.New("right operand of 'matches' must be string literal")
+		}
+		re, err := regexp.Compile(r.litS)
+		if err != nil {
+			return nil, err
+		}
+		lf := l.s
+		return &expr{typ: typeBool, b: func(e *env) bool { return re.MatchString(lf(e)) }}, nil
+	}
+	if l.typ != r.typ {
+		return nil, fmt.Errorf("operands of '%s' must have the same type, got %s and %s", op, l.typ, r.typ)
+	}
+	switch l.typ {
+	case typeNumber:
+		lf, rf := l.n, r.n
+		var cmp func(a, b float64) bool
+		switch op {
+		case "==":
+			cmp = func(a, b float64) bool { return a == b }
+		case "!=":
+			cmp = func(a, b float64) bool { return a != b }
+		case "<":
+			cmp = func(a, b float64) bool { return a < b }
+		case "<=":
+			cmp = func(a, b float64) bool { return a <= b }
+		case ">":
+			cmp = func(a, b float64) bool { return a > b }
+		default:
+			cmp = func(a, b float64) bool { return a >= b }
+		}
+		return &expr{typ: typeBool, b: func(e *env) bool { return cmp(lf(e), rf(e)) }}, nil
+	case typeString:
+		lf, rf := l.s, r.s
+		var cmp func(a, b string) bool
+		switch op {
+		case "==":
+			cmp = func(a, b string) bool { return a == b }
+		case "!=":
+			cmp = func(a, b string) bool { return a != b }
+		case "<":
+			cmp = func(a, b string) bool { return a < b }
+		case "<=":
+			cmp = func(a, b string) bool { return a <= b }
+		case ">":
+			cmp = func(a, b string) bool { return a > b }
+		default:
+			cmp = func(a, b string) bool { return a >= b }
+		}
+		return &expr{typ: typeBool, b: func(e *env) bool { return cmp(lf(e), rf(e)) }}, nil
+	case typeBool:
+		lf, rf := l.b, r.b
+		switch op {
+		case "==":
+			return &expr{typ: typeBool, b: func(e *env) bool { return lf(e) == rf(e) }}, nil
+		case "!=":
+			return &expr{typ: typeBool, b: func(e *env) bool { return lf(e) != rf(e) }}, nil
+		}
+	}
+	return nil, fmt.Errorf("operator '%s' is not applicable to %s", op, l.typ)
+}
+
+func (p *parser) parsePrimary() (*expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokEOF:
+		return nil, errUnexpectedEnd
+	case tokNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at %d: %w", t.pos, err)
+		}
+		return &expr{typ: typeNumber, n: func(*env) float64 { return v }}, nil
+	case tokString:
+		v := t.text
+		return &expr{typ: typeString, s: func(*env) string { return v }, lit: true, litS: v}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			e, err := p.parseOr()
+			if err == nil {
+				err = p.expectOp(")")
+			}
+			return e, err
+		case "[":
+			return p.parseList()
+		}
+		return nil, fmt.Errorf("unexpected '%s' at %d", t.text, t.pos)
+	}
+	switch t.text {
+	case "true", "false":
+		v := t.text == "true"
+		return &expr{typ: typeBool, b: func(*env) bool { return v }}, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		var args []*expr
+		for !p.isOp(")") {
+			if len(args) > 0 {
+				if err := p.expectOp(","); err != nil {
+					return nil, err
+				}
+			}
+			a, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+		}
+		p.next()
+		return compileFunc(t.text, args)
+	}
+	if f, exists := fields[t.text]; exists {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unknown identifier '%s' at %d", t.text, t.pos)
+}
+
+// parseList parses list of string literals, opening bracket is already consumed
+func (p *parser) parseList() (*expr, error) {
+	var items []string
+	for !p.isOp("]") {
+		if len(items) > 0 {
+			if err := p.expectOp(","); err != nil {
+				return nil, err
+			}
+		}
+		t := p.next()
+		switch t.kind {
+		case tokString, tokNumber:
+			items = append(items, t.text)
+		case tokEOF:
+			return nil, errUnexpectedEnd
+		default:
+			return nil, fmt.Errorf("list may contain only literals, got '%s' at %d", t.text, t.pos)
+		}
+	}
+	p.next()
+	return &expr{typ: typeList, l: func(*env) []string { return items }}, nil
+}
+
+func checkArgs(name string, args []*expr, types ...valueType) error {
+	if len(args) != len(types) {
+		return fmt.Errorf("function %s expects %d arguments, got %d", name, len(types), len(args))
+	}
+	for i, t := range types {
+		if err := expectType(args[i], t, fmt.Sprintf("argument %d of %s", i+1, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringPredicate(name string, args []*expr, fn func(s, sub string) bool) (*expr, error) {
+	if err := checkArgs(name, args, typeString, typeString); err != nil {
+		return nil, err
+	}
+	a, b := args[0].s, args[1].s
+	return &expr{typ: typeBool, b: func(e *env) bool { return fn(a(e), b(e)) }}, nil
+}
+
+func compileFunc(name string, args []*expr) (*expr, error) {
+	switch name {
+	case "has_prefix":
+		return stringPredicate(name, args, strings.HasPrefix)
+	case "has_suffix":
+		return stringPredicate(name, args, strings.HasSuffix)
+	case "contains":
+		return stringPredicate(name, args, strings.Contains)
+	case "lower":
+		if err := checkArgs(name, args, typeString); err != nil {
+			return nil, err
+		}
+		a := args[0].s
+		return &expr{typ: typeString, s: func(e *env) string { return strings.ToLower(a(e)) }}, nil
+	case "len":
+		if len(args) == 1 {
+			switch a := args[0]; a.typ {
+			case typeString:
+				return &expr{typ: typeNumber, n: func(e *env) float64 { return float64(len(a.s(e))) }}, nil
+			case typeList:
+				return &expr{typ: typeNumber, n: func(e *env) float64 { return float64(len(a.l(e))) }}, nil
+			}
+		}
+		return nil, errors.New("function len expects one string or list argument")
+	case "route", "param":
+		if len(args) != 1 || !args[0].lit {
+			return nil, fmt.Errorf("function %s expects one string literal argument", name)
+		}
+		key := args[0].litS
+		if name == "route" {
+			return &expr{typ: typeString, s: func(e *env) string { return e.routeParam(key) }}, nil
+		}
+		return &expr{typ: typeString, s: func(e *env) string { return e.queryParam(key) }}, nil
+	case "cidr":
+		if len(args) < 2 || (args[0].typ != typeString && args[0].typ != typeList) {
+			return nil, errors.New("function cidr expects string or list argument and at least one network")
+		}
+		prefixes := make([]netip.Prefix, 0, len(args)-1)
+		for _, a := range args[1:] {
+			if !a.lit {
+				return nil, errors.New("networks of function cidr must be string literals")
+			}
+			pr, err := netip.ParsePrefix(a.litS)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, pr.Masked())
+		}
+		inNet := func(s string) bool {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return false
+			}
+			addr = addr.Unmap()
+			return slices.ContainsFunc(prefixes, func(pr netip.Prefix) bool { return pr.Contains(addr) })
+		}
+		if a := args[0]; a.typ == typeString {
+			return &expr{typ: typeBool, b: func(e *env) bool { return inNet(a.s(e)) }}, nil
+		}
+		a := args[0].l
+		return &expr{typ: typeBool, b: func(e *env) bool { return slices.ContainsFunc(a(e), inNet) }}, nil
+	}
+	return nil, fmt.Errorf("unknown function '%s'", name)
+}
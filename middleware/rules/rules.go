@@ -0,0 +1,405 @@
+// Package rules implements middleware, which evaluates configurable
+// expressions over request fields and applies actions (allow, deny,
+// set numwant, set interval etc.) to matched requests.
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/middleware/clientapproval"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// Name is the name by which this middleware is registered with Conf.
+const Name = "rules"
+
+const (
+	// ActionAllow accepts request and stops rules evaluation
+	ActionAllow = "allow"
+	// ActionDeny rejects request with Rule.Message and stops rules evaluation
+	ActionDeny = "deny"
+	// ActionSetNumWant sets requested peers count to Rule.NumWant
+	// if requested more
+	ActionSetNumWant = "set_numwant"
+	// ActionSetInterval sets announce intervals to Rule.Interval
+	// and Rule.MinInterval (if provided)
+	ActionSetInterval = "set_interval"
+	// ActionSkipSwarmInteraction disables storing announcing peer in storage
+	ActionSkipSwarmInteraction = "skip_swarm_interaction"
+	// ActionWarn adds warning message (Rule.Message) to announce response
+	ActionWarn = "warn"
+
+	defaultPeriod      = time.Minute
+	defaultDenyMessage = "request denied"
+)
+
+var (
+	logger = log.NewLogger("middleware/rules")
+
+	// ErrNoRules returned if neither rules nor file with rules provided
+	ErrNoRules = errors.New("rules or file with rules must be provided")
+)
+
+func init() {
+	middleware.RegisterBuilder(Name, build)
+}
+
+// Rule is the configuration of single rule
+type Rule struct {
+	// Name of rule, used in logs
+	Name string
+	// When is the boolean expression. If empty, rule matches any request
+	When string
+	// Action applied to request if When expression is true
+	Action string
+	// Message of deny or warn actions
+	Message string
+	// NumWant is the value for set_numwant action
+	NumWant uint32 `cfg:"numwant"`
+	// Interval is the value for set_interval action
+	Interval time.Duration
+	// MinInterval is the value for set_interval action
+	MinInterval time.Duration `cfg:"min_interval"`
+}
+
+// Config represents the configuration for the rules middleware.
+type Config struct {
+	// Rules evaluated in provided order
+	Rules []Rule
+	// File is the path to YAML file with `rules` list,
+	// which evaluated after Rules and reloaded when changed
+	File string
+	// Period is the time between two File checks
+	Period time.Duration
+}
+
+// compiledRule is the Rule with compiled expression and action
+type compiledRule struct {
+	name  string
+	when  *expr
+	final bool
+	apply func(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) (context.Context, error)
+	// applyScrape is nil if action is not applicable to scrape
+	applyScrape func() error
+}
+
+func compileRule(r Rule) (cr compiledRule, err error) {
+	cr.name = r.Name
+	if len(r.When) > 0 {
+		if cr.when, err = compile(r.When); err != nil {
+			return cr, fmt.Errorf("rule '%s': %w", r.Name, err)
+		}
+	}
+	switch r.Action {
+	case ActionAllow:
+		cr.final = true
+		cr.apply = func(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+			return ctx, nil
+		}
+		cr.applyScrape = func() error { return nil }
+	case ActionDeny:
+		msg := r.Message
+		if len(msg) == 0 {
+			msg = defaultDenyMessage
+		}
+		denyErr := bittorrent.ClientError(msg)
+		cr.final = true
+		cr.apply = func(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+			return ctx, denyErr
+		}
+		cr.applyScrape = func() error { return denyErr }
+	case ActionSetNumWant:
+		cr.apply = func(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+			req.NumWant = min(req.NumWant, r.NumWant)
+			return ctx, nil
+		}
+	case ActionSetInterval:
+		if r.Interval <= 0 {
+			return cr, fmt.Errorf("rule '%s': interval must be provided for %s action", r.Name, r.Action)
+		}
+		cr.apply = func(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+			resp.Interval = r.Interval
+			if r.MinInterval > 0 {
+				resp.MinInterval = r.MinInterval
+			}
+			resp.MinInterval = min(resp.MinInterval, resp.Interval)
+			return ctx, nil
+		}
+	case ActionSkipSwarmInteraction:
+		cr.apply = func(ctx context.Context, _ *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
+			return context.WithValue(ctx, middleware.SkipSwarmInteractionKey, true), nil
+		}
+	case ActionWarn:
+		if len(r.Message) == 0 {
+			return cr, fmt.Errorf("rule '%s': message must be provided for %s action", r.Name, r.Action)
+		}
+		cr.apply = func(ctx context.Context, _ *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+			resp.Warning = r.Message
+			return ctx, nil
+		}
+	default:
+		err = fmt.Errorf("rule '%s': unknown action '%s'", r.Name, r.Action)
+	}
+	return
+}
+
+func compileRules(rules []Rule) ([]compiledRule, error) {
+	out := make([]compiledRule, 0, len(rules))
+	for _, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cr)
+	}
+	return out, nil
+}
+
+func build(config conf.MapConfig, _ storage.PeerStorage) (middleware.Hook, error) {
+	var cfg Config
+	if err := config.Unmarshal(&cfg); err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	if len(cfg.Rules) == 0 && len(cfg.File) == 0 {
+		return nil, fmt.Errorf("middleware %s: %w", Name, ErrNoRules)
+	}
+	inline, err := compileRules(cfg.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("middleware %s: %w", Name, err)
+	}
+	h := &hook{inline: inline, closed: make(chan any)}
+	h.rules.Store(&inline)
+	if len(cfg.File) > 0 {
+		var mt time.Time
+		if mt, err = h.loadFile(cfg.File); err != nil {
+			return nil, fmt.Errorf("middleware %s: %w", Name, err)
+		}
+		if cfg.Period <= 0 {
+			logger.Warn().
+				Str("name", "Period").
+				Dur("provided", cfg.Period).
+				Dur("default", defaultPeriod).
+				Msg("falling back to default configuration")
+			cfg.Period = defaultPeriod
+		}
+		go h.watchFile(cfg.File, mt, cfg.Period)
+	}
+	return h, nil
+}
+
+type hook struct {
+	inline []compiledRule
+	// rules are inline rules followed by rules from file
+	rules  atomic.Pointer[[]compiledRule]
+	closed chan any
+}
+
+// loadFile reads and compiles rules from file, rules are replaced
+// only if all of them compiled successfully
+func (h *hook) loadFile(path string) (mt time.Time, err error) {
+	var fi os.FileInfo
+	if fi, err = os.Stat(path); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = os.ReadFile(path); err != nil {
+		return
+	}
+	var raw conf.MapConfig
+	if err = yaml.Unmarshal(b, &raw); err != nil {
+		return
+	}
+	var fileCfg Config
+	if raw != nil {
+		if err = raw.Unmarshal(&fileCfg); err != nil {
+			return
+		}
+	}
+	var fileRules []compiledRule
+	if fileRules, err = compileRules(fileCfg.Rules); err != nil {
+		return
+	}
+	all := append(append(make([]compiledRule, 0, len(h.inline)+len(fileRules)), h.inline...), fileRules...)
+	h.rules.Store(&all)
+	return fi.ModTime(), nil
+}
+
+func (h *hook) watchFile(path string, mt time.Time, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-h.closed:
+			return
+		case <-t.C:
+			if fi, err := os.Stat(path); err != nil {
+				logger.Warn().Err(err).Str("file", path).Msg("unable to check rules file")
+			} else if !fi.ModTime().Equal(mt) {
+				if mt, err = h.loadFile(path); err == nil {
+					logger.Info().Str("file", path).Msg("rules reloaded")
+				} else {
+					mt = fi.ModTime()
+					logger.Error().Err(err).Str("file", path).Msg("unable to reload rules, keeping previous")
+				}
+			}
+		}
+	}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
+	e := &env{ctx: ctx, announce: req}
+	for _, r := range *h.rules.Load() {
+		if r.when != nil && !r.when.b(e) {
+			continue
+		}
+		logger.Trace().Str("rule", r.name).Object("request", req).Msg("rule matched")
+		if ctx, err = r.apply(ctx, req, resp); err != nil || r.final {
+			break
+		}
+	}
+	return ctx, err
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (_ context.Context, err error) {
+	e := &env{ctx: ctx, scrape: req}
+	for _, r := range *h.rules.Load() {
+		if r.applyScrape == nil || (r.when != nil && !r.when.b(e)) {
+			continue
+		}
+		logger.Trace().Str("rule", r.name).Object("request", req).Msg("rule matched")
+		if err = r.applyScrape(); err != nil || r.final {
+			break
+		}
+	}
+	return ctx, err
+}
+
+// Close stops watching of rules file
+func (h *hook) Close() error {
+	if h.closed != nil {
+		close(h.closed)
+	}
+	return nil
+}
+
+// env is the expression evaluation environment
+type env struct {
+	ctx       context.Context
+	announce  *bittorrent.AnnounceRequest
+	scrape    *bittorrent.ScrapeRequest
+	addresses []string
+}
+
+func (e *env) requestAddresses() bittorrent.RequestAddresses {
+	if e.announce != nil {
+		return e.announce.RequestAddresses
+	}
+	return e.scrape.RequestAddresses
+}
+
+func (e *env) routeParam(key string) string {
+	if rp, isOk := e.ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams); isOk {
+		return rp.ByName(key)
+	}
+	return ""
+}
+
+func (e *env) queryParam(key string) (v string) {
+	var p bittorrent.Params
+	if e.announce != nil {
+		p = e.announce.Params
+	} else {
+		p = e.scrape.Params
+	}
+	if p != nil {
+		v, _ = p.GetString(key)
+	}
+	return
+}
+
+func announceNumber(f func(*bittorrent.AnnounceRequest) float64) *expr {
+	return &expr{typ: typeNumber, n: func(e *env) float64 {
+		if e.announce == nil {
+			return 0
+		}
+		return f(e.announce)
+	}}
+}
+
+func announceString(f func(*bittorrent.AnnounceRequest) string) *expr {
+	return &expr{typ: typeString, s: func(e *env) string {
+		if e.announce == nil {
+			return ""
+		}
+		return f(e.announce)
+	}}
+}
+
+// fields are request fields, available in expressions
+var fields = map[string]*expr{
+	"action": {typ: typeString, s: func(e *env) string {
+		if e.announce != nil {
+			return "announce"
+		}
+		return "scrape"
+	}},
+	"event": announceString(func(r *bittorrent.AnnounceRequest) string {
+		return r.Event.String()
+	}),
+	"info_hash": announceString(func(r *bittorrent.AnnounceRequest) string {
+		return r.InfoHash.String()
+	}),
+	"peer_id": announceString(func(r *bittorrent.AnnounceRequest) string {
+		return string(r.ID[:])
+	}),
+	"client": announceString(func(r *bittorrent.AnnounceRequest) string {
+		cid := clientapproval.NewClientID(r.ID)
+		return string(cid[:])
+	}),
+	"left": announceNumber(func(r *bittorrent.AnnounceRequest) float64 {
+		return float64(r.Left)
+	}),
+	"downloaded": announceNumber(func(r *bittorrent.AnnounceRequest) float64 {
+		return float64(r.Downloaded)
+	}),
+	"uploaded": announceNumber(func(r *bittorrent.AnnounceRequest) float64 {
+		return float64(r.Uploaded)
+	}),
+	"numwant": announceNumber(func(r *bittorrent.AnnounceRequest) float64 {
+		return float64(r.NumWant)
+	}),
+	"port": announceNumber(func(r *bittorrent.AnnounceRequest) float64 {
+		return float64(r.Port)
+	}),
+	"addresses": {typ: typeList, l: func(e *env) []string {
+		if e.addresses == nil {
+			addrs := e.requestAddresses()
+			e.addresses = make([]string, 0, len(addrs))
+			for _, a := range addrs {
+				e.addresses = append(e.addresses, a.Addr.String())
+			}
+		}
+		return e.addresses
+	}},
+	"info_hashes": {typ: typeList, l: func(e *env) []string {
+		if e.announce != nil {
+			return []string{e.announce.InfoHash.String()}
+		}
+		out := make([]string, 0, len(e.scrape.InfoHashes))
+		for _, ih := range e.scrape.InfoHashes {
+			out = append(out, ih.String())
+		}
+		return out
+	}},
+}
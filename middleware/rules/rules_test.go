@@ -0,0 +1,169 @@
+package rules
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func newAnnounce(peerID, addr string) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		Event:    bittorrent.Started,
+		InfoHash: bittorrent.InfoHash("01234567890123456789"),
+		NumWant:  100,
+		Left:     1000,
+		RequestPeer: bittorrent.RequestPeer{
+			ID:               bittorrent.PeerID([]byte(peerID)),
+			Port:             6881,
+			RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr(addr)}},
+		},
+	}
+}
+
+func TestCompile(t *testing.T) {
+	valid := []string{
+		`true`,
+		`event == "started" && left > 0`,
+		`!(numwant <= 50) || client in ["TR3000", "qB4500"]`,
+		`cidr(addresses, "10.0.0.0/8", "fc00::/7")`,
+		`peer_id matches '^-TR[0-2]'`,
+		`has_prefix(lower(client), "tr") && len(addresses) >= 1`,
+		`route("key") != "" && param("passkey") == ''`,
+		`addresses in ["127.0.0.1"]`,
+	}
+	for _, s := range valid {
+		_, err := compile(s)
+		require.Nil(t, err, s)
+	}
+	invalid := []string{
+		``,
+		`left`,
+		`left == "1"`,
+		`event == `,
+		`unknown == 1`,
+		`client matches client`,
+		`cidr(addresses, "10.0.0.0/33")`,
+		`route(client) == ""`,
+		`"a" < 1`,
+		`(true`,
+		`"unterminated`,
+		`true false`,
+		`numwant in [1, 2]`,
+	}
+	for _, s := range invalid {
+		_, err := compile(s)
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := build(conf.MapConfig{
+		"rules": []any{
+			map[string]any{
+				"name":   "trusted",
+				"when":   `cidr(addresses, "10.0.0.0/8")`,
+				"action": ActionAllow,
+			},
+			map[string]any{
+				"name":    "banned",
+				"when":    `client == "XX0001"`,
+				"action":  ActionDeny,
+				"message": "client banned",
+			},
+			map[string]any{
+				"when":    `has_prefix(client, "TR")`,
+				"action":  ActionSetNumWant,
+				"numwant": 10,
+			},
+			map[string]any{
+				"when":    `client < "TR3000"`,
+				"action":  ActionWarn,
+				"message": "please update client",
+			},
+			map[string]any{
+				"when":         `event == "started"`,
+				"action":       ActionSetInterval,
+				"interval":     "1h",
+				"min_interval": "30m",
+			},
+			map[string]any{
+				"when":   `left == 0`,
+				"action": ActionSkipSwarmInteraction,
+			},
+		},
+	}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+	ctx := context.Background()
+
+	req, resp := newAnnounce("-TR2940-012345678901", "192.168.0.1"), &bittorrent.AnnounceResponse{}
+	outCtx, err := h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(10), req.NumWant)
+	require.Equal(t, "please update client", resp.Warning)
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, 30*time.Minute, resp.MinInterval)
+	require.Nil(t, outCtx.Value(middleware.SkipSwarmInteractionKey))
+
+	req, resp = newAnnounce("-XX0001-012345678901", "10.1.2.3"), &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, uint32(100), req.NumWant)
+	require.Zero(t, resp.Interval)
+
+	req = newAnnounce("-XX0001-012345678901", "192.168.0.1")
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Equal(t, bittorrent.ClientError("client banned"), err)
+
+	req = newAnnounce("-qB4500-012345678901", "::ffff:192.168.0.1")
+	req.Event, req.Left = bittorrent.None, 0
+	outCtx, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.NotNil(t, outCtx.Value(middleware.SkipSwarmInteractionKey))
+}
+
+func TestHandleScrapeAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(`rules:
+    -   when: 'action == "scrape" && cidr(addresses, "192.168.0.0/16")'
+        action: deny
+`), 0o600))
+	h, err := build(conf.MapConfig{"file": path, "period": "10ms"}, nil)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	req := &bittorrent.ScrapeRequest{
+		RequestAddresses: bittorrent.RequestAddresses{{Addr: netip.MustParseAddr("192.168.1.1")}},
+		InfoHashes:       bittorrent.InfoHashes{bittorrent.InfoHash("01234567890123456789")},
+	}
+	_, err = h.HandleScrape(context.Background(), req, nil)
+	require.Equal(t, bittorrent.ClientError(defaultDenyMessage), err)
+
+	// invalid rules should not replace valid ones
+	require.Nil(t, os.WriteFile(path, []byte("rules:\n    -   when: 'left =='\n        action: deny\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	time.Sleep(50 * time.Millisecond)
+	_, err = h.HandleScrape(context.Background(), req, nil)
+	require.NotNil(t, err)
+
+	require.Nil(t, os.WriteFile(path, []byte("rules: []\n"), 0o600))
+	require.Nil(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	require.Eventually(t, func() bool {
+		_, err = h.HandleScrape(context.Background(), req, nil)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
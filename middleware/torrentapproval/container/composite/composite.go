@@ -0,0 +1,155 @@
+// Package composite implements container which combines
+// several named child containers (i.e. white list from directory and
+// emergency black list) and evaluates them in configured order.
+package composite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+)
+
+var logger = log.NewLogger("middleware/torrent approval/composite")
+
+const storageCtxKey = "storage_ctx"
+
+func init() {
+	container.Register("composite", build)
+}
+
+// ChildConfig is the configuration of one child container
+type ChildConfig struct {
+	// Name of child, used in Config.Precedence and logs
+	Name string
+	// Source - name of container (list, directory...)
+	Source string
+	// Configuration depends on used container.
+	// If `storage_ctx` is not set, default context with
+	// child name suffix is used.
+	Configuration conf.MapConfig
+}
+
+// Config - implementation of composite container configuration.
+type Config struct {
+	// Containers is the list of child containers
+	Containers []ChildConfig
+	// Precedence is the order of child containers' evaluation by their names.
+	// If empty, containers evaluated in the same order as provided.
+	Precedence []string
+	// Default is the result of approval if no one of containers
+	// explicitly allowed or denied hash.
+	Default bool
+}
+
+type child struct {
+	name string
+	container.Container
+}
+
+type composite struct {
+	children []child
+	def      bool
+}
+
+func build(cfg conf.MapConfig, st storage.DataStorage) (container.Container, error) {
+	c := new(Config)
+	if err := cfg.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("unable to deserialise configuration: %w", err)
+	}
+	if len(c.Containers) == 0 {
+		return nil, errors.New("child containers not provided")
+	}
+
+	cmp := &composite{def: c.Default}
+	byName := make(map[string]child, len(c.Containers))
+	for _, cc := range c.Containers {
+		if len(cc.Name) == 0 {
+			_ = cmp.Close()
+			return nil, errors.New("child container name not provided")
+		}
+		if _, exists := byName[cc.Name]; exists {
+			_ = cmp.Close()
+			return nil, fmt.Errorf("duplicate child container name: %s", cc.Name)
+		}
+		if cc.Configuration == nil {
+			cc.Configuration = make(conf.MapConfig)
+		}
+		if _, exists := cc.Configuration[storageCtxKey]; !exists {
+			cc.Configuration[storageCtxKey] = container.DefaultStorageCtxName + "_" + cc.Name
+		}
+		cn, err := container.GetContainer(cc.Source, cc.Configuration, st)
+		if err != nil {
+			_ = cmp.Close()
+			return nil, fmt.Errorf("unable to create child container %s: %w", cc.Name, err)
+		}
+		ch := child{cc.Name, cn}
+		byName[cc.Name] = ch
+		cmp.children = append(cmp.children, ch)
+	}
+
+	if len(c.Precedence) > 0 {
+		if len(c.Precedence) != len(cmp.children) {
+			_ = cmp.Close()
+			return nil, errors.New("precedence should contain all child container names")
+		}
+		ordered := make([]child, 0, len(c.Precedence))
+		for _, n := range c.Precedence {
+			ch, exists := byName[n]
+			if !exists {
+				_ = cmp.Close()
+				return nil, fmt.Errorf("unknown child container in precedence: %s", n)
+			}
+			ordered = append(ordered, ch)
+		}
+		cmp.children = ordered
+	}
+
+	return cmp, nil
+}
+
+// Decide evaluates child containers in configured order and returns
+// first explicit decision (container.Allow or container.Deny)
+// or container.Unknown if no one of children has information about hash.
+func (c *composite) Decide(ctx context.Context, hash bittorrent.InfoHash) container.Decision {
+	for _, ch := range c.children {
+		if d := container.Decide(ctx, ch.Container, hash); d != container.Unknown {
+			logger.Trace().
+				Str("container", ch.name).
+				Stringer("infoHash", hash).
+				Bool("approved", d == container.Allow).
+				Msg("decision made")
+			return d
+		}
+	}
+	return container.Unknown
+}
+
+// Approved checks if hash explicitly approved by first deciding child
+// container or returns Config.Default.
+func (c *composite) Approved(ctx context.Context, hash bittorrent.InfoHash) bool {
+	switch c.Decide(ctx, hash) {
+	case container.Allow:
+		return true
+	case container.Deny:
+		return false
+	default:
+		return c.def
+	}
+}
+
+// Close closes all child containers
+func (c *composite) Close() (err error) {
+	for _, ch := range c.children {
+		if cl, isOk := ch.Container.(io.Closer); isOk {
+			err = errors.Join(err, cl.Close())
+		}
+	}
+	return
+}
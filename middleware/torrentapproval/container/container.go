@@ -45,16 +45,69 @@ type Container interface {
 	Approved(context.Context, bittorrent.InfoHash) bool
 }
 
+// BulkContainer is an optional interface that may be implemented by Container
+// to check several hashes at once (i.e. in one storage request)
+type BulkContainer interface {
+	// ApprovedMany checks if each of provided hashes approved or not.
+	// Returned slice has the same length and order as hashes.
+	ApprovedMany(context.Context, bittorrent.InfoHashes) []bool
+}
+
+// ApprovedMany checks if each of provided hashes approved or not.
+// Uses BulkContainer.ApprovedMany if container implements it,
+// otherwise calls Container.Approved for every hash.
+func ApprovedMany(ctx context.Context, c Container, hashes bittorrent.InfoHashes) (approved []bool) {
+	if bc, isOk := c.(BulkContainer); isOk {
+		return bc.ApprovedMany(ctx, hashes)
+	}
+	approved = make([]bool, len(hashes))
+	for i, ih := range hashes {
+		approved[i] = c.Approved(ctx, ih)
+	}
+	return
+}
+
+// Decision is the result of hash check by Decider
+type Decision uint8
+
+const (
+	// Unknown means that container has no information about hash
+	Unknown Decision = iota
+	// Allow means that hash explicitly approved
+	Allow
+	// Deny means that hash explicitly unapproved
+	Deny
+)
+
+// Decider is an optional interface that may be implemented by Container
+// to distinguish explicit approval or denial of hash (i.e. hash found
+// in white or black list) from absence of information about hash.
+// Used by containers which combine several containers.
+type Decider interface {
+	Decide(context.Context, bittorrent.InfoHash) Decision
+}
+
+// Decide checks hash with Decider.Decide if container implements it,
+// otherwise result of Container.Approved considered as explicit decision.
+func Decide(ctx context.Context, c Container, ih bittorrent.InfoHash) Decision {
+	if d, isOk := c.(Decider); isOk {
+		return d.Decide(ctx, ih)
+	}
+	if c.Approved(ctx, ih) {
+		return Allow
+	}
+	return Deny
+}
+
 // GetContainer creates Container by its name and provided confBytes
 func GetContainer(name string, config conf.MapConfig, storage storage.DataStorage) (Container, error) {
 	buildersMU.Lock()
-	defer buildersMU.Unlock()
-	var err error
-	var cn Container
-	if builder, exist := builders[name]; !exist {
-		err = ErrContainerDoesNotExist
-	} else {
-		cn, err = builder(config, storage)
+	builder, exist := builders[name]
+	buildersMU.Unlock()
+	if !exist {
+		return nil, ErrContainerDoesNotExist
 	}
-	return cn, err
+	// builder called without lock because some containers
+	// may create another (child) containers
+	return builder(config, storage)
 }
@@ -8,11 +8,16 @@ import (
 	"context"
 	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zeebo/bencode"
@@ -31,6 +36,7 @@ var logger = log.NewLogger("middleware/torrent approval/directory")
 const (
 	defaultPeriod  = time.Minute
 	maxTorrentSize = 10 * 1024 * 1024
+	torrentExt     = ".torrent"
 )
 
 func init() {
@@ -43,8 +49,17 @@ type Config struct {
 	list.Config
 	// Path in filesystem where torrent files stored and should be watched
 	Path string
-	// Period is time between two Path checks
+	// Period is time between two Path checks in polling mode
+	// or time between index saves in watch mode
 	Period time.Duration
+	// Watch enables event driven (inotify) directory watching.
+	// If not supported by OS, polling is used
+	Watch bool
+	// Recursive enables scanning (and watching) of subdirectories
+	Recursive bool
+	// IndexPath is the path to file, where parsed files' modification time
+	// and hashes are stored to prevent re-parsing after restart
+	IndexPath string `cfg:"index_path"`
 }
 
 func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, error) {
@@ -52,13 +67,20 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 	if err := conf.Unmarshal(c); err != nil {
 		return nil, fmt.Errorf("unable to deserialise configuration: %w", err)
 	}
-	var err error
 	d := &directory{
 		List: list.List{
 			Invert:     c.Invert,
 			Storage:    st,
 			StorageCtx: c.StorageCtx,
 		},
+		path:      c.Path,
+		period:    c.Period,
+		recursive: c.Recursive,
+		indexPath: c.IndexPath,
+		files:     make(map[string]*fileEntry),
+		// nolint:gosec
+		s1:     sha1.New(),
+		s2:     sha256.New(),
 		closed: make(chan bool),
 	}
 	if len(d.StorageCtx) == 0 {
@@ -69,16 +91,18 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 			Msg("falling back to default configuration")
 		d.StorageCtx = container.DefaultStorageCtxName
 	}
-	if c.Period == 0 {
+	if d.period == 0 {
 		logger.Warn().
 			Str("name", "Period").
 			Dur("provided", 0).
 			Dur("default", defaultPeriod).
 			Msg("falling back to default configuration")
-		c.Period = defaultPeriod
+		d.period = defaultPeriod
 	}
-	go d.runScan(c.Path, c.Period)
-	return d, err
+	d.loadIndex()
+	d.wg.Add(1)
+	go d.run(c.Watch)
+	return d, nil
 }
 
 // BencodeRawBytes wrapper for byte slice to get raw 'info' section from
@@ -99,102 +123,285 @@ type torrentNameInfoStruct struct {
 	Name string `bencode:"name"`
 }
 
-func (d *directory) runScan(path string, period time.Duration) {
-	t := time.NewTicker(period)
+// fileEntry holds parsed torrent file information
+type fileEntry struct {
+	ModTime, Size int64
+	V1, V2        bittorrent.InfoHash
+	Name          string
+	// stored flag is set if hashes have been put into storage
+	stored bool
+}
+
+// indexEntry is the serializable representation of fileEntry
+type indexEntry struct {
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+	V1      string `json:"v1"`
+	V2      string `json:"v2"`
+	Name    string `json:"name"`
+}
+
+func (fe *fileEntry) entries() []storage.Entry {
+	bName := str2bytes.StringToBytes(fe.Name)
+	return []storage.Entry{
+		{Key: fe.V1.RawString(), Value: bName},
+		{Key: fe.V2.RawString(), Value: bName},
+		{Key: fe.V2.TruncateV1().RawString(), Value: bName},
+	}
+}
+
+type directory struct {
+	list.List
+	path      string
+	period    time.Duration
+	recursive bool
+	indexPath string
+	// files should be accessed only from run goroutine
+	files  map[string]*fileEntry
+	dirty  bool
+	s1, s2 hash.Hash
+	closed chan bool
+	wg     sync.WaitGroup
+}
+
+func isTorrentFile(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == torrentExt
+}
+
+// parse reads torrent file and calculates V1 and V2 hashes of info section
+func (d *directory) parse(p string) (fe *fileEntry, err error) {
+	var f *os.File
+	if f, err = os.Open(p); err != nil {
+		return
+	}
+	var info torrentRawInfoStruct
+	err = bencode.NewDecoder(io.LimitReader(f, maxTorrentSize)).Decode(&info)
+	_ = f.Close()
+	if err != nil {
+		return
+	}
+	fe = new(fileEntry)
+	d.s1.Write(info.Info)
+	fe.V1, _ = bittorrent.NewInfoHash(d.s1.Sum(nil))
+	d.s1.Reset()
+
+	d.s2.Write(info.Info)
+	fe.V2, _ = bittorrent.NewInfoHash(d.s2.Sum(nil))
+	d.s2.Reset()
+
+	var name torrentNameInfoStruct
+	if err := bencode.DecodeBytes(info.Info, &name); err != nil {
+		logger.Warn().
+			Err(err).
+			Str("file", p).
+			Msg("unable to unmarshal torrent info")
+	}
+	if fe.Name = name.Name; len(fe.Name) == 0 {
+		fe.Name = list.DUMMY
+	}
+	return
+}
+
+// update checks if file is new or changed since last check,
+// parses it and puts hashes into storage.
+func (d *directory) update(p string, fi fs.FileInfo) {
+	mt, size := fi.ModTime().UnixNano(), fi.Size()
+	old, exists := d.files[p]
+	if exists && old.ModTime == mt && old.Size == size {
+		if !old.stored {
+			// entry loaded from index
+			logger.Err(d.Storage.Put(context.Background(), d.StorageCtx, old.entries()...)).
+				Str("file", p).
+				Stringer("infoHash", old.V1).
+				Stringer("infoHashV2", old.V2).
+				Msg("restored torrent from index to approval list")
+			old.stored = true
+		}
+		return
+	}
+	fe, err := d.parse(p)
+	if err != nil {
+		logger.Warn().Err(err).Str("file", p).Msg("unable to read file")
+		return
+	}
+	if exists {
+		d.remove(p)
+	}
+	fe.ModTime, fe.Size = mt, size
+	err = d.Storage.Put(context.Background(), d.StorageCtx, fe.entries()...)
+	fe.stored = err == nil
+	d.files[p], d.dirty = fe, true
+	logger.Err(err).
+		Str("file", p).
+		Stringer("infoHash", fe.V1).
+		Stringer("infoHashV2", fe.V2).
+		Msg("added torrent to approval list")
+}
+
+// updatePath is the same as update, but gets file info by itself
+func (d *directory) updatePath(p string) {
+	if fi, err := os.Stat(p); err == nil {
+		if fi.Mode().IsRegular() {
+			d.update(p, fi)
+		}
+	} else {
+		logger.Warn().Err(err).Str("file", p).Msg("unable to read file")
+	}
+}
+
+// remove deletes file hashes from storage
+func (d *directory) remove(p string) {
+	if fe, exists := d.files[p]; exists {
+		delete(d.files, p)
+		d.dirty = true
+		logger.Err(d.Storage.Delete(context.Background(), d.StorageCtx, fe.V1.RawString(),
+			fe.V2.RawString(), fe.V2.TruncateV1().RawString())).
+			Str("file", p).
+			Stringer("infoHash", fe.V1).
+			Stringer("infoHashV2", fe.V2).
+			Msg("deleted torrent from approval list")
+	}
+}
+
+// removeDir deletes hashes of all files placed in directory (and subdirectories)
+func (d *directory) removeDir(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for p := range d.files {
+		if strings.HasPrefix(p, prefix) {
+			d.remove(p)
+		}
+	}
+}
+
+// scan performs full scan of directory (and subdirectories if recursive),
+// adds new and changed files and removes deleted.
+func (d *directory) scan() {
+	logger.Debug().Msg("starting directory scan")
+	found := make(map[string]bool, len(d.files))
+	err := filepath.WalkDir(d.path, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if p == d.path {
+				return err
+			}
+			logger.Warn().Err(err).Str("path", p).Msg("unable to read path")
+			return nil
+		}
+		if e.IsDir() {
+			if p != d.path && !d.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// os.Stat follows symlinks, DirEntry does not
+		if isTorrentFile(e.Name()) {
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				found[p] = true
+				d.update(p, fi)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to get directory content")
+		return
+	}
+	for p := range d.files {
+		if !found[p] {
+			d.remove(p)
+		}
+	}
+}
+
+func (d *directory) loadIndex() {
+	if len(d.indexPath) == 0 {
+		return
+	}
+	var index map[string]indexEntry
+	b, err := os.ReadFile(d.indexPath)
+	if err == nil {
+		err = json.Unmarshal(b, &index)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Warn().Err(err).Str("file", d.indexPath).Msg("unable to load index")
+		}
+		return
+	}
+	for p, ie := range index {
+		fe := &fileEntry{ModTime: ie.ModTime, Size: ie.Size, Name: ie.Name}
+		if fe.V1, err = bittorrent.NewInfoHashString(ie.V1); err == nil {
+			fe.V2, err = bittorrent.NewInfoHashString(ie.V2)
+		}
+		if err != nil {
+			logger.Warn().Err(err).Str("file", p).Msg("invalid index entry")
+			continue
+		}
+		d.files[p] = fe
+	}
+	logger.Info().Str("file", d.indexPath).Int("count", len(d.files)).Msg("index loaded")
+}
+
+func (d *directory) saveIndex() {
+	if len(d.indexPath) == 0 || !d.dirty {
+		return
+	}
+	index := make(map[string]indexEntry, len(d.files))
+	for p, fe := range d.files {
+		index[p] = indexEntry{
+			ModTime: fe.ModTime,
+			Size:    fe.Size,
+			V1:      fe.V1.String(),
+			V2:      fe.V2.String(),
+			Name:    fe.Name,
+		}
+	}
+	b, err := json.Marshal(index)
+	if err == nil {
+		tmp := d.indexPath + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o600); err == nil {
+			err = os.Rename(tmp, d.indexPath)
+		}
+	}
+	if err == nil {
+		d.dirty = false
+	} else {
+		logger.Warn().Err(err).Str("file", d.indexPath).Msg("unable to save index")
+	}
+}
+
+func (d *directory) run(watch bool) {
+	defer d.wg.Done()
+	defer d.saveIndex()
+	d.scan()
+	if watch {
+		err := d.watch()
+		if err == nil {
+			return
+		}
+		logger.Warn().Err(err).Msg("unable to watch directory, falling back to polling")
+	}
+	d.poll()
+}
+
+func (d *directory) poll() {
+	t := time.NewTicker(d.period)
 	defer t.Stop()
-	files := make(map[string][2]bittorrent.InfoHash)
-	tmpFiles := make(map[string]bool)
-	// nolint:gosec
-	s1, s2 := sha1.New(), sha256.New()
 	for {
 		select {
 		case <-d.closed:
 			return
 		case <-t.C:
-			logger.Debug().Msg("starting directory scan")
-			if entries, err := os.ReadDir(path); err == nil {
-				for _, e := range entries {
-					if !e.IsDir() && strings.ToLower(filepath.Ext(e.Name())) == ".torrent" {
-						tmpFiles[filepath.Join(path, e.Name())] = true
-					}
-				}
-				for p := range tmpFiles {
-					if _, exists := files[p]; !exists {
-						var f *os.File
-						if f, err = os.Open(p); err == nil {
-							var info torrentRawInfoStruct
-							err = bencode.NewDecoder(io.LimitReader(f, maxTorrentSize)).Decode(&info)
-							_ = f.Close()
-							if err == nil {
-								s1.Write(info.Info)
-								h1, _ := bittorrent.NewInfoHash(s1.Sum(nil))
-								s1.Reset()
-
-								s2.Write(info.Info)
-								h2, _ := bittorrent.NewInfoHash(s2.Sum(nil))
-								s2.Reset()
-
-								files[p] = [2]bittorrent.InfoHash{h1, h2}
-								var name torrentNameInfoStruct
-								if err := bencode.DecodeBytes(info.Info, &name); err != nil {
-									logger.Warn().
-										Err(err).
-										Str("file", p).
-										Msg("unable to unmarshal torrent info")
-								}
-								if len(name.Name) == 0 {
-									name.Name = list.DUMMY
-								}
-								bName := str2bytes.StringToBytes(name.Name)
-								logger.Err(d.Storage.Put(context.Background(), d.StorageCtx, storage.Entry{
-									Key:   h1.RawString(),
-									Value: bName,
-								}, storage.Entry{
-									Key:   h2.RawString(),
-									Value: bName,
-								}, storage.Entry{
-									Key:   h2.TruncateV1().RawString(),
-									Value: bName,
-								})).
-									Str("file", p).
-									Stringer("infoHash", h1).
-									Stringer("infoHashV2", h2).
-									Msg("added torrent to approval list")
-							}
-						}
-						if err != nil {
-							logger.Warn().Err(err).Str("file", p).Msg("unable to read file")
-						}
-					}
-				}
-				for p, ih := range files {
-					if _, isOk := tmpFiles[p]; !isOk {
-						delete(files, p)
-						logger.Err(d.Storage.Delete(context.Background(), d.StorageCtx, ih[0].RawString(),
-							ih[1].RawString(), ih[1].TruncateV1().RawString())).
-							Str("file", p).
-							Stringer("infoHash", ih[1]).
-							Stringer("infoHashV2", ih[1]).
-							Msg("deleted torrent from approval list")
-					}
-				}
-				clear(tmpFiles)
-			} else {
-				logger.Warn().Err(err).Msg("unable to get directory content")
-			}
+			d.scan()
+			d.saveIndex()
 		}
 	}
 }
 
-type directory struct {
-	list.List
-	closed chan bool
-}
-
 // Close closes watching of torrent directory
 func (d *directory) Close() error {
 	if d.closed != nil {
 		close(d.closed)
+		d.wg.Wait()
 	}
 	return nil
 }
@@ -0,0 +1,118 @@
+package directory
+
+import (
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+)
+
+func init() {
+	_ = log.ConfigureLogger("", "warn", false, false)
+}
+
+func writeTorrent(t *testing.T, p, name string) bittorrent.InfoHash {
+	info := "d4:name" + strconv.Itoa(len(name)) + ":" + name + "12:piece lengthi16384ee"
+	require.Nil(t, os.WriteFile(p, []byte("d4:info"+info+"e"), 0o600))
+	// nolint:gosec
+	s := sha1.Sum([]byte(info))
+	ih, err := bittorrent.NewInfoHash(s[:])
+	require.Nil(t, err)
+	return ih
+}
+
+func newDirectory(t *testing.T, st storage.DataStorage, cfg conf.MapConfig) *directory {
+	c, err := build(cfg, st)
+	require.Nil(t, err)
+	return c.(*directory)
+}
+
+func approvedEventually(t *testing.T, d *directory, ih bittorrent.InfoHash, expected bool) {
+	require.Eventually(t, func() bool {
+		return d.Approved(context.Background(), ih) == expected
+	}, 5*time.Second, 10*time.Millisecond, ih.String())
+}
+
+func TestWatchRecursive(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st.Close()
+	dir := t.TempDir()
+	index := filepath.Join(t.TempDir(), "index.json")
+	existing := writeTorrent(t, filepath.Join(dir, "existing.torrent"), "existing")
+
+	d := newDirectory(t, st, conf.MapConfig{
+		"path":       dir,
+		"period":     "10ms",
+		"watch":      true,
+		"recursive":  true,
+		"index_path": index,
+	})
+	approvedEventually(t, d, existing, true)
+
+	sub := filepath.Join(dir, "sub")
+	require.Nil(t, os.Mkdir(sub, 0o700))
+	nested := writeTorrent(t, filepath.Join(sub, "nested.torrent"), "nested")
+	approvedEventually(t, d, nested, true)
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "existing.torrent")))
+	approvedEventually(t, d, existing, false)
+
+	require.Nil(t, os.RemoveAll(sub))
+	approvedEventually(t, d, nested, false)
+
+	last := writeTorrent(t, filepath.Join(dir, "last.torrent"), "last")
+	approvedEventually(t, d, last, true)
+	require.Nil(t, d.Close())
+
+	// new container should restore hashes from index without parsing
+	st2, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st2.Close()
+	d = newDirectory(t, st2, conf.MapConfig{
+		"path":       dir,
+		"index_path": index,
+	})
+	approvedEventually(t, d, last, true)
+	require.Nil(t, d.Close())
+	require.Len(t, d.files, 1)
+}
+
+func TestSymlinks(t *testing.T) {
+	st, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	defer st.Close()
+	dir, src := t.TempDir(), t.TempDir()
+	existing := writeTorrent(t, filepath.Join(src, "existing.torrent"), "existing")
+	require.Nil(t, os.Symlink(filepath.Join(src, "existing.torrent"), filepath.Join(dir, "existing.torrent")))
+
+	d := newDirectory(t, st, conf.MapConfig{
+		"path":   dir,
+		"period": "10ms",
+		"watch":  true,
+	})
+	defer d.Close()
+	approvedEventually(t, d, existing, true)
+
+	symlinked := writeTorrent(t, filepath.Join(src, "symlinked.torrent"), "symlinked")
+	require.Nil(t, os.Symlink(filepath.Join(src, "symlinked.torrent"), filepath.Join(dir, "symlinked.torrent")))
+	approvedEventually(t, d, symlinked, true)
+
+	linked := writeTorrent(t, filepath.Join(src, "linked.torrent"), "linked")
+	require.Nil(t, os.Link(filepath.Join(src, "linked.torrent"), filepath.Join(dir, "linked.torrent")))
+	approvedEventually(t, d, linked, true)
+
+	require.Nil(t, os.Remove(filepath.Join(dir, "symlinked.torrent")))
+	approvedEventually(t, d, symlinked, false)
+}
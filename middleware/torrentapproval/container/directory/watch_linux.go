@@ -0,0 +1,199 @@
+//go:build linux
+
+package directory
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+		syscall.IN_DELETE | syscall.IN_CREATE
+	eventsBufferSize = 64 * 1024
+)
+
+// watcher holds inotify descriptor and watched directories
+type watcher struct {
+	*directory
+	fd   int
+	dirs map[int32]string
+}
+
+// watch subscribes to inotify events of directory (and subdirectories if recursive)
+// and processes them until container closed.
+// Returns error if inotify is not available or reading events failed.
+func (d *directory) watch() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	// non-blocking descriptor is registered in runtime poller,
+	// so Read is interrupted by Close
+	f := os.NewFile(uintptr(fd), "inotify")
+	w := &watcher{directory: d, fd: fd, dirs: make(map[int32]string)}
+	if err = w.addWatch(d.path); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if d.recursive {
+		w.addSubdirs(d.path, false)
+	}
+	logger.Info().Str("path", d.path).Bool("recursive", d.recursive).Msg("watching directory")
+
+	events, readErr := make(chan []byte), make(chan error, 1)
+	go func() {
+		defer close(events)
+		buf := make([]byte, eventsBufferSize)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			events <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	t := time.NewTicker(d.period)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.closed:
+			_ = f.Close()
+			for range events {
+			}
+			return nil
+		case b, ok := <-events:
+			if !ok {
+				_ = f.Close()
+				return <-readErr
+			}
+			w.process(b)
+		case <-t.C:
+			d.saveIndex()
+		}
+	}
+}
+
+func (w *watcher) addWatch(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return &fs.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.dirs[int32(wd)] = dir
+	return nil
+}
+
+// addSubdirs adds watches to all subdirectories of dir.
+// If update is true, also adds torrent files found in
+// subdirectories (files may be created before watch added).
+func (w *watcher) addSubdirs(dir string, update bool) {
+	_ = filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			logger.Warn().Err(err).Str("path", p).Msg("unable to read path")
+		case e.IsDir():
+			if p != dir {
+				if err = w.addWatch(p); err != nil {
+					logger.Warn().Err(err).Msg("unable to watch directory")
+					return filepath.SkipDir
+				}
+			}
+		case update && isTorrentFile(e.Name()):
+			w.updatePath(p)
+		}
+		return nil
+	})
+}
+
+// removeWatches removes watches of directory and its subdirectories
+func (w *watcher) removeWatches(dir string) {
+	prefix := dir + string(filepath.Separator)
+	for wd, p := range w.dirs {
+		if p == dir || strings.HasPrefix(p, prefix) {
+			_, _ = syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// process parses raw inotify events and applies changes
+func (w *watcher) process(b []byte) {
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(b); {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&b[off]))
+		off += syscall.SizeofInotifyEvent
+		end := off + int(ev.Len)
+		if end > len(b) {
+			return
+		}
+		name := strings.TrimRight(string(b[off:end]), "\x00")
+		off = end
+
+		if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			logger.Warn().Msg("inotify events queue overflowed, rescanning directory")
+			w.scan()
+			continue
+		}
+		if ev.Mask&syscall.IN_IGNORED != 0 {
+			delete(w.dirs, ev.Wd)
+			continue
+		}
+		dir, exists := w.dirs[ev.Wd]
+		if !exists || len(name) == 0 {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		logger.Trace().Str("path", p).Uint32("mask", ev.Mask).Msg("inotify event")
+		if ev.Mask&syscall.IN_ISDIR != 0 {
+			if !w.recursive {
+				continue
+			}
+			switch {
+			case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+				if err := w.addWatch(p); err == nil {
+					w.addSubdirs(p, true)
+				} else {
+					logger.Warn().Err(err).Msg("unable to watch directory")
+				}
+			case ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+				w.removeWatches(p)
+				w.removeDir(p)
+			}
+			continue
+		}
+		if !isTorrentFile(name) {
+			continue
+		}
+		switch {
+		case ev.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0:
+			w.updatePath(p)
+		case ev.Mask&syscall.IN_CREATE != 0:
+			// symlinks and hard links do not produce IN_CLOSE_WRITE,
+			// new regular files are processed when closed
+			if isLink(p) {
+				w.updatePath(p)
+			}
+		case ev.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+			w.remove(p)
+		}
+	}
+}
+
+// isLink checks if path is symlink or hard link of existing file
+func isLink(p string) bool {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return false
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return true
+	}
+	st, isOk := fi.Sys().(*syscall.Stat_t)
+	return isOk && fi.Mode().IsRegular() && st.Nlink > 1
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package directory
+
+import "errors"
+
+// watch is not supported on this OS, polling is used instead
+func (*directory) watch() error {
+	return errors.ErrUnsupported
+}
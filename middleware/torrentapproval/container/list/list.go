@@ -3,13 +3,17 @@
 package list
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/sot-tech/mochi/bittorrent"
 	"github.com/sot-tech/mochi/middleware/torrentapproval/container"
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
 	"github.com/sot-tech/mochi/storage"
 )
 
@@ -23,6 +27,9 @@ func init() {
 type Config struct {
 	// HashList static list of HEX-encoded InfoHashes.
 	HashList []string `cfg:"hash_list"`
+	// TemporaryHashList is the map of HEX-encoded InfoHashes
+	// and RFC3339 formatted time, after which hash is removed from list.
+	TemporaryHashList map[string]string `cfg:"temporary_hash_list"`
 	// If Invert set to true, all InfoHashes stored in HashList should be blacklisted.
 	Invert bool
 	// StorageCtx is the name of storage context where to store hash list.
@@ -33,6 +40,38 @@ type Config struct {
 // DUMMY used as value placeholder if storage needs some value with
 const DUMMY = "_"
 
+// ExpiryPrefix is the prefix of stored value, which holds
+// expiration time (unix seconds) of entry, i.e. `exp:1735689600`.
+// Expired entries are considered absent.
+const ExpiryPrefix = "exp:"
+
+// ExpiryValue returns value for storage.Entry which
+// expires at specified time
+func ExpiryValue(t time.Time) []byte {
+	return strconv.AppendInt([]byte(ExpiryPrefix), t.Unix(), 10)
+}
+
+// expired checks if stored value has expiration time and it is before now
+func expired(v []byte, now int64) bool {
+	if !bytes.HasPrefix(v, []byte(ExpiryPrefix)) {
+		return false
+	}
+	exp, err := strconv.ParseInt(string(v[len(ExpiryPrefix):]), 10, 64)
+	return err == nil && exp <= now
+}
+
+func hashEntries(hashString string, value []byte) ([]storage.Entry, error) {
+	ih, err := bittorrent.NewInfoHashString(hashString)
+	if err != nil {
+		return nil, err
+	}
+	entries := []storage.Entry{{Key: ih.RawString(), Value: value}}
+	if len(ih) == bittorrent.InfoHashV2Len {
+		entries = append(entries, storage.Entry{Key: ih.TruncateV1().RawString(), Value: value})
+	}
+	return entries, nil
+}
+
 func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, error) {
 	c := new(Config)
 	if err := conf.Unmarshal(c); err != nil {
@@ -53,17 +92,25 @@ func build(conf conf.MapConfig, st storage.DataStorage) (container.Container, er
 		l.StorageCtx = container.DefaultStorageCtxName
 	}
 
-	if len(c.HashList) > 0 {
-		init := make([]storage.Entry, 0, len(c.HashList))
+	if len(c.HashList) > 0 || len(c.TemporaryHashList) > 0 {
+		init := make([]storage.Entry, 0, len(c.HashList)+len(c.TemporaryHashList))
 		for _, hashString := range c.HashList {
-			ih, err := bittorrent.NewInfoHashString(hashString)
+			entries, err := hashEntries(hashString, []byte(DUMMY))
 			if err != nil {
 				return nil, fmt.Errorf("whitelist : %s : %w", hashString, err)
 			}
-			init = append(init, storage.Entry{Key: ih.RawString(), Value: []byte(DUMMY)})
-			if len(ih) == bittorrent.InfoHashV2Len {
-				init = append(init, storage.Entry{Key: ih.TruncateV1().RawString(), Value: []byte(DUMMY)})
+			init = append(init, entries...)
+		}
+		for hashString, expString := range c.TemporaryHashList {
+			exp, err := time.Parse(time.RFC3339, expString)
+			if err != nil {
+				return nil, fmt.Errorf("whitelist : %s : %w", hashString, err)
 			}
+			entries, err := hashEntries(hashString, ExpiryValue(exp))
+			if err != nil {
+				return nil, fmt.Errorf("whitelist : %s : %w", hashString, err)
+			}
+			init = append(init, entries...)
 		}
 		if err := l.Storage.Put(context.Background(), l.StorageCtx, init...); err != nil {
 			return nil, fmt.Errorf("unable to put initial data: %w", err)
@@ -82,22 +129,80 @@ type List struct {
 	StorageCtx string
 }
 
+// contains checks if specified hash (or its V1 truncated representation)
+// is present in storage and not expired
+func (l *List) contains(ctx context.Context, hash bittorrent.InfoHash) (contains bool) {
+	keys := []string{hash.RawString()}
+	if len(hash) == bittorrent.InfoHashV2Len {
+		keys = append(keys, hash.TruncateV1().RawString())
+	}
+	values, err := storage.LoadMany(ctx, l.Storage, l.StorageCtx, keys...)
+	if err != nil {
+		logger.Error().Err(err).Stringer("infoHash", hash).Msg("unable load hash information from storage")
+	}
+	now := timecache.NowUnix()
+	for _, v := range values {
+		if v != nil && !expired(v, now) {
+			contains = true
+			break
+		}
+	}
+	return
+}
+
 // Approved checks if specified hash is approved or not.
 // If List.Invert set to true and hash found in storage, function will return false,
 // that means that hash is blacklisted.
-func (l *List) Approved(ctx context.Context, hash bittorrent.InfoHash) (contains bool) {
-	var err error
-	if contains, err = l.Storage.Contains(ctx, l.StorageCtx, hash.RawString()); err == nil {
-		if len(hash) == bittorrent.InfoHashV2Len {
-			if containsV2, errV2 := l.Storage.Contains(ctx, l.StorageCtx, hash.TruncateV1().RawString()); err == nil {
-				contains = contains || containsV2
-			} else {
-				err = errV2
-			}
+func (l *List) Approved(ctx context.Context, hash bittorrent.InfoHash) bool {
+	return l.contains(ctx, hash) != l.Invert
+}
+
+// Decide returns container.Allow if hash found in white list,
+// container.Deny if hash found in black list or
+// container.Unknown if hash not found (see container.Decider).
+func (l *List) Decide(ctx context.Context, hash bittorrent.InfoHash) (d container.Decision) {
+	if l.contains(ctx, hash) {
+		if l.Invert {
+			d = container.Deny
+		} else {
+			d = container.Allow
 		}
 	}
+	return
+}
+
+// ApprovedMany checks if each of provided hashes approved or not
+// with one storage request (see storage.LoadMany).
+// If storage returned error, hashes considered not found in storage
+// (the same behaviour as Approved).
+func (l *List) ApprovedMany(ctx context.Context, hashes bittorrent.InfoHashes) []bool {
+	keys := make([]string, 0, len(hashes))
+	for _, ih := range hashes {
+		keys = append(keys, ih.RawString())
+		if len(ih) == bittorrent.InfoHashV2Len {
+			keys = append(keys, ih.TruncateV1().RawString())
+		}
+	}
+	approved := make([]bool, len(hashes))
+	values, err := storage.LoadMany(ctx, l.Storage, l.StorageCtx, keys...)
 	if err != nil {
-		logger.Error().Err(err).Stringer("infoHash", hash).Msg("unable load hash information from storage")
+		logger.Error().Err(err).Array("infoHashes", hashes).Msg("unable load hashes information from storage")
+		for i := range approved {
+			approved[i] = l.Invert
+		}
+		return approved
+	}
+	now := timecache.NowUnix()
+	found := func(v []byte) bool {
+		return v != nil && !expired(v, now)
+	}
+	for i, j := 0, 0; i < len(hashes); i++ {
+		contains := found(values[j])
+		if j++; len(hashes[i]) == bittorrent.InfoHashV2Len {
+			contains = contains || found(values[j])
+			j++
+		}
+		approved[i] = contains != l.Invert
 	}
-	return contains != l.Invert
+	return approved
 }
@@ -14,6 +14,9 @@ import (
 	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/storage"
 
+	// import composite container to enable appropriate support
+	_ "github.com/sot-tech/mochi/middleware/torrentapproval/container/composite"
+
 	// import directory watcher to enable appropriate support
 	_ "github.com/sot-tech/mochi/middleware/torrentapproval/container/directory"
 
@@ -26,6 +29,19 @@ const Name = "torrent approval"
 
 const internalStore = "internal"
 
+// Scrape handling modes
+const (
+	// ScrapeFilter removes unapproved hashes from scrape request,
+	// so they will be absent in response.
+	// Note: UDP scrape response has no hashes, only statistics in
+	// the same order as requested, so for UDP requests (see
+	// bittorrent.ScrapeRequest.Positional) statistics are replaced
+	// with zeros as in ScrapeZero mode.
+	ScrapeFilter = "filter"
+	// ScrapeZero replaces statistics of unapproved hashes with zeros
+	ScrapeZero = "zero"
+)
+
 func init() {
 	middleware.RegisterBuilder(Name, build)
 }
@@ -39,6 +55,9 @@ type baseConfig struct {
 	Storage conf.NamedMapConfig
 	// Configuration depends on used container
 	Configuration conf.MapConfig
+	// HandleScrape sets mode of scrape requests processing:
+	// empty (scrapes are not checked), `filter` or `zero`
+	HandleScrape string `cfg:"handle_scrape"`
 }
 
 func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, err error) {
@@ -59,6 +78,12 @@ func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, er
 		return nil, errors.New("preserve option is deprecated, use store parameter")
 	}
 
+	switch cfg.HandleScrape {
+	case "", ScrapeFilter, ScrapeZero:
+	default:
+		return nil, fmt.Errorf("invalid config for middleware %s: unknown scrape mode '%s'", Name, cfg.HandleScrape)
+	}
+
 	var ds, dsc storage.DataStorage
 	if len(cfg.Storage.Name) == 0 || cfg.Storage.Name == internalStore {
 		ds = st
@@ -70,7 +95,7 @@ func build(config conf.MapConfig, st storage.PeerStorage) (h middleware.Hook, er
 
 	var c container.Container
 	if c, err = container.GetContainer(cfg.Source, cfg.Configuration, ds); err == nil {
-		h = &hook{c, dsc}
+		h = &hook{c, dsc, cfg.HandleScrape}
 	}
 	return h, err
 }
@@ -81,6 +106,7 @@ var ErrTorrentUnapproved = bittorrent.ClientError("torrent not allowed by mochi"
 type hook struct {
 	hashContainer   container.Container
 	providedStorage storage.DataStorage
+	scrapeMode      string
 }
 
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, _ *bittorrent.AnnounceResponse) (context.Context, error) {
@@ -93,8 +119,39 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 	return ctx, err
 }
 
-func (h *hook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
-	// Scrapes don't require any protection.
+// HandleScrape removes unapproved hashes from request
+// if scrape mode is ScrapeFilter and request is not positional
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.scrapeMode == ScrapeFilter && !req.Positional && len(req.InfoHashes) > 0 {
+		approved := container.ApprovedMany(ctx, h.hashContainer, req.InfoHashes)
+		filtered := make(bittorrent.InfoHashes, 0, len(req.InfoHashes))
+		for i, ih := range req.InfoHashes {
+			if approved[i] {
+				filtered = append(filtered, ih)
+			}
+		}
+		req.InfoHashes = filtered
+	}
+	return ctx, nil
+}
+
+// ModifyScrapeResponse replaces statistics of unapproved hashes
+// with zeros if scrape mode is ScrapeZero, or ScrapeFilter and
+// request is positional (see middleware.ScrapeResponseModifier).
+func (h *hook) ModifyScrapeResponse(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	zero := h.scrapeMode == ScrapeZero || (h.scrapeMode == ScrapeFilter && req.Positional)
+	if zero && len(resp.Data) > 0 {
+		hashes := make(bittorrent.InfoHashes, len(resp.Data))
+		for i, s := range resp.Data {
+			hashes[i] = s.InfoHash
+		}
+		approved := container.ApprovedMany(ctx, h.hashContainer, hashes)
+		for i := range resp.Data {
+			if !approved[i] {
+				resp.Data[i] = bittorrent.Scrape{InfoHash: resp.Data[i].InfoHash}
+			}
+		}
+	}
 	return ctx, nil
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -99,3 +100,147 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleScrape(t *testing.T) {
+	storage, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	for _, mode := range []string{ScrapeFilter, ScrapeZero} {
+		for _, tt := range cases {
+			t.Run(fmt.Sprintf("%s hash %s", mode, tt.ih), func(t *testing.T) {
+				cfg := conf.MapConfig{
+					"initial_source": tt.cfg.Source,
+					"configuration":  tt.cfg.Configuration,
+					"handle_scrape":  mode,
+				}
+				h, err := build(cfg, storage)
+				require.Nil(t, err)
+				defer h.(*hook).Close()
+
+				ih, err := bittorrent.NewInfoHashString(tt.ih)
+				require.Nil(t, err)
+				ctx := context.Background()
+				req := &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{ih}}
+				resp := &bittorrent.ScrapeResponse{}
+
+				_, err = h.HandleScrape(ctx, req, resp)
+				require.Nil(t, err)
+				if mode == ScrapeFilter {
+					if tt.approved {
+						require.Equal(t, bittorrent.InfoHashes{ih}, req.InfoHashes)
+					} else {
+						require.Empty(t, req.InfoHashes)
+					}
+					return
+				}
+				resp.Data = bittorrent.Scrapes{{InfoHash: ih, Complete: 1, Incomplete: 2, Snatches: 3}}
+				_, err = h.(*hook).ModifyScrapeResponse(ctx, req, resp)
+				require.Nil(t, err)
+				if tt.approved {
+					require.Equal(t, uint32(1), resp.Data[0].Complete)
+				} else {
+					require.Equal(t, bittorrent.Scrape{InfoHash: ih}, resp.Data[0])
+				}
+			})
+		}
+	}
+}
+
+func TestHandleScrapeFilterUDP(t *testing.T) {
+	storage, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	h, err := build(conf.MapConfig{
+		"initial_source": "list",
+		"configuration":  conf.MapConfig{"hash_list": []string{"3532cf2d327fad8448c075b4cb42c8136964a435"}},
+		"handle_scrape":  ScrapeFilter,
+	}, storage)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	unapproved, err := bittorrent.NewInfoHashString("4532cf2d327fad8448c075b4cb42c8136964a435")
+	require.Nil(t, err)
+	approved, err := bittorrent.NewInfoHashString("3532cf2d327fad8448c075b4cb42c8136964a435")
+	require.Nil(t, err)
+	ctx := context.Background()
+	// UDP response is matched with request by position, so hashes must not be removed
+	req := &bittorrent.ScrapeRequest{InfoHashes: bittorrent.InfoHashes{unapproved, approved}, Positional: true}
+	resp := &bittorrent.ScrapeResponse{}
+	_, err = h.HandleScrape(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.InfoHashes{unapproved, approved}, req.InfoHashes)
+
+	resp.Data = bittorrent.Scrapes{
+		{InfoHash: unapproved, Complete: 1, Incomplete: 2, Snatches: 3},
+		{InfoHash: approved, Complete: 4, Incomplete: 5, Snatches: 6},
+	}
+	_, err = h.(*hook).ModifyScrapeResponse(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, bittorrent.Scrapes{
+		{InfoHash: unapproved},
+		{InfoHash: approved, Complete: 4, Incomplete: 5, Snatches: 6},
+	}, resp.Data)
+}
+
+func TestCompositeContainer(t *testing.T) {
+	storage, err := memory.Builder{}.NewPeerStorage(make(conf.MapConfig))
+	require.Nil(t, err)
+	const (
+		whitelisted = "1000000000000000000000000000000000000000"
+		blacklisted = "2000000000000000000000000000000000000000"
+		promo       = "3000000000000000000000000000000000000000"
+		expired     = "4000000000000000000000000000000000000000"
+		unknown     = "5000000000000000000000000000000000000000"
+	)
+	cfg := conf.MapConfig{
+		"initial_source": "composite",
+		"configuration": map[string]any{
+			"containers": []any{
+				map[string]any{
+					"name":   "main",
+					"source": "list",
+					"configuration": map[string]any{
+						"hash_list": []string{whitelisted, blacklisted},
+					},
+				},
+				map[string]any{
+					"name":   "emergency",
+					"source": "list",
+					"configuration": map[string]any{
+						"hash_list": []string{blacklisted},
+						"invert":    true,
+					},
+				},
+				map[string]any{
+					"name":   "promo",
+					"source": "list",
+					"configuration": map[string]any{
+						"temporary_hash_list": map[string]string{
+							promo:   time.Now().Add(time.Hour).Format(time.RFC3339),
+							expired: time.Now().Add(-time.Hour).Format(time.RFC3339),
+						},
+					},
+				},
+			},
+			"precedence": []string{"emergency", "main", "promo"},
+		},
+	}
+	h, err := build(cfg, storage)
+	require.Nil(t, err)
+	defer h.(*hook).Close()
+
+	for ihs, approved := range map[string]bool{
+		whitelisted: true,
+		blacklisted: false,
+		promo:       true,
+		expired:     false,
+		unknown:     false,
+	} {
+		ih, err := bittorrent.NewInfoHashString(ihs)
+		require.Nil(t, err)
+		_, err = h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, nil)
+		if approved {
+			require.Nil(t, err, ihs)
+		} else {
+			require.Equal(t, ErrTorrentUnapproved, err, ihs)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+type exclusionKey struct{}
+
+// Exclusion is the hint for PeerStorage.AnnouncePeers, which peers
+// should not be returned. Drivers may ignore it, so caller
+// should filter returned peers anyway.
+type Exclusion struct {
+	// Peers are excluded by peer ID and address (port is not compared)
+	Peers []bittorrent.Peer
+	// Addrs excludes all peers with these addresses
+	Addrs []netip.Addr
+}
+
+// IsEmpty returns true if nothing is excluded
+func (e Exclusion) IsEmpty() bool {
+	return len(e.Peers) == 0 && len(e.Addrs) == 0
+}
+
+// Excludes checks if peer should not be returned
+func (e Exclusion) Excludes(p bittorrent.Peer) bool {
+	addr := p.Addr()
+	for _, x := range e.Peers {
+		if x.ID == p.ID && x.Addr() == addr {
+			return true
+		}
+	}
+	return slices.Contains(e.Addrs, addr)
+}
+
+// Filter removes excluded peers from provided slice (in place)
+func (e Exclusion) Filter(peers []bittorrent.Peer) []bittorrent.Peer {
+	if e.IsEmpty() {
+		return peers
+	}
+	return slices.DeleteFunc(peers, e.Excludes)
+}
+
+// WithExclusion returns context with exclusion hint for PeerStorage.AnnouncePeers
+func WithExclusion(ctx context.Context, e Exclusion) context.Context {
+	return context.WithValue(ctx, exclusionKey{}, e)
+}
+
+// ExclusionFromContext returns exclusion hint set by WithExclusion
+// or empty Exclusion
+func ExclusionFromContext(ctx context.Context) (e Exclusion) {
+	if ctx != nil {
+		e, _ = ctx.Value(exclusionKey{}).(Exclusion)
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promOperationDurationMilliseconds,
+		promOperationErrorsTotal,
+	)
+}
+
+var (
+	promOperationDurationMilliseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "mochi_storage_operation_duration_milliseconds",
+			Help:    "The time it takes to perform storage operation",
+			Buckets: prometheus.ExponentialBuckets(0.125, 2, 16),
+		},
+		[]string{"driver", "operation"},
+	)
+
+	promOperationErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mochi_storage_operation_errors_total",
+			Help: "The number of failed storage operations",
+		},
+		[]string{"driver", "operation"},
+	)
+)
+
+// instrumentedData is the DataStorage decorator, which records
+// duration and errors of each operation and logs slow operations
+type instrumentedData struct {
+	DataStorage
+	driver        string
+	slowThreshold time.Duration
+}
+
+// observe records duration of operation started at start.
+// ErrResourceDoesNotExist is not considered as error.
+func (d instrumentedData) observe(op string, start time.Time, err error) {
+	duration := time.Since(start)
+	promOperationDurationMilliseconds.
+		WithLabelValues(d.driver, op).
+		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+	if err != nil && !errors.Is(err, ErrResourceDoesNotExist) {
+		promOperationErrorsTotal.WithLabelValues(d.driver, op).Inc()
+	}
+	if d.slowThreshold > 0 && duration >= d.slowThreshold {
+		logger.Warn().
+			Str("driver", d.driver).
+			Str("operation", op).
+			Dur("duration", duration).
+			Dur("threshold", d.slowThreshold).
+			Err(err).
+			Msg("slow storage operation")
+	}
+}
+
+func (d instrumentedData) Put(ctx context.Context, storeCtx string, values ...Entry) (err error) {
+	defer func(start time.Time) { d.observe("put", start, err) }(time.Now())
+	return d.DataStorage.Put(ctx, storeCtx, values...)
+}
+
+func (d instrumentedData) Contains(ctx context.Context, storeCtx string, key string) (contains bool, err error) {
+	defer func(start time.Time) { d.observe("contains", start, err) }(time.Now())
+	return d.DataStorage.Contains(ctx, storeCtx, key)
+}
+
+func (d instrumentedData) Load(ctx context.Context, storeCtx string, key string) (value []byte, err error) {
+	defer func(start time.Time) { d.observe("load", start, err) }(time.Now())
+	return d.DataStorage.Load(ctx, storeCtx, key)
+}
+
+func (d instrumentedData) Delete(ctx context.Context, storeCtx string, keys ...string) (err error) {
+	defer func(start time.Time) { d.observe("delete", start, err) }(time.Now())
+	return d.DataStorage.Delete(ctx, storeCtx, keys...)
+}
+
+// LoadMany calls LoadMany of decorated storage,
+// so bulk load is still used if storage supports it
+func (d instrumentedData) LoadMany(ctx context.Context, storeCtx string, keys ...string) (values [][]byte, err error) {
+	defer func(start time.Time) { d.observe("load_many", start, err) }(time.Now())
+	return LoadMany(ctx, d.DataStorage, storeCtx, keys...)
+}
+
+// instrumentedPeers is the PeerStorage decorator, see instrumentedData
+type instrumentedPeers struct {
+	instrumentedData
+	ps PeerStorage
+}
+
+func (p instrumentedPeers) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	defer func(start time.Time) { p.observe("put_seeder", start, err) }(time.Now())
+	return p.ps.PutSeeder(ctx, ih, peer)
+}
+
+func (p instrumentedPeers) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	defer func(start time.Time) { p.observe("delete_seeder", start, err) }(time.Now())
+	return p.ps.DeleteSeeder(ctx, ih, peer)
+}
+
+func (p instrumentedPeers) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	defer func(start time.Time) { p.observe("put_leecher", start, err) }(time.Now())
+	return p.ps.PutLeecher(ctx, ih, peer)
+}
+
+func (p instrumentedPeers) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	defer func(start time.Time) { p.observe("delete_leecher", start, err) }(time.Now())
+	return p.ps.DeleteLeecher(ctx, ih, peer)
+}
+
+func (p instrumentedPeers) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) (err error) {
+	defer func(start time.Time) { p.observe("graduate_leecher", start, err) }(time.Now())
+	return p.ps.GraduateLeecher(ctx, ih, peer)
+}
+
+func (p instrumentedPeers) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	defer func(start time.Time) { p.observe("announce_peers", start, err) }(time.Now())
+	return p.ps.AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (p instrumentedPeers) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
+	defer func(start time.Time) { p.observe("scrape_swarm", start, err) }(time.Now())
+	return p.ps.ScrapeSwarm(ctx, ih)
+}
+
+func (p instrumentedPeers) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { p.observe("ping", start, err) }(time.Now())
+	return p.ps.Ping(ctx)
+}
+
+// instrumentedIterator is the decorator of PeerStorage, which implements Iterator.
+// Separate type used to not to report Iterator support if decorated storage
+// does not support it.
+type instrumentedIterator struct {
+	instrumentedPeers
+	it Iterator
+}
+
+func (i instrumentedIterator) ScanSwarms(ctx context.Context, cursor string, fn func(SwarmInfo) bool) (next string, err error) {
+	defer func(start time.Time) { i.observe("scan_swarms", start, err) }(time.Now())
+	return i.it.ScanSwarms(ctx, cursor, fn)
+}
+
+func (i instrumentedIterator) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (next string, err error) {
+	defer func(start time.Time) { i.observe("scan_peers", start, err) }(time.Now())
+	return i.it.ScanPeers(ctx, ih, cursor, fn)
+}
+
+// instrumentDataStorage wraps DataStorage with decorator, which records
+// operations latency and errors to prometheus with driver label
+// and logs operations, which took longer than slowThreshold (if set)
+func instrumentDataStorage(ds DataStorage, driver string, slowThreshold time.Duration) DataStorage {
+	return instrumentedData{DataStorage: ds, driver: driver, slowThreshold: slowThreshold}
+}
+
+// instrumentPeerStorage is the same as instrumentDataStorage, but for PeerStorage.
+// Note: returned storage does not implement GarbageCollector and
+// StatisticsCollector, so they should be scheduled before wrapping.
+func instrumentPeerStorage(ps PeerStorage, driver string, slowThreshold time.Duration) PeerStorage {
+	ips := instrumentedPeers{
+		instrumentedData: instrumentedData{DataStorage: ps, driver: driver, slowThreshold: slowThreshold},
+		ps:               ps,
+	}
+	if it, isOk := ps.(Iterator); isOk {
+		return instrumentedIterator{instrumentedPeers: ips, it: it}
+	}
+	return ips
+}
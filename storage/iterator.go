@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// ErrInvalidCursor returned by Iterator methods if provided cursor
+// can not be parsed
+var ErrInvalidCursor = errors.New("invalid iteration cursor")
+
+// SwarmInfo holds info hash and peers count of stored swarm
+type SwarmInfo struct {
+	InfoHash bittorrent.InfoHash
+	Seeders  uint32
+	Leechers uint32
+	// Snatches is downloads count, filling is optional (see PeerStorage.ScrapeSwarm)
+	Snatches uint32
+}
+
+// Iterator marks that PeerStorage supports enumeration of stored
+// swarms and peers, which can be used for full scrape, administration
+// or migration between storages.
+//
+// Iteration is not a snapshot: swarms and peers, which added or deleted
+// while iterating, may or may not be returned, and some drivers may return
+// the same swarm or peer more than once.
+type Iterator interface {
+	// ScanSwarms calls fn for each stored swarm, starting from the position
+	// defined by cursor (empty cursor - from the beginning) until fn returns false,
+	// ctx is done or all swarms are iterated.
+	// Swarms of IPv4 and IPv6 peers with the same info hash are reported once
+	// with summarized counts.
+	// Returns cursor, which may be provided to the next call to continue
+	// iteration after the last swarm passed to fn, or empty string if all
+	// swarms are iterated. Note: iteration with returned cursor may return nothing.
+	ScanSwarms(ctx context.Context, cursor string, fn func(SwarmInfo) bool) (next string, err error)
+
+	// ScanPeers calls fn for each peer of swarm identified by the provided
+	// InfoHash in the same manner as ScanSwarms.
+	ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(p bittorrent.Peer, seeder bool) bool) (next string, err error)
+}
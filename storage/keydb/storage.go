@@ -22,7 +22,11 @@ import (
 	r "github.com/sot-tech/mochi/storage/redis"
 )
 
-const expireMemberCmd = "EXPIREMEMBER"
+const (
+	expireMemberCmd = "EXPIREMEMBER"
+	// iterateBatchSize is the COUNT hint for SCAN-family commands
+	iterateBatchSize = 100
+)
 
 var (
 	logger = log.NewLogger("storage/keydb")
@@ -184,3 +188,24 @@ func (s *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32
 		Msg("scrape swarm")
 	return s.ScrapeIH(ctx, ih, s.SCard)
 }
+
+// peersKeysPattern matches all IPv4/IPv6 seeders/leechers keys
+var peersKeysPattern = r.IH4SeederKey[:len(r.IH4SeederKey)-3] + "[SL][46]_*"
+
+var _ storage.Iterator = &store{}
+
+// ScanSwarms is the same function as redis.ScanSwarms, except info hash keys
+// are obtained with `SCAN` instead of `SSCAN` of info hash set
+// Note: in cluster mode `SCAN` iterates only keys of one node.
+func (s *store) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	return s.Connection.ScanSwarms(ctx, cursor, func(ctx context.Context, _ string, cursor uint64) ([]string, uint64, error) {
+		return s.Scan(ctx, cursor, peersKeysPattern, iterateBatchSize).Result()
+	}, s.SCard, fn)
+}
+
+// ScanPeers is the same function as redis.ScanPeers except `SSCAN` call instead of `HSCAN`
+func (s *store) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	return s.Connection.ScanPeers(ctx, ih, cursor, func(ctx context.Context, key string, cursor uint64) ([]string, uint64, error) {
+		return s.SScan(ctx, key, cursor, "", iterateBatchSize).Result()
+	}, fn)
+}
@@ -0,0 +1,153 @@
+//go:build cgo
+
+package mdb
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// iterateBatchSize is the number of swarms read in one transaction
+const iterateBatchSize = 100
+
+// swarmPrefixes are peer key prefixes in lexicographical order
+var swarmPrefixes = [...][2]byte{
+	{leecherPrefix, ipv4Prefix},
+	{leecherPrefix, ipv6Prefix},
+	{seederPrefix, ipv4Prefix},
+	{seederPrefix, ipv6Prefix},
+}
+
+var _ storage.Iterator = &mdb{}
+
+// isFirstGroup checks if there are no keys of the same info hash
+// with lesser prefix, so swarm is reported only once
+func isFirstGroup(cur *lmdb.Cursor, group []byte) bool {
+	probe := make([]byte, len(group)+1)
+	copy(probe, group)
+	probe[len(group)] = keySeparator
+	for _, p := range swarmPrefixes {
+		if p[0] == group[0] && p[1] == group[1] {
+			return true
+		}
+		probe[0], probe[1] = p[0], p[1]
+		if k, _, err := cur.Get(probe, nil, lmdb.SetRange); err == nil && bytes.HasPrefix(k, probe) {
+			return false
+		}
+	}
+	return true
+}
+
+// swarmGroups returns up to limit key prefixes (`<PREFIX>_<INFOHASH>`)
+// of distinct swarms, starting from seek key
+func (m *mdb) swarmGroups(ctx context.Context, seek []byte, limit int) (groups [][]byte, err error) {
+	m.wg.Add(1)
+	defer m.wg.Done()
+	err = m.View(func(txn *lmdb.Txn) (err error) {
+		txn.RawRead = true
+		var cur, check *lmdb.Cursor
+		if cur, err = txn.OpenCursor(m.peersDB); err != nil {
+			return
+		}
+		defer cur.Close()
+		if check, err = txn.OpenCursor(m.peersDB); err != nil {
+			return
+		}
+		defer check.Close()
+		var k []byte
+		if len(seek) == 0 {
+			k, _, err = cur.Get(nil, nil, lmdb.First)
+		} else {
+			k, _, err = cur.Get(seek, nil, lmdb.SetRange)
+		}
+		for err == nil && len(groups) < limit {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			if !isPeerKey(k) {
+				k, _, err = cur.Get(nil, nil, lmdb.Next)
+				continue
+			}
+			group := bytes.Clone(k[:len(k)-packedPeerLen-1])
+			if isFirstGroup(check, group) {
+				groups = append(groups, group)
+			}
+			// skip all keys of the current group
+			k, _, err = cur.Get(append(group[:len(group):len(group)], keySeparator+1), nil, lmdb.SetRange)
+		}
+		return ignoreNotFound(err)
+	})
+	return
+}
+
+// ScanSwarms iterates over swarms ordered by peer key prefix and info hash.
+// Cursor is the HEX-encoded `<PREFIX>_<INFOHASH>` key part of the last returned swarm.
+func (m *mdb) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	var seek []byte
+	if len(cursor) > 0 {
+		var err error
+		if seek, err = hex.DecodeString(cursor); err != nil || len(seek) < 3 {
+			return "", storage.ErrInvalidCursor
+		}
+		seek = append(seek, keySeparator+1)
+	}
+	for {
+		groups, err := m.swarmGroups(ctx, seek, iterateBatchSize)
+		if err != nil || len(groups) == 0 {
+			return "", err
+		}
+		for _, g := range groups {
+			si := storage.SwarmInfo{InfoHash: bittorrent.InfoHash(g[3:])}
+			if si.Leechers, si.Seeders, si.Snatches, err = m.ScrapeSwarm(ctx, si.InfoHash); err != nil {
+				return "", err
+			}
+			if !fn(si) {
+				return hex.EncodeToString(g), nil
+			}
+		}
+		last := groups[len(groups)-1]
+		seek = append(last[:len(last):len(last)], keySeparator+1)
+	}
+}
+
+// ScanPeers iterates over peers ordered by key.
+// Cursor is the HEX-encoded key of the last returned peer.
+func (m *mdb) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (next string, err error) {
+	var from []byte
+	if len(cursor) > 0 {
+		if from, err = hex.DecodeString(cursor); err != nil {
+			return "", storage.ErrInvalidCursor
+		}
+		from = append(from, 0)
+	}
+	for _, p := range swarmPrefixes {
+		seeder := p[0] == seederPrefix
+		prefix, prefixLen := composeIHKeyPrefix(ih.Bytes(), seeder, p[1] == ipv6Prefix, 0)
+		if len(from) > 0 && !bytes.HasPrefix(from, prefix) {
+			if bytes.Compare(from, prefix) > 0 {
+				// cursor points to the next prefix
+				continue
+			}
+			from = nil
+		}
+		start := from
+		from = nil
+		var stopped bool
+		err = m.scanPeers(ctx, prefix, start, true, func(k, _ []byte) bool {
+			if !fn(unpackPeer(k[prefixLen:]), seeder) {
+				next, stopped = hex.EncodeToString(k), true
+			}
+			return !stopped
+		})
+		if err != nil || stopped {
+			return
+		}
+	}
+	return "", nil
+}
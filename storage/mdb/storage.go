@@ -30,6 +30,7 @@ const (
 	defaultMode       = 0o640
 	defaultMapSize    = 1 << 30
 	defaultMaxReaders = 126
+	defaultSnatchTTL  = 24 * time.Hour
 )
 
 var logger = log.NewLogger("storage/lmdb")
@@ -69,6 +70,8 @@ type config struct {
 	AsyncWrite bool `cfg:"async_write"`
 	// NoMetaSync sets MDB_NOMETASYNC flag, omit the metadata flush.
 	NoMetaSync bool `cfg:"no_sync_meta"`
+	// SnatchTTL - time snatch counter is kept after swarm became empty.
+	SnatchTTL time.Duration `cfg:"snatch_ttl"`
 }
 
 var (
@@ -109,6 +112,14 @@ func (cfg config) validate() (config, error) {
 			Int("default", 126).
 			Msg("falling back to default configuration")
 	}
+	if cfg.SnatchTTL <= 0 {
+		validCfg.SnatchTTL = defaultSnatchTTL
+		logger.Warn().
+			Str("name", "snatch_ttl").
+			Dur("provided", cfg.SnatchTTL).
+			Dur("default", validCfg.SnatchTTL).
+			Msg("falling back to default configuration")
+	}
 	return validCfg, nil
 }
 
@@ -127,6 +138,7 @@ type lmdbEnv interface {
 type mdb struct {
 	lmdbEnv
 	dataDB, peersDB lmdb.DBI
+	snatchTTL       time.Duration
 	onceCloser      sync.Once
 	closed          chan any
 	wg              sync.WaitGroup
@@ -195,10 +207,11 @@ func newStorage(cfg config) (*mdb, error) {
 	}
 
 	return &mdb{
-		lmdbEnv: env,
-		dataDB:  dataDB,
-		peersDB: peersDB,
-		closed:  make(chan any),
+		lmdbEnv:   env,
+		dataDB:    dataDB,
+		peersDB:   peersDB,
+		snatchTTL: cfg.SnatchTTL,
+		closed:    make(chan any),
 	}, nil
 }
 
@@ -283,6 +296,19 @@ func (m *mdb) Load(_ context.Context, storeCtx string, key string) (v []byte, er
 	return
 }
 
+func (m *mdb) LoadMany(_ context.Context, storeCtx string, keys ...string) (values [][]byte, err error) {
+	values = make([][]byte, len(keys))
+	err = m.View(func(txn *lmdb.Txn) (err error) {
+		for i, k := range keys {
+			if values[i], err = ignoreNotFoundData(txn.Get(m.dataDB, composeKey(storeCtx, k))); err != nil {
+				break
+			}
+		}
+		return
+	})
+	return
+}
+
 func (m *mdb) Delete(_ context.Context, storeCtx string, keys ...string) (err error) {
 	if len(keys) > 0 {
 		err = m.Update(func(txn *lmdb.Txn) (err error) {
@@ -306,6 +332,8 @@ const (
 	ipv6Prefix       = '6'
 	countPrefix      = 'C'
 	downloadedPrefix = 'D'
+	// downloaded count value: count (4 bytes) + last swarm activity unix time (8 bytes)
+	downloadedValLen = 4 + 8
 )
 
 func packPeer(peer bittorrent.Peer, out []byte) {
@@ -397,7 +425,8 @@ func (m *mdb) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, peer bi
 		if b, err = txn.PutReserve(m.peersDB, ihKey, 8, 0); err != nil {
 			return
 		}
-		binary.BigEndian.PutUint64(b, uint64(timecache.NowUnixNano()))
+		now := timecache.NowUnix()
+		binary.BigEndian.PutUint64(b, uint64(now))
 
 		ihPrefix := ihKey[:len(ihKey)-packedPeerLen]
 		ihPrefix[0], ihPrefix[1] = downloadedPrefix, countPrefix
@@ -409,24 +438,31 @@ func (m *mdb) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, peer bi
 			v = int(binary.BigEndian.Uint32(b))
 		}
 		v++
-		if b, err = txn.PutReserve(m.peersDB, ihPrefix, 4, 0); err == nil {
+		if b, err = txn.PutReserve(m.peersDB, ihPrefix, downloadedValLen, 0); err == nil {
 			binary.BigEndian.PutUint32(b, uint32(v))
+			binary.BigEndian.PutUint64(b[4:], uint64(now))
 		}
 		return
 	})
 }
 
-func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn func(k, v []byte) bool) (err error) {
+// scanPeers calls fn for each key with provided prefix, starting from
+// the key not less than from (if set) or prefix
+func (m *mdb) scanPeers(ctx context.Context, prefix, from []byte, readRaw bool, fn func(k, v []byte) bool) (err error) {
 	m.wg.Add(1)
 	prefixLen := len(prefix)
+	seek := prefix
+	if len(from) > 0 {
+		seek = from
+	}
 	err = m.View(func(txn *lmdb.Txn) (err error) {
 		txn.RawRead = readRaw
 		scanner := lmdbscan.New(txn, m.peersDB)
 		var op uint = lmdb.SetRange
-		if prefixLen == 0 {
+		if len(seek) == 0 {
 			op = lmdb.First
 		}
-		if scanner.SetNext(prefix, nil, op, lmdb.Next) {
+		if scanner.SetNext(seek, nil, op, lmdb.Next) {
 		loop:
 			for scanner.Scan() {
 				select {
@@ -460,18 +496,23 @@ func (m *mdb) scanPeers(ctx context.Context, prefix []byte, readRaw bool, fn fun
 func (m *mdb) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
 	peers = make([]bittorrent.Peer, 0, numWant)
 	prefix, prefixLen := composeIHKeyPrefix(ih.Bytes(), false, v6, 0)
+	excl := storage.ExclusionFromContext(ctx)
 	appendFn := func(k, _ []byte) bool {
-		peers = append(peers, unpackPeer(k[prefixLen:]))
+		p := unpackPeer(k[prefixLen:])
+		if excl.Excludes(p) {
+			return true
+		}
+		peers = append(peers, p)
 		numWant--
 		return numWant > 0
 	}
 	if forSeeder {
-		err = m.scanPeers(ctx, prefix, true, appendFn)
+		err = m.scanPeers(ctx, prefix, nil, true, appendFn)
 	} else {
 		prefix[0] = seederPrefix
-		if err = m.scanPeers(ctx, prefix, true, appendFn); err == nil && numWant > 0 {
+		if err = m.scanPeers(ctx, prefix, nil, true, appendFn); err == nil && numWant > 0 {
 			prefix[0] = leecherPrefix
-			err = m.scanPeers(ctx, prefix, true, appendFn)
+			err = m.scanPeers(ctx, prefix, nil, true, appendFn)
 		}
 	}
 	return
@@ -545,23 +586,80 @@ const (
 	v2IHKeyPen = bittorrent.InfoHashV2Len + 4 + packedPeerLen
 )
 
+func isPeerKey(k []byte) bool {
+	l := len(k)
+	return (l == v1IHKeyLen || l == v2IHKeyPen) &&
+		(k[0] == seederPrefix || k[0] == leecherPrefix) &&
+		(k[1] == ipv4Prefix || k[1] == ipv6Prefix) &&
+		k[2] == keySeparator
+}
+
+func isDownloadedKey(k []byte) bool {
+	l := len(k)
+	return (l == v1IHKeyLen-packedPeerLen || l == v2IHKeyPen-packedPeerLen) &&
+		k[0] == downloadedPrefix && k[1] == countPrefix &&
+		k[2] == keySeparator && k[l-1] == keySeparator
+}
+
+// gc deletes peers, which were not announced after cutoff, and downloaded
+// counters of swarms, which are empty longer than snatchTTL.
+// Activity time of downloaded counters of non-empty swarms is updated.
 func (m *mdb) gc(cutoff time.Time) {
 	toDel := make([][]byte, 0, 50)
+	var downloaded [][]byte
+	alive := make(map[string]struct{})
 	cutoffUnix := cutoff.Unix()
-	err := m.scanPeers(context.Background(), nil, false, func(k, v []byte) bool {
-		if l := len(k); (l == v1IHKeyLen || l == v2IHKeyPen) &&
-			(k[0] == seederPrefix || k[0] == leecherPrefix) &&
-			(k[1] == ipv4Prefix || k[1] == ipv6Prefix) &&
-			k[2] == keySeparator && len(v) >= 8 && cutoffUnix >= int64(binary.BigEndian.Uint64(v)) {
-			toDel = append(toDel, k)
+	err := m.scanPeers(context.Background(), nil, nil, false, func(k, v []byte) bool {
+		if isPeerKey(k) {
+			if len(v) >= 8 && cutoffUnix >= int64(binary.BigEndian.Uint64(v)) {
+				toDel = append(toDel, k)
+			} else {
+				alive[string(k[3:len(k)-packedPeerLen-1])] = struct{}{}
+			}
+		} else if isDownloadedKey(k) {
+			downloaded = append(downloaded, k)
 		}
 		return true
 	})
 	if err == nil {
+		now := timecache.NowUnix()
+		snatchCutoff := now - int64(m.snatchTTL.Seconds())
+		// activity time is updated not often than half of TTL to reduce writes
+		refreshCutoff := now - int64(m.snatchTTL.Seconds())/2
 		err = m.Update(func(txn *lmdb.Txn) (err error) {
 			for _, k := range toDel {
 				if err = txn.Del(m.peersDB, k, nil); err != nil {
-					break
+					return
+				}
+			}
+			for _, k := range downloaded {
+				var b []byte
+				if b, err = ignoreNotFoundData(txn.Get(m.peersDB, k)); err != nil {
+					return
+				}
+				if len(b) < 4 {
+					continue
+				}
+				var mtime int64
+				if len(b) >= downloadedValLen {
+					mtime = int64(binary.BigEndian.Uint64(b[4:]))
+				}
+				_, isAlive := alive[string(k[3:len(k)-1])]
+				switch {
+				case isAlive && mtime > refreshCutoff:
+				case isAlive || mtime == 0:
+					// value without activity time is written by previous versions,
+					// counter is kept until next period
+					cnt := binary.BigEndian.Uint32(b)
+					if b, err = txn.PutReserve(m.peersDB, k, downloadedValLen, 0); err != nil {
+						return
+					}
+					binary.BigEndian.PutUint32(b, cnt)
+					binary.BigEndian.PutUint64(b[4:], uint64(now))
+				case mtime <= snatchCutoff:
+					if err = txn.Del(m.peersDB, k, nil); err != nil {
+						return
+					}
 				}
 			}
 			return
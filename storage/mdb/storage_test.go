@@ -3,10 +3,16 @@
 package mdb
 
 import (
+	"context"
 	"fmt"
+	"net/netip"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -57,3 +63,45 @@ func BenchmarkStorage(b *testing.B) {
 	cfg.Path = tmpDir
 	test.RunBenchmarks(b, createNew)
 }
+
+func TestSnatches(t *testing.T) {
+	tmpDir, err := os.MkdirTemp(tmpPath, "lmdb*")
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(tmpDir)
+	})
+	c := cfg
+	c.Path, c.SnatchTTL = tmpDir, time.Hour
+	m, err := newStorage(c)
+	require.Nil(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	ih := bittorrent.InfoHash("01234567890123456789")
+	p4 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}
+	p6 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000002")), AddrPort: netip.MustParseAddrPort("[2001:db8::1]:6881")}
+
+	require.Nil(t, m.GraduateLeecher(ctx, ih, p4))
+	require.Nil(t, m.GraduateLeecher(ctx, ih, p6))
+	_, seeders, snatched, err := m.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), seeders)
+	require.Equal(t, uint32(2), snatched)
+
+	// swarm is alive
+	m.gc(time.Now().Add(-time.Minute))
+	_, seeders, snatched, _ = m.ScrapeSwarm(ctx, ih)
+	require.Equal(t, uint32(2), seeders)
+	require.Equal(t, uint32(2), snatched)
+
+	// swarm is empty, but not longer than TTL
+	m.gc(time.Now().Add(time.Minute))
+	_, seeders, snatched, _ = m.ScrapeSwarm(ctx, ih)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(2), snatched)
+
+	m.snatchTTL = -time.Minute
+	m.gc(time.Now())
+	_, _, snatched, _ = m.ScrapeSwarm(ctx, ih)
+	require.Zero(t, snatched)
+}
@@ -0,0 +1,122 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"slices"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+var _ storage.Iterator = &peerStore{}
+
+// ScanSwarms iterates over swarms in shard order, swarms inside shard are
+// sorted by info hash. Cursor is the HEX-encoded last returned info hash.
+func (ps *peerStore) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	var last bittorrent.InfoHash
+	var start int
+	if len(cursor) > 0 {
+		var err error
+		if last, err = bittorrent.NewInfoHashString(cursor); err != nil {
+			return "", storage.ErrInvalidCursor
+		}
+		start = int(ps.shardIndex(last, false))
+	}
+	half := len(ps.shards) / 2
+	for i := start; i < half; i++ {
+		infoHashes := make([]bittorrent.InfoHash, 0, ps.shards[i].swarms.len())
+		for _, shard := range []*peerShard{ps.shards[i], ps.shards[i+half]} {
+			shard.swarms.keys(func(ih bittorrent.InfoHash) bool {
+				if i != start || len(last) == 0 || ih > last {
+					infoHashes = append(infoHashes, ih)
+				}
+				return true
+			})
+		}
+		slices.Sort(infoHashes)
+		for _, ih := range slices.Compact(infoHashes) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			l, s := ps.countPeers(ih, false)
+			l6, s6 := ps.countPeers(ih, true)
+			if l+l6+s+s6 == 0 {
+				continue
+			}
+			if !fn(storage.SwarmInfo{
+				InfoHash: ih,
+				Seeders:  s + s6,
+				Leechers: l + l6,
+				Snatches: ps.shards[i].snatches.get(ih),
+			}) {
+				return ih.String(), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// packedPeer is the sortable peer representation, used as iteration cursor
+type packedPeer [1 + packedPeerLen]byte
+
+func newPackedPeer(p bittorrent.Peer, seeder bool) (pp packedPeer) {
+	// seeders first
+	if !seeder {
+		pp[0] = 1
+	}
+	copy(pp[1:], p.ID[:])
+	a := p.AddrPort.Addr().As16()
+	copy(pp[1+bittorrent.PeerIDLen:], a[:])
+	pp[len(pp)-2], pp[len(pp)-1] = byte(p.Port()>>8), byte(p.Port())
+	return
+}
+
+// ScanPeers iterates over sorted seeders and then leechers of swarm.
+// Cursor is the HEX-encoded seeder flag and serialized last returned peer.
+func (ps *peerStore) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	var last packedPeer
+	if len(cursor) > 0 {
+		b, err := hex.DecodeString(cursor)
+		if err != nil || len(b) != len(last) {
+			return "", storage.ErrInvalidCursor
+		}
+		copy(last[:], b)
+	}
+	type peerEntry struct {
+		packedPeer
+		bittorrent.Peer
+		seeder bool
+	}
+	var entries []peerEntry
+	for _, v6 := range []bool{false, true} {
+		if sw, ok := ps.shards[ps.shardIndex(ih, v6)].swarms.get(ih); ok {
+			for _, seeder := range []bool{true, false} {
+				list := sw.leechers
+				if seeder {
+					list = sw.seeders
+				}
+				list.keys(func(p bittorrent.Peer) bool {
+					pp := newPackedPeer(p, seeder)
+					if len(cursor) == 0 || bytes.Compare(pp[:], last[:]) > 0 {
+						entries = append(entries, peerEntry{pp, p, seeder})
+					}
+					return true
+				})
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b peerEntry) int {
+		return bytes.Compare(a.packedPeer[:], b.packedPeer[:])
+	})
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if !fn(e.Peer, e.seeder) {
+			return hex.EncodeToString(e.packedPeer[:]), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,448 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+// Snapshot file layout (all integers are big-endian or varint-encoded):
+//
+//	header:  magic (4 bytes) | version (1 byte) | creation time (unix nano, 8 bytes)
+//	records: type (1 byte) | payload
+//	         swarm: info hash length (1 byte) | info hash |
+//	                seeders count (uvarint) | seeders... |
+//	                leechers count (uvarint) | leechers...
+//	                where each peer is: ID (20 bytes) | address (16 bytes) | port (2 bytes) | mtime (varint)
+//	         snatch: info hash length (1 byte) | info hash | count (uvarint) | last activity time (varint)
+//	         data:  context length (uvarint) | context | entries count (uvarint) |
+//	                entries... where each entry is: key length (uvarint) | key | value length (uvarint) | value
+//	         end:   no payload
+//	trailer: CRC32 (IEEE) of all previous bytes (4 bytes)
+const (
+	snapshotMagic   = "MCHS"
+	snapshotVersion = 1
+
+	recordEnd    byte = 0
+	recordSwarm  byte = 1
+	recordData   byte = 2
+	recordSnatch byte = 3
+
+	packedPeerLen = bittorrent.PeerIDLen + net6Len + 2
+	net6Len       = 16
+	headerLen     = len(snapshotMagic) + 1 + 8
+	crcLen        = 4
+)
+
+var (
+	errInvalidSnapshot = errors.New("invalid snapshot")
+	errUnexpectedPeers = errors.New("peers record in data snapshot")
+)
+
+// snapshotter writes content of peer store (if set) and data store
+// into snapshot file and restores it
+type snapshotter struct {
+	path  string
+	peers *peerStore
+	data  *dataStore
+}
+
+// snapshotDataStore is the data store without peers,
+// which content is written into snapshot periodically and on close
+type snapshotDataStore struct {
+	*dataStore
+	snapshots  *snapshotter
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func (ds *snapshotDataStore) Close() (err error) {
+	ds.onceCloser.Do(func() {
+		close(ds.closed)
+		ds.wg.Wait()
+		err = ds.snapshots.write()
+	})
+	return
+}
+
+func appendPeer(out []byte, p bittorrent.Peer, mtime int64) []byte {
+	out = append(out, p.ID[:]...)
+	a := p.AddrPort.Addr().As16()
+	out = append(out, a[:]...)
+	out = binary.BigEndian.AppendUint16(out, p.Port())
+	return binary.AppendVarint(out, mtime)
+}
+
+func appendBytes(out, b []byte) []byte {
+	return append(binary.AppendUvarint(out, uint64(len(b))), b...)
+}
+
+// snapshotWriter serializes store content and calculates checksum on the fly
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (sw *snapshotWriter) flushBuf() error {
+	_, err := sw.w.Write(sw.buf)
+	sw.buf = sw.buf[:0]
+	return err
+}
+
+func (sw *snapshotWriter) writeSwarm(ih bittorrent.InfoHash, s swarm) error {
+	sw.buf = append(sw.buf, recordSwarm, byte(len(ih)))
+	sw.buf = append(sw.buf, ih...)
+	for _, pl := range []*peers{s.seeders, s.leechers} {
+		pl.RLock()
+		sw.buf = binary.AppendUvarint(sw.buf, uint64(len(pl.m)))
+		for p, mtime := range pl.m {
+			sw.buf = appendPeer(sw.buf, p, mtime)
+		}
+		pl.RUnlock()
+	}
+	return sw.flushBuf()
+}
+
+func (sw *snapshotWriter) writeSnatches(s *snatches) error {
+	s.Lock()
+	for ih, sn := range s.m {
+		sw.buf = append(sw.buf, recordSnatch, byte(len(ih)))
+		sw.buf = append(sw.buf, ih...)
+		sw.buf = binary.AppendUvarint(sw.buf, uint64(sn.count))
+		sw.buf = binary.AppendVarint(sw.buf, sn.mtime)
+	}
+	s.Unlock()
+	return sw.flushBuf()
+}
+
+func (sw *snapshotWriter) writeData(ctx string, m *sync.Map) (err error) {
+	var entries []byte
+	var count uint64
+	m.Range(func(k, v any) bool {
+		entries = appendBytes(entries, []byte(k.(string)))
+		entries = appendBytes(entries, v.([]byte))
+		count++
+		return true
+	})
+	if count > 0 {
+		sw.buf = append(sw.buf, recordData)
+		sw.buf = appendBytes(sw.buf, []byte(ctx))
+		sw.buf = binary.AppendUvarint(sw.buf, count)
+		sw.buf = append(sw.buf, entries...)
+		err = sw.flushBuf()
+	}
+	return
+}
+
+// writeFile stores all swarms and data entries into file at path.
+// Data is written into temporary file in the same directory, which then
+// renamed to path, so existing snapshot is replaced only if write succeeded.
+func (s *snapshotter) writeFile(path string) (err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp"); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	crc := crc32.NewIEEE()
+	sw := &snapshotWriter{w: bufio.NewWriter(io.MultiWriter(f, crc))}
+	sw.buf = append(sw.buf, snapshotMagic...)
+	sw.buf = append(sw.buf, snapshotVersion)
+	sw.buf = binary.BigEndian.AppendUint64(sw.buf, uint64(time.Now().UnixNano()))
+	if err = sw.flushBuf(); err != nil {
+		return
+	}
+
+	if s.peers != nil {
+		for _, shard := range s.peers.shards {
+			infoHashes := make([]bittorrent.InfoHash, 0, shard.swarms.len())
+			shard.swarms.keys(func(ih bittorrent.InfoHash) bool {
+				infoHashes = append(infoHashes, ih)
+				return true
+			})
+			for _, ih := range infoHashes {
+				if sm, exists := shard.swarms.get(ih); exists {
+					if err = sw.writeSwarm(ih, sm); err != nil {
+						return
+					}
+				}
+			}
+			if err = sw.writeSnatches(shard.snatches); err != nil {
+				return
+			}
+			runtime.Gosched()
+		}
+	}
+
+	s.data.Range(func(k, v any) bool {
+		err = sw.writeData(k.(string), v.(*sync.Map))
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+
+	if err = sw.w.WriteByte(recordEnd); err != nil {
+		return
+	}
+	if err = sw.w.Flush(); err != nil {
+		return
+	}
+	if _, err = f.Write(crc.Sum(nil)); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// snapshotReader parses snapshot content previously loaded into memory
+type snapshotReader struct {
+	*bytes.Reader
+}
+
+func (sr snapshotReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return nil, err
+	}
+	if l > uint64(sr.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, l)
+	_, err = io.ReadFull(sr, b)
+	return b, err
+}
+
+func (sr snapshotReader) readPeer() (p bittorrent.Peer, mtime int64, err error) {
+	var packed [packedPeerLen]byte
+	if _, err = io.ReadFull(sr, packed[:]); err != nil {
+		return
+	}
+	copy(p.ID[:], packed[:bittorrent.PeerIDLen])
+	addr := netip.AddrFrom16([net6Len]byte(packed[bittorrent.PeerIDLen : bittorrent.PeerIDLen+net6Len]))
+	port := binary.BigEndian.Uint16(packed[bittorrent.PeerIDLen+net6Len:])
+	p.AddrPort = netip.AddrPortFrom(addr.Unmap(), port)
+	mtime, err = binary.ReadVarint(sr)
+	return
+}
+
+func (s *snapshotter) restorePeers(sr snapshotReader, ih bittorrent.InfoHash, seeders bool, cutoff int64) (restored int, err error) {
+	var count uint64
+	if count, err = binary.ReadUvarint(sr); err != nil {
+		return
+	}
+	for ; count > 0; count-- {
+		var p bittorrent.Peer
+		var mtime int64
+		if p, mtime, err = sr.readPeer(); err != nil {
+			return
+		}
+		if mtime <= cutoff {
+			continue
+		}
+		sh := s.peers.shards[s.peers.shardIndex(ih, p.Addr().Is6())]
+		sw := sh.swarms.getOrCreate(ih)
+		if seeders {
+			if _, exists := sw.seeders.get(p); !exists {
+				sh.numSeeders.Add(1)
+			}
+			sw.seeders.set(p, mtime)
+		} else {
+			if _, exists := sw.leechers.get(p); !exists {
+				sh.numLeechers.Add(1)
+			}
+			sw.leechers.set(p, mtime)
+		}
+		restored++
+	}
+	return
+}
+
+func (sr snapshotReader) readInfoHash() (ih bittorrent.InfoHash, err error) {
+	var l byte
+	if l, err = sr.ReadByte(); err != nil {
+		return
+	}
+	ihb := make([]byte, l)
+	if _, err = io.ReadFull(sr, ihb); err != nil {
+		return
+	}
+	return bittorrent.NewInfoHash(ihb)
+}
+
+func (s *snapshotter) restoreSwarm(sr snapshotReader, cutoff int64) (restored int, err error) {
+	if s.peers == nil {
+		return 0, errUnexpectedPeers
+	}
+	var ih bittorrent.InfoHash
+	if ih, err = sr.readInfoHash(); err != nil {
+		return
+	}
+	var n int
+	if n, err = s.restorePeers(sr, ih, true, cutoff); err != nil {
+		return
+	}
+	restored, err = s.restorePeers(sr, ih, false, cutoff)
+	restored += n
+	return
+}
+
+func (s *snapshotter) restoreSnatch(sr snapshotReader) (err error) {
+	if s.peers == nil {
+		return errUnexpectedPeers
+	}
+	var ih bittorrent.InfoHash
+	if ih, err = sr.readInfoHash(); err != nil {
+		return
+	}
+	var count uint64
+	if count, err = binary.ReadUvarint(sr); err != nil {
+		return
+	}
+	var mtime int64
+	if mtime, err = binary.ReadVarint(sr); err != nil {
+		return
+	}
+	s.peers.shards[s.peers.shardIndex(ih, false)].snatches.set(ih, uint32(count), mtime)
+	return
+}
+
+func (s *snapshotter) restoreData(sr snapshotReader) (restored int, err error) {
+	var ctx []byte
+	if ctx, err = sr.readBytes(); err != nil {
+		return
+	}
+	var count uint64
+	if count, err = binary.ReadUvarint(sr); err != nil {
+		return
+	}
+	c, _ := s.data.LoadOrStore(string(ctx), new(sync.Map))
+	m := c.(*sync.Map)
+	for ; count > 0; count-- {
+		var k, v []byte
+		if k, err = sr.readBytes(); err != nil {
+			return
+		}
+		if v, err = sr.readBytes(); err != nil {
+			return
+		}
+		m.Store(string(k), v)
+		restored++
+	}
+	return
+}
+
+// read loads swarms and data entries from snapshot file.
+// Peers, which were not announced after cutoff, are skipped.
+// Missing file is not an error.
+func (s *snapshotter) read(cutoff time.Time) error {
+	path := s.path
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Info().Str("path", path).Msg("snapshot does not exist, starting with empty store")
+			return nil
+		}
+		return err
+	}
+	if len(content) < headerLen+1+crcLen {
+		return errInvalidSnapshot
+	}
+	body, sum := content[:len(content)-crcLen], content[len(content)-crcLen:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return fmt.Errorf("%w: checksum mismatch", errInvalidSnapshot)
+	}
+	if string(body[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("%w: unknown format", errInvalidSnapshot)
+	}
+	if v := body[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", errInvalidSnapshot, v)
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(body[len(snapshotMagic)+1:headerLen])))
+
+	sr := snapshotReader{bytes.NewReader(body[headerLen:])}
+	cutoffUnix := cutoff.UnixNano()
+	var peersCount, dataCount int
+	for {
+		var rt byte
+		if rt, err = sr.ReadByte(); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidSnapshot, err)
+		}
+		var n int
+		switch rt {
+		case recordSwarm:
+			n, err = s.restoreSwarm(sr, cutoffUnix)
+			peersCount += n
+		case recordSnatch:
+			err = s.restoreSnatch(sr)
+		case recordData:
+			n, err = s.restoreData(sr)
+			dataCount += n
+		case recordEnd:
+			logger.Info().
+				Str("path", path).
+				Time("created", created).
+				Int("peers", peersCount).
+				Int("entries", dataCount).
+				Msg("snapshot restored")
+			return nil
+		default:
+			err = fmt.Errorf("unknown record type %d", rt)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errInvalidSnapshot, err)
+		}
+	}
+}
+
+// schedule writes snapshot every interval until closed
+func (s *snapshotter) schedule(interval time.Duration, closed <-chan any, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-t.C:
+				_ = s.write()
+			}
+		}
+	}()
+}
+
+// write stores snapshot into file and logs result
+func (s *snapshotter) write() (err error) {
+	start := time.Now()
+	if err = s.writeFile(s.path); err == nil {
+		logger.Debug().Str("path", s.path).Dur("timeTaken", time.Since(start)).Msg("snapshot complete")
+	} else {
+		logger.Error().Err(err).Str("path", s.path).Msg("unable to write snapshot")
+	}
+	return
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.snap")
+	cfg := config{ShardCount: 16, SnapshotPath: path, PeerLifetime: time.Hour}
+	ctx := context.Background()
+
+	ih1 := bittorrent.InfoHash("01234567890123456789")
+	ih2 := bittorrent.InfoHash("0123456789012345678901234567890_")
+	seeder := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}
+	leecher := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000002")), AddrPort: netip.MustParseAddrPort("[2001:db8::1]:6882")}
+	stale := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000003")), AddrPort: netip.MustParseAddrPort("192.0.2.3:6883")}
+
+	ps, err := peerStorage(cfg)
+	require.Nil(t, err)
+	require.True(t, ps.Preservable())
+	require.Nil(t, ps.PutSeeder(ctx, ih1, seeder))
+	require.Nil(t, ps.PutLeecher(ctx, ih1, leecher))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, stale))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, seeder))
+	require.Nil(t, ps.DeleteLeecher(ctx, ih2, seeder))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih2, seeder))
+	require.Nil(t, ps.DeleteSeeder(ctx, ih2, seeder))
+	store := ps.(*peerStore)
+	store.shards[store.shardIndex(ih2, false)].swarms.getOrCreate(ih2).leechers.set(stale, time.Now().Add(-2*time.Hour).UnixNano())
+	require.Nil(t, ps.Put(ctx, "ctx", []storage.Entry{{Key: "k1", Value: []byte("v1")}, {Key: "k2", Value: []byte{}}}...))
+	require.Nil(t, ps.Close())
+
+	ps, err = peerStorage(cfg)
+	require.Nil(t, err)
+	defer ps.Close()
+
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih1)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), leechers)
+	require.Equal(t, uint32(1), seeders)
+	peers, err := ps.AnnouncePeers(ctx, ih1, false, 10, false)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{seeder}, peers)
+	peers, err = ps.AnnouncePeers(ctx, ih1, true, 10, true)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{leecher}, peers)
+
+	leechers, seeders, snatched, err := ps.ScrapeSwarm(ctx, ih2)
+	require.Nil(t, err)
+	require.Zero(t, leechers)
+	require.Zero(t, seeders)
+	require.Equal(t, uint32(1), snatched)
+
+	v, err := ps.Load(ctx, "ctx", "k1")
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), v)
+	exists, err := ps.Contains(ctx, "ctx", "k2")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.snap")
+	cfg := config{ShardCount: 1, SnapshotPath: path}
+	ps, err := peerStorage(cfg)
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(context.Background(), bittorrent.InfoHash("01234567890123456789"),
+		bittorrent.Peer{AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}))
+	require.Nil(t, ps.Close())
+
+	content, err := os.ReadFile(path)
+	require.Nil(t, err)
+	content[headerLen+1] ^= 0xff
+	require.Nil(t, os.WriteFile(path, content, 0o600))
+
+	_, err = peerStorage(cfg)
+	require.ErrorIs(t, err, errInvalidSnapshot)
+}
+
+func TestNotPreservable(t *testing.T) {
+	ps, err := peerStorage(config{ShardCount: 1})
+	require.Nil(t, err)
+	require.False(t, ps.Preservable())
+	require.Nil(t, ps.Close())
+}
+
+func TestDataSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.snap")
+	ctx := context.Background()
+	ds, err := dataStorage(config{SnapshotPath: path})
+	require.Nil(t, err)
+	_, isPeerStorage := ds.(storage.PeerStorage)
+	require.False(t, isPeerStorage)
+	require.True(t, ds.Preservable())
+	require.Nil(t, ds.Put(ctx, "ctx", storage.Entry{Key: "k1", Value: []byte("v1")}))
+	require.Nil(t, ds.Close())
+
+	ds, err = dataStorage(config{SnapshotPath: path})
+	require.Nil(t, err)
+	v, err := ds.Load(ctx, "ctx", "k1")
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), v)
+	require.Nil(t, ds.Close())
+
+	// snapshot of peer store can not be restored into data store
+	ps, err := peerStorage(config{ShardCount: 1, SnapshotPath: path})
+	require.Nil(t, err)
+	require.Nil(t, ps.PutSeeder(ctx, bittorrent.InfoHash("01234567890123456789"),
+		bittorrent.Peer{AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}))
+	require.Nil(t, ps.Close())
+	_, err = dataStorage(config{SnapshotPath: path})
+	require.ErrorIs(t, err, errInvalidSnapshot)
+	require.ErrorIs(t, err, errUnexpectedPeers)
+}
@@ -3,8 +3,10 @@
 package memory
 
 import (
+	"container/heap"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"runtime"
 	"sync"
@@ -24,6 +26,10 @@ const (
 	Name = "memory"
 	// Default config constants.
 	defaultShardCount = 1024
+	// defaultSnatchTTL is the time snatch counter is kept after swarm became empty
+	defaultSnatchTTL = 24 * time.Hour
+	// defaultMaxSnatches is the maximal number of stored snatch counters
+	defaultMaxSnatches = 1 << 20
 	// -1
 	decrUint64 = ^uint64(0)
 )
@@ -38,9 +44,13 @@ func init() {
 // Builder is structure to create new in-memory peer or data storage
 type Builder struct{}
 
-// NewDataStorage creates new in-memory KV storage. Does not need configuration
-func (Builder) NewDataStorage(conf.MapConfig) (storage.DataStorage, error) {
-	return dataStorage(), nil
+// NewDataStorage creates new in-memory KV storage
+func (Builder) NewDataStorage(icfg conf.MapConfig) (storage.DataStorage, error) {
+	var cfg config
+	if err := icfg.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	return dataStorage(cfg.validateSnapshot())
 }
 
 // NewPeerStorage creates new in-memory peer storage
@@ -54,6 +64,19 @@ func (Builder) NewPeerStorage(icfg conf.MapConfig) (storage.PeerStorage, error)
 
 type config struct {
 	ShardCount int `cfg:"shard_count"`
+	// SnapshotPath is the file to store swarms and data into,
+	// empty value disables snapshots
+	SnapshotPath string `cfg:"snapshot_path"`
+	// SnapshotInterval is the period of snapshot writes,
+	// if zero, snapshot is only written on close
+	SnapshotInterval time.Duration `cfg:"snapshot_interval"`
+	// PeerLifetime used to skip stale peers while restoring snapshot
+	PeerLifetime time.Duration `cfg:"peer_lifetime"`
+	// SnatchTTL is the time snatch counter is kept after swarm became empty
+	SnatchTTL time.Duration `cfg:"snatch_ttl"`
+	// MaxSnatches is the maximal number of stored snatch counters,
+	// if exceeded, the least recently active counter is dropped
+	MaxSnatches int `cfg:"max_snatches"`
 }
 
 func (cfg config) validate() config {
@@ -68,19 +91,75 @@ func (cfg config) validate() config {
 			Msg("falling back to default configuration")
 	}
 
+	if cfg.SnatchTTL <= 0 {
+		validcfg.SnatchTTL = defaultSnatchTTL
+		logger.Warn().
+			Str("name", "SnatchTTL").
+			Dur("provided", cfg.SnatchTTL).
+			Dur("default", validcfg.SnatchTTL).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.MaxSnatches <= 0 {
+		validcfg.MaxSnatches = defaultMaxSnatches
+		logger.Warn().
+			Str("name", "MaxSnatches").
+			Int("provided", cfg.MaxSnatches).
+			Int("default", validcfg.MaxSnatches).
+			Msg("falling back to default configuration")
+	}
+
+	return validcfg.validateSnapshot()
+}
+
+// validateSnapshot checks only snapshot parameters
+func (cfg config) validateSnapshot() config {
+	validcfg := cfg
+
+	if len(cfg.SnapshotPath) > 0 {
+		if cfg.SnapshotInterval < 0 {
+			validcfg.SnapshotInterval = 0
+			logger.Warn().
+				Str("name", "SnapshotInterval").
+				Dur("provided", cfg.SnapshotInterval).
+				Dur("default", validcfg.SnapshotInterval).
+				Msg("falling back to default configuration")
+		}
+		if cfg.PeerLifetime <= 0 {
+			validcfg.PeerLifetime = storage.DefaultPeerLifetime
+		}
+	}
+
 	return validcfg
 }
 
 func peerStorage(provided config) (storage.PeerStorage, error) {
 	cfg := provided.validate()
+	ds := &dataStore{preservable: len(cfg.SnapshotPath) > 0}
 	ps := &peerStore{
 		shards:      make([]*peerShard, cfg.ShardCount*2),
-		DataStorage: dataStorage(),
+		DataStorage: ds,
+		snatchTTL:   cfg.SnatchTTL,
 		closed:      make(chan any),
 	}
 
+	// snatch counters are stored only in the first (IPv4) half of shards
+	snatchLimit := max(1, (cfg.MaxSnatches+cfg.ShardCount-1)/cfg.ShardCount)
 	for i := 0; i < cfg.ShardCount*2; i++ {
-		ps.shards[i] = &peerShard{swarms: &ihSwarm{m: make(map[bittorrent.InfoHash]swarm)}}
+		ps.shards[i] = &peerShard{
+			swarms:   &ihSwarm{m: make(map[bittorrent.InfoHash]swarm)},
+			snatches: &snatches{m: make(map[bittorrent.InfoHash]*snatch), limit: snatchLimit},
+		}
+	}
+
+	if len(cfg.SnapshotPath) > 0 {
+		ps.snapshots = &snapshotter{path: cfg.SnapshotPath, peers: ps, data: ds}
+		if err := ps.snapshots.read(time.Now().Add(-cfg.PeerLifetime)); err != nil {
+			return nil, fmt.Errorf("unable to restore snapshot '%s': %w", cfg.SnapshotPath, err)
+		}
+		if cfg.SnapshotInterval > 0 {
+			ps.snapshots.schedule(cfg.SnapshotInterval, ps.closed, &ps.wg)
+		}
 	}
 
 	return ps, nil
@@ -88,6 +167,7 @@ func peerStorage(provided config) (storage.PeerStorage, error) {
 
 type peerShard struct {
 	swarms      *ihSwarm
+	snatches    *snatches
 	numSeeders  atomic.Uint64
 	numLeechers atomic.Uint64
 }
@@ -143,6 +223,116 @@ func (p *ihSwarm) keys(fn func(k bittorrent.InfoHash) bool) {
 	p.RUnlock()
 }
 
+type snatch struct {
+	ih    bittorrent.InfoHash
+	count uint32
+	// mtime is the last time (unix nano), when swarm was active
+	mtime int64
+	// seq is the order of the last update, used to choose the least recently
+	// active counter, if mtime is the same (time is cached with low resolution)
+	seq uint64
+	// index is the position of counter in snatchHeap
+	index int
+}
+
+// snatchHeap is the min-heap of snatch counters ordered by (mtime, seq),
+// so the least recently active counter is on top
+type snatchHeap []*snatch
+
+func (h snatchHeap) Len() int { return len(h) }
+
+func (h snatchHeap) Less(i, j int) bool {
+	return h[i].mtime < h[j].mtime || h[i].mtime == h[j].mtime && h[i].seq < h[j].seq
+}
+
+func (h snatchHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *snatchHeap) Push(x any) {
+	sn := x.(*snatch)
+	sn.index = len(*h)
+	*h = append(*h, sn)
+}
+
+func (h *snatchHeap) Pop() any {
+	old := *h
+	n := len(old) - 1
+	sn := old[n]
+	old[n] = nil
+	*h = old[:n]
+	return sn
+}
+
+type snatches struct {
+	m     map[bittorrent.InfoHash]*snatch
+	h     snatchHeap
+	limit int
+	seq   uint64
+	sync.Mutex
+}
+
+func (s *snatches) get(k bittorrent.InfoHash) (count uint32) {
+	s.Lock()
+	if sn := s.m[k]; sn != nil {
+		count = sn.count
+	}
+	s.Unlock()
+	return
+}
+
+// getOrAdd returns counter of info hash, if counter not exists, creates it
+// and drops the least recently active counter if limit is reached,
+// must be called under lock
+func (s *snatches) getOrAdd(k bittorrent.InfoHash) *snatch {
+	sn := s.m[k]
+	if sn == nil {
+		if len(s.m) >= s.limit {
+			oldest := heap.Pop(&s.h).(*snatch)
+			delete(s.m, oldest.ih)
+		}
+		sn = &snatch{ih: k}
+		s.m[k] = sn
+		heap.Push(&s.h, sn)
+	}
+	return sn
+}
+
+// touch sets activity time of counter and restores heap order,
+// must be called under lock
+func (s *snatches) touch(sn *snatch, mtime int64) {
+	s.seq++
+	sn.mtime, sn.seq = mtime, s.seq
+	heap.Fix(&s.h, sn.index)
+}
+
+// remove deletes counter, must be called under lock
+func (s *snatches) remove(sn *snatch) {
+	heap.Remove(&s.h, sn.index)
+	delete(s.m, sn.ih)
+}
+
+func (s *snatches) set(k bittorrent.InfoHash, count uint32, mtime int64) {
+	s.Lock()
+	sn := s.getOrAdd(k)
+	sn.count = count
+	s.touch(sn, mtime)
+	s.Unlock()
+}
+
+func (s *snatches) incr(k bittorrent.InfoHash, mtime int64) {
+	s.Lock()
+	sn := s.getOrAdd(k)
+	sn.count++
+	s.touch(sn, mtime)
+	s.Unlock()
+}
+
+func (s *snatches) len() int {
+	return len(s.m)
+}
+
 type swarm struct {
 	// map serialized peer to mtime
 	seeders  *peers
@@ -204,6 +394,9 @@ func (p *peers) forEach(fn func(k bittorrent.Peer, v int64) bool) {
 type peerStore struct {
 	storage.DataStorage
 	shards []*peerShard
+	// snapshots is nil if snapshots are disabled
+	snapshots *snapshotter
+	snatchTTL time.Duration
 
 	closed     chan any
 	wg         sync.WaitGroup
@@ -248,15 +441,7 @@ func (ps *peerStore) ScheduleStatisticsCollection(reportInterval time.Duration)
 			case <-t.C:
 				if metrics.Enabled() {
 					before := time.Now()
-					// aggregates metrics over all shards and then posts them to
-					// prometheus.
-					var numInfoHashes, numSeeders, numLeechers uint64
-
-					for _, s := range ps.shards {
-						numInfoHashes += uint64(s.swarms.len())
-						numSeeders += s.numSeeders.Load()
-						numLeechers += s.numLeechers.Load()
-					}
+					numInfoHashes, numSeeders, numLeechers, _ := ps.CountStatistics(context.Background())
 
 					storage.PromInfoHashesCount.Set(float64(numInfoHashes))
 					storage.PromSeedersCount.Set(float64(numSeeders))
@@ -268,6 +453,16 @@ func (ps *peerStore) ScheduleStatisticsCollection(reportInterval time.Duration)
 	}()
 }
 
+// CountStatistics aggregates counts over all shards
+func (ps *peerStore) CountStatistics(context.Context) (numInfoHashes, numSeeders, numLeechers uint64, _ error) {
+	for _, s := range ps.shards {
+		numInfoHashes += uint64(s.swarms.len())
+		numSeeders += s.numSeeders.Load()
+		numLeechers += s.numLeechers.Load()
+	}
+	return
+}
+
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, v6 bool) uint32 {
 	// There are twice the amount of shards specified by the user, the first
 	// half is dedicated to IPv4 swarms and the second half is dedicated to
@@ -393,12 +588,14 @@ func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash,
 		sh.numSeeders.Add(1)
 	}
 
-	sw.seeders.set(p, timecache.NowUnixNano())
+	now := timecache.NowUnixNano()
+	sw.seeders.set(p, now)
+	ps.shards[ps.shardIndex(ih, false)].snatches.incr(ih, now)
 
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -413,7 +610,11 @@ func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, fo
 
 	if sw, ok := ps.shards[ps.shardIndex(ih, v6)].swarms.get(ih); ok {
 		peers = make([]bittorrent.Peer, 0, numWant/2)
+		excl := storage.ExclusionFromContext(ctx)
 		rangeFn := func(p bittorrent.Peer) bool {
+			if excl.Excludes(p) {
+				return true
+			}
 			peers = append(peers, p)
 			numWant--
 			return numWant > 0
@@ -452,16 +653,35 @@ func (ps *peerStore) ScrapeSwarm(_ context.Context, ih bittorrent.InfoHash) (lee
 	leechers, seeders = ps.countPeers(ih, false)
 	l, s := ps.countPeers(ih, true)
 	leechers, seeders = leechers+l, seeders+s
+	snatched = ps.shards[ps.shardIndex(ih, false)].snatches.get(ih)
 
 	return
 }
 
-func dataStorage() storage.DataStorage {
-	return new(dataStore)
+// dataStorage creates KV store, which is restored from snapshot
+// and written into it, if snapshot path provided
+func dataStorage(cfg config) (storage.DataStorage, error) {
+	ds := &dataStore{preservable: len(cfg.SnapshotPath) > 0}
+	if !ds.preservable {
+		return ds, nil
+	}
+	sds := &snapshotDataStore{
+		dataStore: ds,
+		snapshots: &snapshotter{path: cfg.SnapshotPath, data: ds},
+		closed:    make(chan any),
+	}
+	if err := sds.snapshots.read(time.Now()); err != nil {
+		return nil, fmt.Errorf("unable to restore snapshot '%s': %w", cfg.SnapshotPath, err)
+	}
+	if cfg.SnapshotInterval > 0 {
+		sds.snapshots.schedule(cfg.SnapshotInterval, sds.closed, &sds.wg)
+	}
+	return sds, nil
 }
 
 type dataStore struct {
 	sync.Map
+	preservable bool
 }
 
 func (ds *dataStore) Put(_ context.Context, ctx string, values ...storage.Entry) error {
@@ -483,6 +703,18 @@ func (ds *dataStore) Contains(_ context.Context, ctx string, key string) (bool,
 	return exist, nil
 }
 
+func (ds *dataStore) LoadMany(_ context.Context, ctx string, keys ...string) ([][]byte, error) {
+	out := make([][]byte, len(keys))
+	if m, found := ds.Map.Load(ctx); found {
+		for i, k := range keys {
+			if v, _ := m.(*sync.Map).Load(k); v != nil {
+				out[i] = v.([]byte)
+			}
+		}
+	}
+	return out, nil
+}
+
 func (ds *dataStore) Load(_ context.Context, ctx string, key string) (out []byte, _ error) {
 	if m, found := ds.Map.Load(ctx); found {
 		if v, _ := m.(*sync.Map).Load(key); v != nil {
@@ -504,7 +736,7 @@ func (ds *dataStore) Delete(_ context.Context, ctx string, keys ...string) error
 	return nil
 }
 
-func (*dataStore) Preservable() bool { return false }
+func (ds *dataStore) Preservable() bool { return ds.preservable }
 
 func (ds *dataStore) Close() error { return nil }
 
@@ -578,17 +810,44 @@ func (ps *peerStore) gc(cutoff time.Time) {
 
 		runtime.Gosched()
 	}
+
+	ps.gcSnatches(timecache.NowUnixNano())
+}
+
+// gcSnatches updates activity time of snatch counters, which swarms
+// still exist, and deletes counters of swarms, which are empty longer than snatchTTL
+func (ps *peerStore) gcSnatches(now int64) {
+	cutoff := now - ps.snatchTTL.Nanoseconds()
+	for _, shard := range ps.shards[:len(ps.shards)/2] {
+		shard.snatches.Lock()
+		for ih, sn := range shard.snatches.m {
+			_, alive := shard.swarms.get(ih)
+			if !alive {
+				_, alive = ps.shards[ps.shardIndex(ih, true)].swarms.get(ih)
+			}
+			if alive {
+				shard.snatches.touch(sn, now)
+			} else if sn.mtime <= cutoff {
+				shard.snatches.remove(sn)
+			}
+		}
+		shard.snatches.Unlock()
+		runtime.Gosched()
+	}
 }
 
 func (*peerStore) Ping(context.Context) error {
 	return nil
 }
 
-func (ps *peerStore) Close() error {
+func (ps *peerStore) Close() (err error) {
 	ps.onceCloser.Do(func() {
 		close(ps.closed)
 		ps.wg.Wait()
+		if ps.snapshots != nil {
+			err = ps.snapshots.write()
+		}
 	})
 
-	return nil
+	return
 }
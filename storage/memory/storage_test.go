@@ -1,8 +1,15 @@
 package memory
 
 import (
+	"context"
+	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
 	"github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -17,4 +24,87 @@ func createNew() storage.PeerStorage {
 
 func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
 
+// TestInstrumentedStorage checks storage created by storage.NewPeerStorage,
+// which is wrapped with metrics decorator
+func TestInstrumentedStorage(t *testing.T) {
+	ps, err := storage.NewPeerStorage(conf.NamedMapConfig{
+		Name:   Name,
+		Config: conf.MapConfig{"slow_operation_threshold": time.Nanosecond},
+	})
+	require.Nil(t, err)
+	_, isOk := ps.(storage.Iterator)
+	require.True(t, isOk)
+	test.RunTests(t, ps)
+}
+
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
+
+func TestSnatches(t *testing.T) {
+	ps, err := peerStorage(config{ShardCount: 1, SnatchTTL: time.Hour, MaxSnatches: 2})
+	require.Nil(t, err)
+	defer ps.Close()
+	store := ps.(*peerStore)
+	ctx := context.Background()
+
+	ih1 := bittorrent.InfoHash("01234567890123456789")
+	ih2 := bittorrent.InfoHash("12345678901234567890")
+	ih3 := bittorrent.InfoHash("23456789012345678901")
+	p4 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001")), AddrPort: netip.MustParseAddrPort("192.0.2.1:6881")}
+	p6 := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000002")), AddrPort: netip.MustParseAddrPort("[2001:db8::1]:6881")}
+
+	require.Nil(t, ps.GraduateLeecher(ctx, ih1, p4))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih1, p6))
+	_, _, snatched, err := ps.ScrapeSwarm(ctx, ih1)
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), snatched)
+
+	// swarm still exists, so counter must be kept and refreshed
+	store.gcSnatches(time.Now().Add(2 * time.Hour).UnixNano())
+	_, _, snatched, _ = ps.ScrapeSwarm(ctx, ih1)
+	require.Equal(t, uint32(2), snatched)
+
+	// swarm is empty, but not longer than TTL
+	store.gc(time.Now().Add(time.Minute))
+	_, _, snatched, _ = ps.ScrapeSwarm(ctx, ih1)
+	require.Equal(t, uint32(2), snatched)
+
+	store.gcSnatches(time.Now().Add(4 * time.Hour).UnixNano())
+	_, _, snatched, _ = ps.ScrapeSwarm(ctx, ih1)
+	require.Zero(t, snatched)
+
+	// the least recently active counter is dropped if limit exceeded
+	require.Nil(t, ps.GraduateLeecher(ctx, ih1, p4))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih2, p4))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih3, p4))
+	_, _, snatched, _ = ps.ScrapeSwarm(ctx, ih1)
+	require.Zero(t, snatched)
+	for _, ih := range []bittorrent.InfoHash{ih2, ih3} {
+		_, _, snatched, _ = ps.ScrapeSwarm(ctx, ih)
+		require.Equal(t, uint32(1), snatched)
+	}
+}
+
+func TestSnatchesEvictionOrder(t *testing.T) {
+	s := &snatches{m: make(map[bittorrent.InfoHash]*snatch), limit: 2}
+	ih1 := bittorrent.InfoHash("01234567890123456789")
+	ih2 := bittorrent.InfoHash("12345678901234567890")
+	ih3 := bittorrent.InfoHash("23456789012345678901")
+	ih4 := bittorrent.InfoHash("34567890123456789012")
+
+	// restored counters may be out of order
+	s.set(ih1, 1, 10)
+	s.set(ih2, 1, 5)
+	s.incr(ih3, 20)
+	require.Zero(t, s.get(ih2))
+	require.Equal(t, uint32(1), s.get(ih1))
+
+	// refreshed counter is kept, the same mtime is ordered by update
+	s.Lock()
+	s.touch(s.m[ih1], 20)
+	s.Unlock()
+	s.incr(ih4, 20)
+	require.Zero(t, s.get(ih3))
+	require.Equal(t, uint32(1), s.get(ih1))
+	require.Equal(t, 2, s.len())
+	require.Len(t, s.h, 2)
+}
@@ -0,0 +1,215 @@
+package pg
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// iterateBatchSize is the number of rows requested by one iteration query
+const iterateBatchSize = 1000
+
+// iterableStore is the store, which implements storage.Iterator.
+// Separate type used to not to report Iterator support if
+// iteration queries are not provided.
+type iterableStore struct {
+	*store
+}
+
+var _ storage.Iterator = iterableStore{}
+
+// wrap returns iterableStore if `iterate.info_hashes_query`
+// and `iterate.peers_query` provided, otherwise returns store itself
+func (s *store) wrap() storage.PeerStorage {
+	if len(s.Iterate.InfoHashesQuery) == 0 || len(s.Iterate.PeersQuery) == 0 {
+		return s
+	}
+	return iterableStore{s}
+}
+
+// columnIndexes returns indexes of columns with provided (upper-cased) names
+// in result set and the maximal index. Empty names are ignored (index is -1).
+func columnIndexes(rows pgx.Rows, names ...string) (indexes []int, maxIndex int, err error) {
+	indexes = make([]int, len(names))
+	var missing []string
+	for i, name := range names {
+		indexes[i] = -1
+		if len(name) == 0 {
+			continue
+		}
+		for j, field := range rows.FieldDescriptions() {
+			if strings.ToUpper(field.Name) == name {
+				indexes[i] = j
+				break
+			}
+		}
+		if indexes[i] < 0 {
+			missing = append(missing, name)
+		}
+		maxIndex = max(maxIndex, indexes[i])
+	}
+	if len(missing) > 0 {
+		err = fmt.Errorf(errRequiredColumnsNotFoundMsg, missing)
+	}
+	return
+}
+
+func (s *store) swarmsBatch(ctx context.Context, after []byte) (batch []storage.SwarmInfo, err error) {
+	var rows pgx.Rows
+	if rows, err = s.Query(ctx, s.Iterate.InfoHashesQuery, pgx.NamedArgs{
+		pInfoHash: after,
+		pCount:    iterateBatchSize,
+	}); err != nil {
+		return
+	}
+	defer rows.Close()
+	indexes, maxIndex, err := columnIndexes(rows,
+		s.Iterate.InfoHashColumn,
+		s.Peer.CountSeedersColumn,
+		s.Peer.CountLeechersColumn,
+		s.Iterate.DownloadsColumn,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var ih []byte
+		var si storage.SwarmInfo
+		var downloads *uint32
+		into := make([]any, maxIndex+1)
+		into[indexes[0]], into[indexes[1]], into[indexes[2]] = &ih, &si.Seeders, &si.Leechers
+		if indexes[3] >= 0 {
+			into[indexes[3]] = &downloads
+		}
+		if err = rows.Scan(into...); err != nil {
+			return
+		}
+		if si.InfoHash, err = bittorrent.NewInfoHash(ih); err != nil {
+			return
+		}
+		if downloads != nil {
+			si.Snatches = *downloads
+		}
+		batch = append(batch, si)
+	}
+	err = rows.Err()
+	return
+}
+
+// ScanSwarms iterates over swarms returned by `iterate.info_hashes_query`,
+// which should return info hashes greater than @info_hash ordered by info hash.
+// Cursor is the HEX-encoded last returned info hash.
+func (s iterableStore) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	after, err := hex.DecodeString(cursor)
+	if err != nil {
+		return "", storage.ErrInvalidCursor
+	}
+	for {
+		if err = ctx.Err(); err != nil {
+			return "", err
+		}
+		var batch []storage.SwarmInfo
+		if batch, err = s.swarmsBatch(ctx, after); err != nil {
+			return "", err
+		}
+		for _, si := range batch {
+			if !fn(si) {
+				return si.InfoHash.String(), nil
+			}
+		}
+		if len(batch) < iterateBatchSize {
+			return "", nil
+		}
+		after = batch[len(batch)-1].InfoHash.Bytes()
+	}
+}
+
+type iteratedPeer struct {
+	bittorrent.Peer
+	seeder bool
+}
+
+func (s *store) peersBatch(ctx context.Context, ih []byte, offset int) (batch []iteratedPeer, err error) {
+	var rows pgx.Rows
+	if rows, err = s.Query(ctx, s.Iterate.PeersQuery, pgx.NamedArgs{
+		pInfoHash: ih,
+		pCount:    iterateBatchSize,
+		pOffset:   offset,
+	}); err != nil {
+		return
+	}
+	defer rows.Close()
+	indexes, maxIndex, err := columnIndexes(rows,
+		s.Announce.PeerIDColumn,
+		s.Announce.AddressColumn,
+		s.Announce.PortColumn,
+		s.Iterate.SeederColumn,
+	)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var p iteratedPeer
+		var id []byte
+		var ip net.IP
+		var port int
+		into := make([]any, maxIndex+1)
+		into[indexes[0]], into[indexes[1]], into[indexes[2]], into[indexes[3]] = &id, &ip, &port, &p.seeder
+		if err = rows.Scan(into...); err != nil {
+			return
+		}
+		if p.ID, err = bittorrent.NewPeerID(id); err != nil {
+			return
+		}
+		netAddr, isOk := netip.AddrFromSlice(ip)
+		if !isOk {
+			err = bittorrent.ErrInvalidIP
+			return
+		}
+		p.AddrPort = netip.AddrPortFrom(netAddr.Unmap(), uint16(port))
+		batch = append(batch, p)
+	}
+	err = rows.Err()
+	return
+}
+
+// ScanPeers iterates over peers returned by `iterate.peers_query`,
+// which should return stable ordered peers of @info_hash with @offset.
+// Cursor is the number of already returned peers.
+func (s iterableStore) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	var offset int
+	if len(cursor) > 0 {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return "", storage.ErrInvalidCursor
+		}
+	}
+	ihb := ih.Bytes()
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		batch, err := s.peersBatch(ctx, ihb, offset)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range batch {
+			offset++
+			if !fn(p.Peer, p.seeder) {
+				return strconv.Itoa(offset), nil
+			}
+		}
+		if len(batch) < iterateBatchSize {
+			return "", nil
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Built-in queries, which work with schema created by migrations.
+// Each query is used only if corresponding parameter is not provided
+// in configuration.
+const (
+	defaultPeerAddQuery            = "INSERT INTO mo_peers VALUES(@info_hash, @peer_id, @address, @port, @is_seeder, @is_v6, @created) ON CONFLICT (info_hash, peer_id, address, port) DO UPDATE SET created = EXCLUDED.created, is_seeder = EXCLUDED.is_seeder"
+	defaultPeerDelQuery            = "DELETE FROM mo_peers WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND is_seeder=@is_seeder"
+	defaultPeerGraduateQuery       = "UPDATE mo_peers SET is_seeder=TRUE WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND NOT is_seeder"
+	defaultPeerCountQuery          = "SELECT COUNT(1) FILTER (WHERE is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT is_seeder) AS leechers FROM mo_peers"
+	defaultPeerCountSeedersColumn  = "seeders"
+	defaultPeerCountLeechersColumn = "leechers"
+	defaultPeerByInfoHashClause    = "WHERE info_hash = @info_hash"
+
+	defaultAnnounceQuery         = "SELECT peer_id, address, port FROM mo_peers WHERE info_hash=@info_hash AND is_seeder=@is_seeder AND is_v6=@is_v6 LIMIT @count"
+	defaultAnnouncePeerIDColumn  = "peer_id"
+	defaultAnnounceAddressColumn = "address"
+	defaultAnnouncePortColumn    = "port"
+
+	defaultDownloadsGetQuery       = "SELECT downloads FROM mo_downloads WHERE info_hash=@info_hash"
+	defaultDownloadsIncrementQuery = "INSERT INTO mo_downloads VALUES(@info_hash) ON CONFLICT(info_hash) DO UPDATE SET downloads = mo_downloads.downloads + 1"
+
+	defaultDataAddQuery = "INSERT INTO mo_kv VALUES(@context, @key, @value) ON CONFLICT (context, name) DO NOTHING"
+	defaultDataGetQuery = "SELECT value FROM mo_kv WHERE context=@context AND name=@key"
+	defaultDataDelQuery = "DELETE FROM mo_kv WHERE context=@context AND name = ANY(@key)"
+
+	defaultIterateInfoHashesQuery = "SELECT p.info_hash, COUNT(1) FILTER (WHERE p.is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT p.is_seeder) AS leechers, MAX(d.downloads) AS downloads FROM mo_peers p LEFT JOIN mo_downloads d ON d.info_hash = p.info_hash WHERE p.info_hash > @info_hash GROUP BY p.info_hash ORDER BY p.info_hash LIMIT @count"
+	defaultIterateInfoHashColumn  = "info_hash"
+	defaultIterateDownloadsColumn = "downloads"
+	defaultIteratePeersQuery      = "SELECT peer_id, address, port, is_seeder FROM mo_peers WHERE info_hash=@info_hash ORDER BY is_seeder DESC, peer_id, address, port LIMIT @count OFFSET @offset"
+	defaultIterateSeederColumn    = "is_seeder"
+
+	defaultGCQuery            = "DELETE FROM mo_peers WHERE created <= @created"
+	defaultInfoHashCountQuery = "SELECT COUNT(DISTINCT info_hash) AS info_hashes FROM mo_peers"
+)
+
+const (
+	// schemaLockID is the key of advisory lock, which prevents
+	// concurrent migrations by several MoChi instances
+	schemaLockID int64 = 0x6d6f636869 // "mochi"
+
+	createVersionTableQuery = `CREATE TABLE IF NOT EXISTS mo_schema_version (
+	version int PRIMARY KEY NOT NULL,
+	applied timestamp NOT NULL DEFAULT current_timestamp
+)`
+	selectVersionQuery = "SELECT COALESCE(MAX(version), 0) FROM mo_schema_version"
+	insertVersionQuery = "INSERT INTO mo_schema_version(version) VALUES(@version)"
+	// selectTablesParamsQuery returns if downloads table is unlogged (peers table
+	// is not unlogged if partitioned) and the number of peers table partitions
+	selectTablesParamsQuery = `SELECT
+	COALESCE((SELECT relpersistence = 'u' FROM pg_class WHERE oid = to_regclass('mo_downloads')), FALSE),
+	(SELECT COUNT(1) FROM pg_inherits WHERE inhparent = to_regclass('mo_peers'))`
+)
+
+type schemaConf struct {
+	// Unmanaged disables migrations and built-in queries of optional
+	// features (iteration, GC and info hashes statistics).
+	// Set automatically if any of peer, announce, downloads
+	// or data queries provided (see config.hasCustomQueries)
+	Unmanaged bool
+	// Unlogged creates peers and downloads tables without WAL
+	Unlogged bool
+	// Partitions is the number of hash partitions of peers table
+	// (by info hash), 0 means peers table is not partitioned
+	Partitions int
+}
+
+// migration returns statements, which upgrade schema to the next version
+type migration func(sc schemaConf) []string
+
+// migrations is the list of all schema versions. Version number is the
+// index in list plus one. Applied migrations MUST NOT be changed,
+// new version should be appended instead.
+var migrations = []migration{
+	createTables,
+}
+
+// createTables creates initial tables and indexes
+func createTables(sc schemaConf) []string {
+	var unlogged string
+	if sc.Unlogged {
+		unlogged = "UNLOGGED "
+	}
+	peersTable := `TABLE IF NOT EXISTS mo_peers (
+	info_hash bytea NOT NULL,
+	peer_id bytea NOT NULL,
+	address inet NOT NULL,
+	port int4 NOT NULL,
+	is_seeder bool NOT NULL,
+	is_v6 bool NOT NULL,
+	created timestamp NOT NULL DEFAULT current_timestamp,
+	PRIMARY KEY (info_hash, peer_id, address, port)
+)`
+	var stmts []string
+	if sc.Partitions > 0 {
+		// partitioned table itself can not be unlogged, only its partitions
+		stmts = append(stmts, "CREATE "+peersTable+" PARTITION BY HASH (info_hash)")
+		for i := 0; i < sc.Partitions; i++ {
+			stmts = append(stmts, fmt.Sprintf(
+				"CREATE %sTABLE IF NOT EXISTS mo_peers_%d PARTITION OF mo_peers FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+				unlogged, i, sc.Partitions, i))
+		}
+	} else {
+		stmts = append(stmts, "CREATE "+unlogged+peersTable)
+	}
+	return append(stmts,
+		"CREATE INDEX IF NOT EXISTS mo_peers_created_idx ON mo_peers (created)",
+		"CREATE INDEX IF NOT EXISTS mo_peers_announce_idx ON mo_peers (info_hash, is_seeder, is_v6)",
+		`CREATE `+unlogged+`TABLE IF NOT EXISTS mo_downloads (
+	info_hash bytea PRIMARY KEY NOT NULL,
+	downloads int NOT NULL DEFAULT 1
+)`,
+		`CREATE TABLE IF NOT EXISTS mo_kv (
+	context varchar NOT NULL,
+	name bytea NOT NULL,
+	value bytea,
+	PRIMARY KEY (context, name)
+)`,
+	)
+}
+
+// migrate applies migrations, which are not applied yet, in one transaction.
+// Transaction-level advisory lock is held while migration, so if
+// several instances start simultaneously, only one of them changes schema.
+func (sc schemaConf) migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) (err error) {
+		if _, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", schemaLockID); err != nil {
+			return
+		}
+		if _, err = tx.Exec(ctx, createVersionTableQuery); err != nil {
+			return
+		}
+		var version int
+		if err = tx.QueryRow(ctx, selectVersionQuery).Scan(&version); err != nil {
+			return
+		}
+		if version > 0 {
+			// check is executed in savepoint, so its error does not abort migration
+			if err := pgx.BeginFunc(ctx, tx, func(tx pgx.Tx) error {
+				return sc.checkTablesParams(ctx, tx)
+			}); err != nil {
+				logger.Warn().Err(err).Msg("unable to check tables parameters")
+			}
+		}
+		if version > len(migrations) {
+			logger.Warn().
+				Int("version", version).
+				Int("supported", len(migrations)).
+				Msg("database schema is newer than supported")
+			return
+		}
+		for ; version < len(migrations); version++ {
+			for _, stmt := range migrations[version](sc) {
+				if _, err = tx.Exec(ctx, stmt); err != nil {
+					return fmt.Errorf("unable to migrate schema to version %d: %w", version+1, err)
+				}
+			}
+			if _, err = tx.Exec(ctx, insertVersionQuery, pgx.NamedArgs{"version": version + 1}); err != nil {
+				return
+			}
+			logger.Info().Int("version", version+1).Msg("schema migrated")
+		}
+		return
+	})
+}
+
+// checkTablesParams warns if `unlogged` or `partitions` parameters
+// differ from existing tables, because they are applied only when
+// tables are created
+func (sc schemaConf) checkTablesParams(ctx context.Context, tx pgx.Tx) error {
+	var unlogged bool
+	var partitions int
+	if err := tx.QueryRow(ctx, selectTablesParamsQuery).Scan(&unlogged, &partitions); err != nil {
+		return err
+	}
+	if unlogged != sc.Unlogged || partitions != sc.Partitions {
+		logger.Warn().
+			Bool("unlogged", unlogged).
+			Int("partitions", partitions).
+			Bool("providedUnlogged", sc.Unlogged).
+			Int("providedPartitions", sc.Partitions).
+			Msg("schema parameters differ from existing tables, they are applied only when tables are created")
+	}
+	return nil
+}
+
+// defaultsLog sets built-in values to parameters, which are not provided,
+// and collects names of such parameters
+type defaultsLog []string
+
+func (d *defaultsLog) set(p *string, value, name string) {
+	if *p = strings.TrimSpace(*p); len(*p) == 0 {
+		*p = value
+		*d = append(*d, name)
+	}
+}
+
+// report logs names of parameters, which use built-in values
+func (d defaultsLog) report() {
+	if len(d) > 0 {
+		logger.Info().Strs("parameters", d).Msg("using built-in queries")
+	}
+}
@@ -1,6 +1,7 @@
 // Package pg implements PostgreSQL-like storage interface.
 // This implementation does not use ORM and relies on database structure
-// and queries provided in configuration.
+// and queries provided in configuration. If they are not provided,
+// built-in schema (created by migrations at startup) and queries are used.
 package pg
 
 import (
@@ -27,7 +28,6 @@ import (
 const (
 	defaultPingQuery = "SELECT 0"
 
-	errRequiredParameterNotSetMsg = "required parameter not provided: %s"
 	errRequiredColumnsNotFoundMsg = "one or more required columns not found in result set: %v"
 	errRollBackMsg                = "error occurred while rolling back failed query: %v, failed query error: %v"
 
@@ -42,6 +42,7 @@ const (
 	pSeeder   = "is_seeder"
 	pCreated  = "created"
 	pCount    = "count"
+	pOffset   = "offset"
 )
 
 var (
@@ -103,13 +104,27 @@ func newStore(cfg config) (storage.PeerStorage, error) {
 		return nil, err
 	}
 
-	return &store{
+	if !cfg.Schema.Unmanaged {
+		if err = cfg.Schema.migrate(context.Background(), con); err != nil {
+			con.Close()
+			return nil, err
+		}
+	}
+
+	st := &store{
 		config:     cfg,
 		Pool:       con,
 		wg:         sync.WaitGroup{},
 		closed:     make(chan any),
 		onceCloser: sync.Once{},
-	}, nil
+	}
+	if cfg.WriteBuffer.BatchSize > 0 {
+		st.writeBuffer = newWriteBuffer(cfg.WriteBuffer.BatchSize, cfg.WriteBuffer.MaxPending,
+			cfg.WriteBuffer.FlushAttempts, st.flushPeers)
+		st.scheduleFlush(cfg.WriteBuffer.FlushInterval)
+	}
+
+	return st.wrap(), nil
 }
 
 type peerQueryConf struct {
@@ -140,25 +155,42 @@ type downloadQueryConf struct {
 	IncrementQuery string `cfg:"inc_query"`
 }
 
-func checkParameter(p *string, name string) (err error) {
-	if *p = strings.TrimSpace(*p); len(*p) == 0 {
-		err = fmt.Errorf(errRequiredParameterNotSetMsg, name)
-	}
-	return
+type iterateQueryConf struct {
+	InfoHashesQuery string `cfg:"info_hashes_query"`
+	InfoHashColumn  string `cfg:"info_hash_column"`
+	DownloadsColumn string `cfg:"downloads_column"`
+	PeersQuery      string `cfg:"peers_query"`
+	SeederColumn    string `cfg:"seeder_column"`
 }
 
 type config struct {
 	ConnectionString   string `cfg:"connection_string"`
 	PingQuery          string `cfg:"ping_query"`
+	Schema             schemaConf
 	Peer               peerQueryConf
 	Announce           announceQueryConf
 	Downloads          downloadQueryConf
 	Data               dataQueryConf
-	GCQuery            string `cfg:"gc_query"`
-	InfoHashCountQuery string `cfg:"info_hash_count_query"`
+	Iterate            iterateQueryConf
+	GCQuery            string          `cfg:"gc_query"`
+	InfoHashCountQuery string          `cfg:"info_hash_count_query"`
+	WriteBuffer        writeBufferConf `cfg:"write_buffer"`
 }
 
 func (cfg config) validateDataStore() (config, error) {
+	validCfg, err := cfg.validateCommon()
+	if err != nil {
+		return cfg, err
+	}
+
+	var defaults defaultsLog
+	validCfg.setDataDefaults(&defaults)
+	defaults.report()
+
+	return validCfg, nil
+}
+
+func (cfg config) validateCommon() (config, error) {
 	validCfg := cfg
 	validCfg.ConnectionString = strings.TrimSpace(validCfg.ConnectionString)
 	if len(validCfg.ConnectionString) == 0 {
@@ -174,77 +206,142 @@ func (cfg config) validateDataStore() (config, error) {
 			Msg("falling back to default configuration")
 	}
 
-	if err := checkParameter(&validCfg.Data.AddQuery, "data.addQuery"); err != nil {
-		return cfg, err
+	if !cfg.Schema.Unmanaged && cfg.hasCustomQueries() {
+		validCfg.Schema.Unmanaged = true
+		logger.Warn().
+			Str("name", "schema.unmanaged").
+			Bool("provided", cfg.Schema.Unmanaged).
+			Bool("default", validCfg.Schema.Unmanaged).
+			Msg("custom queries provided, schema is not managed")
 	}
 
-	if err := checkParameter(&validCfg.Data.GetQuery, "data.getQuery"); err != nil {
-		return cfg, err
+	if cfg.Schema.Partitions < 0 {
+		validCfg.Schema.Partitions = 0
+		logger.Warn().
+			Str("name", "schema.partitions").
+			Int("provided", cfg.Schema.Partitions).
+			Int("default", validCfg.Schema.Partitions).
+			Msg("falling back to default configuration")
 	}
 
-	if err := checkParameter(&validCfg.Data.DelQuery, "data.delQuery"); err != nil {
-		return cfg, err
+	return validCfg, nil
+}
+
+// hasCustomQueries checks if any of peer, announce, downloads or data
+// queries provided, so database structure is probably custom,
+// and migrations should not be applied
+func (cfg config) hasCustomQueries() bool {
+	for _, q := range []string{
+		cfg.Peer.AddQuery, cfg.Peer.DelQuery, cfg.Peer.GraduateQuery, cfg.Peer.CountQuery,
+		cfg.Announce.Query,
+		cfg.Downloads.GetQuery, cfg.Downloads.IncrementQuery,
+		cfg.Data.AddQuery, cfg.Data.GetQuery, cfg.Data.DelQuery,
+	} {
+		if len(strings.TrimSpace(q)) > 0 {
+			return true
+		}
 	}
+	return false
+}
 
-	return validCfg, nil
+func (cfg *config) setDataDefaults(d *defaultsLog) {
+	d.set(&cfg.Data.AddQuery, defaultDataAddQuery, "data.addQuery")
+	d.set(&cfg.Data.GetQuery, defaultDataGetQuery, "data.getQuery")
+	d.set(&cfg.Data.DelQuery, defaultDataDelQuery, "data.delQuery")
 }
 
 func (cfg config) validateFull() (config, error) {
-	validCfg, err := cfg.validateDataStore()
+	validCfg, err := cfg.validateCommon()
 	if err != nil {
 		return cfg, err
 	}
 
-	if err = checkParameter(&validCfg.Peer.AddQuery, "peer.addQuery"); err != nil {
-		return cfg, err
-	}
+	var defaults defaultsLog
+	validCfg.setDataDefaults(&defaults)
 
-	if err = checkParameter(&validCfg.Peer.DelQuery, "peer.delQuery"); err != nil {
-		return cfg, err
-	}
+	defaults.set(&validCfg.Peer.AddQuery, defaultPeerAddQuery, "peer.addQuery")
+	defaults.set(&validCfg.Peer.DelQuery, defaultPeerDelQuery, "peer.delQuery")
+	defaults.set(&validCfg.Peer.GraduateQuery, defaultPeerGraduateQuery, "peer.graduateQuery")
+	defaults.set(&validCfg.Peer.CountQuery, defaultPeerCountQuery, "peer.countQuery")
+	defaults.set(&validCfg.Peer.CountSeedersColumn, defaultPeerCountSeedersColumn, "peer.countSeedersColumn")
+	defaults.set(&validCfg.Peer.CountLeechersColumn, defaultPeerCountLeechersColumn, "peer.countLeechersColumn")
+	defaults.set(&validCfg.Peer.ByInfoHashClause, defaultPeerByInfoHashClause, "peer.byInfoHashClause")
 
-	if err = checkParameter(&validCfg.Peer.GraduateQuery, "peer.graduateQuery"); err != nil {
-		return cfg, err
-	}
+	defaults.set(&validCfg.Announce.Query, defaultAnnounceQuery, "announce.query")
+	defaults.set(&validCfg.Announce.PeerIDColumn, defaultAnnouncePeerIDColumn, "announce.peerIDColumn")
+	defaults.set(&validCfg.Announce.AddressColumn, defaultAnnounceAddressColumn, "announce.addressColumn")
+	defaults.set(&validCfg.Announce.PortColumn, defaultAnnouncePortColumn, "announce.portColumn")
 
-	if err = checkParameter(&validCfg.Peer.CountQuery, "peer.countQuery"); err != nil {
-		return cfg, err
-	}
+	defaults.set(&validCfg.Downloads.GetQuery, defaultDownloadsGetQuery, "downloads.getQuery")
+	defaults.set(&validCfg.Downloads.IncrementQuery, defaultDownloadsIncrementQuery, "downloads.incrementQuery")
 
-	if err = checkParameter(&validCfg.Peer.CountSeedersColumn, "peer.countSeedersColumn"); err != nil {
-		return cfg, err
-	}
+	validCfg.Announce.PeerIDColumn = strings.ToUpper(validCfg.Announce.PeerIDColumn)
+	validCfg.Announce.AddressColumn = strings.ToUpper(validCfg.Announce.AddressColumn)
+	validCfg.Announce.PortColumn = strings.ToUpper(validCfg.Announce.PortColumn)
 
-	if err = checkParameter(&validCfg.Peer.CountLeechersColumn, "peer.countLeechersColumn"); err != nil {
-		return cfg, err
-	}
+	validCfg.Peer.CountSeedersColumn = strings.ToUpper(validCfg.Peer.CountSeedersColumn)
+	validCfg.Peer.CountLeechersColumn = strings.ToUpper(validCfg.Peer.CountLeechersColumn)
 
-	if err = checkParameter(&validCfg.Peer.ByInfoHashClause, "peer.byInfoHashClause"); err != nil {
-		return cfg, err
+	// queries of optional features are set only if schema is created by migrations,
+	// otherwise they may refer to tables, which not exist in custom schema
+	if !validCfg.Schema.Unmanaged {
+		defaults.set(&validCfg.Iterate.InfoHashesQuery, defaultIterateInfoHashesQuery, "iterate.infoHashesQuery")
+		defaults.set(&validCfg.GCQuery, defaultGCQuery, "gcQuery")
+		defaults.set(&validCfg.InfoHashCountQuery, defaultInfoHashCountQuery, "infoHashCountQuery")
 	}
 
-	if err = checkParameter(&validCfg.Announce.Query, "announce.query"); err != nil {
-		return cfg, err
-	}
+	if validCfg.Iterate.InfoHashesQuery = strings.TrimSpace(validCfg.Iterate.InfoHashesQuery); len(validCfg.Iterate.InfoHashesQuery) > 0 {
+		defaults.set(&validCfg.Iterate.InfoHashColumn, defaultIterateInfoHashColumn, "iterate.infoHashColumn")
+		defaults.set(&validCfg.Iterate.PeersQuery, defaultIteratePeersQuery, "iterate.peersQuery")
+		defaults.set(&validCfg.Iterate.SeederColumn, defaultIterateSeederColumn, "iterate.seederColumn")
+		if !validCfg.Schema.Unmanaged {
+			defaults.set(&validCfg.Iterate.DownloadsColumn, defaultIterateDownloadsColumn, "iterate.downloadsColumn")
+		}
 
-	if err = checkParameter(&validCfg.Announce.PeerIDColumn, "announce.peerIDColumn"); err != nil {
-		return cfg, err
+		validCfg.Iterate.InfoHashColumn = strings.ToUpper(validCfg.Iterate.InfoHashColumn)
+		validCfg.Iterate.DownloadsColumn = strings.ToUpper(strings.TrimSpace(validCfg.Iterate.DownloadsColumn))
+		validCfg.Iterate.SeederColumn = strings.ToUpper(validCfg.Iterate.SeederColumn)
 	}
 
-	if err = checkParameter(&validCfg.Announce.AddressColumn, "announce.addressColumn"); err != nil {
-		return cfg, err
+	if cfg.WriteBuffer.BatchSize < 0 {
+		validCfg.WriteBuffer.BatchSize = 0
+		logger.Warn().
+			Str("name", "writeBuffer.batchSize").
+			Int("provided", cfg.WriteBuffer.BatchSize).
+			Int("default", validCfg.WriteBuffer.BatchSize).
+			Msg("falling back to default configuration")
 	}
 
-	if err = checkParameter(&validCfg.Announce.PortColumn, "announce.portColumn"); err != nil {
-		return cfg, err
+	if validCfg.WriteBuffer.BatchSize > 0 {
+		if cfg.WriteBuffer.FlushInterval <= 0 {
+			validCfg.WriteBuffer.FlushInterval = defaultFlushInterval
+			logger.Warn().
+				Str("name", "writeBuffer.flushInterval").
+				Dur("provided", cfg.WriteBuffer.FlushInterval).
+				Dur("default", validCfg.WriteBuffer.FlushInterval).
+				Msg("falling back to default configuration")
+		}
+		if cfg.WriteBuffer.MaxPending < validCfg.WriteBuffer.BatchSize {
+			validCfg.WriteBuffer.MaxPending = validCfg.WriteBuffer.BatchSize * 4
+			logger.Warn().
+				Str("name", "writeBuffer.maxPending").
+				Int("provided", cfg.WriteBuffer.MaxPending).
+				Int("default", validCfg.WriteBuffer.MaxPending).
+				Msg("falling back to default configuration")
+		}
+		if cfg.WriteBuffer.FlushAttempts <= 0 {
+			validCfg.WriteBuffer.FlushAttempts = defaultFlushAttempts
+			logger.Warn().
+				Str("name", "writeBuffer.flushAttempts").
+				Int("provided", cfg.WriteBuffer.FlushAttempts).
+				Int("default", validCfg.WriteBuffer.FlushAttempts).
+				Msg("falling back to default configuration")
+		}
+		defaults.set(&validCfg.WriteBuffer.AddQuery, defaultBatchAddQuery, "writeBuffer.addQuery")
+		defaults.set(&validCfg.WriteBuffer.DelQuery, defaultBatchDelQuery, "writeBuffer.delQuery")
 	}
 
-	validCfg.Announce.PeerIDColumn = strings.ToUpper(validCfg.Announce.PeerIDColumn)
-	validCfg.Announce.AddressColumn = strings.ToUpper(validCfg.Announce.AddressColumn)
-	validCfg.Announce.PortColumn = strings.ToUpper(validCfg.Announce.PortColumn)
-
-	validCfg.Peer.CountSeedersColumn = strings.ToUpper(validCfg.Peer.CountSeedersColumn)
-	validCfg.Peer.CountLeechersColumn = strings.ToUpper(validCfg.Peer.CountLeechersColumn)
+	defaults.report()
 
 	return validCfg, nil
 }
@@ -255,6 +352,10 @@ type store struct {
 	wg         sync.WaitGroup
 	closed     chan any
 	onceCloser sync.Once
+	// writeBuffer is set if peers operations are buffered
+	writeBuffer *writeBuffer
+	// flushed receives result of write buffer flush on close
+	flushed chan error
 }
 
 func (s *store) txBatch(ctx context.Context, batch *pgx.Batch) (err error) {
@@ -302,6 +403,25 @@ func (s *store) Load(ctx context.Context, storeCtx string, key string) (out []by
 	return
 }
 
+func (s *store) LoadMany(ctx context.Context, storeCtx string, keys ...string) (values [][]byte, err error) {
+	values = make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return
+	}
+	b := new(pgx.Batch)
+	for _, k := range keys {
+		b.Queue(s.Data.GetQuery, pgx.NamedArgs{pCtx: storeCtx, pKey: []byte(k)})
+	}
+	br := s.SendBatch(ctx, b)
+	defer br.Close()
+	for i := range keys {
+		if err = noResultErr(br.QueryRow().Scan(&values[i])); err != nil {
+			break
+		}
+	}
+	return
+}
+
 func (s *store) Delete(ctx context.Context, storeCtx string, keys ...string) (err error) {
 	if len(keys) > 0 {
 		baKeys := make([][]byte, len(keys))
@@ -362,15 +482,7 @@ func (s *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 			case <-t.C:
 				if metrics.Enabled() {
 					before := time.Now()
-					sc, lc, err := s.countPeers(context.Background(), nil)
-					if err = noResultErr(err); err != nil {
-						logger.Error().Err(err).Msg("error occurred while get peers count count")
-					}
-					var hc int
-					err = s.QueryRow(context.Background(), s.InfoHashCountQuery).Scan(&hc)
-					if err = noResultErr(err); err != nil {
-						logger.Error().Err(err).Msg("error occurred while get info hash count")
-					}
+					hc, sc, lc, _ := s.CountStatistics(context.Background())
 
 					storage.PromInfoHashesCount.Set(float64(hc))
 					storage.PromSeedersCount.Set(float64(sc))
@@ -382,12 +494,34 @@ func (s *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 	}()
 }
 
+// CountStatistics returns peers count, provided by `peer.count_query`
+// and info hashes count, provided by `info_hash_count_query` (if set)
+func (s *store) CountStatistics(ctx context.Context) (hc, sc, lc uint64, err error) {
+	var sc32, lc32 uint32
+	sc32, lc32, err = s.countPeers(ctx, nil)
+	if err = noResultErr(err); err != nil {
+		logger.Error().Err(err).Msg("error occurred while get peers count count")
+		return
+	}
+	sc, lc = uint64(sc32), uint64(lc32)
+	if len(s.InfoHashCountQuery) > 0 {
+		err = s.QueryRow(ctx, s.InfoHashCountQuery).Scan(&hc)
+		if err = noResultErr(err); err != nil {
+			logger.Error().Err(err).Msg("error occurred while get info hash count")
+		}
+	}
+	return
+}
+
 func (s *store) putPeer(ctx context.Context, ih []byte, peer bittorrent.Peer, seeder bool) (err error) {
 	logger.Trace().
 		Hex("infoHash", ih).
 		Object("peer", peer).
 		Bool("seeder", seeder).
 		Msg("put peer")
+	if s.writeBuffer != nil {
+		return s.bufferPeer(ctx, ih, peer, seeder, false)
+	}
 	_, err = s.Exec(ctx, s.Peer.AddQuery, pgx.NamedArgs{
 		pInfoHash: ih,
 		pPeerID:   peer.ID.Bytes(),
@@ -405,6 +539,9 @@ func (s *store) delPeer(ctx context.Context, ih []byte, peer bittorrent.Peer, se
 		Hex("infoHash", ih).
 		Object("peer", peer).
 		Msg("del peer")
+	if s.writeBuffer != nil {
+		return s.bufferPeer(ctx, ih, peer, seeder, true)
+	}
 	_, err = s.Exec(ctx, s.Peer.DelQuery, pgx.NamedArgs{
 		pInfoHash: ih,
 		pPeerID:   peer.ID.Bytes(),
@@ -436,25 +573,33 @@ func (s *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pee
 		Stringer("infoHash", ih).
 		Object("peer", peer).
 		Msg("graduate leecher")
-	var batch pgx.Batch
 	ihb := ih.Bytes()
-	batch.Queue(s.Peer.GraduateQuery, pgx.NamedArgs{
-		pInfoHash: ihb,
-		pPeerID:   peer.ID.Bytes(),
-		pAddress:  net.IP(peer.Addr().AsSlice()),
-		pPort:     peer.Port(),
-	})
-	batch.Queue(s.Downloads.IncrementQuery, pgx.NamedArgs{pInfoHash: ihb})
-	return s.txBatch(ctx, &batch)
+	update := func() error {
+		var batch pgx.Batch
+		batch.Queue(s.Peer.GraduateQuery, pgx.NamedArgs{
+			pInfoHash: ihb,
+			pPeerID:   peer.ID.Bytes(),
+			pAddress:  net.IP(peer.Addr().AsSlice()),
+			pPort:     peer.Port(),
+		})
+		batch.Queue(s.Downloads.IncrementQuery, pgx.NamedArgs{pInfoHash: ihb})
+		return s.txBatch(ctx, &batch)
+	}
+	if s.writeBuffer != nil {
+		return s.writeBuffer.graduate(ihb, peer, update)
+	}
+	return update()
 }
 
 func (s *store) getPeers(ctx context.Context, ih []byte, seeders bool, maxCount int, isV6 bool) (peers []bittorrent.Peer, err error) {
 	var rows pgx.Rows
+	excl := storage.ExclusionFromContext(ctx)
 	if rows, err = s.Query(ctx, s.Announce.Query, pgx.NamedArgs{
 		pInfoHash: ih,
 		pSeeder:   seeders,
 		pV6:       isV6,
-		pCount:    maxCount,
+		// excluded peers are skipped while scanning
+		pCount: maxCount + len(excl.Peers),
 	}); err == nil {
 		defer rows.Close()
 		idIndex, ipIndex, portIndex := -1, -1, -1
@@ -505,7 +650,9 @@ func (s *store) getPeers(ctx context.Context, ih []byte, seeders bool, maxCount
 				}
 			}
 			if err == nil {
-				peers = append(peers, peer)
+				if !excl.Excludes(peer) {
+					peers = append(peers, peer)
+				}
 			} else {
 				logger.Warn().
 					Err(err).
@@ -608,12 +755,18 @@ func (s *store) Ping(ctx context.Context) error {
 	return err
 }
 
-func (s *store) Close() error {
-	go func() {
+func (s *store) Close() (err error) {
+	s.onceCloser.Do(func() {
 		close(s.closed)
-		s.wg.Wait()
-		logger.Info().Msg("pg exiting. mochi does not clear data in database when exiting.")
-		s.Pool.Close()
-	}()
-	return nil
+		if s.writeBuffer != nil {
+			// waited synchronously, so buffered peers are not lost if process exits right after Close
+			err = <-s.flushed
+		}
+		go func() {
+			s.wg.Wait()
+			logger.Info().Msg("pg exiting. mochi does not clear data in database when exiting.")
+			s.Pool.Close()
+		}()
+	})
+	return
 }
@@ -3,16 +3,24 @@ package pg
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
 
 const (
-	createTablesQuery = `
-DROP TABLE IF EXISTS mo_peers;
-CREATE UNLOGGED TABLE mo_peers (
+	dropTablesQuery = "DROP TABLE IF EXISTS mo_peers, mo_downloads, mo_kv, mo_schema_version"
+
+	// createCustomTablesQuery creates tables for customCfg,
+	// which are not managed by storage
+	createCustomTablesQuery = `
+DROP TABLE IF EXISTS custom_peers;
+CREATE UNLOGGED TABLE custom_peers (
 	info_hash bytea NOT NULL,
 	peer_id bytea NOT NULL,
 	address inet NOT NULL,
@@ -23,17 +31,17 @@ CREATE UNLOGGED TABLE mo_peers (
 	PRIMARY KEY (info_hash, peer_id, address, port)
 );
 
-CREATE INDEX mo_peers_created_idx ON mo_peers(created);
-CREATE INDEX mo_peers_announce_idx ON mo_peers(info_hash, is_seeder, is_v6);
+CREATE INDEX custom_peers_created_idx ON custom_peers(created);
+CREATE INDEX custom_peers_announce_idx ON custom_peers(info_hash, is_seeder, is_v6);
 
-DROP TABLE IF EXISTS mo_downloads;
-CREATE UNLOGGED TABLE mo_downloads (
+DROP TABLE IF EXISTS custom_downloads;
+CREATE UNLOGGED TABLE custom_downloads (
 	info_hash bytea PRIMARY KEY NOT NULL,
 	downloads int NOT NULL DEFAULT 1
 );
 
-DROP TABLE IF EXISTS mo_kv;
-CREATE TABLE mo_kv (
+DROP TABLE IF EXISTS custom_kv;
+CREATE TABLE custom_kv (
 	context varchar NOT NULL,
 	name bytea NOT NULL,
 	value bytea,
@@ -45,32 +53,47 @@ CREATE TABLE mo_kv (
 var cfg = config{
 	ConnectionString: "host=127.0.0.1 database=test user=postgres pool_max_conns=50",
 	PingQuery:        "SELECT 1",
+	Schema:           schemaConf{Unlogged: true},
+}
+
+// customCfg is the configuration with explicit queries and unmanaged schema
+var customCfg = config{
+	ConnectionString: "host=127.0.0.1 database=test user=postgres pool_max_conns=50",
+	PingQuery:        "SELECT 1",
+	Schema:           schemaConf{Unmanaged: true},
 	Peer: peerQueryConf{
-		AddQuery:            "INSERT INTO mo_peers VALUES(@info_hash, @peer_id, @address, @port, @is_seeder, @is_v6, @created) ON CONFLICT (info_hash, peer_id, address, port) DO UPDATE SET created = EXCLUDED.created, is_seeder = EXCLUDED.is_seeder",
-		DelQuery:            "DELETE FROM mo_peers WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND is_seeder=@is_seeder",
-		GraduateQuery:       "UPDATE mo_peers SET is_seeder=TRUE WHERE info_hash=@info_hash AND peer_id=peer_id AND address=@address AND port=@port AND NOT is_seeder",
-		CountQuery:          "SELECT COUNT(1) FILTER (WHERE is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT is_seeder) AS leechers FROM mo_peers",
+		AddQuery:            "INSERT INTO custom_peers VALUES(@info_hash, @peer_id, @address, @port, @is_seeder, @is_v6, @created) ON CONFLICT (info_hash, peer_id, address, port) DO UPDATE SET created = EXCLUDED.created, is_seeder = EXCLUDED.is_seeder",
+		DelQuery:            "DELETE FROM custom_peers WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND is_seeder=@is_seeder",
+		GraduateQuery:       "UPDATE custom_peers SET is_seeder=TRUE WHERE info_hash=@info_hash AND peer_id=@peer_id AND address=@address AND port=@port AND NOT is_seeder",
+		CountQuery:          "SELECT COUNT(1) FILTER (WHERE is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT is_seeder) AS leechers FROM custom_peers",
 		CountSeedersColumn:  "seeders",
 		CountLeechersColumn: "leechers",
 		ByInfoHashClause:    "WHERE info_hash = @info_hash",
 	},
 	Announce: announceQueryConf{
-		Query:         "SELECT peer_id, address, port FROM mo_peers WHERE info_hash=@info_hash AND is_seeder=@is_seeder AND is_v6=@is_v6 LIMIT @count",
+		Query:         "SELECT peer_id, address, port FROM custom_peers WHERE info_hash=@info_hash AND is_seeder=@is_seeder AND is_v6=@is_v6 LIMIT @count",
 		PeerIDColumn:  "peer_id",
 		AddressColumn: "address",
 		PortColumn:    "port",
 	},
 	Downloads: downloadQueryConf{
-		GetQuery:       "SELECT downloads FROM mo_downloads where info_hash=@info_hash",
-		IncrementQuery: "INSERT INTO mo_downloads VALUES(@info_hash) ON CONFLICT(info_hash) DO UPDATE SET downloads = mo_downloads.downloads + 1",
+		GetQuery:       "SELECT downloads FROM custom_downloads where info_hash=@info_hash",
+		IncrementQuery: "INSERT INTO custom_downloads VALUES(@info_hash) ON CONFLICT(info_hash) DO UPDATE SET downloads = custom_downloads.downloads + 1",
 	},
 	Data: dataQueryConf{
-		AddQuery: "INSERT INTO mo_kv VALUES(@context, @key, @value) ON CONFLICT (context, name) DO NOTHING",
-		GetQuery: "SELECT value FROM mo_kv WHERE context=@context AND name=@key",
-		DelQuery: "DELETE FROM mo_kv WHERE context=@context AND name = ANY(@key)",
+		AddQuery: "INSERT INTO custom_kv VALUES(@context, @key, @value) ON CONFLICT (context, name) DO NOTHING",
+		GetQuery: "SELECT value FROM custom_kv WHERE context=@context AND name=@key",
+		DelQuery: "DELETE FROM custom_kv WHERE context=@context AND name = ANY(@key)",
 	},
-	GCQuery:            "DELETE FROM mo_peers WHERE created <= @created",
-	InfoHashCountQuery: "SELECT COUNT(DISTINCT info_hash) as info_hashes FROM mo_peers",
+	Iterate: iterateQueryConf{
+		InfoHashesQuery: "SELECT p.info_hash, COUNT(1) FILTER (WHERE p.is_seeder) AS seeders, COUNT(1) FILTER (WHERE NOT p.is_seeder) AS leechers, MAX(d.downloads) AS downloads FROM custom_peers p LEFT JOIN custom_downloads d ON d.info_hash = p.info_hash WHERE p.info_hash > @info_hash GROUP BY p.info_hash ORDER BY p.info_hash LIMIT @count",
+		InfoHashColumn:  "info_hash",
+		DownloadsColumn: "downloads",
+		PeersQuery:      "SELECT peer_id, address, port, is_seeder FROM custom_peers WHERE info_hash=@info_hash ORDER BY is_seeder DESC, peer_id, address, port LIMIT @count OFFSET @offset",
+		SeederColumn:    "is_seeder",
+	},
+	GCQuery:            "DELETE FROM custom_peers WHERE created <= @created",
+	InfoHashCountQuery: "SELECT COUNT(DISTINCT info_hash) as info_hashes FROM custom_peers",
 }
 
 func createNew() s.PeerStorage {
@@ -80,17 +103,85 @@ func createNew() s.PeerStorage {
 	if err != nil {
 		panic(fmt.Sprint("invalid configuration: ", err))
 	}
+	var con *pgx.Conn
+	if con, err = pgx.Connect(context.Background(), cfg.ConnectionString); err != nil {
+		panic(fmt.Sprint("Unable to create PostgreSQL connection: ", err, "\nThis driver needs real PostgreSQL instance"))
+	}
+	defer con.Close(context.Background())
+	if _, err = con.Exec(context.Background(), dropTablesQuery); err != nil {
+		panic(fmt.Sprint("Unable to drop test PostgreSQL tables: ", err))
+	}
 	ps, err = newStore(cfg)
+	if err != nil {
+		panic(fmt.Sprint("Unable to create PostgreSQL storage: ", err))
+	}
+	return ps
+}
+
+func createNewCustom() s.PeerStorage {
+	var ps s.PeerStorage
+	var err error
+	customCfg, err = customCfg.validateFull()
+	if err != nil {
+		panic(fmt.Sprint("invalid configuration: ", err))
+	}
+	ps, err = newStore(customCfg)
 	if err != nil {
 		panic(fmt.Sprint("Unable to create PostgreSQL connection: ", err, "\nThis driver needs real PostgreSQL instance"))
 	}
-	pss := ps.(*store)
-	if _, err = pss.Exec(context.Background(), createTablesQuery); err != nil {
+	if _, err = ps.(iterableStore).Exec(context.Background(), createCustomTablesQuery); err != nil {
 		panic(fmt.Sprint("Unable to create test PostgreSQL tables: ", err))
 	}
 	return ps
 }
 
+func TestConfigDefaults(t *testing.T) {
+	const customQuery = "DELETE FROM peers WHERE created <= @created"
+	c, err := config{ConnectionString: "host=127.0.0.1", GCQuery: customQuery}.validateFull()
+	require.Nil(t, err)
+	require.Equal(t, defaultPeerAddQuery, c.Peer.AddQuery)
+	require.Equal(t, strings.ToUpper(defaultAnnouncePeerIDColumn), c.Announce.PeerIDColumn)
+	require.Equal(t, defaultIterateInfoHashesQuery, c.Iterate.InfoHashesQuery)
+	require.Equal(t, customQuery, c.GCQuery)
+
+	c, err = config{ConnectionString: "host=127.0.0.1", Schema: schemaConf{Unmanaged: true}}.validateFull()
+	require.Nil(t, err)
+	require.Equal(t, defaultPeerAddQuery, c.Peer.AddQuery)
+	require.Empty(t, c.Iterate.InfoHashesQuery)
+	require.Empty(t, c.GCQuery)
+
+	// custom queries disable migrations
+	c, err = config{ConnectionString: "host=127.0.0.1", Peer: peerQueryConf{AddQuery: customCfg.Peer.AddQuery}}.validateFull()
+	require.Nil(t, err)
+	require.True(t, c.Schema.Unmanaged)
+	require.Empty(t, c.GCQuery)
+
+	_, err = config{}.validateFull()
+	require.ErrorIs(t, err, errConnectionStringNotProvided)
+}
+
+func TestIteratorWrap(t *testing.T) {
+	c, err := config{ConnectionString: "host=127.0.0.1"}.validateFull()
+	require.Nil(t, err)
+	_, isOk := (&store{config: c}).wrap().(s.Iterator)
+	require.True(t, isOk)
+
+	c, err = config{ConnectionString: "host=127.0.0.1", Schema: schemaConf{Unmanaged: true}}.validateFull()
+	require.Nil(t, err)
+	_, isOk = (&store{config: c}).wrap().(s.Iterator)
+	require.False(t, isOk)
+}
+
+func TestCreateTablesPartitions(t *testing.T) {
+	stmts := strings.Join(createTables(schemaConf{Unlogged: true, Partitions: 4}), ";\n")
+	require.Contains(t, stmts, "PARTITION BY HASH (info_hash)")
+	require.Contains(t, stmts, "CREATE UNLOGGED TABLE IF NOT EXISTS mo_peers_3 PARTITION OF mo_peers FOR VALUES WITH (MODULUS 4, REMAINDER 3)")
+	require.NotContains(t, stmts, "UNLOGGED TABLE IF NOT EXISTS mo_peers (")
+	require.NotContains(t, stmts, "mo_peers_4")
+}
+
 func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
 
+func TestStorageCustomQueries(t *testing.T) { test.RunTests(t, createNewCustom()) }
+
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
@@ -0,0 +1,297 @@
+package pg
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/timecache"
+)
+
+const (
+	defaultFlushInterval = time.Second
+	defaultFlushAttempts = 3
+
+	// Built-in queries of write buffer, which add or delete all peers
+	// of one batch with array parameters
+	defaultBatchAddQuery = "INSERT INTO mo_peers SELECT * FROM unnest(@info_hash::bytea[], @peer_id::bytea[], @address::inet[], @port::int4[], @is_seeder::bool[], @is_v6::bool[], @created::timestamp[]) ON CONFLICT (info_hash, peer_id, address, port) DO UPDATE SET created = EXCLUDED.created, is_seeder = EXCLUDED.is_seeder"
+	defaultBatchDelQuery = "DELETE FROM mo_peers p USING unnest(@info_hash::bytea[], @peer_id::bytea[], @address::inet[], @port::int4[], @is_seeder::bool[]) AS d(info_hash, peer_id, address, port, is_seeder) WHERE p.info_hash = d.info_hash AND p.peer_id = d.peer_id AND p.address = d.address AND p.port = d.port AND p.is_seeder = d.is_seeder"
+)
+
+func init() {
+	prometheus.MustRegister(promBatchSize, promBatchFlushDurationMilliseconds)
+}
+
+var (
+	promBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mochi_storage_pg_batch_size",
+		Help:    "The number of peer operations flushed by one batch",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	})
+
+	promBatchFlushDurationMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mochi_storage_pg_batch_flush_duration_milliseconds",
+		Help:    "The time it takes to flush batch of peer operations",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 16),
+	})
+)
+
+type writeBufferConf struct {
+	// BatchSize is the number of buffered peers, which triggers flush,
+	// 0 disables buffering
+	BatchSize     int           `cfg:"batch_size"`
+	FlushInterval time.Duration `cfg:"flush_interval"`
+	// MaxPending is the maximal number of buffered peers,
+	// writers wait for flush if buffer is full
+	MaxPending int `cfg:"max_pending"`
+	// FlushAttempts is the number of flushes of peer operation,
+	// after which failed operation is dropped
+	FlushAttempts int    `cfg:"flush_attempts"`
+	AddQuery      string `cfg:"add_query"`
+	DelQuery      string `cfg:"del_query"`
+}
+
+// peerKey is the identity of peer row
+type peerKey struct {
+	ih   string
+	id   bittorrent.PeerID
+	addr netip.AddrPort
+}
+
+// peerOp is the pending operation with peer
+type peerOp struct {
+	ih      []byte
+	peer    bittorrent.Peer
+	seeder  bool
+	created time.Time
+}
+
+// pendingOps holds operations with one peer: put is flushed before delete,
+// so sequence put-delete with the same seeder flag removes peer
+type pendingOps struct {
+	put, del *peerOp
+	// failures is the number of failed flushes of operations
+	failures int
+}
+
+// writeBuffer coalesces peer puts and deletes and flushes
+// them by batches in background, if number of buffered peers
+// reaches batch size or by timer.
+type writeBuffer struct {
+	batchSize, maxPending, attempts int
+	// flushFn writes batch to database, puts MUST be applied before deletes
+	flushFn func(ctx context.Context, puts, dels []peerOp) error
+	mu      sync.Mutex
+	pending map[peerKey]*pendingOps
+	// drained is closed (and replaced) when pending operations
+	// are taken for flush, writers of full buffer wait for it
+	drained chan struct{}
+	// full signals background flusher, that batch size is reached
+	full chan struct{}
+	// flushMu serializes flushes, so batches are applied in order they
+	// were collected
+	flushMu sync.Mutex
+}
+
+func newWriteBuffer(batchSize, maxPending, attempts int, flushFn func(ctx context.Context, puts, dels []peerOp) error) *writeBuffer {
+	return &writeBuffer{
+		batchSize:  batchSize,
+		maxPending: maxPending,
+		attempts:   attempts,
+		flushFn:    flushFn,
+		pending:    make(map[peerKey]*pendingOps, batchSize),
+		drained:    make(chan struct{}),
+		full:       make(chan struct{}, 1),
+	}
+}
+
+// add buffers operation and signals flusher if batch size is reached.
+// If buffer holds MaxPending peers, add waits until it is taken for flush.
+// The last put of peer replaces previous operations,
+// delete is ignored, if peer is put with another seeder flag.
+func (wb *writeBuffer) add(ctx context.Context, op peerOp, del bool) error {
+	k := peerKey{ih: string(op.ih), id: op.peer.ID, addr: op.peer.AddrPort}
+	wb.mu.Lock()
+	ops := wb.pending[k]
+	for ops == nil && len(wb.pending) >= wb.maxPending {
+		drained := wb.drained
+		wb.mu.Unlock()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		wb.mu.Lock()
+		ops = wb.pending[k]
+	}
+	if ops == nil {
+		ops = new(pendingOps)
+		wb.pending[k] = ops
+	}
+	switch {
+	case !del:
+		ops.put, ops.del = &op, nil
+	case ops.put == nil || ops.put.seeder == op.seeder:
+		ops.del = &op
+	}
+	full := len(wb.pending) >= wb.batchSize
+	wb.mu.Unlock()
+	if full {
+		select {
+		case wb.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// graduate marks buffered leecher as seeder, so leecher, which is not
+// flushed yet, will not be put after graduation, and calls updateFn,
+// which graduates already flushed leecher. Graduation waits for in-flight
+// flush, otherwise leecher, which is being flushed, is neither marked
+// in buffer nor updated in database.
+func (wb *writeBuffer) graduate(ih []byte, peer bittorrent.Peer, updateFn func() error) error {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+	wb.mu.Lock()
+	if ops := wb.pending[peerKey{ih: string(ih), id: peer.ID, addr: peer.AddrPort}]; ops != nil && ops.put != nil {
+		ops.put.seeder = true
+	}
+	wb.mu.Unlock()
+	return updateFn()
+}
+
+// flush writes all buffered operations. Operations of failed batch are
+// returned to buffer, unless they are replaced by newer operations with
+// the same peer or failed FlushAttempts times.
+func (wb *writeBuffer) flush(ctx context.Context) error {
+	wb.flushMu.Lock()
+	defer wb.flushMu.Unlock()
+	wb.mu.Lock()
+	pending := wb.pending
+	if len(pending) == 0 {
+		wb.mu.Unlock()
+		return nil
+	}
+	wb.pending = make(map[peerKey]*pendingOps, wb.batchSize)
+	close(wb.drained)
+	wb.drained = make(chan struct{})
+	wb.mu.Unlock()
+
+	var puts, dels []peerOp
+	for _, ops := range pending {
+		if ops.put != nil {
+			puts = append(puts, *ops.put)
+		}
+		if ops.del != nil {
+			dels = append(dels, *ops.del)
+		}
+	}
+	start := time.Now()
+	err := wb.flushFn(ctx, puts, dels)
+	promBatchFlushDurationMilliseconds.Observe(float64(time.Since(start).Nanoseconds()) / float64(time.Millisecond))
+	promBatchSize.Observe(float64(len(puts) + len(dels)))
+	if err != nil {
+		var requeued, dropped int
+		wb.mu.Lock()
+		for k, ops := range pending {
+			if _, exists := wb.pending[k]; exists {
+				continue
+			}
+			if ops.failures++; ops.failures < wb.attempts {
+				wb.pending[k] = ops
+				requeued++
+			} else {
+				dropped++
+			}
+		}
+		wb.mu.Unlock()
+		logger.Error().Err(err).
+			Int("puts", len(puts)).
+			Int("deletes", len(dels)).
+			Int("requeued", requeued).
+			Int("dropped", dropped).
+			Msg("unable to flush peers batch")
+	}
+	return err
+}
+
+// drain flushes buffer until it is empty or
+// all failed operations are dropped
+func (wb *writeBuffer) drain(ctx context.Context) (err error) {
+	for range wb.attempts {
+		if err = wb.flush(ctx); err == nil {
+			break
+		}
+	}
+	return
+}
+
+// flushPeers adds and deletes peers with batch queries in one transaction
+func (s *store) flushPeers(ctx context.Context, puts, dels []peerOp) error {
+	var batch pgx.Batch
+	if len(puts) > 0 {
+		args := peerArrays(puts)
+		isV6, created := make([]bool, len(puts)), make([]time.Time, len(puts))
+		for i, op := range puts {
+			isV6[i], created[i] = op.peer.Addr().Is6(), op.created
+		}
+		args[pV6], args[pCreated] = isV6, created
+		batch.Queue(s.WriteBuffer.AddQuery, args)
+	}
+	if len(dels) > 0 {
+		batch.Queue(s.WriteBuffer.DelQuery, peerArrays(dels))
+	}
+	return s.txBatch(ctx, &batch)
+}
+
+// peerArrays returns arguments for batch queries, common for puts and deletes
+func peerArrays(ops []peerOp) pgx.NamedArgs {
+	ihs, ids := make([][]byte, len(ops)), make([][]byte, len(ops))
+	addrs, ports := make([]net.IP, len(ops)), make([]int32, len(ops))
+	seeders := make([]bool, len(ops))
+	for i, op := range ops {
+		ihs[i], ids[i] = op.ih, op.peer.ID.Bytes()
+		addrs[i], ports[i] = net.IP(op.peer.Addr().AsSlice()), int32(op.peer.Port())
+		seeders[i] = op.seeder
+	}
+	return pgx.NamedArgs{
+		pInfoHash: ihs,
+		pPeerID:   ids,
+		pAddress:  addrs,
+		pPort:     ports,
+		pSeeder:   seeders,
+	}
+}
+
+// scheduleFlush starts background flush of write buffer by timer or if
+// batch size is reached. Buffer is drained when storage is closed,
+// result is sent to flushed channel.
+func (s *store) scheduleFlush(interval time.Duration) {
+	s.flushed = make(chan error, 1)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.closed:
+				s.flushed <- s.writeBuffer.drain(context.Background())
+				return
+			case <-t.C:
+			case <-s.writeBuffer.full:
+			}
+			_ = s.writeBuffer.flush(context.Background())
+		}
+	}()
+}
+
+// bufferPeer adds peer operation to write buffer
+func (s *store) bufferPeer(ctx context.Context, ih []byte, peer bittorrent.Peer, seeder, del bool) error {
+	return s.writeBuffer.add(ctx, peerOp{ih: ih, peer: peer, seeder: seeder, created: timecache.Now()}, del)
+}
@@ -0,0 +1,168 @@
+package pg
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+)
+
+type flushedOps struct {
+	puts, dels []peerOp
+}
+
+func (f *flushedOps) flush(_ context.Context, puts, dels []peerOp) error {
+	f.puts, f.dels = append(f.puts, puts...), append(f.dels, dels...)
+	return nil
+}
+
+func testPeer(port uint16) bittorrent.Peer {
+	id, _ := bittorrent.NewPeerID([]byte("-MO0001-000000000000"))
+	return bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port)}
+}
+
+func TestWriteBufferCoalesce(t *testing.T) {
+	ctx, ih := context.Background(), []byte("01234567890123456789")
+	var f flushedOps
+	wb := newWriteBuffer(100, 400, 3, f.flush)
+
+	// put - put: the last put wins
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(1), seeder: false}, false))
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(1), seeder: true}, false))
+	// put - delete with the same flag: both flushed
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(2), seeder: true}, false))
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(2), seeder: true}, true))
+	// put - delete with another flag: delete ignored
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(3), seeder: false}, false))
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(3), seeder: true}, true))
+	// delete - put: put only
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(4), seeder: false}, true))
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(4), seeder: false}, false))
+	// buffered leecher graduated
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(5), seeder: false}, false))
+	require.Nil(t, wb.graduate(ih, testPeer(5), func() error { return nil }))
+
+	require.Nil(t, wb.flush(ctx))
+	require.Len(t, f.puts, 5)
+	require.Len(t, f.dels, 1)
+	require.Equal(t, uint16(2), f.dels[0].peer.Port())
+	for _, op := range f.puts {
+		switch op.peer.Port() {
+		case 1, 2, 5:
+			require.True(t, op.seeder)
+		default:
+			require.False(t, op.seeder)
+		}
+	}
+
+	// nothing left after flush
+	f = flushedOps{}
+	require.Nil(t, wb.flush(ctx))
+	require.Empty(t, f.puts)
+	require.Empty(t, f.dels)
+}
+
+func TestWriteBufferSignalOnBatchSize(t *testing.T) {
+	ctx, ih := context.Background(), []byte("01234567890123456789")
+	var f flushedOps
+	wb := newWriteBuffer(3, 12, 3, f.flush)
+	for i := uint16(1); i <= 2; i++ {
+		require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(i)}, false))
+	}
+	require.Empty(t, wb.full)
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(3)}, false))
+	require.Len(t, wb.full, 1)
+	// writer does not flush itself
+	require.Empty(t, f.puts)
+}
+
+func TestWriteBufferMaxPending(t *testing.T) {
+	ih := []byte("01234567890123456789")
+	var f flushedOps
+	wb := newWriteBuffer(1, 2, 3, f.flush)
+	require.Nil(t, wb.add(context.Background(), peerOp{ih: ih, peer: testPeer(1)}, false))
+	require.Nil(t, wb.add(context.Background(), peerOp{ih: ih, peer: testPeer(2)}, false))
+	// buffered peer may be updated while buffer is full
+	require.Nil(t, wb.add(context.Background(), peerOp{ih: ih, peer: testPeer(2), seeder: true}, false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(3)}, false), context.DeadlineExceeded)
+
+	added := make(chan error)
+	go func() { added <- wb.add(context.Background(), peerOp{ih: ih, peer: testPeer(3)}, false) }()
+	require.Nil(t, wb.flush(context.Background()))
+	require.Nil(t, <-added)
+	require.Len(t, f.puts, 2)
+}
+
+func TestWriteBufferRetry(t *testing.T) {
+	ctx, ih := context.Background(), []byte("01234567890123456789")
+	errFlush := errors.New("flush failed")
+	var f flushedOps
+	failures := 0
+	wb := newWriteBuffer(10, 40, 2, func(ctx context.Context, puts, dels []peerOp) error {
+		if failures > 0 {
+			failures--
+			return errFlush
+		}
+		return f.flush(ctx, puts, dels)
+	})
+
+	// failed batch is requeued, newer operation replaces failed one
+	failures = 1
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(1)}, false))
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(2)}, false))
+	require.ErrorIs(t, wb.flush(ctx), errFlush)
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(2), seeder: true}, false))
+	require.Nil(t, wb.flush(ctx))
+	require.Len(t, f.puts, 2)
+	for _, op := range f.puts {
+		require.Equal(t, op.peer.Port() == 2, op.seeder)
+	}
+
+	// operations are dropped after FlushAttempts failures
+	f, failures = flushedOps{}, 2
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(3)}, false))
+	require.ErrorIs(t, wb.drain(ctx), errFlush)
+	require.Nil(t, wb.flush(ctx))
+	require.Empty(t, f.puts)
+}
+
+func TestWriteBufferGraduateWaitsFlush(t *testing.T) {
+	ctx, ih := context.Background(), []byte("01234567890123456789")
+	var f flushedOps
+	flushing, release := make(chan struct{}), make(chan struct{})
+	wb := newWriteBuffer(10, 40, 3, func(ctx context.Context, puts, dels []peerOp) error {
+		close(flushing)
+		<-release
+		return f.flush(ctx, puts, dels)
+	})
+	require.Nil(t, wb.add(ctx, peerOp{ih: ih, peer: testPeer(1)}, false))
+	flushed := make(chan error)
+	go func() { flushed <- wb.flush(ctx) }()
+	<-flushing
+
+	// leecher is taken for flush, so it is updated only after flush completed
+	graduated, flushedPuts := make(chan error), 0
+	go func() {
+		graduated <- wb.graduate(ih, testPeer(1), func() error {
+			flushedPuts = len(f.puts)
+			return nil
+		})
+	}()
+	select {
+	case <-graduated:
+		t.Fatal("graduation did not wait for in-flight flush")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	require.Nil(t, <-flushed)
+	require.Nil(t, <-graduated)
+	require.Equal(t, 1, flushedPuts)
+}
@@ -0,0 +1,178 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/storage"
+)
+
+// iterateBatchSize is the COUNT hint for SCAN-family commands
+const iterateBatchSize = 100
+
+// ScanFn returns the next portion of elements of server-side iteration (SCAN, SSCAN etc.)
+// for key (if applicable) and the next server cursor (0 if iteration is complete)
+type ScanFn func(ctx context.Context, key string, cursor uint64) (elements []string, next uint64, err error)
+
+// scanCursor is the position of iteration:
+// stage (index of the key being scanned), server-side cursor
+// and number of elements of the current page already passed to callback
+type scanCursor struct {
+	stage  int
+	server uint64
+	skip   int
+}
+
+func parseScanCursor(s string) (c scanCursor, err error) {
+	if len(s) > 0 {
+		if _, err = fmt.Sscanf(s, "%d:%d:%d", &c.stage, &c.server, &c.skip); err != nil || c.stage < 0 || c.skip < 0 {
+			err = storage.ErrInvalidCursor
+		}
+	}
+	return
+}
+
+func (c scanCursor) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.stage, c.server, c.skip)
+}
+
+// scanFrom calls fn for each element returned by scanFn for key
+// until fn returns false. If so, returns cursor to continue from and
+// true, otherwise, if all elements are scanned, returns false.
+func scanFrom(ctx context.Context, c scanCursor, key string, scanFn ScanFn, fn func(string) bool) (scanCursor, bool, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return c, false, err
+		}
+		elements, next, err := scanFn(ctx, key, c.server)
+		if err = NoResultErr(err); err != nil {
+			return c, false, err
+		}
+		for i := c.skip; i < len(elements); i++ {
+			if !fn(elements[i]) {
+				c.skip = i + 1
+				return c, true, nil
+			}
+		}
+		if next == 0 {
+			return c, false, nil
+		}
+		c.server, c.skip = next, 0
+	}
+}
+
+// infoHashFromKey extracts info hash from peers key and returns
+// index of key in infoHashKeys or -1 if key is not peers key
+func infoHashFromKey(key string) (idx int, infoHash string) {
+	for i, prefix := range [...]string{IH4LeecherKey, IH6LeecherKey, IH4SeederKey, IH6SeederKey} {
+		if tag, found := strings.CutPrefix(key, prefix); found {
+			if strings.HasPrefix(tag, "{#") && strings.HasSuffix(tag, "}") {
+				return i, tag[2 : len(tag)-1]
+			}
+			// key written before hashtags were introduced
+			return i, tag
+		}
+	}
+	return -1, ""
+}
+
+// ScanSwarms iterates over info hash keys, returned by keysFn, and calls fn
+// with peers counts (calculated by countFn) of each swarm.
+// Swarm is reported only for the first non-empty key from infoHashKeys.
+func (ps *Connection) ScanSwarms(ctx context.Context, cursor string, keysFn ScanFn, countFn getPeerCountFn, fn func(storage.SwarmInfo) bool) (string, error) {
+	c, err := parseScanCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	var stopped bool
+	var fnErr error
+	c, stopped, err = scanFrom(ctx, c, "", keysFn, func(key string) bool {
+		idx, infoHash := infoHashFromKey(key)
+		if idx < 0 {
+			return true
+		}
+		var counts [4]int64
+		if counts, fnErr = countPeers(ctx, infoHash, countFn); fnErr != nil {
+			return false
+		}
+		for i := 0; i < idx; i++ {
+			if counts[i] > 0 {
+				// swarm is reported by another key
+				return true
+			}
+		}
+		if counts[idx] == 0 {
+			return true
+		}
+		si := storage.SwarmInfo{
+			InfoHash: bittorrent.InfoHash(infoHash),
+			Leechers: uint32(counts[0] + counts[1]),
+			Seeders:  uint32(counts[2] + counts[3]),
+		}
+		var dc int64
+		dc, fnErr = ps.HGet(ctx, CountDownloadsKey, infoHash).Int64()
+		if fnErr = NoResultErr(fnErr); fnErr != nil {
+			return false
+		}
+		si.Snatches = uint32(dc)
+		return fn(si)
+	})
+	if err == nil {
+		err = fnErr
+	}
+	if err != nil || !stopped {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// ScanPeers iterates over members of peers keys of info hash (in infoHashKeys order),
+// returned by membersFn, and calls fn for each decoded peer.
+func (ps *Connection) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, membersFn ScanFn, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	c, err := parseScanCursor(cursor)
+	if err != nil {
+		return "", err
+	}
+	keys := infoHashKeys(ih.RawString())
+	for ; c.stage < len(keys); c = (scanCursor{stage: c.stage + 1}) {
+		seeder := c.stage >= 2
+		var stopped bool
+		c, stopped, err = scanFrom(ctx, c, keys[c.stage], membersFn, func(member string) bool {
+			p, err := UnpackPeer(member)
+			if err != nil {
+				logger.Error().Err(err).Str("peerID", member).Msg("unable to decode peer")
+				return true
+			}
+			return fn(p, seeder)
+		})
+		if err != nil {
+			return "", err
+		}
+		if stopped {
+			return c.String(), nil
+		}
+	}
+	return "", nil
+}
+
+var _ storage.Iterator = &store{}
+
+func (ps *store) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	return ps.Connection.ScanSwarms(ctx, cursor, func(ctx context.Context, _ string, cursor uint64) ([]string, uint64, error) {
+		return ps.SScan(ctx, IHKey, cursor, "", iterateBatchSize).Result()
+	}, ps.HLen, fn)
+}
+
+func (ps *store) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	return ps.Connection.ScanPeers(ctx, ih, cursor, func(ctx context.Context, key string, cursor uint64) ([]string, uint64, error) {
+		fieldValues, next, err := ps.HScan(ctx, key, cursor, "", iterateBatchSize).Result()
+		// HSCAN returns field-value pairs, values (timestamps) are not needed
+		fields := make([]string, 0, len(fieldValues)/2)
+		for i := 0; i < len(fieldValues); i += 2 {
+			fields = append(fields, fieldValues[i])
+		}
+		return fields, next, err
+	}, fn)
+}
@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Server-side scripts, which modify peers hash together with counters and
+// info hash set atomically.
+//
+// All peers hashes of one info hash share hashtag (see InfoHashKey), so
+// in cluster mode peer is moved between leechers and seeders hashes
+// by one script too. Counters, info hash set and downloads hash are global
+// keys, which can not share slot with all peers hashes, so in cluster mode
+// they are not passed to script (optional keys are nil), and caller updates
+// them with returned values by separate pipelined commands. If MoChi stops
+// between script and pipeline, counters and info hash set may drift
+// from peers hashes.
+var (
+	// putPeerScript adds peer to hash and, if it is new, increments counter.
+	// KEYS: peers hash, [peers count, info hashes set]
+	// ARGV: peer, timestamp, [peer TTL]
+	// Returns 1 if peer added, 0 if updated.
+	putPeerScript = redis.NewScript(`
+local added = redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if ARGV[3] then
+	redis.call('HEXPIRE', KEYS[1], ARGV[3], 'FIELDS', 1, ARGV[1])
+end
+if KEYS[2] then
+	if added > 0 then
+		redis.call('INCR', KEYS[2])
+	end
+	redis.call('SADD', KEYS[3], KEYS[1])
+end
+return added
+`)
+
+	// delPeerScript deletes peer from hash and, if it existed, decrements counter.
+	// KEYS: peers hash, [peers count, info hashes set]
+	// ARGV: peer
+	// Returns 1 if peer deleted, 0 if it not exists.
+	delPeerScript = redis.NewScript(`
+local deleted = redis.call('HDEL', KEYS[1], ARGV[1])
+if KEYS[2] and deleted > 0 then
+	redis.call('DECR', KEYS[2])
+	if redis.call('HLEN', KEYS[1]) == 0 then
+		redis.call('SREM', KEYS[3], KEYS[1])
+	end
+end
+return deleted
+`)
+
+	// graduateLeecherScript moves peer from leechers hash to seeders
+	// and increments downloads count.
+	// KEYS: leechers hash, seeders hash, [leechers count, seeders count, info hashes set, downloads hash]
+	// ARGV: peer, timestamp, info hash, [peer TTL]
+	// Returns 1 if peer deleted from leechers (0 if it not exists) and 1 if peer
+	// added to seeders (0 if updated).
+	graduateLeecherScript = redis.NewScript(`
+local deleted = redis.call('HDEL', KEYS[1], ARGV[1])
+local added = redis.call('HSET', KEYS[2], ARGV[1], ARGV[2])
+if ARGV[4] then
+	redis.call('HEXPIRE', KEYS[2], ARGV[4], 'FIELDS', 1, ARGV[1])
+end
+if KEYS[3] then
+	if deleted > 0 then
+		redis.call('DECR', KEYS[3])
+		if redis.call('HLEN', KEYS[1]) == 0 then
+			redis.call('SREM', KEYS[5], KEYS[1])
+		end
+	end
+	if added > 0 then
+		redis.call('INCR', KEYS[4])
+	end
+	redis.call('SADD', KEYS[5], KEYS[2])
+	redis.call('HINCRBY', KEYS[6], ARGV[3], 1)
+end
+return {deleted, added}
+`)
+
+	// expirePeersScript deletes provided peers, which timestamps are not
+	// greater than cutoff, so peers announced after GC fetched hash are kept.
+	// KEYS: peers hash, [peers count, info hashes set]
+	// ARGV: cutoff, peers...
+	// Returns number of deleted peers and number of remaining peers.
+	expirePeersScript = redis.NewScript(`
+local cutoff, removed = tonumber(ARGV[1]), 0
+for i = 2, #ARGV do
+	local mtime = redis.call('HGET', KEYS[1], ARGV[i])
+	if mtime and tonumber(mtime) <= cutoff then
+		removed = removed + redis.call('HDEL', KEYS[1], ARGV[i])
+	end
+end
+local remaining = redis.call('HLEN', KEYS[1])
+if KEYS[2] then
+	if removed > 0 then
+		redis.call('DECRBY', KEYS[2], removed)
+	end
+	if remaining == 0 then
+		redis.call('SREM', KEYS[3], KEYS[1])
+	end
+end
+return {removed, remaining}
+`)
+
+	// expireFieldsScript sets TTL to peers, which do not have it, i.e. written
+	// before server upgrade or by instance, which does not use HEXPIRE.
+	// Fields are passed to HEXPIRE by chunks because of Lua stack limit.
+	// KEYS: peers hash
+	// ARGV: peer TTL
+	// Returns number of peers.
+	expireFieldsScript = redis.NewScript(`
+local fields = redis.call('HKEYS', KEYS[1])
+for i = 1, #fields, 1000 do
+	local chunk = {unpack(fields, i, math.min(i + 999, #fields))}
+	redis.call('HEXPIRE', KEYS[1], ARGV[1], 'NX', 'FIELDS', #chunk, unpack(chunk))
+end
+return #fields
+`)
+
+	// countPeersScript returns number of peers in hash and, if it is empty,
+	// removes hash from info hashes set.
+	// KEYS: peers hash, [peers count, info hashes set]
+	// Returns number of peers.
+	countPeersScript = redis.NewScript(`
+local n = redis.call('HLEN', KEYS[1])
+if KEYS[2] and n == 0 then
+	redis.call('SREM', KEYS[3], KEYS[1])
+end
+return n
+`)
+
+	scripts = []*redis.Script{
+		putPeerScript, delPeerScript, graduateLeecherScript,
+		expirePeersScript, expireFieldsScript, countPeersScript,
+	}
+)
+
+// loadScripts preloads scripts, so they can be called by SHA.
+// Scripts are also loaded on demand if server responds with NOSCRIPT
+// (i.e. after restart), so error is only logged.
+func (ps *store) loadScripts(ctx context.Context) {
+	for _, s := range scripts {
+		if err := s.Load(ctx, ps.UniversalClient).Err(); err != nil {
+			logger.Warn().Err(err).Msg("unable to preload script")
+		}
+	}
+}
+
+// withFieldTTL appends peer TTL to script arguments
+// if server supports hash fields expiration
+func (ps *store) withFieldTTL(args ...any) []any {
+	if ps.fieldTTL > 0 {
+		args = append(args, ps.fieldTTL)
+	}
+	return args
+}
+
+// scriptKeys returns keys, which should be passed to script:
+// all keys in standalone mode, and only peers hash key in cluster mode
+func (ps *store) scriptKeys(peersKey, countKey string) []string {
+	if ps.cluster {
+		return []string{peersKey}
+	}
+	return []string{peersKey, countKey, IHKey}
+}
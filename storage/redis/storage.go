@@ -20,6 +20,9 @@
 //
 //   - CHI_C_L (key type)
 //     To record the number of leechers.
+//
+// Peers hashes, counters and info hash set are modified by server-side scripts
+// (see scripts.go).
 package redis
 
 import (
@@ -73,6 +76,8 @@ const (
 	CountLeecherKey = "CHI_C_L"
 	// CountDownloadsKey redis key for snatches (downloads) count
 	CountDownloadsKey = "CHI_D"
+	// hExpireCmd is the command to set hash field TTL (since Redis 7.4)
+	hExpireCmd = "HEXPIRE"
 )
 
 var (
@@ -115,7 +120,37 @@ func NewStore(cfg Config) (storage.PeerStorage, error) {
 		return nil, err
 	}
 
-	return &store{Connection: rs, closed: make(chan any)}, nil
+	_, isCluster := rs.UniversalClient.(*redis.ClusterClient)
+	ps := &store{Connection: rs, cluster: isCluster, closed: make(chan any)}
+	if rs.supportsCommand(context.Background(), hExpireCmd) {
+		if cfg.PeerLifetime <= 0 {
+			logger.Warn().
+				Str("name", "peerLifetime").
+				Dur("provided", cfg.PeerLifetime).
+				Dur("default", storage.DefaultPeerLifetime).
+				Msg("falling back to default configuration")
+			cfg.PeerLifetime = storage.DefaultPeerLifetime
+		}
+		ps.fieldTTL = int64(cfg.PeerLifetime.Seconds())
+		logger.Info().
+			Dur("peerLifetime", cfg.PeerLifetime).
+			Msg("server supports hash fields expiration, GC only reconciles counters")
+		ps.wg.Add(1)
+		go ps.expireFields()
+	}
+	ps.loadScripts(context.Background())
+	return ps, nil
+}
+
+// supportsCommand checks if server knows provided command
+func (ps *Connection) supportsCommand(ctx context.Context, name string) bool {
+	cmd := redis.NewCommandsInfoCmd(ctx, "COMMAND", "INFO", name)
+	_ = ps.Process(ctx, cmd)
+	if err := NoResultErr(cmd.Err()); err != nil {
+		logger.Warn().Err(err).Str("command", name).Msg("unable to get command info")
+		return false
+	}
+	return len(cmd.Val()) > 0
 }
 
 // Config holds the configuration of a redis PeerStorage.
@@ -314,11 +349,7 @@ func (ps *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
 			case <-t.C:
 				if metrics.Enabled() {
 					before := time.Now()
-					// populateProm aggregates metrics over all groups and then posts them to
-					// prometheus.
-					numInfoHashes := ps.count(IHKey, true)
-					numSeeders := ps.count(CountSeederKey, false)
-					numLeechers := ps.count(CountLeecherKey, false)
+					numInfoHashes, numSeeders, numLeechers, _ := ps.CountStatistics(context.Background())
 
 					storage.PromInfoHashesCount.Set(float64(numInfoHashes))
 					storage.PromSeedersCount.Set(float64(numSeeders))
@@ -337,17 +368,22 @@ type Connection struct {
 
 type store struct {
 	Connection
+	// cluster is set if keys may be placed in different slots
+	// and can not be modified in one script
+	cluster bool
+	// fieldTTL is the peer lifetime in seconds, set to peers hash fields
+	// with HEXPIRE, zero if server does not support fields expiration
+	fieldTTL   int64
 	closed     chan any
 	wg         sync.WaitGroup
 	onceCloser sync.Once
 }
 
-func (ps *store) count(key string, getLength bool) (n uint64) {
-	var err error
+func (ps *store) count(ctx context.Context, key string, getLength bool) (n uint64, err error) {
 	if getLength {
-		n, err = ps.SCard(context.Background(), key).Uint64()
+		n, err = ps.SCard(ctx, key).Uint64()
 	} else {
-		n, err = ps.Get(context.Background(), key).Uint64()
+		n, err = ps.Get(ctx, key).Uint64()
 	}
 	err = NoResultErr(err)
 	if err != nil {
@@ -356,27 +392,22 @@ func (ps *store) count(key string, getLength bool) (n uint64) {
 	return
 }
 
-func (ps *store) getClock() int64 {
-	return timecache.NowUnixNano()
-}
-
-func (ps *store) tx(ctx context.Context, txf func(tx redis.Pipeliner) error) (err error) {
-	if pipe, txErr := ps.TxPipelined(ctx, txf); txErr == nil {
-		errs := make([]string, 0)
-		for _, c := range pipe {
-			if err := c.Err(); err != nil {
-				errs = append(errs, err.Error())
-			}
-		}
-		if len(errs) > 0 {
-			err = errors.New(strings.Join(errs, "; "))
-		}
-	} else {
-		err = txErr
+// CountStatistics returns info hashes count and seeders/leechers counters
+func (ps *store) CountStatistics(ctx context.Context) (numInfoHashes, numSeeders, numLeechers uint64, err error) {
+	if numInfoHashes, err = ps.count(ctx, IHKey, true); err != nil {
+		return
+	}
+	if numSeeders, err = ps.count(ctx, CountSeederKey, false); err != nil {
+		return
 	}
+	numLeechers, err = ps.count(ctx, CountLeecherKey, false)
 	return
 }
 
+func (ps *store) getClock() int64 {
+	return timecache.NowUnixNano()
+}
+
 // NoResultErr returns nil if provided err is redis.Nil
 // otherwise returns err
 func NoResultErr(err error) error {
@@ -405,25 +436,35 @@ func InfoHashKey(infoHash string, seeder, v6 bool) (infoHashKey string) {
 	case 0b00:
 		infoHashKey = IH4LeecherKey
 	}
-	infoHashKey += infoHash
+	infoHashKey += hashTag(infoHash)
 	return
 }
 
+// hashTag wraps info hash into braces, so all peers hashes of info hash
+// are placed in one cluster slot. Redis hashes only part between '{'
+// and the first '}', so info hash is prefixed with fixed character,
+// otherwise tag of info hash, which starts with '}', would be empty.
+func hashTag(infoHash string) string {
+	return "{#" + infoHash + "}"
+}
+
 func (ps *store) putPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
 	logger.Trace().
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("put peer")
-	return ps.tx(ctx, func(tx redis.Pipeliner) (err error) {
-		if err = tx.HSet(ctx, infoHashKey, peerID, ps.getClock()).Err(); err != nil {
-			return
-		}
-		if err = tx.Incr(ctx, peerCountKey).Err(); err != nil {
-			return
-		}
-		err = tx.SAdd(ctx, IHKey, infoHashKey).Err()
-		return
-	})
+	added, err := putPeerScript.Run(ctx, ps.UniversalClient, ps.scriptKeys(infoHashKey, peerCountKey),
+		ps.withFieldTTL(peerID, ps.getClock())...).Int64()
+	if err == nil && ps.cluster {
+		_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+			if added > 0 {
+				p.Incr(ctx, peerCountKey)
+			}
+			p.SAdd(ctx, IHKey, infoHashKey)
+			return nil
+		})
+	}
+	return err
 }
 
 func (ps *store) delPeer(ctx context.Context, infoHashKey, peerCountKey, peerID string) error {
@@ -431,12 +472,12 @@ func (ps *store) delPeer(ctx context.Context, infoHashKey, peerCountKey, peerID
 		Str("infoHashKey", infoHashKey).
 		Str("peerID", peerID).
 		Msg("del peer")
-	deleted, err := ps.HDel(ctx, infoHashKey, peerID).Uint64()
-	err = NoResultErr(err)
-	if err == nil {
+	deleted, err := delPeerScript.Run(ctx, ps.UniversalClient, ps.scriptKeys(infoHashKey, peerCountKey), peerID).Int64()
+	if err = NoResultErr(err); err == nil {
 		if deleted == 0 {
 			err = storage.ErrResourceDoesNotExist
-		} else {
+		} else if ps.cluster {
+			// empty hash is removed from info hash set by GC
 			err = ps.Decr(ctx, peerCountKey).Err()
 		}
 	}
@@ -479,28 +520,27 @@ func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, pe
 	infoHash, peerID, isV6 := ih.RawString(), PackPeer(peer), peer.Addr().Is6()
 	ihSeederKey, ihLeecherKey := InfoHashKey(infoHash, true, isV6), InfoHashKey(infoHash, false, isV6)
 
-	return ps.tx(ctx, func(tx redis.Pipeliner) error {
-		deleted, err := tx.HDel(ctx, ihLeecherKey, peerID).Uint64()
-		err = NoResultErr(err)
-		if err == nil {
-			if deleted > 0 {
-				err = tx.Decr(ctx, CountLeecherKey).Err()
-			}
-		}
-		if err == nil {
-			err = tx.HSet(ctx, ihSeederKey, peerID, ps.getClock()).Err()
-		}
-		if err == nil {
-			err = tx.Incr(ctx, CountSeederKey).Err()
-		}
-		if err == nil {
-			err = tx.SAdd(ctx, IHKey, ihSeederKey).Err()
+	keys := []string{ihLeecherKey, ihSeederKey}
+	if !ps.cluster {
+		keys = append(keys, CountLeecherKey, CountSeederKey, IHKey, CountDownloadsKey)
+	}
+	res, err := graduateLeecherScript.Run(ctx, ps.UniversalClient, keys,
+		ps.withFieldTTL(peerID, ps.getClock(), infoHash)...).Int64Slice()
+	if err != nil || !ps.cluster || len(res) < 2 {
+		return err
+	}
+	_, err = ps.Pipelined(ctx, func(p redis.Pipeliner) error {
+		if res[0] > 0 {
+			p.Decr(ctx, CountLeecherKey)
 		}
-		if err == nil {
-			err = tx.HIncrBy(ctx, CountDownloadsKey, infoHash, 1).Err()
+		if res[1] > 0 {
+			p.Incr(ctx, CountSeederKey)
 		}
-		return err
+		p.SAdd(ctx, IHKey, ihSeederKey)
+		p.HIncrBy(ctx, CountDownloadsKey, infoHash, 1)
+		return nil
 	})
+	return err
 }
 
 // peerMinimumLen is the least allowed length of string serialized Peer
@@ -532,13 +572,15 @@ func UnpackPeer(data string) (peer bittorrent.Peer, err error) {
 	return
 }
 
-func (ps *Connection) parsePeersList(peersResult *redis.StringSliceCmd) (peers []bittorrent.Peer, err error) {
+func (ps *Connection) parsePeersList(peersResult *redis.StringSliceCmd, excl storage.Exclusion) (peers []bittorrent.Peer, err error) {
 	var peerIDs []string
 	peerIDs, err = peersResult.Result()
 	if err = NoResultErr(err); err == nil {
 		for _, peerID := range peerIDs {
 			if p, err := UnpackPeer(peerID); err == nil {
-				peers = append(peers, p)
+				if !excl.Excludes(p) {
+					peers = append(peers, p)
+				}
 			} else {
 				logger.Error().Err(err).Str("peerID", peerID).Msg("unable to decode peer")
 			}
@@ -567,9 +609,13 @@ func (ps *Connection) GetPeers(
 		infoHashKeys = append(infoHashKeys, InfoHashKey(infoHash, false, isV6))
 	}
 
+	// random fields can not be excluded on server side, so
+	// more fields requested and excluded ones skipped while parsing
+	excl := storage.ExclusionFromContext(ctx)
 	for _, infoHashKey := range infoHashKeys {
 		var peers []bittorrent.Peer
-		peers, err = ps.parsePeersList(membersFn(ctx, infoHashKey, maxCount))
+		peers, err = ps.parsePeersList(membersFn(ctx, infoHashKey, maxCount+len(excl.Peers)), excl)
+		peers = peers[:min(len(peers), maxCount)]
 		maxCount -= len(peers)
 		out = append(out, peers...)
 		if err != nil || maxCount <= 0 {
@@ -604,34 +650,43 @@ func (ps *store) AnnouncePeers(
 
 type getPeerCountFn func(context.Context, string) *redis.IntCmd
 
+// infoHashKeys returns keys of IPv4 and IPv6 leechers and seeders (in this order) of info hash
+func infoHashKeys(infoHash string) [4]string {
+	return [...]string{
+		InfoHashKey(infoHash, false, false),
+		InfoHashKey(infoHash, false, true),
+		InfoHashKey(infoHash, true, false),
+		InfoHashKey(infoHash, true, true),
+	}
+}
+
+// countPeers calls provided countFn for each key returned by infoHashKeys
+func countPeers(ctx context.Context, infoHash string, countFn getPeerCountFn) (counts [4]int64, err error) {
+	for i, k := range infoHashKeys(infoHash) {
+		counts[i], err = countFn(ctx, k).Result()
+		if err = NoResultErr(err); err != nil {
+			break
+		}
+	}
+	return
+}
+
 // ScrapeIH calls provided countFn and returns seeders, leechers and downloads count for specified info hash
 func (ps *Connection) ScrapeIH(ctx context.Context, ih bittorrent.InfoHash, countFn getPeerCountFn) (
 	leechersCount, seedersCount, downloadsCount uint32, err error,
 ) {
 	infoHash := ih.RawString()
-	var lc4, lc6, sc4, sc6, dc int64
+	var counts [4]int64
+	var dc int64
 
-	lc4, err = countFn(ctx, InfoHashKey(infoHash, false, false)).Result()
-	if err = NoResultErr(err); err != nil {
-		return
-	}
-	lc6, err = countFn(ctx, InfoHashKey(infoHash, false, true)).Result()
-	if err = NoResultErr(err); err != nil {
-		return
-	}
-	sc4, err = countFn(ctx, InfoHashKey(infoHash, true, false)).Result()
-	if err = NoResultErr(err); err != nil {
-		return
-	}
-	sc6, err = countFn(ctx, InfoHashKey(infoHash, true, true)).Result()
-	if err = NoResultErr(err); err != nil {
+	if counts, err = countPeers(ctx, infoHash, countFn); err != nil {
 		return
 	}
 	dc, err = ps.HGet(ctx, CountDownloadsKey, infoHash).Int64()
 	if err = NoResultErr(err); err != nil {
 		return
 	}
-	leechersCount, seedersCount, downloadsCount = uint32(lc4+lc6), uint32(sc4+sc6), uint32(dc)
+	leechersCount, seedersCount, downloadsCount = uint32(counts[0]+counts[1]), uint32(counts[2]+counts[3]), uint32(dc)
 	return
 }
 
@@ -685,6 +740,24 @@ func (ps *Connection) Load(ctx context.Context, storeCtx string, key string) (v
 	return
 }
 
+// LoadMany - storage.BulkLoader implementation
+func (ps *Connection) LoadMany(ctx context.Context, storeCtx string, keys ...string) (values [][]byte, err error) {
+	values = make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return
+	}
+	var res []any
+	if res, err = ps.HMGet(ctx, PrefixKey+storeCtx, keys...).Result(); err == nil {
+		for i, v := range res {
+			if s, isOk := v.(string); isOk {
+				values[i] = []byte(s)
+			}
+		}
+	}
+	err = NoResultErr(err)
+	return
+}
+
 // Delete - storage.DataStorage implementation
 func (ps *Connection) Delete(ctx context.Context, storeCtx string, keys ...string) (err error) {
 	if len(keys) > 0 {
@@ -713,67 +786,132 @@ func (ps *Connection) Ping(ctx context.Context) error {
 	return ps.UniversalClient.Ping(ctx).Err()
 }
 
-// GC deletes all Peers from the PeerStorage which are older than the
-// cutoff time.
+// peerCountKey returns key of seeders or leechers counter
+// for peers hash key or empty string if key is unknown
+func peerCountKey(infoHashKey string) string {
+	switch {
+	case strings.HasPrefix(infoHashKey, IH4SeederKey), strings.HasPrefix(infoHashKey, IH6SeederKey):
+		return CountSeederKey
+	case strings.HasPrefix(infoHashKey, IH4LeecherKey), strings.HasPrefix(infoHashKey, IH6LeecherKey):
+		return CountLeecherKey
+	default:
+		logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
+		return ""
+	}
+}
+
+// reconcile is used instead of gc if peers expire by server (see store.fieldTTL):
+// empty peers hashes are removed from info hash set and seeders and
+// leechers counters are recalculated from hashes lengths
+func (ps *store) reconcile() {
+	ctx := context.Background()
+	infoHashKeys, err := ps.SMembers(ctx, IHKey).Result()
+	if err = NoResultErr(err); err != nil {
+		logger.Error().Err(err).
+			Str("hashSet", IHKey).
+			Msg("unable to fetch info hash peers")
+		return
+	}
+	counts := map[string]int64{CountSeederKey: 0, CountLeecherKey: 0}
+	for _, infoHashKey := range infoHashKeys {
+		cntKey := peerCountKey(infoHashKey)
+		if len(cntKey) == 0 {
+			continue
+		}
+		remaining, err := ps.reconcileHash(ctx, infoHashKey, cntKey)
+		if err != nil {
+			logger.Error().Err(err).
+				Str("infoHashKey", infoHashKey).
+				Msg("unable to clean info hash records")
+			continue
+		}
+		counts[cntKey] += remaining
+	}
+	// peers added or deleted while reconciliation may be not counted,
+	// it will be fixed by the next reconciliation
+	for cntKey, n := range counts {
+		if err = ps.Set(ctx, cntKey, n, 0).Err(); err != nil {
+			logger.Error().Err(err).
+				Str("countKey", cntKey).
+				Msg("unable to set seeder/leecher peer count")
+		}
+	}
+}
+
+// reconcileHash returns number of peers in hash and deletes empty
+// hash key from info hash set.
+func (ps *store) reconcileHash(ctx context.Context, infoHashKey, countKey string) (remaining int64, err error) {
+	remaining, err = countPeersScript.Run(ctx, ps.UniversalClient, ps.scriptKeys(infoHashKey, countKey)).Int64()
+	if err = NoResultErr(err); err == nil && ps.cluster && remaining == 0 {
+		err = NoResultErr(ps.SRem(ctx, IHKey, infoHashKey).Err())
+	}
+	return
+}
+
+// expireFields sets TTL to peers, which were written without it.
+// Called once on start, peers written after that always have TTL.
+func (ps *store) expireFields() {
+	defer ps.wg.Done()
+	ctx := context.Background()
+	infoHashKeys, err := ps.SMembers(ctx, IHKey).Result()
+	if err = NoResultErr(err); err != nil {
+		logger.Error().Err(err).
+			Str("hashSet", IHKey).
+			Msg("unable to fetch info hash peers")
+		return
+	}
+	start := time.Now()
+	for _, infoHashKey := range infoHashKeys {
+		select {
+		case <-ps.closed:
+			return
+		default:
+		}
+		if len(peerCountKey(infoHashKey)) == 0 {
+			continue
+		}
+		err = NoResultErr(expireFieldsScript.Run(ctx, ps.UniversalClient, []string{infoHashKey}, ps.fieldTTL).Err())
+		if err != nil {
+			logger.Error().Err(err).
+				Str("infoHashKey", infoHashKey).
+				Msg("unable to set peers TTL")
+		}
+	}
+	logger.Info().
+		Int("hashes", len(infoHashKeys)).
+		Dur("timeTaken", time.Since(start)).
+		Msg("peers TTL set")
+}
+
+// gc deletes all peers, which timestamps are not greater than cutoff.
 //
 // This function must be able to execute while other methods on this interface
-// are being executed in parallel.
+// are being executed in parallel:
 //
-//   - The Delete(Seeder|Leecher) and GraduateLeecher methods never delete an
-//     infohash key from an addressFamily hash. They also never decrement the
-//     infohash counter.
-//   - The Put(Seeder|Leecher) and GraduateLeecher methods only ever add infohash
-//     keys to addressFamily hashes and increment the infohash counter.
-//   - The only method that deletes from the addressFamily hashes is
-//     gc, which also decrements the counters. That means that,
-//     even if a Delete(Seeder|Leecher) call removes the last peer from a swarm,
-//     the infohash counter is not changed and the infohash is left in the
-//     addressFamily hash until it will be cleaned up by gc.
-//   - gc must run regularly.
-//   - A WATCH ... MULTI ... EXEC block fails, if between the WATCH and the 'EXEC'
-//     any of the watched keys have changed. The location of the 'MULTI' doesn't
-//     matter.
+//   - Peers of each hash from CHI_I set are fetched by HGETALL and stale
+//     peers are deleted by expirePeersScript, which checks timestamps again,
+//     so peers re-announced after HGETALL are kept.
+//   - The same script decrements counter by the number of really deleted
+//     peers and removes empty hash from CHI_I set.
+//   - Put(Seeder|Leecher), Delete(Seeder|Leecher) and GraduateLeecher update
+//     counters and CHI_I set by scripts too, and only if peer was really added
+//     or deleted, so counters do not depend on gc.
 //
-// We have to analyze four cases to prove our algorithm works. I'll characterize
-// them by a tuple (number of peers in a swarm before WATCH, number of peers in
-// the swarm during the transaction).
-//
-//  1. (0,0), the easy case: The swarm is empty, we watch the key, we execute
-//     HLEN and find it empty. We remove it and decrement the counter. It stays
-//     empty the entire time, the transaction goes through.
-//  2. (1,n > 0): The swarm is not empty, we watch the key, we find it non-empty,
-//     we unwatch the key. All good. No transaction is made, no transaction fails.
-//  3. (0,1): We have to analyze this in two ways.
-//     - If the change happens before the HLEN call, we will see that the swarm is
-//     not empty and start no transaction.
-//     - If the change happens after the HLEN, we will attempt a transaction and it
-//     will fail. This is okay, the swarm is not empty, we will try cleaning it up
-//     next time gc runs.
-//  4. (1,0): Again, two ways:
-//     - If the change happens before the HLEN, we will see an empty swarm. This
-//     situation happens if a call to Delete(Seeder|Leecher) removed the last
-//     peer asynchronously. We will attempt a transaction, but the transaction
-//     will fail. This is okay, the infohash key will remain in the addressFamily
-//     hash, we will attempt to clean it up the next time 'gc` runs.
-//     - If the change happens after the HLEN, we will not even attempt to make the
-//     transaction. The infohash key will remain in the addressFamil hash and
-//     we'll attempt to clean it up the next time gc runs.
+// In cluster mode counters and CHI_I set are updated by separate commands,
+// which are not atomic with scripts (see scripts.go).
 func (ps *store) gc(cutoff time.Time) {
+	if ps.fieldTTL > 0 {
+		ps.reconcile()
+		return
+	}
 	cutoffNanos := cutoff.UnixNano()
 	// list all infoHashKeys in the group
 	infoHashKeys, err := ps.SMembers(context.Background(), IHKey).Result()
 	err = NoResultErr(err)
 	if err == nil {
 		for _, infoHashKey := range infoHashKeys {
-			var cntKey string
-			var seeder bool
-			if seeder = strings.HasPrefix(infoHashKey, IH4SeederKey) || strings.HasPrefix(infoHashKey,
-				IH6SeederKey); seeder {
-				cntKey = CountSeederKey
-			} else if strings.HasPrefix(infoHashKey, IH4LeecherKey) || strings.HasPrefix(infoHashKey, IH6LeecherKey) {
-				cntKey = CountLeecherKey
-			} else {
-				logger.Warn().Str("infoHashKey", infoHashKey).Msg("unexpected record found in info hash set")
+			cntKey := peerCountKey(infoHashKey)
+			if len(cntKey) == 0 {
 				continue
 			}
 			// list all (peer, timeout) pairs for the ih
@@ -795,52 +933,9 @@ func (ps *store) gc(cutoff time.Time) {
 							Msg("unable to decode peer timestamp")
 					}
 				}
-				if len(peersToRemove) > 0 {
-					removedPeerCount, err := ps.HDel(context.Background(), infoHashKey, peersToRemove...).Result()
-					err = NoResultErr(err)
-					if err != nil {
-						if strings.Contains(err.Error(), argNumErrorMsg) {
-							logger.Warn().Msg("This Redis version/implementation does not support variadic arguments for HDEL")
-							for _, k := range peersToRemove {
-								count, err := ps.HDel(context.Background(), infoHashKey, k).Result()
-								err = NoResultErr(err)
-								if err != nil {
-									logger.Error().Err(err).
-										Str("infoHashKey", infoHashKey).
-										Str("peerID", k).
-										Msg("unable to delete peer")
-								} else {
-									removedPeerCount += count
-								}
-							}
-						} else {
-							logger.Error().Err(err).
-								Str("infoHashKey", infoHashKey).
-								Strs("peerIDs", peersToRemove).
-								Msg("unable to delete peers")
-						}
-					}
-					if removedPeerCount > 0 { // DECR seeder/leecher counter
-						if err = ps.DecrBy(context.Background(), cntKey, removedPeerCount).Err(); err != nil {
-							logger.Error().Err(err).
-								Str("infoHashKey", infoHashKey).
-								Str("countKey", cntKey).
-								Msg("unable to decrement seeder/leecher peer count")
-						}
-					}
-				}
-
-				err = NoResultErr(ps.Watch(context.Background(), func(_ *redis.Tx) (err error) {
-					var infoHashCount uint64
-					infoHashCount, err = ps.HLen(context.Background(), infoHashKey).Uint64()
-					err = NoResultErr(err)
-					if err == nil && infoHashCount == 0 {
-						// Empty hashes are not shown among existing keys,
-						// in other words, it's removed automatically after `HDEL` the last field.
-						err = NoResultErr(ps.SRem(context.Background(), IHKey, infoHashKey).Err())
-					}
-					return err
-				}, infoHashKey))
+				// timestamps are checked again by script, so peers
+				// announced after HGETALL are not deleted
+				err = ps.expirePeers(context.Background(), infoHashKey, cntKey, cutoffNanos, peersToRemove)
 				if err != nil {
 					logger.Error().Err(err).
 						Str("infoHashKey", infoHashKey).
@@ -859,6 +954,31 @@ func (ps *store) gc(cutoff time.Time) {
 	}
 }
 
+// expirePeers deletes provided peers with timestamps not greater than cutoff,
+// decrements counter and deletes empty hash key from info hash set
+func (ps *store) expirePeers(ctx context.Context, infoHashKey, countKey string, cutoff int64, peerIDs []string) error {
+	args := make([]any, 0, len(peerIDs)+1)
+	args = append(args, cutoff)
+	for _, id := range peerIDs {
+		args = append(args, id)
+	}
+	res, err := expirePeersScript.Run(ctx, ps.UniversalClient, ps.scriptKeys(infoHashKey, countKey), args...).Int64Slice()
+	if err = NoResultErr(err); err != nil || !ps.cluster || len(res) < 2 {
+		return err
+	}
+	if removed := res[0]; removed > 0 {
+		if err = ps.DecrBy(ctx, countKey, removed).Err(); err != nil {
+			return err
+		}
+	}
+	if remaining := res[1]; remaining == 0 {
+		// Empty hashes are not shown among existing keys,
+		// in other words, it's removed automatically after `HDEL` the last field.
+		err = NoResultErr(ps.SRem(ctx, IHKey, infoHashKey).Err())
+	}
+	return err
+}
+
 func (ps *store) Close() (err error) {
 	ps.onceCloser.Do(func() {
 		close(ps.closed)
@@ -2,9 +2,12 @@ package redis
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	s "github.com/sot-tech/mochi/storage"
 	"github.com/sot-tech/mochi/storage/test"
 )
@@ -28,4 +31,26 @@ func createNew() s.PeerStorage {
 
 func TestStorage(t *testing.T) { test.RunTests(t, createNew()) }
 
+func TestInfoHashKeysHashTag(t *testing.T) {
+	for _, infoHash := range []string{"01234567890123456789", "}1234567890123456789", "0123456789{}23456789"} {
+		var tags []string
+		for i, key := range infoHashKeys(infoHash) {
+			idx, ih := infoHashFromKey(key)
+			require.Equal(t, i, idx)
+			require.Equal(t, infoHash, ih)
+			// the same (non-empty) part of key is hashed by cluster
+			start := strings.IndexByte(key, '{')
+			end := strings.IndexByte(key[start+1:], '}')
+			require.Positive(t, end)
+			tags = append(tags, key[start+1:start+1+end])
+		}
+		for _, tag := range tags {
+			require.Equal(t, tags[0], tag)
+		}
+	}
+	idx, ih := infoHashFromKey(IH4SeederKey + "01234567890123456789")
+	require.Equal(t, 2, idx)
+	require.Equal(t, "01234567890123456789", ih)
+}
+
 func BenchmarkStorage(b *testing.B) { test.RunBenchmarks(b, createNew) }
@@ -0,0 +1,539 @@
+// Package sharded implements the storage interface for a BitTorrent tracker,
+// which distributes swarms and key-value data across several storages
+// (shards) with weighted rendezvous hashing.
+//
+// Each shard may have replicas, which are used for reads if shard's primary
+// storage does not respond to health checks. Writes are always sent to primary.
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/metrics"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// Name - registered name of the storage
+	Name = "sharded"
+	// Default config constants.
+	defaultWeight              = 1.0
+	defaultHealthCheckInterval = 5 * time.Second
+)
+
+var (
+	logger = log.NewLogger("storage/sharded")
+
+	errNoShards = errors.New("shards not provided")
+)
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, Builder{})
+}
+
+// Builder is structure to create new sharded peer or data storage
+type Builder struct{}
+
+// NewDataStorage creates new sharded KV storage
+func (b Builder) NewDataStorage(icfg conf.MapConfig) (storage.DataStorage, error) {
+	return b.NewPeerStorage(icfg)
+}
+
+// NewPeerStorage creates new sharded peer storage
+func (Builder) NewPeerStorage(icfg conf.MapConfig) (storage.PeerStorage, error) {
+	var cfg config
+	if err := icfg.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+	cfg, err := cfg.validate()
+	if err != nil {
+		return nil, err
+	}
+	ps, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ps.wrap(), nil
+}
+
+type shardConfig struct {
+	// Name and Config of primary storage
+	conf.NamedMapConfig
+	// ID identifies shard in hashing, so it should not be changed
+	// while shard is in use. Default is the index of shard in list.
+	ID string `cfg:"id"`
+	// Weight is the relative amount of data stored in shard
+	Weight float64 `cfg:"weight"`
+	// Replicas are used for reads if primary storage is unhealthy
+	Replicas []conf.NamedMapConfig `cfg:"replicas"`
+}
+
+type config struct {
+	Shards []shardConfig `cfg:"shards"`
+	// HealthCheckInterval is the period of shards storages pings,
+	// ping timeout is the same as interval
+	HealthCheckInterval time.Duration `cfg:"health_check_interval"`
+}
+
+func (cfg config) validate() (config, error) {
+	if len(cfg.Shards) == 0 {
+		return cfg, errNoShards
+	}
+	validCfg := cfg
+	validCfg.Shards = make([]shardConfig, len(cfg.Shards))
+	ids := make(map[string]bool, len(cfg.Shards))
+	for i, sc := range cfg.Shards {
+		if len(sc.ID) == 0 {
+			sc.ID = strconv.Itoa(i)
+		}
+		if ids[sc.ID] {
+			return cfg, fmt.Errorf("duplicate shard id '%s'", sc.ID)
+		}
+		ids[sc.ID] = true
+		if sc.Weight <= 0 || math.IsInf(sc.Weight, 0) || math.IsNaN(sc.Weight) {
+			logger.Warn().
+				Str("name", "Weight").
+				Str("shard", sc.ID).
+				Float64("provided", sc.Weight).
+				Float64("default", defaultWeight).
+				Msg("falling back to default configuration")
+			sc.Weight = defaultWeight
+		}
+		validCfg.Shards[i] = sc
+	}
+
+	if cfg.HealthCheckInterval <= 0 {
+		validCfg.HealthCheckInterval = defaultHealthCheckInterval
+		logger.Warn().
+			Str("name", "HealthCheckInterval").
+			Dur("provided", cfg.HealthCheckInterval).
+			Dur("default", validCfg.HealthCheckInterval).
+			Msg("falling back to default configuration")
+	}
+
+	return validCfg, nil
+}
+
+// member is the primary or replica storage of shard
+type member struct {
+	storage.PeerStorage
+	name    string
+	healthy atomic.Bool
+}
+
+type shard struct {
+	id     string
+	seed   uint64
+	weight float64
+	// members are primary storage and replicas in order of preference
+	members []*member
+}
+
+// primary returns member, which receives writes
+func (sh *shard) primary() *member {
+	return sh.members[0]
+}
+
+// active returns the first healthy member of shard, which is used for reads,
+// or primary if there are no healthy members
+func (sh *shard) active() *member {
+	for _, m := range sh.members {
+		if m.healthy.Load() {
+			return m
+		}
+	}
+	return sh.members[0]
+}
+
+type store struct {
+	shards     []*shard
+	closed     chan any
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newStore(cfg config) (ps *store, err error) {
+	ps = &store{
+		shards: make([]*shard, 0, len(cfg.Shards)),
+		closed: make(chan any),
+	}
+	defer func() {
+		if err != nil {
+			_ = ps.closeMembers()
+		}
+	}()
+	for _, sc := range cfg.Shards {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(sc.ID))
+		sh := &shard{id: sc.ID, seed: h.Sum64(), weight: sc.Weight}
+		ps.shards = append(ps.shards, sh)
+		for _, mc := range append([]conf.NamedMapConfig{sc.NamedMapConfig}, sc.Replicas...) {
+			if mc.Config == nil {
+				mc.Config = make(conf.MapConfig)
+			}
+			var st storage.PeerStorage
+			if st, err = storage.NewUnscheduledPeerStorage(mc); err != nil {
+				return
+			}
+			m := &member{PeerStorage: st, name: mc.Name}
+			m.healthy.Store(true)
+			sh.members = append(sh.members, m)
+		}
+	}
+	ps.wg.Add(1)
+	go ps.runHealthChecks(cfg.HealthCheckInterval)
+	logger.Info().Int("shards", len(ps.shards)).Msg("sharded storage started")
+	return
+}
+
+func (ps *store) runHealthChecks(interval time.Duration) {
+	defer ps.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ps.closed:
+			return
+		case <-t.C:
+			ps.checkHealth(interval)
+		}
+	}
+}
+
+// checkHealth pings all members of all shards and updates their health flags
+func (ps *store) checkHealth(timeout time.Duration) {
+	for _, sh := range ps.shards {
+		for i, m := range sh.members {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			err := m.Ping(ctx)
+			cancel()
+			if healthy := err == nil; m.healthy.Swap(healthy) != healthy {
+				e := logger.Warn()
+				if healthy {
+					e = logger.Info()
+				}
+				e.Err(err).
+					Str("shard", sh.id).
+					Str("storage", m.name).
+					Bool("replica", i > 0).
+					Bool("healthy", healthy).
+					Msg("shard storage health changed")
+			}
+		}
+	}
+}
+
+// mix is the finalizer of SplitMix64, used to distribute FNV hash bits
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// shardFor selects shard for key with weighted rendezvous hashing:
+// shard with the maximal `weight / -ln(hash)` score wins,
+// where hash is the uniformly distributed value in (0, 1).
+func (ps *store) shardFor(key ...string) *shard {
+	if len(ps.shards) == 1 {
+		return ps.shards[0]
+	}
+	h := fnv.New64a()
+	for _, k := range key {
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+	}
+	kh := h.Sum64()
+	var best *shard
+	bestScore := math.Inf(-1)
+	for _, sh := range ps.shards {
+		u := (float64(mix(kh^sh.seed)>>11) + 0.5) / (1 << 53)
+		if score := sh.weight / -math.Log(u); score > bestScore {
+			best, bestScore = sh, score
+		}
+	}
+	return best
+}
+
+// forInfoHash returns storage of swarm: primary for writes, active for reads
+func (ps *store) forInfoHash(ih bittorrent.InfoHash, write bool) storage.PeerStorage {
+	sh := ps.shardFor(ih.RawString())
+	if write {
+		return sh.primary()
+	}
+	return sh.active()
+}
+
+// forKey returns storage of KV data: primary for writes, active for reads
+func (ps *store) forKey(storeCtx, key string, write bool) storage.PeerStorage {
+	sh := ps.shardFor(storeCtx, key)
+	if write {
+		return sh.primary()
+	}
+	return sh.active()
+}
+
+func (ps *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return ps.forInfoHash(ih, true).PutSeeder(ctx, ih, peer)
+}
+
+func (ps *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return ps.forInfoHash(ih, true).DeleteSeeder(ctx, ih, peer)
+}
+
+func (ps *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return ps.forInfoHash(ih, true).PutLeecher(ctx, ih, peer)
+}
+
+func (ps *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return ps.forInfoHash(ih, true).DeleteLeecher(ctx, ih, peer)
+}
+
+func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	return ps.forInfoHash(ih, true).GraduateLeecher(ctx, ih, peer)
+}
+
+func (ps *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) ([]bittorrent.Peer, error) {
+	return ps.forInfoHash(ih, false).AnnouncePeers(ctx, ih, forSeeder, numWant, v6)
+}
+
+func (ps *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (uint32, uint32, uint32, error) {
+	return ps.forInfoHash(ih, false).ScrapeSwarm(ctx, ih)
+}
+
+// groupKeys groups indexes of keys by storage, which keys are routed to
+func (ps *store) groupKeys(storeCtx string, keys []string, write bool) map[storage.PeerStorage][]int {
+	groups := make(map[storage.PeerStorage][]int)
+	for i, k := range keys {
+		st := ps.forKey(storeCtx, k, write)
+		groups[st] = append(groups[st], i)
+	}
+	return groups
+}
+
+func (ps *store) Put(ctx context.Context, storeCtx string, values ...storage.Entry) error {
+	keys := make([]string, len(values))
+	for i, v := range values {
+		keys[i] = v.Key
+	}
+	for st, indexes := range ps.groupKeys(storeCtx, keys, true) {
+		entries := make([]storage.Entry, len(indexes))
+		for i, idx := range indexes {
+			entries[i] = values[idx]
+		}
+		if err := st.Put(ctx, storeCtx, entries...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps *store) Contains(ctx context.Context, storeCtx string, key string) (bool, error) {
+	return ps.forKey(storeCtx, key, false).Contains(ctx, storeCtx, key)
+}
+
+func (ps *store) Load(ctx context.Context, storeCtx string, key string) ([]byte, error) {
+	return ps.forKey(storeCtx, key, false).Load(ctx, storeCtx, key)
+}
+
+func (ps *store) Delete(ctx context.Context, storeCtx string, keys ...string) error {
+	for st, indexes := range ps.groupKeys(storeCtx, keys, true) {
+		stKeys := make([]string, len(indexes))
+		for i, idx := range indexes {
+			stKeys[i] = keys[idx]
+		}
+		if err := st.Delete(ctx, storeCtx, stKeys...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadMany loads keys from each shard with storage.LoadMany
+func (ps *store) LoadMany(ctx context.Context, storeCtx string, keys ...string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for st, indexes := range ps.groupKeys(storeCtx, keys, false) {
+		stKeys := make([]string, len(indexes))
+		for i, idx := range indexes {
+			stKeys[i] = keys[idx]
+		}
+		stValues, err := storage.LoadMany(ctx, st, storeCtx, stKeys...)
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range indexes {
+			values[idx] = stValues[i]
+		}
+	}
+	return values, nil
+}
+
+// Preservable returns true only if all shards are preservable
+func (ps *store) Preservable() bool {
+	for _, sh := range ps.shards {
+		if !sh.primary().Preservable() {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks active storage of each shard
+func (ps *store) Ping(ctx context.Context) error {
+	for _, sh := range ps.shards {
+		if err := sh.active().Ping(ctx); err != nil {
+			return fmt.Errorf("shard '%s': %w", sh.id, err)
+		}
+	}
+	return nil
+}
+
+// ScheduleGC schedules GC of all primary storages, which support it.
+// Replicas are expected to be synchronized with primary by storage itself.
+func (ps *store) ScheduleGC(gcInterval, peerLifeTime time.Duration) {
+	for _, sh := range ps.shards {
+		if gc, isOk := sh.primary().PeerStorage.(storage.GarbageCollector); isOk {
+			gc.ScheduleGC(gcInterval, peerLifeTime)
+		}
+	}
+}
+
+// CountStatistics summarizes statistics of active storages of all shards,
+// which implement storage.StatisticsCounter
+func (ps *store) CountStatistics(ctx context.Context) (numInfoHashes, numSeeders, numLeechers uint64, err error) {
+	for _, sh := range ps.shards {
+		if sc, isOk := sh.active().PeerStorage.(storage.StatisticsCounter); isOk {
+			var h, s, l uint64
+			if h, s, l, err = sc.CountStatistics(ctx); err != nil {
+				return
+			}
+			numInfoHashes, numSeeders, numLeechers = numInfoHashes+h, numSeeders+s, numLeechers+l
+		}
+	}
+	return
+}
+
+func (ps *store) ScheduleStatisticsCollection(reportInterval time.Duration) {
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(reportInterval)
+		for {
+			select {
+			case <-ps.closed:
+				t.Stop()
+				return
+			case <-t.C:
+				if metrics.Enabled() {
+					before := time.Now()
+					numInfoHashes, numSeeders, numLeechers, err := ps.CountStatistics(context.Background())
+					if err != nil {
+						logger.Error().Err(err).Msg("error occurred while count statistics")
+						continue
+					}
+					storage.PromInfoHashesCount.Set(float64(numInfoHashes))
+					storage.PromSeedersCount.Set(float64(numSeeders))
+					storage.PromLeechersCount.Set(float64(numLeechers))
+					logger.Debug().TimeDiff("timeTaken", time.Now(), before).Msg("populate prom complete")
+				}
+			}
+		}
+	}()
+}
+
+func (ps *store) closeMembers() (err error) {
+	for _, sh := range ps.shards {
+		for _, m := range sh.members {
+			err = errors.Join(err, m.Close())
+		}
+	}
+	return
+}
+
+func (ps *store) Close() (err error) {
+	ps.onceCloser.Do(func() {
+		close(ps.closed)
+		ps.wg.Wait()
+		err = ps.closeMembers()
+	})
+	return
+}
+
+// iterableStore is the store, which implements storage.Iterator.
+// Separate type used to not to report Iterator support if
+// some of shards storages do not support it.
+type iterableStore struct {
+	*store
+}
+
+var _ storage.Iterator = iterableStore{}
+
+// wrap returns iterableStore if all storages of all shards
+// implement storage.Iterator, otherwise returns store itself
+func (ps *store) wrap() storage.PeerStorage {
+	for _, sh := range ps.shards {
+		for _, m := range sh.members {
+			if _, isOk := m.PeerStorage.(storage.Iterator); !isOk {
+				return ps
+			}
+		}
+	}
+	return iterableStore{ps}
+}
+
+// ScanSwarms iterates over swarms of active storages of shards one by one.
+// Cursor is the index of shard and cursor of shard's storage separated by colon.
+// Note: if active storage of shard changed between calls, cursor may be invalid.
+func (ps iterableStore) ScanSwarms(ctx context.Context, cursor string, fn func(storage.SwarmInfo) bool) (string, error) {
+	var i int
+	var inner string
+	if len(cursor) > 0 {
+		idx, c, found := strings.Cut(cursor, ":")
+		var err error
+		if i, err = strconv.Atoi(idx); !found || err != nil || i < 0 || i >= len(ps.shards) {
+			return "", storage.ErrInvalidCursor
+		}
+		inner = c
+	}
+	for ; i < len(ps.shards); i++ {
+		var stopped bool
+		next, err := ps.shards[i].active().PeerStorage.(storage.Iterator).ScanSwarms(ctx, inner, func(si storage.SwarmInfo) bool {
+			stopped = !fn(si)
+			return !stopped
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(next) > 0 {
+			return strconv.Itoa(i) + ":" + next, nil
+		}
+		if stopped {
+			if i+1 < len(ps.shards) {
+				return strconv.Itoa(i+1) + ":", nil
+			}
+			return "", nil
+		}
+		inner = ""
+	}
+	return "", nil
+}
+
+// ScanPeers iterates over peers of swarm in active storage of its shard
+func (ps iterableStore) ScanPeers(ctx context.Context, ih bittorrent.InfoHash, cursor string, fn func(bittorrent.Peer, bool) bool) (string, error) {
+	return ps.shardFor(ih.RawString()).active().PeerStorage.(storage.Iterator).ScanPeers(ctx, ih, cursor, fn)
+}
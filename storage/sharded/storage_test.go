@@ -0,0 +1,98 @@
+package sharded
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	s "github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+	"github.com/sot-tech/mochi/storage/test"
+)
+
+func memoryConfig() conf.NamedMapConfig {
+	return conf.NamedMapConfig{Name: memory.Name, Config: conf.MapConfig{"shard_count": 16}}
+}
+
+func createNew() *store {
+	cfg, err := config{Shards: []shardConfig{
+		{NamedMapConfig: memoryConfig(), Weight: 1},
+		{NamedMapConfig: memoryConfig(), Weight: 2, Replicas: []conf.NamedMapConfig{memoryConfig()}},
+		{NamedMapConfig: memoryConfig(), Weight: 1},
+	}}.validate()
+	if err != nil {
+		panic(err)
+	}
+	ps, err := newStore(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func TestStorage(t *testing.T) {
+	ps := createNew().wrap()
+	_, isOk := ps.(s.Iterator)
+	require.True(t, isOk)
+	test.RunTests(t, ps)
+}
+
+func BenchmarkStorage(b *testing.B) {
+	test.RunBenchmarks(b, func() s.PeerStorage { return createNew().wrap() })
+}
+
+func TestWeightedRouting(t *testing.T) {
+	ps := createNew()
+	defer ps.Close()
+	const n = 30000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		ih := bittorrent.InfoHash(fmt.Sprintf("%020d", i))
+		sh := ps.shardFor(ih.RawString())
+		require.Same(t, sh, ps.shardFor(ih.RawString()))
+		counts[sh.id]++
+	}
+	// shard "1" has double weight, so it should get about a half of keys
+	require.InDelta(t, n/4, counts["0"], n/20)
+	require.InDelta(t, n/2, counts["1"], n/20)
+	require.InDelta(t, n/4, counts["2"], n/20)
+}
+
+func TestFailover(t *testing.T) {
+	ps := createNew()
+	defer ps.Close()
+	ctx := context.Background()
+	sh := ps.shards[1]
+	var ih bittorrent.InfoHash
+	for i := 0; ; i++ {
+		if ih = bittorrent.InfoHash(fmt.Sprintf("%020d", i)); ps.shardFor(ih.RawString()) == sh {
+			break
+		}
+	}
+	peer := bittorrent.Peer{ID: bittorrent.PeerID([]byte("-TR3000-000000000001"))}
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer))
+	_, seeders, _, err := sh.members[0].ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), seeders)
+
+	// primary is down, replica is used for reads, writes are sent to primary
+	sh.members[0].healthy.Store(false)
+	require.Same(t, sh.members[1], sh.active())
+	require.Nil(t, sh.members[1].PutSeeder(ctx, ih, peer))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer))
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), leechers)
+	require.Equal(t, uint32(1), seeders)
+	leechers, _, _, _ = sh.members[0].ScrapeSwarm(ctx, ih)
+	require.Equal(t, uint32(1), leechers)
+
+	// health check restores primary
+	ps.checkHealth(defaultHealthCheckInterval)
+	require.Same(t, sh.members[0], sh.active())
+}
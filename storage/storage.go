@@ -38,6 +38,9 @@ type Config struct {
 	PeerLifetime time.Duration `cfg:"peer_lifetime"`
 	// PrometheusReportingInterval period of statistics data polling
 	PrometheusReportingInterval time.Duration `cfg:"prometheus_reporting_interval"`
+	// SlowOperationThreshold minimal duration of storage operation to be logged
+	// as slow, zero value disables logging
+	SlowOperationThreshold time.Duration `cfg:"slow_operation_threshold"`
 }
 
 func (c Config) sanitizeGCConfig() (gcInterval, peerTTL time.Duration) {
@@ -180,6 +183,8 @@ type PeerStorage interface {
 	// - if seeder is true, should ideally return more leechers than seeders
 	// - if seeder is false, should ideally return more seeders than
 	//   leechers
+	// - without peers excluded by Exclusion hint (see WithExclusion),
+	//   if it is set in ctx
 	//
 	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
 	AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error)
@@ -216,6 +221,39 @@ type StatisticsCollector interface {
 	ScheduleStatisticsCollection(reportInterval time.Duration)
 }
 
+// StatisticsCounter marks that storage can count stored info hashes
+// and peers on demand. Used by storages, which aggregate statistics
+// of several storages.
+type StatisticsCounter interface {
+	// CountStatistics returns number of stored info hashes, seeders and leechers
+	CountStatistics(ctx context.Context) (infoHashes, seeders, leechers uint64, err error)
+}
+
+// BulkLoader marks that DataStorage supports loading
+// data of several keys in one request
+type BulkLoader interface {
+	// LoadMany loads data for each of provided keys in specified context.
+	// Returned slice has the same length and order as keys,
+	// element is nil if data for key does not exist.
+	LoadMany(ctx context.Context, storeCtx string, keys ...string) ([][]byte, error)
+}
+
+// LoadMany loads data for each of provided keys in specified context.
+// Uses BulkLoader.LoadMany if storage implements it,
+// otherwise calls DataStorage.Load for every key.
+func LoadMany(ctx context.Context, ds DataStorage, storeCtx string, keys ...string) (values [][]byte, err error) {
+	if bl, isOk := ds.(BulkLoader); isOk {
+		return bl.LoadMany(ctx, storeCtx, keys...)
+	}
+	values = make([][]byte, len(keys))
+	for i, k := range keys {
+		if values[i], err = ds.Load(ctx, storeCtx, k); err != nil {
+			break
+		}
+	}
+	return
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -238,41 +276,51 @@ func RegisterDriver(name string, d Driver) {
 	drivers[name] = d
 }
 
+// getDriver returns registered Driver by its name.
+// Lock is not held while driver creates storage, so driver may
+// create another (backend) storage by itself.
+func getDriver(name string) (Driver, error) {
+	driversMU.RLock()
+	defer driversMU.RUnlock()
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("storage with name '%s' does not exists", name)
+	}
+	return d, nil
+}
+
 // NewDataStorage attempts to initialize a new DataStorage instance from
 // the list of registered drivers.
 func NewDataStorage(cfg conf.NamedMapConfig) (DataStorage, error) {
-	driversMU.RLock()
-	defer driversMU.RUnlock()
 	logger.Debug().Object("config", cfg).Msg("starting data storage")
 
-	var d Driver
-	d, ok := drivers[cfg.Name]
-	if !ok {
-		return nil, fmt.Errorf("storage with name '%s' does not exists", cfg.Name)
+	d, err := getDriver(cfg.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	return d.NewPeerStorage(cfg.Config)
+	c := new(Config)
+	if err = cfg.Config.Unmarshal(c); err != nil {
+		return nil, err
+	}
+
+	ds, err := d.NewPeerStorage(cfg.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	return instrumentDataStorage(ds, cfg.Name, c.SlowOperationThreshold), nil
 }
 
 // NewPeerStorage attempts to initialize a new PeerStorage instance from
 // the list of registered drivers.
 func NewPeerStorage(cfg conf.NamedMapConfig) (ps PeerStorage, err error) {
-	driversMU.RLock()
-	defer driversMU.RUnlock()
-	logger.Debug().Object("config", cfg).Msg("starting peer storage")
-
-	var d Driver
-	d, ok := drivers[cfg.Name]
-	if !ok {
-		return nil, fmt.Errorf("storage with name '%s' does not exists", cfg.Name)
-	}
-
 	c := new(Config)
 	if err = cfg.Config.Unmarshal(c); err != nil {
 		return
 	}
 
-	if ps, err = d.NewPeerStorage(cfg.Config); err != nil {
+	if ps, err = NewUnscheduledPeerStorage(cfg); err != nil {
 		return
 	}
 
@@ -306,7 +354,24 @@ func NewPeerStorage(cfg conf.NamedMapConfig) (ps PeerStorage, err error) {
 			Msg("storage does not support statistics collection")
 	}
 
+	ps = instrumentPeerStorage(ps, cfg.Name, c.SlowOperationThreshold)
+
 	logger.Info().Str("name", cfg.Name).Msg("storage started")
 
 	return
 }
+
+// NewUnscheduledPeerStorage initializes a new PeerStorage instance from
+// the list of registered drivers, but, unlike NewPeerStorage, does not
+// schedule GC and statistics collection and does not wrap storage with
+// metrics decorator. Used by drivers, which manage several storages by themselves.
+func NewUnscheduledPeerStorage(cfg conf.NamedMapConfig) (PeerStorage, error) {
+	logger.Debug().Object("config", cfg).Msg("starting peer storage")
+
+	d, err := getDriver(cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.NewPeerStorage(cfg.Config)
+}
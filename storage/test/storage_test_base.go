@@ -5,6 +5,7 @@ package test
 import (
 	"context"
 	"errors"
+	"net/netip"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -147,6 +148,34 @@ func (th *testHolder) SeederPutAnnounceDeleteAnnounce(t *testing.T) {
 	}
 }
 
+func (th *testHolder) LeecherPutAnnounceExclusion(t *testing.T) {
+	for _, c := range testData {
+		isV6 := c.peer.Addr().Is6()
+		dummy := v4Peer
+		if isV6 {
+			dummy = v6Peer
+		}
+		err := th.st.PutLeecher(context.TODO(), c.ih, c.peer)
+		require.Nil(t, err)
+
+		// exclusion is the hint, so check only that excluded peer is not returned
+		ctx := storage.WithExclusion(context.TODO(), storage.Exclusion{Peers: []bittorrent.Peer{c.peer}})
+		peers, err := th.st.AnnouncePeers(ctx, c.ih, true, 50, isV6)
+		require.Nil(t, err)
+		require.False(t, containsPeer(peers, c.peer))
+		require.True(t, containsPeer(peers, dummy))
+
+		ctx = storage.WithExclusion(context.TODO(), storage.Exclusion{Addrs: []netip.Addr{dummy.Addr()}})
+		peers, err = th.st.AnnouncePeers(ctx, c.ih, true, 50, isV6)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
+		require.False(t, containsPeer(peers, dummy))
+
+		err = th.st.DeleteLeecher(context.TODO(), c.ih, c.peer)
+		require.Nil(t, err)
+	}
+}
+
 func (th *testHolder) LeecherPutGraduateAnnounceDeleteAnnounce(t *testing.T) {
 	for _, c := range testData {
 		isV6 := c.peer.Addr().Is6()
@@ -199,6 +228,92 @@ func (th *testHolder) LeecherPutGraduateAnnounceDeleteAnnounce(t *testing.T) {
 	}
 }
 
+// maxIterations limits number of iterator calls if storage
+// returns cursors endlessly
+const maxIterations = 1000
+
+func (th *testHolder) Iterate(t *testing.T) {
+	it := th.st.(storage.Iterator)
+	for _, c := range testData {
+		dummy := v4Peer
+		if c.peer.Addr().Is6() {
+			dummy = v6Peer
+		}
+		require.Nil(t, th.st.PutSeeder(context.TODO(), c.ih, c.peer))
+		require.Nil(t, th.st.PutLeecher(context.TODO(), c.ih, dummy))
+	}
+
+	// iterate one swarm per call to check cursors
+	swarms := make(map[bittorrent.InfoHash]storage.SwarmInfo)
+	var cursor string
+	var err error
+	for i := 0; i < maxIterations; i++ {
+		cursor, err = it.ScanSwarms(context.TODO(), cursor, func(si storage.SwarmInfo) bool {
+			swarms[si.InfoHash] = si
+			return false
+		})
+		require.Nil(t, err)
+		if len(cursor) == 0 {
+			break
+		}
+	}
+	require.Empty(t, cursor)
+
+	// iterate all swarms in one call
+	var count int
+	cursor, err = it.ScanSwarms(context.TODO(), "", func(storage.SwarmInfo) bool {
+		count++
+		return true
+	})
+	require.Nil(t, err)
+	require.Empty(t, cursor)
+	require.GreaterOrEqual(t, count, len(testData))
+
+	for _, c := range testData {
+		si, found := swarms[c.ih]
+		require.True(t, found)
+		require.Equal(t, uint32(1), si.Seeders)
+		require.Equal(t, uint32(1), si.Leechers)
+
+		dummy := v4Peer
+		if c.peer.Addr().Is6() {
+			dummy = v6Peer
+		}
+		var seeders, leechers []bittorrent.Peer
+		cursor = ""
+		for i := 0; i < maxIterations; i++ {
+			cursor, err = it.ScanPeers(context.TODO(), c.ih, cursor, func(p bittorrent.Peer, seeder bool) bool {
+				if seeder {
+					seeders = append(seeders, p)
+				} else {
+					leechers = append(leechers, p)
+				}
+				return false
+			})
+			require.Nil(t, err)
+			if len(cursor) == 0 {
+				break
+			}
+		}
+		require.Empty(t, cursor)
+		require.True(t, containsPeer(seeders, c.peer))
+		require.True(t, containsPeer(leechers, dummy))
+		require.Len(t, seeders, 1)
+		require.Len(t, leechers, 1)
+
+		require.Nil(t, th.st.DeleteSeeder(context.TODO(), c.ih, c.peer))
+		require.Nil(t, th.st.DeleteLeecher(context.TODO(), c.ih, dummy))
+	}
+
+	// cancelled context stops iteration
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Nil(t, th.st.PutSeeder(context.TODO(), testData[0].ih, testData[0].peer))
+	_, err = it.ScanPeers(ctx, testData[0].ih, "", func(bittorrent.Peer, bool) bool { return true })
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, th.st.DeleteSeeder(context.TODO(), testData[0].ih, testData[0].peer))
+}
+
 func (th *testHolder) CustomPutContainsLoadDelete(t *testing.T) {
 	for _, c := range testData {
 		err := th.st.Put(context.TODO(), kvStoreCtx, storage.Entry{Key: c.peer.String(), Value: []byte(c.ih.RawString())})
@@ -256,6 +371,15 @@ func (th *testHolder) CustomBulkPutContainsLoadDelete(t *testing.T) {
 		require.True(t, contains)
 	}
 
+	// check bulk load (with absent key) in ctx we put
+	values, err := storage.LoadMany(context.TODO(), th.st, kvStoreCtx, append(keys, "absent")...)
+	require.Nil(t, err)
+	require.Len(t, values, len(keys)+1)
+	for i, p := range pairs {
+		require.Equal(t, p.Value, values[i])
+	}
+	require.Nil(t, values[len(keys)])
+
 	// check value and type in ctx we put
 	for _, p := range pairs {
 		out, _ := th.st.Load(context.TODO(), kvStoreCtx, p.Key)
@@ -299,9 +423,17 @@ func RunTests(t *testing.T, p storage.PeerStorage) {
 	// Test PutSeeder -> Announce -> DeleteSeeder -> Announce
 	t.Run("SeederPutAnnounceDeleteAnnounce", th.SeederPutAnnounceDeleteAnnounce)
 
+	// Test PutLeecher -> Announce with exclusion hint -> DeleteLeecher
+	t.Run("LeecherPutAnnounceExclusion", th.LeecherPutAnnounceExclusion)
+
 	// Test PutLeecher -> Graduate -> Announce -> DeleteLeecher -> Announce
 	t.Run("LeecherPutGraduateAnnounceDeleteAnnounce", th.LeecherPutGraduateAnnounceDeleteAnnounce)
 
+	// Test swarms and peers iteration with cursors
+	if _, isOk := th.st.(storage.Iterator); isOk {
+		t.Run("Iterate", th.Iterate)
+	}
+
 	t.Run("CustomPutContainsLoadDelete", th.CustomPutContainsLoadDelete)
 	t.Run("CustomBulkPutContainsLoadDelete", th.CustomBulkPutContainsLoadDelete)
 
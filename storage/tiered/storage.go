@@ -0,0 +1,658 @@
+// Package tiered implements the storage interface for a BitTorrent tracker,
+// which keeps local in-memory replica of swarms in front of shared (backend)
+// storage, i.e. Redis or PostgreSQL.
+//
+// AnnouncePeers and ScrapeSwarm are served from replica, which is lazily
+// loaded from backend and kept not longer than configured TTL.
+// Writes are passed through to backend or, if enabled, queued and
+// written behind in batches.
+package tiered
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	"github.com/sot-tech/mochi/pkg/log"
+	"github.com/sot-tech/mochi/pkg/timecache"
+	"github.com/sot-tech/mochi/storage"
+)
+
+const (
+	// Name - registered name of the storage
+	Name = "tiered"
+	// Default config constants.
+	defaultReplicaTTL           = 5 * time.Second
+	defaultReplicaMaxPeers      = 1000
+	defaultWriteBehindBatchSize = 1000
+	defaultWriteBehindWorkers   = 8
+)
+
+var (
+	logger = log.NewLogger("storage/tiered")
+
+	errBackendNotSet         = errors.New("backend storage not set")
+	errBackendNotIterable    = errors.New("backend storage does not support iteration")
+	errRecursiveBackendUsage = errors.New("backend storage can not be " + Name)
+)
+
+func init() {
+	// Register the storage driver.
+	storage.RegisterDriver(Name, Builder{})
+}
+
+// Builder is structure to create new tiered peer storage
+type Builder struct{}
+
+// NewDataStorage creates backend storage, KV operations are not cached
+func (Builder) NewDataStorage(icfg conf.MapConfig) (storage.DataStorage, error) {
+	cfg, err := newConfig(icfg)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewDataStorage(cfg.Backend)
+}
+
+// NewPeerStorage creates backend storage and wraps it with replica
+func (Builder) NewPeerStorage(icfg conf.MapConfig) (storage.PeerStorage, error) {
+	cfg, err := newConfig(icfg)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := storage.NewPeerStorage(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := newStore(cfg, backend)
+	if err != nil {
+		_ = backend.Close()
+	}
+	return ps, err
+}
+
+type config struct {
+	// Backend is the shared storage configuration
+	Backend conf.NamedMapConfig `cfg:"backend"`
+	// ReplicaTTL is the maximal time swarm replica is used
+	// before it is reloaded from backend
+	ReplicaTTL time.Duration `cfg:"replica_ttl"`
+	// ReplicaMaxPeers is the maximal number of peers kept in swarm replica
+	ReplicaMaxPeers int `cfg:"replica_max_peers"`
+	// WriteBehindInterval is the period of queued writes flush,
+	// zero value disables write-behind (writes passed directly to backend)
+	WriteBehindInterval time.Duration `cfg:"write_behind_interval"`
+	// WriteBehindBatchSize is the number of queued writes, which triggers
+	// flush before WriteBehindInterval elapsed
+	WriteBehindBatchSize int `cfg:"write_behind_batch_size"`
+	// WriteBehindMaxPending is the maximal number of queued writes,
+	// writers wait for flush if queue is full
+	WriteBehindMaxPending int `cfg:"write_behind_max_pending"`
+	// WriteBehindWorkers is the number of swarms flushed concurrently
+	WriteBehindWorkers int `cfg:"write_behind_workers"`
+}
+
+func newConfig(icfg conf.MapConfig) (cfg config, err error) {
+	if err = icfg.Unmarshal(&cfg); err == nil {
+		cfg, err = cfg.validate()
+	}
+	return
+}
+
+func (cfg config) validate() (config, error) {
+	validCfg := cfg
+
+	if len(cfg.Backend.Name) == 0 {
+		return cfg, errBackendNotSet
+	}
+	if cfg.Backend.Name == Name {
+		return cfg, errRecursiveBackendUsage
+	}
+	if cfg.Backend.Config == nil {
+		validCfg.Backend.Config = make(conf.MapConfig)
+	}
+
+	if cfg.ReplicaTTL <= 0 {
+		validCfg.ReplicaTTL = defaultReplicaTTL
+		logger.Warn().
+			Str("name", "ReplicaTTL").
+			Dur("provided", cfg.ReplicaTTL).
+			Dur("default", validCfg.ReplicaTTL).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.ReplicaMaxPeers <= 0 {
+		validCfg.ReplicaMaxPeers = defaultReplicaMaxPeers
+		logger.Warn().
+			Str("name", "ReplicaMaxPeers").
+			Int("provided", cfg.ReplicaMaxPeers).
+			Int("default", validCfg.ReplicaMaxPeers).
+			Msg("falling back to default configuration")
+	}
+
+	if cfg.WriteBehindInterval < 0 {
+		validCfg.WriteBehindInterval = 0
+		logger.Warn().
+			Str("name", "WriteBehindInterval").
+			Dur("provided", cfg.WriteBehindInterval).
+			Dur("default", validCfg.WriteBehindInterval).
+			Msg("falling back to default configuration")
+	}
+
+	if validCfg.WriteBehindInterval > 0 && cfg.WriteBehindBatchSize <= 0 {
+		validCfg.WriteBehindBatchSize = defaultWriteBehindBatchSize
+		logger.Warn().
+			Str("name", "WriteBehindBatchSize").
+			Int("provided", cfg.WriteBehindBatchSize).
+			Int("default", validCfg.WriteBehindBatchSize).
+			Msg("falling back to default configuration")
+	}
+
+	if validCfg.WriteBehindInterval > 0 && cfg.WriteBehindMaxPending < validCfg.WriteBehindBatchSize {
+		validCfg.WriteBehindMaxPending = validCfg.WriteBehindBatchSize * 4
+		logger.Warn().
+			Str("name", "WriteBehindMaxPending").
+			Int("provided", cfg.WriteBehindMaxPending).
+			Int("default", validCfg.WriteBehindMaxPending).
+			Msg("falling back to default configuration")
+	}
+
+	if validCfg.WriteBehindInterval > 0 && cfg.WriteBehindWorkers <= 0 {
+		validCfg.WriteBehindWorkers = defaultWriteBehindWorkers
+		logger.Warn().
+			Str("name", "WriteBehindWorkers").
+			Int("provided", cfg.WriteBehindWorkers).
+			Int("default", validCfg.WriteBehindWorkers).
+			Msg("falling back to default configuration")
+	}
+
+	return validCfg, nil
+}
+
+// replica is the local copy of swarm
+type replica struct {
+	// seeders and leechers of IPv4 (0) and IPv6 (1) swarms
+	seeders, leechers [2][]bittorrent.Peer
+	// known contains all peers of replica with seeder flag
+	known                       map[bittorrent.Peer]bool
+	leechersCount, seedersCount uint32
+	snatched                    uint32
+	expires                     int64
+}
+
+func familyIndex(v6 bool) int {
+	if v6 {
+		return 1
+	}
+	return 0
+}
+
+type opType uint8
+
+const (
+	opPutSeeder opType = iota
+	opDeleteSeeder
+	opPutLeecher
+	opDeleteLeecher
+	opGraduateLeecher
+)
+
+// pendingSwarm holds queued operations of swarm peers. Operations
+// of different peers are independent, so only order per peer is kept.
+type pendingSwarm map[bittorrent.Peer][]opType
+
+type store struct {
+	storage.PeerStorage
+	it        storage.Iterator
+	ttl       time.Duration
+	maxPeers  int
+	mu        sync.RWMutex
+	replicas  map[bittorrent.InfoHash]*replica
+	lastSweep int64
+	// loads coalesces concurrent loads of the same swarm
+	loads        singleflight.Group
+	writeBatch   int
+	maxPending   int
+	flushWorkers int
+	pendingMU    sync.Mutex
+	pending      map[bittorrent.InfoHash]pendingSwarm
+	pendingLen   int
+	// drained is closed (and replaced) when queued operations taken
+	// for flush, so writers, waiting for free space, may continue
+	drained chan struct{}
+	// flushMU serializes pending operations execution, so operations
+	// of the same swarm are written in order
+	flushMU    sync.Mutex
+	flushCh    chan struct{}
+	closed     chan struct{}
+	wg         sync.WaitGroup
+	onceCloser sync.Once
+}
+
+func newStore(cfg config, backend storage.PeerStorage) (*store, error) {
+	it, isOk := backend.(storage.Iterator)
+	if !isOk {
+		return nil, errBackendNotIterable
+	}
+	ps := &store{
+		PeerStorage: backend,
+		it:          it,
+		ttl:         cfg.ReplicaTTL,
+		maxPeers:    cfg.ReplicaMaxPeers,
+		replicas:    make(map[bittorrent.InfoHash]*replica),
+		lastSweep:   timecache.NowUnixNano(),
+		closed:      make(chan struct{}),
+	}
+	if cfg.WriteBehindInterval > 0 {
+		ps.writeBatch = cfg.WriteBehindBatchSize
+		ps.maxPending = cfg.WriteBehindMaxPending
+		ps.flushWorkers = cfg.WriteBehindWorkers
+		ps.pending = make(map[bittorrent.InfoHash]pendingSwarm)
+		ps.drained = make(chan struct{})
+		ps.flushCh = make(chan struct{}, 1)
+		ps.wg.Add(1)
+		go ps.runFlusher(cfg.WriteBehindInterval)
+	}
+	logger.Info().
+		Str("backend", cfg.Backend.Name).
+		Dur("replicaTTL", cfg.ReplicaTTL).
+		Dur("writeBehindInterval", cfg.WriteBehindInterval).
+		Msg("tiered storage started")
+	return ps, nil
+}
+
+func (ps *store) runFlusher(interval time.Duration) {
+	defer ps.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ps.closed:
+			ps.flushAll()
+			return
+		case <-t.C:
+			ps.flushAll()
+		case <-ps.flushCh:
+			ps.flushAll()
+		}
+	}
+}
+
+// execute writes operation to backend
+func (ps *store) execute(ctx context.Context, ih bittorrent.InfoHash, op opType, peer bittorrent.Peer) (err error) {
+	switch op {
+	case opPutSeeder:
+		err = ps.PeerStorage.PutSeeder(ctx, ih, peer)
+	case opDeleteSeeder:
+		err = ps.PeerStorage.DeleteSeeder(ctx, ih, peer)
+	case opPutLeecher:
+		err = ps.PeerStorage.PutLeecher(ctx, ih, peer)
+	case opDeleteLeecher:
+		err = ps.PeerStorage.DeleteLeecher(ctx, ih, peer)
+	case opGraduateLeecher:
+		err = ps.PeerStorage.GraduateLeecher(ctx, ih, peer)
+	}
+	return
+}
+
+// flushOps writes queued operations of swarm to backend.
+// Errors are only logged, because caller already got response.
+func (ps *store) flushOps(ih bittorrent.InfoHash, sw pendingSwarm) {
+	for peer, ops := range sw {
+		for _, op := range ops {
+			if err := ps.execute(context.Background(), ih, op, peer); err != nil && !errors.Is(err, storage.ErrResourceDoesNotExist) {
+				logger.Error().Err(err).
+					Stringer("infoHash", ih).
+					Object("peer", peer).
+					Uint8("op", uint8(op)).
+					Msg("unable to write queued operation")
+			}
+		}
+	}
+}
+
+// releaseWriters wakes up writers, waiting for free space in queue.
+// Should be called with acquired pendingMU.
+func (ps *store) releaseWriters() {
+	close(ps.drained)
+	ps.drained = make(chan struct{})
+}
+
+// flushAll writes all queued operations to backend,
+// swarms are written concurrently by flushWorkers goroutines
+func (ps *store) flushAll() {
+	ps.flushMU.Lock()
+	defer ps.flushMU.Unlock()
+	ps.pendingMU.Lock()
+	pending := ps.pending
+	ps.pending, ps.pendingLen = make(map[bittorrent.InfoHash]pendingSwarm), 0
+	ps.releaseWriters()
+	ps.pendingMU.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	ihs := make(chan bittorrent.InfoHash)
+	var wg sync.WaitGroup
+	for i := 0; i < min(ps.flushWorkers, len(pending)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ih := range ihs {
+				ps.flushOps(ih, pending[ih])
+			}
+		}()
+	}
+	for ih := range pending {
+		ihs <- ih
+	}
+	close(ihs)
+	wg.Wait()
+}
+
+// flushSwarm writes queued operations of provided swarm to backend,
+// so reloaded replica contains changes made by this instance
+func (ps *store) flushSwarm(ih bittorrent.InfoHash) {
+	ps.flushMU.Lock()
+	defer ps.flushMU.Unlock()
+	ps.pendingMU.Lock()
+	sw, found := ps.pending[ih]
+	if found {
+		delete(ps.pending, ih)
+		for _, ops := range sw {
+			ps.pendingLen -= len(ops)
+		}
+		ps.releaseWriters()
+	}
+	ps.pendingMU.Unlock()
+	ps.flushOps(ih, sw)
+}
+
+func (ps *store) signalFlush() {
+	select {
+	case ps.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// write passes operation to backend or queues it if write-behind enabled.
+// Repeated operation (i.e. re-announce) of the same peer is queued once.
+// If queue is full, write waits until queued operations are taken for flush.
+func (ps *store) write(ctx context.Context, ih bittorrent.InfoHash, op opType, peer bittorrent.Peer) error {
+	if ps.pending == nil {
+		return ps.execute(ctx, ih, op, peer)
+	}
+	for {
+		ps.pendingMU.Lock()
+		if ps.pendingLen < ps.maxPending {
+			sw := ps.pending[ih]
+			if sw == nil {
+				sw = make(pendingSwarm)
+				ps.pending[ih] = sw
+			}
+			if ops := sw[peer]; len(ops) == 0 || ops[len(ops)-1] != op {
+				sw[peer] = append(ops, op)
+				ps.pendingLen++
+			}
+			full := ps.pendingLen >= ps.writeBatch
+			ps.pendingMU.Unlock()
+			if full {
+				ps.signalFlush()
+			}
+			return nil
+		}
+		drained := ps.drained
+		ps.pendingMU.Unlock()
+		ps.signalFlush()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sweep deletes expired replicas. Should be called with acquired write lock.
+func (ps *store) sweep(now int64) {
+	if now-ps.lastSweep < int64(ps.ttl) {
+		return
+	}
+	ps.lastSweep = now
+	for ih, r := range ps.replicas {
+		if r.expires <= now {
+			delete(ps.replicas, ih)
+		}
+	}
+}
+
+func (ps *store) invalidate(ih bittorrent.InfoHash) {
+	ps.mu.Lock()
+	delete(ps.replicas, ih)
+	ps.mu.Unlock()
+}
+
+// putLocal adds provided peer to replica of swarm, if it does not
+// contain peer with the same seeder flag, and adjusts peers counts.
+// Replica may be used by concurrent readers, so it is copied before change.
+// If replica already contains maxPeers, random peer of the same type is replaced.
+func (ps *store) putLocal(ih bittorrent.InfoHash, peer bittorrent.Peer, seeder bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	r, found := ps.replicas[ih]
+	if !found {
+		return
+	}
+	wasSeeder, known := r.known[peer]
+	if known && wasSeeder == seeder {
+		return
+	}
+	nr := &replica{
+		seeders:       r.seeders,
+		leechers:      r.leechers,
+		known:         maps.Clone(r.known),
+		leechersCount: r.leechersCount,
+		seedersCount:  r.seedersCount,
+		snatched:      r.snatched,
+		expires:       r.expires,
+	}
+	i := familyIndex(peer.Addr().Is6())
+	from, to, fromCount, toCount := &nr.seeders[i], &nr.leechers[i], &nr.seedersCount, &nr.leechersCount
+	if seeder {
+		from, to, fromCount, toCount = to, from, toCount, fromCount
+	}
+	if known {
+		*from = slices.DeleteFunc(slices.Clone(*from), func(p bittorrent.Peer) bool { return p == peer })
+		if *fromCount > 0 {
+			*fromCount--
+		}
+	}
+	*toCount++
+	switch {
+	case known || len(nr.known) < ps.maxPeers:
+		*to = append(slices.Clone(*to), peer)
+		nr.known[peer] = seeder
+	case len(*to) > 0:
+		*to = slices.Clone(*to)
+		j := rand.IntN(len(*to)) //nolint:gosec
+		delete(nr.known, (*to)[j])
+		(*to)[j] = peer
+		nr.known[peer] = seeder
+	}
+	ps.replicas[ih] = nr
+}
+
+// reservoir holds uniform random sample of scanned peers
+type reservoir struct {
+	peers []bittorrent.Peer
+	size  int
+	seen  int
+}
+
+func (r *reservoir) add(p bittorrent.Peer) {
+	r.seen++
+	if len(r.peers) < r.size {
+		r.peers = append(r.peers, p)
+	} else if j := rand.IntN(r.seen); j < r.size { //nolint:gosec
+		r.peers[j] = p
+	}
+}
+
+// load returns actual replica of swarm, or loads it from backend.
+// Concurrent loads of the same swarm are coalesced.
+func (ps *store) load(ctx context.Context, ih bittorrent.InfoHash) (*replica, error) {
+	ps.mu.RLock()
+	r, found := ps.replicas[ih]
+	ps.mu.RUnlock()
+	if found && r.expires > timecache.NowUnixNano() {
+		return r, nil
+	}
+	// load is shared between callers, so it should not be canceled by one of them
+	v, err, _ := ps.loads.Do(ih.RawString(), func() (any, error) {
+		return ps.loadReplica(context.WithoutCancel(ctx), ih)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*replica), nil
+}
+
+// loadReplica reads swarm from backend and stores its replica.
+// Replica contains random sample of seeders and leechers, each type
+// gets half of maxPeers, or more, if another type has fewer peers.
+func (ps *store) loadReplica(ctx context.Context, ih bittorrent.InfoHash) (*replica, error) {
+	if ps.pending != nil {
+		ps.flushSwarm(ih)
+	}
+
+	now := timecache.NowUnixNano()
+	r := &replica{known: make(map[bittorrent.Peer]bool), expires: now + int64(ps.ttl)}
+	var err error
+	if r.leechersCount, r.seedersCount, r.snatched, err = ps.PeerStorage.ScrapeSwarm(ctx, ih); err != nil {
+		return nil, err
+	}
+	if r.leechersCount+r.seedersCount > 0 {
+		var seeders, leechers reservoir
+		leechers.size = min(int(r.leechersCount), ps.maxPeers/2)
+		seeders.size = min(int(r.seedersCount), ps.maxPeers-leechers.size)
+		leechers.size = min(int(r.leechersCount), ps.maxPeers-seeders.size)
+		_, err = ps.it.ScanPeers(ctx, ih, "", func(p bittorrent.Peer, seeder bool) bool {
+			if seeder {
+				seeders.add(p)
+			} else {
+				leechers.add(p)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range seeders.peers {
+			i := familyIndex(p.Addr().Is6())
+			r.seeders[i] = append(r.seeders[i], p)
+			r.known[p] = true
+		}
+		for _, p := range leechers.peers {
+			i := familyIndex(p.Addr().Is6())
+			r.leechers[i] = append(r.leechers[i], p)
+			r.known[p] = false
+		}
+	}
+
+	ps.mu.Lock()
+	ps.sweep(now)
+	ps.replicas[ih] = r
+	ps.mu.Unlock()
+	return r, nil
+}
+
+func (ps *store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if err := ps.write(ctx, ih, opPutSeeder, peer); err != nil {
+		return err
+	}
+	ps.putLocal(ih, peer, true)
+	return nil
+}
+
+func (ps *store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer ps.invalidate(ih)
+	return ps.write(ctx, ih, opDeleteSeeder, peer)
+}
+
+func (ps *store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	if err := ps.write(ctx, ih, opPutLeecher, peer); err != nil {
+		return err
+	}
+	ps.putLocal(ih, peer, false)
+	return nil
+}
+
+func (ps *store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer ps.invalidate(ih)
+	return ps.write(ctx, ih, opDeleteLeecher, peer)
+}
+
+func (ps *store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	defer ps.invalidate(ih)
+	return ps.write(ctx, ih, opGraduateLeecher, peer)
+}
+
+// samplePeers appends up to n random not excluded peers from pool to out
+func samplePeers(out, pool []bittorrent.Peer, n int, excl storage.Exclusion) []bittorrent.Peer {
+	candidates := excl.Filter(append([]bittorrent.Peer(nil), pool...))
+	n = min(n, len(candidates))
+	for i := 0; i < n; i++ {
+		j := i + rand.IntN(len(candidates)-i) //nolint:gosec
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	}
+	return append(out, candidates[:n]...)
+}
+
+// AnnouncePeers returns random leechers from replica if forSeeder set,
+// otherwise seeders and then leechers
+func (ps *store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, forSeeder bool, numWant int, v6 bool) (peers []bittorrent.Peer, err error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Bool("forSeeder", forSeeder).
+		Int("numWant", numWant).
+		Bool("v6", v6).
+		Msg("announce peers")
+	var r *replica
+	if r, err = ps.load(ctx, ih); err != nil {
+		return
+	}
+	i, excl := familyIndex(v6), storage.ExclusionFromContext(ctx)
+	if !forSeeder {
+		peers = samplePeers(peers, r.seeders[i], numWant, excl)
+	}
+	if numWant > len(peers) {
+		peers = samplePeers(peers, r.leechers[i], numWant-len(peers), excl)
+	}
+	return
+}
+
+func (ps *store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash) (leechers uint32, seeders uint32, snatched uint32, err error) {
+	logger.Trace().
+		Stringer("infoHash", ih).
+		Msg("scrape swarm")
+	var r *replica
+	if r, err = ps.load(ctx, ih); err == nil {
+		leechers, seeders, snatched = r.leechersCount, r.seedersCount, r.snatched
+	}
+	return
+}
+
+// Close flushes queued operations and closes backend
+func (ps *store) Close() (err error) {
+	ps.onceCloser.Do(func() {
+		close(ps.closed)
+		ps.wg.Wait()
+		err = ps.PeerStorage.Close()
+	})
+	return
+}
@@ -0,0 +1,105 @@
+package tiered
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/sot-tech/mochi/bittorrent"
+	"github.com/sot-tech/mochi/pkg/conf"
+	s "github.com/sot-tech/mochi/storage"
+	"github.com/sot-tech/mochi/storage/memory"
+	"github.com/sot-tech/mochi/storage/test"
+)
+
+func createNew(writeBehindInterval time.Duration) s.PeerStorage {
+	ps, err := Builder{}.NewPeerStorage(conf.MapConfig{
+		"backend": conf.MapConfig{
+			"name":   memory.Name,
+			"config": conf.MapConfig{"shard_count": 1024},
+		},
+		"replica_ttl":           time.Minute,
+		"write_behind_interval": writeBehindInterval,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return ps
+}
+
+func TestStorage(t *testing.T) { test.RunTests(t, createNew(0)) }
+
+func TestWriteBehindStorage(t *testing.T) { test.RunTests(t, createNew(time.Hour)) }
+
+func BenchmarkStorage(b *testing.B) {
+	test.RunBenchmarks(b, func() s.PeerStorage { return createNew(0) })
+}
+
+func TestReplicaContainsBothPeerTypes(t *testing.T) {
+	ps, err := Builder{}.NewPeerStorage(conf.MapConfig{
+		"backend":           conf.MapConfig{"name": memory.Name},
+		"replica_ttl":       time.Minute,
+		"replica_max_peers": 4,
+	})
+	require.Nil(t, err)
+	defer ps.Close()
+	ctx, ih := context.Background(), bittorrent.InfoHash("01234567890123456789")
+	for i := 0; i < 10; i++ {
+		id, _ := bittorrent.NewPeerID([]byte(fmt.Sprintf("-MO0001-%012d", i)))
+		require.Nil(t, ps.PutSeeder(ctx, ih, bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(i+1))}))
+		require.Nil(t, ps.PutLeecher(ctx, ih, bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), uint16(i+1))}))
+	}
+	leechers, err := ps.AnnouncePeers(ctx, ih, true, 10, false)
+	require.Nil(t, err)
+	require.Len(t, leechers, 2)
+	peers, err := ps.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	require.Len(t, peers, 4)
+}
+
+func TestReplicaKeptOnPut(t *testing.T) {
+	ps, err := Builder{}.NewPeerStorage(conf.MapConfig{
+		"backend":           conf.MapConfig{"name": memory.Name},
+		"replica_ttl":       time.Minute,
+		"replica_max_peers": 4,
+	})
+	require.Nil(t, err)
+	defer ps.Close()
+	st := ps.(*store)
+	ctx, ih := context.Background(), bittorrent.InfoHash("01234567890123456789")
+	newPeer := func(i int) bittorrent.Peer {
+		id, _ := bittorrent.NewPeerID([]byte(fmt.Sprintf("-MO0001-%012d", i)))
+		return bittorrent.Peer{ID: id, AddrPort: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(i+1))}
+	}
+	require.Nil(t, ps.PutSeeder(ctx, ih, newPeer(0)))
+	_, err = ps.AnnouncePeers(ctx, ih, false, 10, false)
+	require.Nil(t, err)
+	expires := st.replicas[ih].expires
+
+	for i := 1; i < 10; i++ {
+		require.Nil(t, ps.PutLeecher(ctx, ih, newPeer(i)))
+	}
+	// seeder becomes leecher
+	require.Nil(t, ps.PutLeecher(ctx, ih, newPeer(0)))
+
+	r := st.replicas[ih]
+	require.Equal(t, expires, r.expires)
+	require.Equal(t, uint32(0), r.seedersCount)
+	require.Equal(t, uint32(10), r.leechersCount)
+	require.Empty(t, r.seeders[0])
+	require.Len(t, r.leechers[0], 4)
+	require.Len(t, r.known, 4)
+	for _, p := range r.leechers[0] {
+		seeder, found := r.known[p]
+		require.True(t, found)
+		require.False(t, seeder)
+	}
+	leechers, seeders, _, err := ps.ScrapeSwarm(ctx, ih)
+	require.Nil(t, err)
+	require.Equal(t, uint32(10), leechers)
+	require.Equal(t, uint32(0), seeders)
+}